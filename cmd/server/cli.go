@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/lei/yaml-helm-pipeline/internal/api"
+)
+
+// Exit codes of the CLI mode
+const (
+	exitOK     = 0
+	exitFailed = 1 // At least one group failed
+	exitUsage  = 2 // Invalid arguments
+)
+
+// parseCLIArgs parses the arguments of the CLI mode
+func parseCLIArgs(args []string, stderr io.Writer) (api.RunOptions, error) {
+	var opts api.RunOptions
+	var groups string
+
+	flags := flag.NewFlagSet("cli", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.StringVar(&opts.Branch, "branch", "", "template repository branch (required)")
+	flags.StringVar(&groups, "groups", "", "comma-separated groups to process (default: all)")
+	flags.StringVar(&opts.Message, "message", "", "commit message")
+	flags.BoolVar(&opts.Preview, "preview", false, "preview the changes without committing")
+	flags.BoolVar(&opts.Squash, "squash", false, "make one commit per output repository for all groups")
+
+	if err := flags.Parse(args); err != nil {
+		return opts, err
+	}
+	if flags.NArg() > 0 {
+		return opts, fmt.Errorf("unexpected arguments: %s", strings.Join(flags.Args(), " "))
+	}
+	if opts.Branch == "" {
+		return opts, fmt.Errorf("--branch is required")
+	}
+
+	for _, group := range strings.Split(groups, ",") {
+		if group = strings.TrimSpace(group); group != "" {
+			opts.Groups = append(opts.Groups, group)
+		}
+	}
+
+	return opts, nil
+}
+
+// runCLI processes groups once, prints the results as JSON, and returns the
+// process exit code
+func runCLI(ctx context.Context, handler *api.Handler, args []string, stdout, stderr io.Writer) int {
+	opts, err := parseCLIArgs(args, stderr)
+	if err != nil {
+		if err != flag.ErrHelp {
+			fmt.Fprintf(stderr, "Error: %v\n", err)
+		}
+		return exitUsage
+	}
+
+	results, runErr := handler.Run(ctx, opts)
+
+	output := map[string]interface{}{
+		"results": results,
+		"branch":  opts.Branch,
+	}
+	if runErr != nil {
+		output["error"] = runErr.Error()
+	}
+
+	encoder := json.NewEncoder(stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(output); err != nil {
+		fmt.Fprintf(stderr, "Error: failed to write results: %v\n", err)
+		return exitFailed
+	}
+
+	if runErr != nil {
+		return exitFailed
+	}
+	return exitOK
+}
+
+// runSelfCheck checks every group without committing, prints the report as
+// JSON, and returns the process exit code
+func runSelfCheck(ctx context.Context, handler *api.Handler, branch string, stdout, stderr io.Writer) int {
+	report, err := handler.SelfCheck(ctx, branch, nil)
+	if err != nil {
+		fmt.Fprintf(stderr, "Error: %v\n", err)
+		return exitFailed
+	}
+
+	encoder := json.NewEncoder(stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		fmt.Fprintf(stderr, "Error: failed to write results: %v\n", err)
+		return exitFailed
+	}
+
+	if ok, _ := report["ok"].(bool); !ok {
+		return exitFailed
+	}
+	return exitOK
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-billy/v5/osfs"
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport/client"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-git/go-git/v5/plumbing/transport/server"
+	"github.com/lei/yaml-helm-pipeline/internal/api"
+	"github.com/lei/yaml-helm-pipeline/internal/config"
+	"github.com/lei/yaml-helm-pipeline/internal/extractor"
+	"github.com/lei/yaml-helm-pipeline/internal/git"
+	"github.com/lei/yaml-helm-pipeline/internal/github"
+	"github.com/lei/yaml-helm-pipeline/internal/helm"
+	"github.com/lei/yaml-helm-pipeline/internal/retry"
+)
+
+func TestParseCLIArgs(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		want    api.RunOptions
+		wantErr bool
+	}{
+		{
+			name: "all flags",
+			args: []string{"--branch", "main", "--groups", "web, api,", "--message", "Release", "--preview"},
+			want: api.RunOptions{Branch: "main", Groups: []string{"web", "api"}, Message: "Release", Preview: true},
+		},
+		{
+			name: "every group",
+			args: []string{"-branch=main"},
+			want: api.RunOptions{Branch: "main"},
+		},
+		{name: "missing branch", args: []string{"--groups", "web"}, wantErr: true},
+		{name: "unknown flag", args: []string{"--branch", "main", "--force"}, wantErr: true},
+		{name: "extra arguments", args: []string{"--branch", "main", "web"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseCLIArgs(tt.args, &bytes.Buffer{})
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("parseCLIArgs() = %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseCLIArgs() = %+v, %v, want %+v", got, err, tt.want)
+			}
+		})
+	}
+}
+
+// fakeHelmScript renders the last values file it is given as the chart's
+// output
+const fakeHelmScript = `#!/bin/sh
+[ "$1" = template ] || exit 0
+for arg; do
+	[ "$previous" = "-f" ] && values=$arg
+	previous=$arg
+done
+cat "$values"
+`
+
+// apiTransport answers GitHub API requests for repositories on master,
+// which is all the CLI asks the API for
+type apiTransport struct {
+	server *httptest.Server
+}
+
+// RoundTrip implements http.RoundTripper
+func (t apiTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	target, _ := url.Parse(t.server.URL)
+	req = req.Clone(req.Context())
+	req.URL.Scheme = target.Scheme
+	req.URL.Host = target.Host
+	return t.server.Client().Transport.RoundTrip(req)
+}
+
+// addRepo creates the bare repository owner/repo under root with files
+func addRepo(t *testing.T, root, owner, repo string, files map[string]string) {
+	t.Helper()
+
+	work := t.TempDir()
+	clone, err := gogit.PlainInit(work, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		path := filepath.Join(work, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	worktree, err := clone.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := worktree.AddWithOptions(&gogit.AddOptions{All: true}); err != nil {
+		t.Fatal(err)
+	}
+	_, err = worktree.Commit("test commit", &gogit.CommitOptions{
+		Author: &object.Signature{Name: "Test", Email: "test@example.com", When: time.Now()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := gogit.PlainClone(filepath.Join(root, owner, repo+".git"), true, &gogit.CloneOptions{URL: work}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// cliHandler returns a handler for a group web previewing web.yaml of
+// acme/values with a fake helm, from repositories served in place of
+// github.com
+func cliHandler(t *testing.T) *api.Handler {
+	t.Helper()
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "helm"), []byte(fakeHelmScript), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	t.Setenv("TMPDIR", t.TempDir())
+
+	root := t.TempDir()
+	client.InstallProtocol("https", server.NewClient(server.NewFilesystemLoader(osfs.New(root))))
+	t.Cleanup(func() { client.InstallProtocol("https", githttp.DefaultClient) })
+
+	githubAPI := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if len(parts) != 3 || parts[0] != "repos" {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"name":           parts[2],
+			"owner":          map[string]string{"login": parts[1]},
+			"clone_url":      "https://github.com/" + parts[1] + "/" + parts[2] + ".git",
+			"default_branch": "master",
+		})
+	}))
+	t.Cleanup(githubAPI.Close)
+
+	addRepo(t, root, "acme", "charts", map[string]string{
+		"Chart.yaml":         "apiVersion: v2\nname: app\nversion: 1.0.0\n",
+		"templates/.gitkeep": "",
+	})
+	addRepo(t, root, "acme", "values", map[string]string{
+		"web.yaml": "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: web\ndata:\n  value: one\n",
+	})
+	addRepo(t, root, "acme", "deploy", map[string]string{"README.md": "deploy\n"})
+
+	group := config.ConfigGroup{
+		Name:        "web",
+		ValuesRepos: []config.ValuesRepo{{Owner: "acme", Repo: "values", Path: "web.yaml", Branch: "master"}},
+		OutputRepo: config.OutputRepo{
+			Owner:    "acme",
+			Repo:     "deploy",
+			Path:     "web",
+			Filename: "generated.yaml",
+			Branch:   "master",
+		},
+	}
+
+	once := retry.Policy{MaxAttempts: 1}
+	githubHTTP := github.HTTPOptions{Transport: apiTransport{githubAPI}}
+	return api.NewHandler(github.NewService("token", "acme", "charts", once, githubHTTP), helm.NewService(0),
+		git.NewService("token", once), extractor.NewService(), &config.Config{Groups: []config.ConfigGroup{group}})
+}
+
+func TestRunCLIExitCodes(t *testing.T) {
+	handler := cliHandler(t)
+
+	tests := []struct {
+		name   string
+		args   []string
+		want   int
+		result string // Key expected in the group's result
+	}{
+		{"preview", []string{"--branch", "master", "--preview"}, exitOK, "changes"},
+		{"unknown group", []string{"--branch", "master", "--groups", "missing", "--preview"}, exitFailed, "error"},
+		{"usage", []string{"--groups", "web"}, exitUsage, ""},
+		{"help", []string{"-h"}, exitUsage, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			if got := runCLI(context.Background(), handler, tt.args, &stdout, &stderr); got != tt.want {
+				t.Fatalf("runCLI() = %d, want %d (stdout %s, stderr %s)", got, tt.want, &stdout, &stderr)
+			}
+			if tt.result == "" {
+				if stdout.Len() > 0 || stderr.Len() == 0 {
+					t.Errorf("runCLI() printed %q and usage %q, want only usage", &stdout, &stderr)
+				}
+				return
+			}
+
+			var output struct {
+				Results map[string]map[string]interface{}
+				Branch  string
+				Error   string
+			}
+			if err := json.Unmarshal(stdout.Bytes(), &output); err != nil {
+				t.Fatalf("runCLI() printed %q: %v", &stdout, err)
+			}
+			if len(output.Results) != 1 || output.Branch != "master" {
+				t.Errorf("output = %+v, want one group's result on master", output)
+			}
+			for _, result := range output.Results {
+				if _, ok := result[tt.result]; !ok {
+					t.Errorf("result = %v, want %s", result, tt.result)
+				}
+			}
+			if (output.Error != "") != (tt.want != exitOK) {
+				t.Errorf("error = %q, want one only when a group failed", output.Error)
+			}
+			if tt.want != exitOK && !strings.Contains(output.Error, "1 of 1 groups failed") {
+				t.Errorf("error = %q, want the failed groups counted", output.Error)
+			}
+		})
+	}
+}
@@ -1,11 +1,13 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"log"
 	"net/http"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -14,21 +16,64 @@ import (
 	"github.com/joho/godotenv"
 	"github.com/lei/yaml-helm-pipeline/internal/api"
 	"github.com/lei/yaml-helm-pipeline/internal/config"
+	"github.com/lei/yaml-helm-pipeline/internal/extractor"
 	"github.com/lei/yaml-helm-pipeline/internal/git"
 	"github.com/lei/yaml-helm-pipeline/internal/github"
+	"github.com/lei/yaml-helm-pipeline/internal/gitlab"
 	"github.com/lei/yaml-helm-pipeline/internal/helm"
+	"github.com/lei/yaml-helm-pipeline/internal/retry"
+	"github.com/lei/yaml-helm-pipeline/internal/scm"
+)
+
+// Build information, set at build time with
+// -ldflags "-X main.version=... -X main.commit=... -X main.buildDate=..."
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildDate = "unknown"
+)
+
+// Supported values of SCM_PROVIDER
+const (
+	scmGitHub = "github"
+	scmGitLab = "gitlab"
 )
 
 func main() {
+	// Run as the HTTP server, or process groups once with -mode=cli
+	mode := flag.String("mode", "server", `"server" or "cli"`)
+	validateAll := flag.Bool("validate-all", false, "clone and render every group without committing, then exit")
+	validateBranch := flag.String("validate-branch", "", "template repository branch for -validate-all (default: its default branch)")
+	flag.Parse()
+	if *mode != "server" && *mode != "cli" {
+		log.Fatalf("Invalid mode: %s", *mode)
+	}
+
 	// Load environment variables from .env file
 	if err := godotenv.Load(); err != nil {
 		log.Println("No .env file found, using environment variables")
 	}
 
-	// Check for required environment variables
+	// Check for required environment variables. GitHub App credentials take
+	// precedence over a personal access token when both are present.
+	scmProvider := os.Getenv("SCM_PROVIDER")
+	if scmProvider == "" {
+		scmProvider = scmGitHub
+	}
 	githubToken := os.Getenv("GITHUB_TOKEN")
-	if githubToken == "" {
-		log.Fatal("GITHUB_TOKEN environment variable is required")
+	githubAppID := os.Getenv("GITHUB_APP_ID")
+	gitlabToken := os.Getenv("GITLAB_TOKEN")
+	switch scmProvider {
+	case scmGitHub:
+		if githubToken == "" && githubAppID == "" {
+			log.Fatal("GITHUB_TOKEN or GITHUB_APP_ID environment variable is required")
+		}
+	case scmGitLab:
+		if gitlabToken == "" {
+			log.Fatal("GITLAB_TOKEN environment variable is required with SCM_PROVIDER=gitlab")
+		}
+	default:
+		log.Fatalf("Invalid SCM_PROVIDER: %s", scmProvider)
 	}
 
 	repoOwner := os.Getenv("REPO_OWNER")
@@ -48,10 +93,97 @@ func main() {
 		log.Fatalf("Failed to load configuration: %v", err)
 	}
 
+	// Retry transient GitHub and git failures
+	maxRetries := 3
+	if value := os.Getenv("GIT_MAX_RETRIES"); value != "" {
+		maxRetries, err = strconv.Atoi(value)
+		if err != nil {
+			log.Fatalf("Invalid GIT_MAX_RETRIES: %v", err)
+		}
+	}
+	retryPolicy := retry.NewPolicy(maxRetries)
+
+	// Bound how long a single helm template run may take
+	var helmTimeout time.Duration
+	if value := os.Getenv("HELM_TIMEOUT"); value != "" {
+		helmTimeout, err = time.ParseDuration(value)
+		if err != nil {
+			log.Fatalf("Invalid HELM_TIMEOUT: %v", err)
+		}
+	}
+
+	// Bound how long a single attempt of a GitHub or GitLab API call may take
+	var githubHTTP github.HTTPOptions
+	if value := os.Getenv("GITHUB_HTTP_TIMEOUT"); value != "" {
+		githubHTTP.Timeout, err = time.ParseDuration(value)
+		if err != nil {
+			log.Fatalf("Invalid GITHUB_HTTP_TIMEOUT: %v", err)
+		}
+	}
+	var gitlabHTTP gitlab.HTTPOptions
+	if value := os.Getenv("GITLAB_HTTP_TIMEOUT"); value != "" {
+		gitlabHTTP.Timeout, err = time.ParseDuration(value)
+		if err != nil {
+			log.Fatalf("Invalid GITLAB_HTTP_TIMEOUT: %v", err)
+		}
+	}
+
 	// Initialize services
-	githubService := github.NewService(githubToken, repoOwner, repoName)
-	helmService := helm.NewService()
-	gitService := git.NewService(githubToken)
+	var provider scm.Provider
+	var gitService *git.Service
+	if scmProvider == scmGitLab {
+		provider = gitlab.NewService(os.Getenv("GITLAB_URL"), gitlabToken, repoOwner, repoName, retryPolicy, gitlabHTTP)
+		gitService = git.NewService(gitlabToken, retryPolicy)
+	} else if githubAppID != "" {
+		appID, installationID, privateKey := githubAppCredentials(githubAppID)
+
+		appService, err := github.NewAppService(appID, installationID, privateKey, repoOwner, repoName, retryPolicy, githubHTTP)
+		if err != nil {
+			log.Fatalf("Failed to configure GitHub App authentication: %v", err)
+		}
+		provider = appService
+
+		// Share the installation token cache between the API client and git
+		gitService = git.NewServiceWithTokenSource(appService.TokenSource(), retryPolicy)
+		log.Printf("Authenticating as GitHub App %d (installation %d)", appID, installationID)
+	} else {
+		provider = github.NewService(githubToken, repoOwner, repoName, retryPolicy, githubHTTP)
+		gitService = git.NewService(githubToken, retryPolicy)
+	}
+
+	// Clone into WORK_DIR instead of the system's temporary directory
+	if err := gitService.SetWorkDir(os.Getenv("WORK_DIR")); err != nil {
+		log.Fatalf("Invalid WORK_DIR: %v", err)
+	}
+
+	helmService := helm.NewService(helmTimeout)
+	if err := helmService.SetBinary(os.Getenv("HELM_BIN")); err != nil {
+		log.Fatalf("Invalid HELM_BIN: %v", err)
+	}
+	if err := helmService.SetMinVersion(os.Getenv("HELM_MIN_VERSION")); err != nil {
+		log.Fatalf("Invalid HELM_MIN_VERSION: %v", err)
+	}
+
+	// Retry helm template runs that fail on flaky chart downloads
+	if value := os.Getenv("HELM_MAX_RETRIES"); value != "" {
+		helmRetries, err := strconv.Atoi(value)
+		if err != nil {
+			log.Fatalf("Invalid HELM_MAX_RETRIES: %v", err)
+		}
+		helmService.SetRetries(helmRetries)
+	}
+
+	// Check that every group can be rendered and exit instead of serving
+	if *validateAll {
+		handler := api.NewHandler(provider, helmService, gitService, extractor.NewService(), appConfig)
+		os.Exit(runSelfCheck(context.Background(), handler, *validateBranch, os.Stdout, os.Stderr))
+	}
+
+	// Process the requested groups once and exit instead of serving
+	if *mode == "cli" {
+		handler := api.NewHandler(provider, helmService, gitService, extractor.NewService(), appConfig)
+		os.Exit(runCLI(context.Background(), handler, flag.Args(), os.Stdout, os.Stderr))
+	}
 
 	// Initialize router
 	router := chi.NewRouter()
@@ -61,7 +193,6 @@ func main() {
 	router.Use(middleware.RealIP)
 	router.Use(middleware.Logger)
 	router.Use(middleware.Recoverer)
-	router.Use(middleware.Timeout(60 * time.Second))
 
 	// Setup CORS
 	router.Use(func(next http.Handler) http.Handler {
@@ -85,7 +216,62 @@ func main() {
 	FileServer(router, "/", filesDir)
 
 	// Setup API routes
-	api.SetupRoutes(router, githubService, helmService, gitService, appConfig)
+	apiOptions := api.Options{
+		APITokens:     api.ParseTokens(os.Getenv("API_TOKEN")),
+		ConfigPath:    configPath,
+		WebhookSecret: os.Getenv("WEBHOOK_SECRET"),
+		BuildInfo:     api.BuildInfo{Version: version, Commit: commit, Date: buildDate},
+
+		// Applied to the API routes, except the commit stream and self check
+		RequestTimeout: 60 * time.Second,
+	}
+	apiOptions.TokenScopes, err = api.ParseTokenScopes(os.Getenv("API_TOKEN_GROUPS"))
+	if err != nil {
+		log.Fatalf("Invalid API_TOKEN_GROUPS: %v", err)
+	}
+	apiOptions.ScopePreviews = os.Getenv("API_TOKEN_SCOPE_PREVIEWS") == "true"
+	if len(apiOptions.APITokens) == 0 && len(apiOptions.TokenScopes) == 0 {
+		log.Println("API_TOKEN not set, API authentication is disabled")
+	}
+
+	if rps := os.Getenv("RATE_LIMIT_RPS"); rps != "" {
+		apiOptions.RateLimitRPS, err = strconv.ParseFloat(rps, 64)
+		if err != nil {
+			log.Fatalf("Invalid RATE_LIMIT_RPS: %v", err)
+		}
+	}
+
+	if burst := os.Getenv("RATE_LIMIT_BURST"); burst != "" {
+		apiOptions.RateLimitBurst, err = strconv.Atoi(burst)
+		if err != nil {
+			log.Fatalf("Invalid RATE_LIMIT_BURST: %v", err)
+		}
+	}
+
+	if maxRendered := os.Getenv("MAX_RENDERED_BYTES"); maxRendered != "" {
+		apiOptions.MaxRenderedBytes, err = strconv.Atoi(maxRendered)
+		if err != nil {
+			log.Fatalf("Invalid MAX_RENDERED_BYTES: %v", err)
+		}
+	}
+
+	if ttl := os.Getenv("PREVIEW_TOKEN_TTL"); ttl != "" {
+		apiOptions.PreviewTTL, err = time.ParseDuration(ttl)
+		if err != nil {
+			log.Fatalf("Invalid PREVIEW_TOKEN_TTL: %v", err)
+		}
+	}
+	handler := api.SetupRoutes(router, provider, helmService, gitService, appConfig, apiOptions)
+
+	// Commit groups with a schedule at the times they set
+	if os.Getenv("SCHEDULER_ENABLED") == "true" {
+		handler.StartScheduler(context.Background())
+		log.Println("Scheduler started")
+	}
+
+	// Optionally verify push access to every output repository on readiness,
+	// which costs a GitHub API call per repository
+	checkWriteAccess := os.Getenv("READINESS_CHECK_WRITE") == "true"
 
 	// Add health check endpoints
 	router.Get("/healthz", func(w http.ResponseWriter, r *http.Request) {
@@ -94,24 +280,33 @@ func main() {
 	})
 
 	router.Get("/healthz/ready", func(w http.ResponseWriter, r *http.Request) {
-		// Check GitHub API connectivity
+		// Check SCM API connectivity
 		ctx := r.Context()
-		if !githubService.IsAuthenticated(ctx) {
+		if !provider.IsAuthenticated(ctx) {
 			w.WriteHeader(http.StatusServiceUnavailable)
-			w.Write([]byte("GitHub API not available"))
+			w.Write([]byte("SCM API not available"))
 			return
 		}
 
-		// Check Helm CLI availability
-		cmd := exec.Command("helm", "version", "--short")
-		if err := cmd.Run(); err != nil {
+		// Check Helm CLI availability and version
+		helmStatus, err := helmService.CheckVersion(ctx)
+		if err != nil {
 			w.WriteHeader(http.StatusServiceUnavailable)
-			w.Write([]byte("Helm CLI not available"))
+			w.Write([]byte(err.Error()))
 			return
 		}
 
+		// Check write access to the output repositories
+		if checkWriteAccess {
+			if err := handler.CheckOutputAccess(ctx); err != nil {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				w.Write([]byte(err.Error()))
+				return
+			}
+		}
+
 		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("Ready"))
+		w.Write([]byte("Ready (helm " + helmStatus.Version + ")"))
 	})
 
 	// Get port and host from environment or use defaults
@@ -125,13 +320,55 @@ func main() {
 		host = "0.0.0.0" // Default to all interfaces
 	}
 
+	// Serve HTTPS when a certificate is configured
+	tlsSetup, err := tlsSettings(os.Getenv)
+	if err != nil {
+		log.Fatalf("Invalid TLS configuration: %v", err)
+	}
+	server := &http.Server{Addr: host + ":" + port, Handler: router}
+
 	// Start server
-	log.Printf("Server starting on %s:%s...", host, port)
-	if err := http.ListenAndServe(host+":"+port, router); err != nil {
+	if tlsSetup != nil {
+		server.TLSConfig = tlsSetup.config
+		log.Printf("Server starting on %s:%s with TLS...", host, port)
+		err = server.ListenAndServeTLS(tlsSetup.certFile, tlsSetup.keyFile)
+	} else {
+		log.Printf("Server starting on %s:%s...", host, port)
+		err = server.ListenAndServe()
+	}
+	if err != nil {
 		log.Fatalf("Failed to start server: %v", err)
 	}
 }
 
+// githubAppCredentials reads the GitHub App installation settings from the
+// environment. The private key is read from GITHUB_APP_PRIVATE_KEY_PATH, or
+// taken directly from GITHUB_APP_PRIVATE_KEY.
+func githubAppCredentials(appIDValue string) (int64, int64, []byte) {
+	appID, err := strconv.ParseInt(appIDValue, 10, 64)
+	if err != nil {
+		log.Fatalf("Invalid GITHUB_APP_ID: %v", err)
+	}
+
+	installationID, err := strconv.ParseInt(os.Getenv("GITHUB_APP_INSTALLATION_ID"), 10, 64)
+	if err != nil {
+		log.Fatalf("Invalid GITHUB_APP_INSTALLATION_ID: %v", err)
+	}
+
+	privateKey := []byte(os.Getenv("GITHUB_APP_PRIVATE_KEY"))
+	if path := os.Getenv("GITHUB_APP_PRIVATE_KEY_PATH"); path != "" {
+		privateKey, err = os.ReadFile(path)
+		if err != nil {
+			log.Fatalf("Failed to read GitHub App private key: %v", err)
+		}
+	}
+	if len(privateKey) == 0 {
+		log.Fatal("GITHUB_APP_PRIVATE_KEY or GITHUB_APP_PRIVATE_KEY_PATH is required with GITHUB_APP_ID")
+	}
+
+	return appID, installationID, privateKey
+}
+
 // FileServer conveniently sets up a http.FileServer handler to serve
 // static files from a http.FileSystem.
 func FileServer(r chi.Router, path string, root http.FileSystem) {
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+)
+
+// tlsVersions are the accepted values of TLS_MIN_VERSION
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// serverTLS is the TLS setup of the server
+type serverTLS struct {
+	certFile string
+	keyFile  string
+	config   *tls.Config
+}
+
+// tlsSettings returns the TLS setup configured by TLS_CERT_FILE, TLS_KEY_FILE,
+// and TLS_MIN_VERSION, or nil to serve plain HTTP when no certificate is set
+func tlsSettings(getenv func(string) string) (*serverTLS, error) {
+	certFile := getenv("TLS_CERT_FILE")
+	keyFile := getenv("TLS_KEY_FILE")
+	if certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+
+	minVersion := uint16(tls.VersionTLS12)
+	if value := getenv("TLS_MIN_VERSION"); value != "" {
+		version, ok := tlsVersions[value]
+		if !ok {
+			return nil, fmt.Errorf("unsupported TLS_MIN_VERSION %q, use 1.2 or 1.3", value)
+		}
+		minVersion = version
+	}
+
+	return &serverTLS{
+		certFile: certFile,
+		keyFile:  keyFile,
+		config:   &tls.Config{MinVersion: minVersion},
+	}, nil
+}
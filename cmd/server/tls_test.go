@@ -0,0 +1,67 @@
+package main
+
+import (
+	"crypto/tls"
+	"testing"
+)
+
+func TestTLSSettings(t *testing.T) {
+	tests := []struct {
+		name       string
+		env        map[string]string
+		wantTLS    bool
+		minVersion uint16
+		wantErr    bool
+	}{
+		{name: "no certificate", env: map[string]string{}},
+		{
+			name:       "certificate and key",
+			env:        map[string]string{"TLS_CERT_FILE": "tls.crt", "TLS_KEY_FILE": "tls.key"},
+			wantTLS:    true,
+			minVersion: tls.VersionTLS12,
+		},
+		{
+			name:       "minimum version",
+			env:        map[string]string{"TLS_CERT_FILE": "tls.crt", "TLS_KEY_FILE": "tls.key", "TLS_MIN_VERSION": "1.3"},
+			wantTLS:    true,
+			minVersion: tls.VersionTLS13,
+		},
+		{name: "only a certificate", env: map[string]string{"TLS_CERT_FILE": "tls.crt"}, wantErr: true},
+		{name: "only a key", env: map[string]string{"TLS_KEY_FILE": "tls.key"}, wantErr: true},
+		{
+			name:    "unsupported minimum version",
+			env:     map[string]string{"TLS_CERT_FILE": "tls.crt", "TLS_KEY_FILE": "tls.key", "TLS_MIN_VERSION": "1.1"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tlsSettings(func(key string) string { return tt.env[key] })
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("tlsSettings() = %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("tlsSettings() error = %v", err)
+			}
+			if !tt.wantTLS {
+				if got != nil {
+					t.Errorf("tlsSettings() = %+v, want plain HTTP", got)
+				}
+				return
+			}
+			if got == nil {
+				t.Fatal("tlsSettings() = nil, want TLS")
+			}
+			if got.certFile != tt.env["TLS_CERT_FILE"] || got.keyFile != tt.env["TLS_KEY_FILE"] {
+				t.Errorf("tlsSettings() files = %s, %s", got.certFile, got.keyFile)
+			}
+			if got.config.MinVersion != tt.minVersion {
+				t.Errorf("MinVersion = %x, want %x", got.config.MinVersion, tt.minVersion)
+			}
+		})
+	}
+}
@@ -15,7 +15,7 @@ fi
 
 # Start the backend in the background
 echo "Starting backend server..."
-go run cmd/server/main.go &
+go run ./cmd/server &
 BACKEND_PID=$!
 
 # Wait for the backend to start
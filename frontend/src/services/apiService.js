@@ -7,6 +7,15 @@ const api = axios.create({
   },
 });
 
+// Attach the API token if one has been stored in the browser
+api.interceptors.request.use((config) => {
+  const token = localStorage.getItem('apiToken');
+  if (token) {
+    config.headers.Authorization = `Bearer ${token}`;
+  }
+  return config;
+});
+
 export const apiService = {
   // Get list of branches
   async getBranches() {
@@ -88,6 +97,57 @@ export const apiService = {
     }
   },
 
+  // Commit changes like commitChanges, calling onEvent with each progress
+  // event ({ event, data }) as it arrives. Uses fetch rather than EventSource,
+  // which can't send the request body or the Authorization header.
+  async commitStream(branch, message, groups = [], options = {}, onEvent = () => {}) {
+    const headers = { 'Content-Type': 'application/json' };
+    const token = localStorage.getItem('apiToken');
+    if (token) {
+      headers.Authorization = `Bearer ${token}`;
+    }
+
+    const response = await fetch('/api/commit/stream', {
+      method: 'POST',
+      headers,
+      body: JSON.stringify({ branch, message, groups, ...options }),
+    });
+    if (!response.ok) {
+      const text = await response.text();
+      console.error('Error streaming commit:', text);
+      throw new Error(text || response.statusText);
+    }
+
+    // Events are separated by a blank line, each with an event and a data line
+    const reader = response.body.getReader();
+    const decoder = new TextDecoder();
+    let buffer = '';
+    for (;;) {
+      const { done, value } = await reader.read();
+      if (done) {
+        break;
+      }
+      buffer += decoder.decode(value, { stream: true });
+
+      let end;
+      while ((end = buffer.indexOf('\n\n')) !== -1) {
+        const block = buffer.slice(0, end);
+        buffer = buffer.slice(end + 2);
+
+        let event = 'message';
+        let data = '';
+        for (const line of block.split('\n')) {
+          if (line.startsWith('event: ')) {
+            event = line.slice('event: '.length);
+          } else if (line.startsWith('data: ')) {
+            data += line.slice('data: '.length);
+          }
+        }
+        onEvent({ event, data: data ? JSON.parse(data) : null });
+      }
+    }
+  },
+
   // Check API health
   async checkHealth() {
     try {
@@ -0,0 +1,162 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// TokenScopes maps API tokens to the groups they may commit, as path.Match
+// patterns such as "team-a-*". Tokens that aren't listed may commit every
+// group.
+type TokenScopes map[string][]string
+
+// tokenGroupsKey is the context key for the group patterns of a scoped token
+type tokenGroupsKey struct{}
+
+// TokenAuth returns middleware that requires a valid bearer token in the
+// Authorization header. Scoped tokens are accepted as well and limit the
+// request to their groups. It is a no-op when no tokens are configured.
+func TokenAuth(tokens []string, scopes TokenScopes) func(http.Handler) http.Handler {
+	accepted := append([]string(nil), tokens...)
+	for token := range scopes {
+		accepted = append(accepted, token)
+	}
+
+	return func(next http.Handler) http.Handler {
+		if len(accepted) == 0 {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token, ok := bearerToken(r)
+			if !ok || !validToken(accepted, token) {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+
+			if groups, scoped := scopes.lookup(token); scoped {
+				r = r.WithContext(context.WithValue(r.Context(), tokenGroupsKey{}, groups))
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// lookup returns the group patterns of a token, comparing tokens in
+// constant time
+func (s TokenScopes) lookup(token string) ([]string, bool) {
+	var groups []string
+	found := false
+	for t, patterns := range s {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			groups = patterns
+			found = true
+		}
+	}
+	return groups, found
+}
+
+// tokenAllowsGroup reports whether the token of a request may use a group.
+// Requests without a scoped token may use every group.
+func tokenAllowsGroup(ctx context.Context, name string) bool {
+	patterns, scoped := ctx.Value(tokenGroupsKey{}).([]string)
+	if !scoped {
+		return true
+	}
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// bearerToken extracts the bearer token from the Authorization header
+func bearerToken(r *http.Request) (string, bool) {
+	header := r.Header.Get("Authorization")
+	scheme, token, found := strings.Cut(header, " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
+
+// validToken checks the token against the configured tokens in constant time
+func validToken(tokens []string, token string) bool {
+	valid := false
+	for _, t := range tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			valid = true
+		}
+	}
+	return valid
+}
+
+// ParseTokenScopes parses semicolon-separated "token=group,group" entries
+// limiting tokens to the listed groups
+func ParseTokenScopes(value string) (TokenScopes, error) {
+	scopes := make(TokenScopes)
+	for i, entry := range strings.Split(value, ";") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+
+		token, groups, found := strings.Cut(entry, "=")
+		token = strings.TrimSpace(token)
+		if !found || token == "" {
+			return nil, fmt.Errorf("token scope %d is not of the form token=group,group", i+1)
+		}
+
+		patterns := ParseTokens(groups)
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("invalid group pattern %q: %w", pattern, err)
+			}
+		}
+		scopes[token] = append(scopes[token], patterns...)
+	}
+	return scopes, nil
+}
+
+// ParseTokens parses a comma-separated list of API tokens
+func ParseTokens(value string) []string {
+	var tokens []string
+	for _, token := range strings.Split(value, ",") {
+		if token = strings.TrimSpace(token); token != "" {
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens
+}
+
+// groupNames returns the names of the configured groups, leaving out those
+// the request's token may not use when scoped
+func (h *Handler) groupNames(r *http.Request, scoped bool) []string {
+	var names []string
+	for _, group := range h.currentConfig().Groups {
+		if !scoped || tokenAllowsGroup(r.Context(), group.Name) {
+			names = append(names, group.Name)
+		}
+	}
+	return names
+}
+
+// forbidGroups responds with 403 and returns true if the request's token may
+// not use one of the groups
+func forbidGroups(w http.ResponseWriter, r *http.Request, groups []string) bool {
+	for _, name := range groups {
+		if !tokenAllowsGroup(r.Context(), name) {
+			http.Error(w, fmt.Sprintf("Token is not allowed to use group %s", name), http.StatusForbidden)
+			return true
+		}
+	}
+	return false
+}
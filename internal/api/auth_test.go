@@ -0,0 +1,130 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func TestTokenAuth(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	tests := []struct {
+		name          string
+		tokens        []string
+		authorization string
+		want          int
+	}{
+		{"disabled", nil, "", http.StatusNoContent},
+		{"valid", []string{"one", "two"}, "Bearer two", http.StatusNoContent},
+		{"scheme case", []string{"one"}, "bearer one", http.StatusNoContent},
+		{"missing", []string{"one"}, "", http.StatusUnauthorized},
+		{"invalid", []string{"one"}, "Bearer three", http.StatusUnauthorized},
+		{"empty", []string{"one"}, "Bearer ", http.StatusUnauthorized},
+		{"basic", []string{"one"}, "Basic one", http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/api/groups", nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			w := httptest.NewRecorder()
+
+			TokenAuth(tt.tokens, nil)(ok).ServeHTTP(w, req)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d", w.Code, tt.want)
+			}
+			if tt.want == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+				t.Error("WWW-Authenticate header not set")
+			}
+		})
+	}
+}
+
+func TestParseTokens(t *testing.T) {
+	if got := ParseTokens(""); got != nil {
+		t.Errorf("ParseTokens(\"\") = %q, want none", got)
+	}
+	if got, want := ParseTokens(" one, ,two,"), []string{"one", "two"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseTokens() = %q, want %q", got, want)
+	}
+}
+
+func TestParseTokenScopes(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    TokenScopes
+		invalid bool
+	}{
+		{"empty", "", TokenScopes{}, false},
+		{"several tokens", "a=web, api ; b=team-*", TokenScopes{"a": {"web", "api"}, "b": {"team-*"}}, false},
+		{"repeated token", "a=web;a=api", TokenScopes{"a": {"web", "api"}}, false},
+		{"trailing separator", "a=web;", TokenScopes{"a": {"web"}}, false},
+		{"no groups", "a", nil, true},
+		{"no token", "=web", nil, true},
+		{"invalid pattern", "a=[web", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseTokenScopes(tt.value)
+			if (err != nil) != tt.invalid {
+				t.Fatalf("ParseTokenScopes(%q) error = %v, want invalid %v", tt.value, err, tt.invalid)
+			}
+			if !tt.invalid && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseTokenScopes(%q) = %v, want %v", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTokenScopes(t *testing.T) {
+	p := newTestPipeline(t, pipelineGroup("web", "deploy"), pipelineGroup("api", "deploy"))
+	p.addRepo(t, "acme", "values", map[string]string{
+		"web.yaml": configMap("web", "one"),
+		"api.yaml": configMap("api", "two"),
+	})
+	p.addRepo(t, "acme", "deploy", map[string]string{"README.md": "deploy\n"})
+
+	router := chi.NewRouter()
+	SetupRoutes(router, p.scm, p.helmService, p.gitService, p.config, Options{
+		APITokens:   []string{"admin"},
+		TokenScopes: TokenScopes{"web-token": {"w*"}},
+	})
+	commit := func(token, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodPost, "/api/commit", strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := commit("unknown", `{"branch":"master","message":"Update"}`); w.Code != http.StatusUnauthorized {
+		t.Errorf("commit with an unknown token status = %d, want 401", w.Code)
+	}
+	if w := commit("web-token", `{"branch":"master","message":"Update","groups":["web","api"]}`); w.Code != http.StatusForbidden {
+		t.Errorf("commit of another group with a scoped token status = %d, want 403", w.Code)
+	}
+
+	// Without groups, a scoped token commits only its own
+	if w := commit("web-token", `{"branch":"master","message":"Update"}`); w.Code != http.StatusOK {
+		t.Fatalf("commit with a scoped token status = %d, body %s", w.Code, w.Body)
+	}
+	if p.file(t, "acme", "deploy", "web/generated.yaml") == "" || p.file(t, "acme", "deploy", "api/generated.yaml") != "" {
+		t.Error("scoped token didn't commit exactly its group")
+	}
+
+	if w := commit("admin", `{"branch":"master","message":"Update","groups":["api"]}`); w.Code != http.StatusOK {
+		t.Errorf("commit with an unscoped token status = %d, body %s", w.Code, w.Body)
+	}
+}
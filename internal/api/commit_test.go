@@ -0,0 +1,1012 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/transport/client"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/lei/yaml-helm-pipeline/internal/config"
+	"github.com/lei/yaml-helm-pipeline/internal/github"
+	"github.com/lei/yaml-helm-pipeline/internal/retry"
+	"github.com/lei/yaml-helm-pipeline/internal/scm"
+)
+
+// commitChanges posts a commit request to the pipeline and returns the
+// status and decoded response
+func (p *testPipeline) commitChanges(t *testing.T, body string) (int, map[string]interface{}) {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	p.CommitChanges(w, httptest.NewRequest(http.MethodPost, "/api/commit", strings.NewReader(body)))
+	var response map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("CommitChanges() status = %d, body %s", w.Code, w.Body)
+	}
+	return w.Code, response
+}
+
+// groupResult returns the result of a group in a commit response
+func groupResult(t *testing.T, response map[string]interface{}, name string) map[string]interface{} {
+	t.Helper()
+
+	results, _ := response["results"].(map[string]interface{})
+	result, ok := results[name].(map[string]interface{})
+	if !ok {
+		t.Fatalf("no result for group %s in %v", name, response)
+	}
+	return result
+}
+
+func TestCommitRefusesInvalidOutput(t *testing.T) {
+	p := newTestPipeline(t, pipelineGroup("web", "deploy"))
+	p.addRepo(t, "acme", "values", map[string]string{
+		"web.yaml": configMap("web", "one") + "---\nkind: [ConfigMap\n",
+	})
+	p.addRepo(t, "acme", "deploy", map[string]string{"README.md": "deploy\n"})
+
+	_, response := p.commitChanges(t, `{"branch":"master","message":"Update"}`)
+	result := groupResult(t, response, "web")
+	if err, _ := result["error"].(string); !strings.Contains(err, "document 2") {
+		t.Errorf("result = %v, want an error naming document 2", result)
+	}
+	if n := p.commits(t, "acme", "deploy"); n != 1 {
+		t.Errorf("acme/deploy has %d commits, want nothing pushed", n)
+	}
+}
+
+func TestCommitUsesGroupTemplateRepo(t *testing.T) {
+	web := pipelineGroup("web", "deploy")
+	web.TemplateRepo = &config.TemplateRepo{Owner: "acme", Repo: "platform-charts"}
+	p := newTestPipeline(t, web, pipelineGroup("api", "deploy"))
+	p.addRepo(t, "acme", "platform-charts", map[string]string{
+		"Chart.yaml":         "apiVersion: v2\nname: platform\nversion: 1.0.0\n",
+		"templates/.gitkeep": "",
+	})
+	p.addRepo(t, "acme", "values", map[string]string{
+		"web.yaml": configMap("web", "one"),
+		"api.yaml": configMap("api", "two"),
+	})
+	p.addRepo(t, "acme", "deploy", map[string]string{"README.md": "deploy\n"})
+
+	// The global repository doesn't exist, so only the group overriding
+	// it can render
+	p.scm = github.NewService("token", "acme", "missing", retry.Policy{MaxAttempts: 1}, p.githubHTTP)
+
+	_, response := p.commitChanges(t, `{"branch":"master","message":"Update"}`)
+	if result := groupResult(t, response, "web"); result["error"] != nil {
+		t.Errorf("web result = %v, want it rendered from acme/platform-charts", result)
+	}
+	if result := groupResult(t, response, "api"); result["error"] == nil {
+		t.Errorf("api result = %v, want it to fail with the global repository", result)
+	}
+	if got := p.file(t, "acme", "deploy", "web/generated.yaml"); !strings.Contains(got, "value: one") {
+		t.Errorf("web/generated.yaml = %q, want the rendered output", got)
+	}
+}
+
+func TestCommitRollsBackFailedWrites(t *testing.T) {
+	// The output directory is taken by a file, so the output can't be written
+	web := pipelineGroup("web", "deploy")
+	web.OutputRepo.Path = "README.md"
+	p := newTestPipeline(t, web)
+	p.addRepo(t, "acme", "values", map[string]string{"web.yaml": configMap("web", "one")})
+	p.addRepo(t, "acme", "deploy", map[string]string{"README.md": "deploy\n"})
+
+	_, response := p.commitChanges(t, `{"branch":"master","message":"Update"}`)
+	if result := groupResult(t, response, "web"); result["error"] == nil {
+		t.Fatalf("web result = %v, want a write error", result)
+	}
+	if n := p.commits(t, "acme", "deploy"); n != 1 {
+		t.Errorf("acme/deploy has %d commits, want nothing pushed", n)
+	}
+}
+
+func TestWriteOutputFilesRollsBack(t *testing.T) {
+	p := newTestPipeline(t)
+	p.addRepo(t, "acme", "deploy", map[string]string{"web/generated.yaml": "old\n", "README.md": "deploy\n"})
+	work := filepath.Join(t.TempDir(), "deploy")
+	if _, err := git.PlainClone(work, false, &git.CloneOptions{URL: p.remote("acme", "deploy")}); err != nil {
+		t.Fatal(err)
+	}
+
+	err := p.writeOutputFiles(work, []outputFile{
+		{path: filepath.Join(work, "web", "generated.yaml"), content: []byte("new\n"), mode: 0644},
+		{path: filepath.Join(work, "api", "generated.yaml"), content: []byte("new\n"), mode: 0644},
+		{path: filepath.Join(work, "README.md", "generated.yaml"), content: []byte("new\n"), mode: 0644},
+	}, nil)
+	if err == nil {
+		t.Fatal("writeOutputFiles() succeeded, want the last write to fail")
+	}
+
+	if content, err := os.ReadFile(filepath.Join(work, "web", "generated.yaml")); err != nil || string(content) != "old\n" {
+		t.Errorf("web/generated.yaml = %q, %v, want it restored", content, err)
+	}
+	if _, err := os.Stat(filepath.Join(work, "api")); !os.IsNotExist(err) {
+		t.Errorf("api/ still exists after the rollback: %v", err)
+	}
+}
+
+func TestCommitRegistersHelmRepos(t *testing.T) {
+	web := pipelineGroup("web", "deploy")
+	web.TemplateRepo = &config.TemplateRepo{Owner: "acme", Repo: "umbrella"}
+	p := newTestPipeline(t, web)
+	p.config.HelmRepos = []config.HelmRepo{{
+		Name:     "private",
+		URL:      "https://charts.example.com",
+		Username: "bot",
+		Password: "${HELM_REPO_PASSWORD}",
+	}}
+	t.Setenv("HELM_REPO_PASSWORD", "s3cret")
+	p.addRepo(t, "acme", "umbrella", map[string]string{
+		"Chart.yaml": "apiVersion: v2\nname: umbrella\nversion: 1.0.0\ndependencies:\n" +
+			"  - name: app\n    version: 1.0.0\n    repository: https://charts.example.com\n",
+		"templates/.gitkeep": "",
+	})
+	p.addRepo(t, "acme", "values", map[string]string{"web.yaml": configMap("web", "one")})
+	p.addRepo(t, "acme", "deploy", map[string]string{"README.md": "deploy\n"})
+
+	_, response := p.commitChanges(t, `{"branch":"master","message":"Update"}`)
+	if result := groupResult(t, response, "web"); result["error"] != nil {
+		t.Fatalf("web result = %v", result)
+	}
+
+	log, err := os.ReadFile(p.runs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runs := strings.Split(strings.TrimSpace(string(log)), "\n")
+	if len(runs) != 3 ||
+		runs[0] != "repo add private https://charts.example.com --force-update --username bot --password-stdin" ||
+		!strings.HasPrefix(runs[1], "dependency build ") ||
+		!strings.HasPrefix(runs[2], "template ") {
+		t.Errorf("helm runs = %q, want the repository added before building dependencies", runs)
+	}
+}
+
+func TestCommitRecordsHistory(t *testing.T) {
+	p := newTestPipeline(t, pipelineGroup("web", "deploy"), pipelineGroup("api", "deploy"))
+	p.addRepo(t, "acme", "values", map[string]string{
+		"web.yaml": configMap("web", "one"),
+		"api.yaml": configMap("api", "two"),
+	})
+	p.addRepo(t, "acme", "deploy", map[string]string{"README.md": "deploy\n"})
+
+	// Nothing changes on the second run, so it pushes nothing and isn't recorded
+	for i := 0; i < 2; i++ {
+		_, response := p.commitChanges(t, `{"branch":"master","message":"Update","groups":["web"]}`)
+		if result := groupResult(t, response, "web"); result["error"] != nil {
+			t.Fatalf("run %d result = %v", i+1, result)
+		}
+	}
+
+	remote, err := git.PlainOpen(p.remote("acme", "deploy"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, err := remote.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries := p.history.List("", 0)
+	if len(entries) != 1 {
+		t.Fatalf("history has %d entries, want 1: %+v", len(entries), entries)
+	}
+	entry := entries[0]
+	if entry.CommitSHA != head.Hash().String() {
+		t.Errorf("CommitSHA = %s, want the pushed commit %s", entry.CommitSHA, head.Hash())
+	}
+	if entry.Group != "web" || entry.Branch != "master" || entry.Repository != "acme/deploy" || entry.Timestamp.IsZero() {
+		t.Errorf("entry = %+v", entry)
+	}
+	if entry.Changes["all_new"] != true {
+		t.Errorf("Changes = %v, want the new file summarized", entry.Changes)
+	}
+
+	w := httptest.NewRecorder()
+	p.ListHistory(w, httptest.NewRequest(http.MethodGet, "/api/history?group=api", nil))
+	if !strings.Contains(w.Body.String(), `"history":[]`) {
+		t.Errorf("history of api = %s, want none", w.Body)
+	}
+	w = httptest.NewRecorder()
+	p.ListHistory(w, httptest.NewRequest(http.MethodGet, "/api/history?limit=0", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("limit=0 status = %d, want 400", w.Code)
+	}
+}
+
+// rollbackGroup posts a rollback request for the group at target, e.g.
+// "/api/groups/web/rollback"
+func (p *testPipeline) rollbackGroup(target, body string) *httptest.ResponseRecorder {
+	router := chi.NewRouter()
+	router.Post("/api/groups/{name}/rollback", p.RollbackGroup)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, target, strings.NewReader(body)))
+	return w
+}
+
+func TestRollbackGroup(t *testing.T) {
+	p := newTestPipeline(t, pipelineGroup("web", "deploy"))
+	p.addRepo(t, "acme", "deploy", map[string]string{"web/generated.yaml": configMap("web", "one")})
+	first := p.head(t, "acme", "deploy")
+	p.pushFiles(t, "acme", "deploy", map[string]string{"README.md": "deploy\n"})
+	p.pushFiles(t, "acme", "deploy", map[string]string{"web/generated.yaml": configMap("web", "two")})
+
+	w := p.rollbackGroup("/api/groups/web/rollback", `{"message":"Revert bad render"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body)
+	}
+	var response map[string]string
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	// The README commit didn't touch the file, so the file's previous
+	// version is the one from the first commit
+	if response["reverted_to"] != first {
+		t.Errorf("reverted_to = %s, want the commit before the last change", response["reverted_to"])
+	}
+	if response["commit_sha"] != p.head(t, "acme", "deploy") {
+		t.Errorf("commit_sha = %s, want the pushed rollback", response["commit_sha"])
+	}
+	if got := p.file(t, "acme", "deploy", "web/generated.yaml"); got != configMap("web", "one") {
+		t.Errorf("web/generated.yaml = %q, want the previous version", got)
+	}
+	if n := p.commits(t, "acme", "deploy"); n != 4 {
+		t.Errorf("acme/deploy has %d commits, want the rollback committed", n)
+	}
+}
+
+func TestRollbackGroupRejectsBadRequests(t *testing.T) {
+	p := newTestPipeline(t, pipelineGroup("web", "deploy"))
+	p.addRepo(t, "acme", "deploy", map[string]string{"web/generated.yaml": configMap("web", "one")})
+
+	tests := []struct {
+		target, body string
+		want         int
+	}{
+		{"/api/groups/missing/rollback", "", http.StatusNotFound},
+		{"/api/groups/web/rollback", "{", http.StatusBadRequest},
+		// A file with a single version has nothing to roll back to
+		{"/api/groups/web/rollback", "", http.StatusConflict},
+	}
+	for _, tt := range tests {
+		if w := p.rollbackGroup(tt.target, tt.body); w.Code != tt.want {
+			t.Errorf("POST %s %q status = %d, want %d", tt.target, tt.body, w.Code, tt.want)
+		}
+	}
+	if n := p.commits(t, "acme", "deploy"); n != 1 {
+		t.Errorf("acme/deploy has %d commits, want nothing pushed", n)
+	}
+}
+
+func TestCommitReportsMissingValues(t *testing.T) {
+	unknownRepo := pipelineGroup("jobs", "deploy")
+	unknownRepo.ValuesRepos[0].Repo = "missing"
+	unknownPath := pipelineGroup("api", "deploy")
+	unknownPath.ValuesRepos[0].Path = "api-values.yaml"
+	p := newTestPipeline(t, unknownRepo, unknownPath, pipelineGroup("web", "deploy"))
+	p.addRepo(t, "acme", "values", map[string]string{
+		"api.yaml":     configMap("api", "one"),
+		"web.yaml/old": configMap("web", "one"),
+	})
+	p.addRepo(t, "acme", "deploy", map[string]string{"README.md": "deploy\n"})
+
+	_, response := p.commitChanges(t, `{"branch":"master","message":"Update"}`)
+	tests := []struct {
+		group, want string
+	}{
+		{"jobs", "failed to clone values repository acme/missing"},
+		{"api", "values file api-values.yaml not found in repository acme/values (ref: master)"},
+		{"web", "values path web.yaml in repository acme/values (ref: master) is a directory"},
+	}
+	for _, tt := range tests {
+		if err, _ := groupResult(t, response, tt.group)["error"].(string); !strings.Contains(err, tt.want) {
+			t.Errorf("group %s error = %q, want %q", tt.group, err, tt.want)
+		}
+	}
+	if n := p.helmRuns(t); n != 0 {
+		t.Errorf("helm ran %d times, want nothing rendered", n)
+	}
+}
+
+func TestCommitSkipsUnchangedOutput(t *testing.T) {
+	p := newTestPipeline(t, pipelineGroup("web", "deploy"))
+	p.addRepo(t, "acme", "values", map[string]string{"web.yaml": configMap("web", "one")})
+	p.addRepo(t, "acme", "deploy", map[string]string{"README.md": "deploy\n"})
+
+	tests := []struct {
+		name        string
+		values      string
+		wantChanged bool
+		wantCommits int
+	}{
+		{"new file", "", true, 2},
+		{"unchanged", "", false, 2},
+		{"changed", configMap("web", "two"), true, 3},
+		{"unchanged again", "", false, 3},
+	}
+	for _, tt := range tests {
+		if tt.values != "" {
+			p.pushFiles(t, "acme", "values", map[string]string{"web.yaml": tt.values})
+		}
+
+		_, response := p.commitChanges(t, `{"branch":"master","message":"Update"}`)
+		result := groupResult(t, response, "web")
+		if result["content_changed"] != tt.wantChanged {
+			t.Errorf("%s: result = %v, want content_changed %v", tt.name, result, tt.wantChanged)
+		}
+		if !tt.wantChanged && !strings.Contains(result["message"].(string), "No changes detected") {
+			t.Errorf("%s: message = %q", tt.name, result["message"])
+		}
+		if n := p.commits(t, "acme", "deploy"); n != tt.wantCommits {
+			t.Errorf("%s: acme/deploy has %d commits, want %d", tt.name, n, tt.wantCommits)
+		}
+	}
+	if entries := p.history.List("", 0); len(entries) != 2 {
+		t.Errorf("history has %d entries, want only the pushed runs", len(entries))
+	}
+}
+
+func TestWriteOutputFilesMode(t *testing.T) {
+	p := newTestPipeline(t)
+	p.addRepo(t, "acme", "deploy", map[string]string{"web/generated.yaml": "old\n"})
+	work := filepath.Join(t.TempDir(), "deploy")
+	if _, err := git.PlainClone(work, false, &git.CloneOptions{URL: p.remote("acme", "deploy")}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Both a new file and one that already exists get the configured mode
+	mode := config.OutputRepo{FileMode: "0640"}.Mode()
+	files := []outputFile{
+		{path: filepath.Join(work, "web", "generated.yaml"), content: []byte("new\n"), mode: mode},
+		{path: filepath.Join(work, "api", "generated.yaml"), content: []byte("new\n"), mode: mode},
+	}
+	if err := p.writeOutputFiles(work, files, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		info, err := os.Stat(file.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := info.Mode().Perm(); got != 0640 {
+			t.Errorf("%s mode = %o, want 0640", file.path, got)
+		}
+	}
+}
+
+func TestCommitAllOrNothing(t *testing.T) {
+	newPipeline := func(t *testing.T) *testPipeline {
+		p := newTestPipeline(t, pipelineGroup("web", "deploy"), pipelineGroup("api", "deploy"))
+		p.addRepo(t, "acme", "values", map[string]string{
+			"web.yaml": configMap("web", "one"),
+			"api.yaml": configMap("api", "two"),
+		})
+		p.addRepo(t, "acme", "deploy", map[string]string{"README.md": "deploy\n"})
+		return p
+	}
+
+	t.Run("renders once", func(t *testing.T) {
+		p := newPipeline(t)
+
+		code, response := p.commitChanges(t, `{"branch":"master","message":"Update","all_or_nothing":true}`)
+		if code != http.StatusOK {
+			t.Fatalf("CommitChanges() status = %d, response %v", code, response)
+		}
+		if n := p.helmRuns(t); n != 2 {
+			t.Errorf("helm ran %d times, want once per group", n)
+		}
+		if n := p.commits(t, "acme", "deploy"); n != 3 {
+			t.Errorf("acme/deploy has %d commits, want one per group", n)
+		}
+	})
+
+	t.Run("pushes nothing on failure", func(t *testing.T) {
+		p := newPipeline(t)
+		p.config.Groups = append(p.config.Groups, pipelineGroup("broken", "deploy"))
+
+		code, response := p.commitChanges(t, `{"branch":"master","message":"Update","all_or_nothing":true}`)
+		if code != http.StatusUnprocessableEntity {
+			t.Fatalf("CommitChanges() status = %d, want 422", code)
+		}
+		if err, _ := groupResult(t, response, "broken")["error"].(string); !strings.Contains(err, "broken.yaml not found") {
+			t.Errorf("broken group error = %q, want the missing values file", err)
+		}
+		if msg, _ := groupResult(t, response, "web")["message"].(string); !strings.Contains(msg, "another group failed") {
+			t.Errorf("web group message = %q, want it not committed", msg)
+		}
+		if n := p.commits(t, "acme", "deploy"); n != 1 {
+			t.Errorf("acme/deploy has %d commits, want nothing pushed", n)
+		}
+	})
+
+	t.Run("best effort by default", func(t *testing.T) {
+		p := newPipeline(t)
+		p.config.Groups = append(p.config.Groups, pipelineGroup("broken", "deploy"))
+
+		code, response := p.commitChanges(t, `{"branch":"master","message":"Update"}`)
+		if code != http.StatusOK {
+			t.Fatalf("CommitChanges() status = %d, want 200", code)
+		}
+		if groupResult(t, response, "broken")["error"] == nil {
+			t.Error("broken group has no error")
+		}
+		if n := p.commits(t, "acme", "deploy"); n != 3 {
+			t.Errorf("acme/deploy has %d commits, want the other groups pushed", n)
+		}
+	})
+}
+
+func TestCommitReusesIdenticalRenders(t *testing.T) {
+	web := pipelineGroup("web", "deploy")
+	mirror := pipelineGroup("mirror", "mirror")
+	mirror.ValuesRepos[0].Path = "mirror.yaml"
+	p := newTestPipeline(t, web, mirror)
+	p.addRepo(t, "acme", "values", map[string]string{
+		"web.yaml":    configMap("web", "one"),
+		"mirror.yaml": configMap("web", "one"),
+	})
+	p.addRepo(t, "acme", "deploy", map[string]string{"README.md": "deploy\n"})
+	p.addRepo(t, "acme", "mirror", map[string]string{"README.md": "mirror\n"})
+
+	_, response := p.commitChanges(t, `{"branch":"master","message":"Update","groups":["web","mirror"]}`)
+	if n := p.helmRuns(t); n != 1 {
+		t.Errorf("helm ran %d times, want the identical render reused", n)
+	}
+	if result := groupResult(t, response, "web"); result["deduped"] != nil {
+		t.Errorf("web result = %v, want the first render not deduped", result)
+	}
+	if result := groupResult(t, response, "mirror"); result["deduped"] != true {
+		t.Errorf("mirror result = %v, want deduped", result)
+	}
+	if got, want := p.file(t, "acme", "mirror", "mirror/generated.yaml"), p.file(t, "acme", "deploy", "web/generated.yaml"); got != want || got == "" {
+		t.Errorf("mirror output = %q, want the same output as web, %q", got, want)
+	}
+}
+
+func TestCommitReturnsLinks(t *testing.T) {
+	split := pipelineGroup("api", "deploy")
+	split.OutputRepo.SplitByResource = true
+	p := newTestPipeline(t, pipelineGroup("web", "deploy"), split)
+	p.addRepo(t, "acme", "values", map[string]string{
+		"web.yaml": configMap("web", "one"),
+		"api.yaml": configMap("api", "one"),
+	})
+	p.addRepo(t, "acme", "deploy", map[string]string{"README.md": "deploy\n"})
+
+	_, response := p.commitChanges(t, `{"branch":"master","message":"Update","groups":["web"]}`)
+	result := groupResult(t, response, "web")
+	sha := p.head(t, "acme", "deploy")
+	want := map[string]interface{}{
+		"commit_sha": sha,
+		"commit_url": "https://github.com/acme/deploy/commit/" + sha,
+		"file_url":   "https://github.com/acme/deploy/blob/" + sha + "/web/generated.yaml",
+	}
+	for key, value := range want {
+		if result[key] != value {
+			t.Errorf("%s = %v, want %v", key, result[key], value)
+		}
+	}
+
+	// Split output links to its directory
+	_, response = p.commitChanges(t, `{"branch":"master","message":"Update","groups":["api"]}`)
+	sha = p.head(t, "acme", "deploy")
+	if got, want := groupResult(t, response, "api")["file_url"], "https://github.com/acme/deploy/tree/"+sha+"/api"; got != want {
+		t.Errorf("file_url = %v, want %v", got, want)
+	}
+
+	// Nothing is linked when nothing was committed
+	_, response = p.commitChanges(t, `{"branch":"master","message":"Update","groups":["web"]}`)
+	result = groupResult(t, response, "web")
+	for key := range want {
+		if _, ok := result[key]; ok {
+			t.Errorf("result = %v, want no %s without a commit", result, key)
+		}
+	}
+}
+
+func TestCommitExcludesKinds(t *testing.T) {
+	group := pipelineGroup("web", "deploy")
+	group.OutputRepo.ExcludeKinds = []string{"Secret"}
+	p := newTestPipeline(t, group)
+	secret := "apiVersion: v1\nkind: Secret\nmetadata:\n  name: web\ndata:\n  password: c2VjcmV0\n"
+	p.addRepo(t, "acme", "values", map[string]string{"web.yaml": secret + "---\n" + configMap("web", "one")})
+	p.addRepo(t, "acme", "deploy", map[string]string{"README.md": "deploy\n"})
+
+	if code, response := p.commitChanges(t, `{"branch":"master","message":"Update"}`); code != http.StatusOK {
+		t.Fatalf("CommitChanges() status = %d, response %v", code, response)
+	}
+	if got := p.file(t, "acme", "deploy", "web/generated.yaml"); got != configMap("web", "one") {
+		t.Errorf("web/generated.yaml = %q, want the Secret left out", got)
+	}
+}
+
+func TestCommitIncludesKinds(t *testing.T) {
+	group := pipelineGroup("web", "deploy")
+	group.OutputRepo.IncludeKinds = []string{"ConfigMap", "Secret"}
+	group.OutputRepo.ExcludeKinds = []string{"Secret"}
+	p := newTestPipeline(t, group)
+	secret := "apiVersion: v1\nkind: Secret\nmetadata:\n  name: web\n"
+	service := "apiVersion: v1\nkind: Service\nmetadata:\n  name: web\n"
+	p.addRepo(t, "acme", "values", map[string]string{"web.yaml": secret + "---\n" + configMap("web", "one") + "---\n" + service})
+	p.addRepo(t, "acme", "deploy", map[string]string{"README.md": "deploy\n"})
+
+	if code, response := p.commitChanges(t, `{"branch":"master","message":"Update"}`); code != http.StatusOK {
+		t.Fatalf("CommitChanges() status = %d, response %v", code, response)
+	}
+	if got := p.file(t, "acme", "deploy", "web/generated.yaml"); got != configMap("web", "one") {
+		t.Errorf("web/generated.yaml = %q, want only the ConfigMap", got)
+	}
+}
+
+func TestCommitAllowedBranches(t *testing.T) {
+	tests := []struct {
+		allowed []string
+		want    int
+	}{
+		{nil, http.StatusOK},
+		{[]string{"master"}, http.StatusOK},
+		{[]string{"release/*"}, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.allowed, ","), func(t *testing.T) {
+			p := newSharedOutputPipeline(t)
+			p.config.AllowedBranches = tt.allowed
+
+			w := httptest.NewRecorder()
+			body := `{"branch":"master","message":"Update","groups":["web"]}`
+			p.CommitChanges(w, httptest.NewRequest(http.MethodPost, "/api/commit", strings.NewReader(body)))
+			if w.Code != tt.want {
+				t.Fatalf("CommitChanges() status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			wantCommits := 2
+			if tt.want == http.StatusForbidden {
+				wantCommits = 1
+				if n := p.helmRuns(t); n != 0 {
+					t.Errorf("helm ran %d times, want nothing rendered", n)
+				}
+			}
+			if n := p.commits(t, "acme", "deploy"); n != wantCommits {
+				t.Errorf("acme/deploy has %d commits, want %d", n, wantCommits)
+			}
+		})
+	}
+}
+
+func TestRunRejectsDisallowedBranches(t *testing.T) {
+	p := newSharedOutputPipeline(t)
+	p.config.AllowedBranches = []string{"release/*"}
+
+	if _, err := p.Run(context.Background(), RunOptions{Branch: "master", Message: "Update"}); err == nil {
+		t.Fatal("Run() succeeded, want the branch rejected")
+	}
+	if n := p.commits(t, "acme", "deploy"); n != 1 {
+		t.Errorf("acme/deploy has %d commits, want nothing pushed", n)
+	}
+
+	// Previews aren't restricted
+	if _, err := p.Run(context.Background(), RunOptions{Branch: "master", Preview: true}); err != nil {
+		t.Errorf("Run() preview error = %v", err)
+	}
+}
+
+func TestCommitBranchTemplatedPath(t *testing.T) {
+	web := pipelineGroup("web", "deploy")
+	web.OutputRepo.Path = "deploy/{{branch}}"
+	p := newTestPipeline(t, web)
+	p.addRepo(t, "acme", "values", map[string]string{"web.yaml": configMap("web", "one")})
+	p.addRepo(t, "acme", "deploy", map[string]string{"README.md": "deploy\n"})
+
+	_, response := p.commitChanges(t, `{"branch":"master","message":"Update"}`)
+	if result := groupResult(t, response, "web"); result["error"] != nil {
+		t.Fatalf("web result = %v", result)
+	}
+	if got := p.file(t, "acme", "deploy", "deploy/master/generated.yaml"); got != configMap("web", "one") {
+		t.Errorf("deploy/master/generated.yaml = %q, want the output under the branch", got)
+	}
+
+	// The configured group is left templated for the next request
+	if got := p.config.Groups[0].OutputRepo.Path; got != "deploy/{{branch}}" {
+		t.Errorf("configured path = %q, want it unchanged", got)
+	}
+}
+
+func TestCommitAllOrNothingResolvesPaths(t *testing.T) {
+	// Groups pinned to a ref render whatever branch is requested, so only the
+	// output path can reject it
+	newGroup := func(name string) config.ConfigGroup {
+		group := pipelineGroup(name, "deploy")
+		group.TemplateRepo = &config.TemplateRepo{Owner: "acme", Repo: "charts", Ref: "master"}
+		return group
+	}
+	web := newGroup("web")
+	web.OutputRepo.Path = "deploy/{{branch}}"
+	p := newTestPipeline(t, newGroup("api"), web)
+	p.addRepo(t, "acme", "values", map[string]string{
+		"web.yaml": configMap("web", "one"),
+		"api.yaml": configMap("api", "two"),
+	})
+	p.addRepo(t, "acme", "deploy", map[string]string{"README.md": "deploy\n"})
+
+	code, response := p.commitChanges(t, `{"branch":"..","message":"Update","all_or_nothing":true}`)
+	if code != http.StatusUnprocessableEntity {
+		t.Fatalf("CommitChanges() status = %d, want 422", code)
+	}
+	if err, _ := groupResult(t, response, "web")["error"].(string); !strings.Contains(err, "cannot be used in output path") {
+		t.Errorf("web group error = %q, want the output path rejected", err)
+	}
+	if n := p.commits(t, "acme", "deploy"); n != 1 {
+		t.Errorf("acme/deploy has %d commits, want nothing pushed", n)
+	}
+}
+
+func TestCommitAllOrNothingRendersHeaders(t *testing.T) {
+	web := pipelineGroup("web", "deploy")
+	web.OutputRepo.Header = "generated from {{.Missing}}"
+	p := newTestPipeline(t, pipelineGroup("api", "deploy"), web)
+	p.addRepo(t, "acme", "values", map[string]string{
+		"web.yaml": configMap("web", "one"),
+		"api.yaml": configMap("api", "two"),
+	})
+	p.addRepo(t, "acme", "deploy", map[string]string{"README.md": "deploy\n"})
+
+	code, response := p.commitChanges(t, `{"branch":"master","message":"Update","all_or_nothing":true}`)
+	if code != http.StatusUnprocessableEntity {
+		t.Fatalf("CommitChanges() status = %d, want 422", code)
+	}
+	if err, _ := groupResult(t, response, "web")["error"].(string); !strings.Contains(err, "Missing") {
+		t.Errorf("web group error = %q, want the header template failure", err)
+	}
+	if n := p.commits(t, "acme", "deploy"); n != 1 {
+		t.Errorf("acme/deploy has %d commits, want nothing pushed", n)
+	}
+}
+
+func TestCommitGroupTemplatedPath(t *testing.T) {
+	web := pipelineGroup("web", "deploy")
+	web.OutputRepo.Path = "clusters/{{group}}/{{branch}}"
+	p := newTestPipeline(t, web)
+	p.addRepo(t, "acme", "values", map[string]string{"web.yaml": configMap("web", "one")})
+	p.addRepo(t, "acme", "deploy", map[string]string{"README.md": "deploy\n"})
+
+	_, response := p.commitChanges(t, `{"branch":"master","message":"Update"}`)
+	if result := groupResult(t, response, "web"); result["error"] != nil {
+		t.Fatalf("web result = %v", result)
+	}
+	if got := p.file(t, "acme", "deploy", "clusters/web/master/generated.yaml"); got != configMap("web", "one") {
+		t.Errorf("clusters/web/master/generated.yaml = %q, want the output under the group and branch", got)
+	}
+}
+
+func TestCommitSortsDocuments(t *testing.T) {
+	web := pipelineGroup("web", "deploy")
+	web.OutputRepo.SortDocuments = true
+	p := newTestPipeline(t, web)
+	p.addRepo(t, "acme", "values", map[string]string{"web.yaml": configMap("web", "one") + "---\n" + configMap("api", "two")})
+	p.addRepo(t, "acme", "deploy", map[string]string{"README.md": "deploy\n"})
+
+	_, response := p.commitChanges(t, `{"branch":"master","message":"Update"}`)
+	if result := groupResult(t, response, "web"); result["error"] != nil {
+		t.Fatalf("web result = %v", result)
+	}
+	if got, want := p.file(t, "acme", "deploy", "web/generated.yaml"), configMap("api", "two")+"---\n"+configMap("web", "one"); got != want {
+		t.Errorf("web/generated.yaml = %q, want the documents ordered by name", got)
+	}
+}
+
+func TestCommitCreatesMissingBranch(t *testing.T) {
+	for _, create := range []bool{false, true} {
+		t.Run(fmt.Sprintf("create %v", create), func(t *testing.T) {
+			web := pipelineGroup("web", "deploy")
+			web.OutputRepo.Branch = "release"
+			web.OutputRepo.CreateBranchIfMissing = create
+			p := newTestPipeline(t, web)
+			p.addRepo(t, "acme", "values", map[string]string{"web.yaml": configMap("web", "one")})
+			p.addRepo(t, "acme", "deploy", map[string]string{"README.md": "deploy\n"})
+
+			_, response := p.commitChanges(t, `{"branch":"master","message":"Update"}`)
+			result := groupResult(t, response, "web")
+			if !create {
+				if err, _ := result["error"].(string); !strings.Contains(err, "failed to clone output repository acme/deploy") {
+					t.Errorf("web result = %v, want the clone to fail", result)
+				}
+				return
+			}
+			if result["error"] != nil {
+				t.Fatalf("web result = %v", result)
+			}
+
+			remote, err := git.PlainOpen(p.remote("acme", "deploy"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			ref, err := remote.Reference(plumbing.NewBranchReferenceName("release"), true)
+			if err != nil {
+				t.Fatalf("release branch: %v", err)
+			}
+			commit, err := remote.CommitObject(ref.Hash())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := commit.File("README.md"); err != nil {
+				t.Errorf("release branch lacks README.md, want it started from master: %v", err)
+			}
+			if p.commits(t, "acme", "deploy") != 1 {
+				t.Errorf("master gained commits, want only the new branch pushed")
+			}
+		})
+	}
+}
+
+func TestCommitChartVersions(t *testing.T) {
+	web := pipelineGroup("web", "deploy")
+	web.TemplateRepo = &config.TemplateRepo{Owner: "acme", Repo: "web-chart"}
+	p := newTestPipeline(t, web)
+	p.addRepo(t, "acme", "web-chart", map[string]string{
+		"Chart.yaml":         "apiVersion: v2\nname: web\nversion: 1.2.3\nappVersion: \"2.0\"\n",
+		"templates/.gitkeep": "",
+	})
+	p.addRepo(t, "acme", "values", map[string]string{"web.yaml": configMap("web", "one")})
+	p.addRepo(t, "acme", "deploy", map[string]string{"README.md": "deploy\n"})
+
+	_, response := p.commitChanges(t, `{"branch":"master","message":"Release {{chart_version}} (app {{app_version}})"}`)
+	result := groupResult(t, response, "web")
+	if result["chart_version"] != "1.2.3" || result["app_version"] != "2.0" {
+		t.Errorf("web result = %v, want the chart's versions", result)
+	}
+
+	remote, err := git.PlainOpen(p.remote("acme", "deploy"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit, err := remote.CommitObject(plumbing.NewHash(p.head(t, "acme", "deploy")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(commit.Message, "Release 1.2.3 (app 2.0)") {
+		t.Errorf("commit message = %q, want the versions filled in", commit.Message)
+	}
+}
+
+func TestCommitStripsEmptyDocuments(t *testing.T) {
+	p := newTestPipeline(t, pipelineGroup("web", "deploy"))
+	p.addRepo(t, "acme", "values", map[string]string{
+		"web.yaml": "---\n" + configMap("web", "one") + "---\n# Source: app/templates/hpa.yaml\n---\n" + configMap("api", "two") + "---\n",
+	})
+	p.addRepo(t, "acme", "deploy", map[string]string{"README.md": "deploy\n"})
+
+	_, response := p.commitChanges(t, `{"branch":"master","message":"Update"}`)
+	if result := groupResult(t, response, "web"); result["error"] != nil {
+		t.Fatalf("web result = %v", result)
+	}
+	want := configMap("web", "one") + "---\n" + configMap("api", "two")
+	if got := p.file(t, "acme", "deploy", "web/generated.yaml"); got != want {
+		t.Errorf("web/generated.yaml = %q, want %q", got, want)
+	}
+}
+
+// localProvider wraps a provider to clone from the test pipeline's bare
+// repositories directly and link to another host, as a provider other than
+// GitHub would
+type localProvider struct {
+	scm.Provider
+	p *testPipeline
+}
+
+func (l localProvider) GetRepository(ctx context.Context) (*scm.Repository, error) {
+	repo, err := l.Provider.GetRepository(ctx)
+	if err != nil {
+		return nil, err
+	}
+	local := *repo
+	local.CloneURL = l.CloneURL(repo.Owner, repo.Name)
+	return &local, nil
+}
+
+func (l localProvider) CloneURL(owner, repo string) string {
+	return l.p.remote(owner, repo)
+}
+
+func (l localProvider) CommitURL(owner, repo, sha string) string {
+	return "https://scm.example.com/" + owner + "/" + repo + "/-/commit/" + sha
+}
+
+func (l localProvider) FileURL(owner, repo, sha, filePath string, dir bool) string {
+	return "https://scm.example.com/" + owner + "/" + repo + "/-/blob/" + sha + "/" + filePath
+}
+
+func TestCommitClonesThroughProvider(t *testing.T) {
+	p := newTestPipeline(t, pipelineGroup("web", "deploy"))
+	p.addRepo(t, "acme", "values", map[string]string{"web.yaml": configMap("web", "one")})
+	p.addRepo(t, "acme", "deploy", map[string]string{"README.md": "deploy\n"})
+	p.scm = localProvider{Provider: p.scm, p: p}
+
+	// Nothing is served in place of github.com anymore
+	client.InstallProtocol("https", githttp.DefaultClient)
+
+	_, response := p.commitChanges(t, `{"branch":"master","message":"Update"}`)
+	result := groupResult(t, response, "web")
+	if result["error"] != nil {
+		t.Fatalf("web result = %v", result)
+	}
+	if got := p.file(t, "acme", "deploy", "web/generated.yaml"); got != configMap("web", "one") {
+		t.Errorf("web/generated.yaml = %q", got)
+	}
+	sha := p.head(t, "acme", "deploy")
+	if got, want := result["commit_url"], "https://scm.example.com/acme/deploy/-/commit/"+sha; got != want {
+		t.Errorf("commit_url = %v, want %v", got, want)
+	}
+}
+
+func TestCommitReportsErrorPhases(t *testing.T) {
+	template := pipelineGroup("template", "deploy")
+	template.TemplateRepo = &config.TemplateRepo{Owner: "acme", Repo: "missing"}
+	values := pipelineGroup("values", "deploy")
+	values.ValuesRepos[0].Repo = "missing"
+	output := pipelineGroup("output", "missing")
+	p := newTestPipeline(t, template, values, pipelineGroup("render", "deploy"), output)
+	p.addRepo(t, "acme", "values", map[string]string{
+		"template.yaml": configMap("template", "one"),
+		"render.yaml":   configMap("render", "one") + "---\nkind: [ConfigMap\n",
+		"output.yaml":   configMap("output", "one"),
+	})
+	p.addRepo(t, "acme", "deploy", map[string]string{"README.md": "deploy\n"})
+
+	_, response := p.commitChanges(t, `{"branch":"master","message":"Update",
+		"groups":["unknown","template","values","render","output"]}`)
+	tests := []struct {
+		group, want string
+	}{
+		{"unknown", phaseConfig},
+		{"template", phaseCloneTemplate},
+		{"values", phaseCloneValues},
+		{"render", phaseRender},
+		{"output", phaseCloneOutput},
+	}
+	for _, tt := range tests {
+		result := groupResult(t, response, tt.group)
+		if result["phase"] != tt.want || result["error"] == nil {
+			t.Errorf("group %s result = %v, want an error in phase %s", tt.group, result, tt.want)
+		}
+	}
+}
+
+func TestCommitStrictValues(t *testing.T) {
+	var groups []config.ConfigGroup
+	for _, name := range []string{"web", "typo"} {
+		group := pipelineGroup(name, "deploy")
+		group.TemplateRepo = &config.TemplateRepo{Owner: "acme", Repo: "web-chart"}
+		group.StrictValues = true
+		groups = append(groups, group)
+	}
+	p := newTestPipeline(t, groups...)
+	p.addRepo(t, "acme", "web-chart", map[string]string{
+		"Chart.yaml":         "apiVersion: v2\nname: web\nversion: 1.0.0\n",
+		"values.yaml":        configMap("web", "default"),
+		"templates/.gitkeep": "",
+	})
+	p.addRepo(t, "acme", "values", map[string]string{
+		"web.yaml":  configMap("web", "one"),
+		"typo.yaml": configMap("typo", "one") + "dta:\n  value: two\n",
+	})
+	p.addRepo(t, "acme", "deploy", map[string]string{"README.md": "deploy\n"})
+
+	_, response := p.commitChanges(t, `{"branch":"master","message":"Update"}`)
+	if result := groupResult(t, response, "web"); result["error"] != nil {
+		t.Errorf("web result = %v, want it committed", result)
+	}
+	if got := p.file(t, "acme", "deploy", "web/generated.yaml"); got != configMap("web", "one") {
+		t.Errorf("web/generated.yaml = %q, want the web output", got)
+	}
+
+	result := groupResult(t, response, "typo")
+	if err, _ := result["error"].(string); !strings.Contains(err, "values set keys the chart doesn't define: dta") || result["phase"] != phaseRender {
+		t.Errorf("typo result = %v, want the undefined key reported in phase %s", result, phaseRender)
+	}
+
+	// Charts from a template repository are also linted strictly
+	log, err := os.ReadFile(p.runs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(log), "lint ") || !strings.Contains(string(log), " --strict\n") {
+		t.Errorf("helm runs = %q, want a strict lint", log)
+	}
+}
+
+func TestCommitEmptyOutput(t *testing.T) {
+	allowed := pipelineGroup("allowed", "deploy")
+	allowed.AllowEmptyOutput = true
+	p := newTestPipeline(t, pipelineGroup("web", "deploy"), allowed)
+	p.addRepo(t, "acme", "values", map[string]string{
+		"web.yaml":     "# nothing to render\n",
+		"allowed.yaml": "---\n  \n",
+	})
+	p.addRepo(t, "acme", "deploy", map[string]string{
+		"README.md":          "deploy\n",
+		"web/generated.yaml": configMap("web", "one"),
+	})
+
+	_, response := p.commitChanges(t, `{"branch":"master","message":"Update"}`)
+
+	// An empty render doesn't wipe the previous output
+	result := groupResult(t, response, "web")
+	if err, _ := result["error"].(string); !strings.Contains(err, "chart rendered no resources") || result["phase"] != phaseRender {
+		t.Errorf("web result = %v, want the empty render reported in phase %s", result, phaseRender)
+	}
+	if got := p.file(t, "acme", "deploy", "web/generated.yaml"); got != configMap("web", "one") {
+		t.Errorf("web/generated.yaml = %q, want it unchanged", got)
+	}
+
+	// Unless the group expects it
+	if result := groupResult(t, response, "allowed"); result["error"] != nil {
+		t.Errorf("allowed result = %v, want it committed", result)
+	}
+	if got := p.file(t, "acme", "deploy", "allowed/generated.yaml"); got != "---\n  \n" {
+		t.Errorf("allowed/generated.yaml = %q, want the empty render", got)
+	}
+}
+
+func TestCommitSemanticCompare(t *testing.T) {
+	semantic := pipelineGroup("semantic", "deploy")
+	semantic.OutputRepo.SemanticCompare = true
+	p := newTestPipeline(t, semantic, pipelineGroup("web", "deploy"))
+	p.addRepo(t, "acme", "values", map[string]string{
+		"semantic.yaml": configMap("web", "one"),
+		"web.yaml":      configMap("web", "one"),
+	})
+
+	// The same data as the render, formatted differently
+	reformatted := "# previous helm\nkind: ConfigMap\napiVersion: \"v1\"\nmetadata: {name: web}\ndata:\n    value: 'one'"
+	p.addRepo(t, "acme", "deploy", map[string]string{
+		"semantic/generated.yaml": reformatted,
+		"web/generated.yaml":      reformatted,
+	})
+
+	w := p.previewChanges(`{"branch":"master","groups":["semantic"]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("preview status = %d, body %s", w.Code, w.Body)
+	}
+	if strings.Contains(w.Body.String(), `"content_changed":true`) {
+		t.Errorf("preview = %s, want a formatting change reported as unchanged", w.Body)
+	}
+
+	_, response := p.commitChanges(t, `{"branch":"master","message":"Update"}`)
+	if result := groupResult(t, response, "semantic"); result["content_changed"] != false {
+		t.Errorf("semantic result = %v, want a formatting change left uncommitted", result)
+	}
+	if got := p.file(t, "acme", "deploy", "semantic/generated.yaml"); got != reformatted {
+		t.Errorf("semantic/generated.yaml = %q, want it untouched", got)
+	}
+
+	// Without semantic_compare any byte difference is committed
+	if result := groupResult(t, response, "web"); result["content_changed"] != true {
+		t.Errorf("web result = %v, want the output committed", result)
+	}
+	if got := p.file(t, "acme", "deploy", "web/generated.yaml"); got != configMap("web", "one") {
+		t.Errorf("web/generated.yaml = %q, want the render", got)
+	}
+
+	// A change in the data is committed exactly as rendered
+	p.pushFiles(t, "acme", "values", map[string]string{"semantic.yaml": configMap("web", "two")})
+	_, response = p.commitChanges(t, `{"branch":"master","message":"Update","groups":["semantic"]}`)
+	if result := groupResult(t, response, "semantic"); result["content_changed"] != true {
+		t.Errorf("semantic result = %v, want the changed data committed", result)
+	}
+	if got := p.file(t, "acme", "deploy", "semantic/generated.yaml"); got != configMap("web", "two") {
+		t.Errorf("semantic/generated.yaml = %q, want the render", got)
+	}
+}
@@ -0,0 +1,78 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/lei/yaml-helm-pipeline/internal/config"
+)
+
+// groupsRouter returns a router serving the group endpoints of a handler
+// for the groups web and api
+func groupsRouter() http.Handler {
+	h := NewHandler(nil, nil, nil, nil, &config.Config{Groups: []config.ConfigGroup{
+		pipelineGroup("web", "deploy"),
+		pipelineGroup("api", "deploy"),
+	}})
+
+	router := chi.NewRouter()
+	router.Get("/api/groups", h.ListConfigGroups)
+	router.Get("/api/groups/{name}", h.GetConfigGroup)
+	return router
+}
+
+// get requests target from router and returns the response
+func get(router http.Handler, target string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+	return w
+}
+
+func TestListConfigGroups(t *testing.T) {
+	router := groupsRouter()
+
+	var names struct{ Groups []string }
+	if err := json.Unmarshal(get(router, "/api/groups").Body.Bytes(), &names); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"web", "api"}; !reflect.DeepEqual(names.Groups, want) {
+		t.Errorf("groups = %v, want %v", names.Groups, want)
+	}
+
+	var detailed struct{ Groups []config.ConfigGroup }
+	if err := json.Unmarshal(get(router, "/api/groups?detailed=true").Body.Bytes(), &detailed); err != nil {
+		t.Fatal(err)
+	}
+	want := []config.ConfigGroup{pipelineGroup("web", "deploy"), pipelineGroup("api", "deploy")}
+	if !reflect.DeepEqual(detailed.Groups, want) {
+		t.Errorf("detailed groups = %+v, want %+v", detailed.Groups, want)
+	}
+}
+
+func TestGetConfigGroup(t *testing.T) {
+	router := groupsRouter()
+
+	w := get(router, "/api/groups/api")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body)
+	}
+	var group config.ConfigGroup
+	if err := json.Unmarshal(w.Body.Bytes(), &group); err != nil {
+		t.Fatal(err)
+	}
+	if want := pipelineGroup("api", "deploy"); !reflect.DeepEqual(group, want) {
+		t.Errorf("group = %+v, want %+v", group, want)
+	}
+	if strings.Contains(strings.ToLower(w.Body.String()), "token") {
+		t.Errorf("group details mention a token: %s", w.Body)
+	}
+
+	if w := get(router, "/api/groups/missing"); w.Code != http.StatusNotFound {
+		t.Errorf("missing group status = %d, want 404", w.Code)
+	}
+}
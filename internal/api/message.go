@@ -0,0 +1,108 @@
+package api
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/lei/yaml-helm-pipeline/internal/config"
+)
+
+// defaultCommitType is the conventional commit type used when none is set
+const defaultCommitType = "chore"
+
+// commitFormat returns the commit format that applies to a group: the one
+// given in the request, else the group's, else the top-level one
+func (h *Handler) commitFormat(group *config.ConfigGroup, requested *config.CommitFormat) *config.CommitFormat {
+	if requested != nil {
+		return requested
+	}
+	if group.CommitFormat != nil {
+		return group.CommitFormat
+	}
+	if format := h.currentConfig().CommitFormat; format != nil {
+		return format
+	}
+	return &config.CommitFormat{}
+}
+
+// buildCommitMessage builds the message for a commit of a group's output from
+// the message given in the request and the source of the chart.
+//
+// The suffix style produces "message (generated from source, group: name)"
+// and leaves an empty message empty. The conventional style produces a
+// "type(scope): message" subject, with the source and group in the body.
+// Trailers are appended to any non-empty message after a blank line.
+func buildCommitMessage(format *config.CommitFormat, message, source, groupName string) string {
+	// Trailers need a message to attach to
+	if message == "" && (format.Style == config.CommitStyleConventional || len(format.Trailers) > 0) {
+		message = fmt.Sprintf("update generated output for %s", groupName)
+	}
+	if message == "" {
+		return ""
+	}
+
+	var built string
+	switch format.Style {
+	case config.CommitStyleConventional:
+		prefix := format.Type
+		if prefix == "" {
+			prefix = defaultCommitType
+		}
+		if format.Scope != "" {
+			prefix += "(" + format.Scope + ")"
+		}
+
+		// Keep the subject a single line and move the rest into the body
+		subject, body, _ := strings.Cut(message, "\n")
+		built = fmt.Sprintf("%s: %s\n\nGenerated from %s, group: %s", prefix, subject, source, groupName)
+		if body = strings.TrimSpace(body); body != "" {
+			built += "\n\n" + body
+		}
+	default:
+		built = fmt.Sprintf("%s (generated from %s, group: %s)", message, source, groupName)
+	}
+
+	if len(format.Trailers) > 0 {
+		lines := make([]string, 0, len(format.Trailers))
+		for _, trailer := range format.Trailers {
+			lines = append(lines, trailer.Key+": "+trailer.Value)
+		}
+		built += "\n\n" + strings.Join(lines, "\n")
+	}
+
+	return built
+}
+
+// Placeholders in commit messages replaced with the rendered chart's versions
+const (
+	chartVersionPlaceholder = "{{chart_version}}"
+	appVersionPlaceholder   = "{{app_version}}"
+)
+
+// expandChartVersions fills in the chart version placeholders of a commit
+// message. Versions the chart doesn't declare become empty.
+func expandChartVersions(message string, chart *chartSource) string {
+	var version, appVersion string
+	if chart.metadata != nil {
+		version = chart.metadata.Version
+		appVersion = chart.metadata.AppVersion
+	}
+	return strings.NewReplacer(
+		chartVersionPlaceholder, version,
+		appVersionPlaceholder, appVersion,
+	).Replace(message)
+}
+
+// addChartVersions records the chart's version and appVersion in a result,
+// leaving out the ones it doesn't declare
+func addChartVersions(result map[string]interface{}, chart *chartSource) {
+	if chart.metadata == nil {
+		return
+	}
+	if chart.metadata.Version != "" {
+		result["chart_version"] = chart.metadata.Version
+	}
+	if chart.metadata.AppVersion != "" {
+		result["app_version"] = chart.metadata.AppVersion
+	}
+}
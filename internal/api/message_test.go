@@ -0,0 +1,113 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/lei/yaml-helm-pipeline/internal/config"
+	"github.com/lei/yaml-helm-pipeline/internal/helm"
+)
+
+func TestBuildCommitMessage(t *testing.T) {
+	signedOff := []config.Trailer{
+		{Key: "Signed-off-by", Value: "Helm Pipeline <helm-pipeline@example.com>"},
+		{Key: "Refs", Value: "OPS-12"},
+	}
+
+	tests := []struct {
+		name    string
+		format  config.CommitFormat
+		message string
+		want    string
+	}{
+		{
+			name:    "suffix",
+			message: "Update",
+			want:    "Update (generated from acme/charts (branch: main), group: web)",
+		},
+		{
+			name: "suffix without message",
+			want: "",
+		},
+		{
+			name:    "conventional",
+			format:  config.CommitFormat{Style: config.CommitStyleConventional, Scope: "helm"},
+			message: "bump replicas",
+			want:    "chore(helm): bump replicas\n\nGenerated from acme/charts (branch: main), group: web",
+		},
+		{
+			name:    "conventional type and body",
+			format:  config.CommitFormat{Style: config.CommitStyleConventional, Type: "feat"},
+			message: "bump replicas\n\nFor the launch.\n",
+			want:    "feat: bump replicas\n\nGenerated from acme/charts (branch: main), group: web\n\nFor the launch.",
+		},
+		{
+			name:   "conventional without message",
+			format: config.CommitFormat{Style: config.CommitStyleConventional},
+			want:   "chore: update generated output for web\n\nGenerated from acme/charts (branch: main), group: web",
+		},
+		{
+			name:    "trailers",
+			format:  config.CommitFormat{Trailers: signedOff},
+			message: "Update",
+			want: "Update (generated from acme/charts (branch: main), group: web)\n\n" +
+				"Signed-off-by: Helm Pipeline <helm-pipeline@example.com>\nRefs: OPS-12",
+		},
+		{
+			name:   "trailers without message",
+			format: config.CommitFormat{Trailers: signedOff[:1]},
+			want: "update generated output for web (generated from acme/charts (branch: main), group: web)\n\n" +
+				"Signed-off-by: Helm Pipeline <helm-pipeline@example.com>",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := buildCommitMessage(&tt.format, tt.message, "acme/charts (branch: main)", "web"); got != tt.want {
+				t.Errorf("buildCommitMessage() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCommitFormatPrecedence(t *testing.T) {
+	top := &config.CommitFormat{Scope: "top"}
+	own := &config.CommitFormat{Scope: "group"}
+	requested := &config.CommitFormat{Scope: "request"}
+
+	h := &Handler{config: &config.Config{CommitFormat: top}}
+
+	grouped := &config.ConfigGroup{CommitFormat: own}
+	if got := h.commitFormat(grouped, requested); got != requested {
+		t.Errorf("commitFormat() = %+v, want the requested format", got)
+	}
+	if got := h.commitFormat(grouped, nil); got != own {
+		t.Errorf("commitFormat() = %+v, want the group's format", got)
+	}
+	if got := h.commitFormat(&config.ConfigGroup{}, nil); got != top {
+		t.Errorf("commitFormat() = %+v, want the top-level format", got)
+	}
+
+	h.config = &config.Config{}
+	if got := h.commitFormat(&config.ConfigGroup{}, nil); got == nil || got.Style != "" {
+		t.Errorf("commitFormat() = %+v, want the default suffix format", got)
+	}
+}
+
+func TestExpandChartVersions(t *testing.T) {
+	chart := &chartSource{metadata: &helm.ChartMetadata{Name: "web", Version: "1.2.3", AppVersion: "2.0"}}
+	if got := expandChartVersions("Release {{chart_version}} (app {{app_version}})", chart); got != "Release 1.2.3 (app 2.0)" {
+		t.Errorf("expandChartVersions() = %q", got)
+	}
+
+	// Chart references have no Chart.yaml, and charts may not declare an appVersion
+	for _, chart := range []*chartSource{{}, {metadata: &helm.ChartMetadata{Version: "1.2.3"}}} {
+		if got := expandChartVersions("app {{app_version}}", chart); got != "app " {
+			t.Errorf("expandChartVersions() = %q, want the missing version empty", got)
+		}
+		result := map[string]interface{}{}
+		addChartVersions(result, chart)
+		if _, ok := result["app_version"]; ok {
+			t.Errorf("result = %v, want no app_version", result)
+		}
+	}
+}
@@ -0,0 +1,367 @@
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/lei/yaml-helm-pipeline/internal/config"
+	"github.com/lei/yaml-helm-pipeline/internal/manifest"
+)
+
+// renderOutputFiles converts rendered YAML into the files written to a
+// group's output directory, keyed by file name. Split output gets one file
+// per resource; otherwise everything goes into the configured output file.
+func renderOutputFiles(group *config.ConfigGroup, out *groupRender) (map[string][]byte, error) {
+	// Each release has a file of its own
+	if out.releases != nil {
+		files := make(map[string][]byte, len(out.releases))
+		for _, release := range out.releases {
+			files[release.file] = release.output
+		}
+		return files, nil
+	}
+
+	yamlOutput := out.output
+	if !group.OutputRepo.SplitByResource {
+		content, err := encodeOutput(group, yamlOutput)
+		if err != nil {
+			return nil, err
+		}
+		return map[string][]byte{outputFilename(group): content}, nil
+	}
+
+	resources, err := manifest.Split(yamlOutput)
+	if err != nil {
+		return nil, fmt.Errorf("failed to split output: %w", err)
+	}
+
+	files := make(map[string][]byte, len(resources))
+	for i, resource := range resources {
+		files[resourceFileName(resource, i, files)] = resource.Content
+	}
+	return files, nil
+}
+
+// resourceFileName names a resource's file <kind>-<name>.yaml, adding the
+// namespace and then a counter when names would otherwise collide
+func resourceFileName(resource manifest.Resource, index int, taken map[string][]byte) string {
+	if resource.Kind == "" || resource.Name == "" {
+		return fmt.Sprintf("resource-%d.yaml", index+1)
+	}
+
+	base := safeName(strings.ToLower(resource.Kind) + "-" + resource.Name)
+	if _, exists := taken[base+".yaml"]; exists && resource.Namespace != "" {
+		base = safeName(strings.ToLower(resource.Kind) + "-" + resource.Namespace + "-" + resource.Name)
+	}
+
+	name := base + ".yaml"
+	for n := 2; ; n++ {
+		if _, exists := taken[name]; !exists {
+			return name
+		}
+		name = fmt.Sprintf("%s-%d.yaml", base, n)
+	}
+}
+
+// readOutputFiles reads a group's current files from its output directory.
+// For split output every YAML file directly in the directory belongs to the
+// group, so files from earlier renders can be found and removed. Groups with
+// releases also own the single output file they wrote before having any, so
+// it is removed once they are rendered per release.
+func readOutputFiles(group *config.ConfigGroup, outputDir string) (map[string][]byte, error) {
+	files := make(map[string][]byte)
+
+	if !group.OutputRepo.SplitByResource {
+		names := []string{outputFilename(group)}
+		for _, release := range group.Releases {
+			if release.Filename() != names[0] {
+				names = append(names, release.Filename())
+			}
+		}
+
+		for _, name := range names {
+			content, err := os.ReadFile(filepath.Join(outputDir, name))
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to read existing output: %w", err)
+			}
+			files[name] = content
+		}
+		return files, nil
+	}
+
+	entries, err := os.ReadDir(outputDir)
+	if os.IsNotExist(err) {
+		return files, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read output directory: %w", err)
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".yaml" {
+			continue
+		}
+		content, err := os.ReadFile(filepath.Join(outputDir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read existing output: %w", err)
+		}
+		files[entry.Name()] = content
+	}
+	return files, nil
+}
+
+// joinOutputFiles joins files in name order into a single stream, so split
+// and single-file output can be compared the same way
+func joinOutputFiles(files map[string][]byte) []byte {
+	names := sortedNames(files)
+	if len(names) == 1 {
+		return files[names[0]]
+	}
+
+	var buf bytes.Buffer
+	for i, name := range names {
+		if i > 0 {
+			buf.WriteString("---\n")
+		}
+		buf.Write(files[name])
+	}
+	return buf.Bytes()
+}
+
+// staleOutputFiles returns the existing files the new render no longer produces
+func staleOutputFiles(existing, rendered map[string][]byte) []string {
+	var stale []string
+	for _, name := range sortedNames(existing) {
+		if _, ok := rendered[name]; !ok {
+			stale = append(stale, name)
+		}
+	}
+	return stale
+}
+
+// File actions listed in a preview's file plan
+const (
+	fileActionCreate = "create"
+	fileActionUpdate = "update"
+	fileActionDelete = "delete"
+)
+
+// outputFilesPlan lists the files a commit would create, update, or delete,
+// as {path, action} entries ordered by path. Paths are relative to the root
+// of the output repository. Unchanged files are left out.
+func outputFilesPlan(group *config.ConfigGroup, existing, rendered map[string][]byte) []map[string]interface{} {
+	names := make(map[string][]byte, len(existing)+len(rendered))
+	for name := range existing {
+		names[name] = nil
+	}
+	for name := range rendered {
+		names[name] = nil
+	}
+
+	plan := []map[string]interface{}{}
+	for _, name := range sortedNames(names) {
+		oldContent, exists := existing[name]
+		newContent, kept := rendered[name]
+
+		var action string
+		switch {
+		case !exists:
+			action = fileActionCreate
+		case !kept:
+			action = fileActionDelete
+		case !bytes.Equal(oldContent, newContent):
+			action = fileActionUpdate
+		default:
+			continue
+		}
+
+		plan = append(plan, map[string]interface{}{
+			"path":   path.Join(group.OutputRepo.Path, name),
+			"action": action,
+		})
+	}
+	return plan
+}
+
+// outputFilesDiff returns a unified diff covering every file that changed,
+// was added, or was removed, with sensitive values redacted on both sides
+func (h *Handler) outputFilesDiff(group *config.ConfigGroup, redactor *manifest.Redactor, existing, rendered map[string][]byte) (string, error) {
+	names := make(map[string][]byte, len(existing)+len(rendered))
+	for name := range existing {
+		names[name] = nil
+	}
+	for name := range rendered {
+		names[name] = nil
+	}
+
+	var diff strings.Builder
+	for _, name := range sortedNames(names) {
+		oldContent, err := redactOutputFile(group, redactor, existing[name])
+		if err != nil {
+			return "", fmt.Errorf("failed to redact existing %s: %w", name, err)
+		}
+		newContent, err := redactOutputFile(group, redactor, rendered[name])
+		if err != nil {
+			return "", fmt.Errorf("failed to redact rendered %s: %w", name, err)
+		}
+		diff.WriteString(h.extractorService.UnifiedDiff(name, oldContent, newContent))
+	}
+	return diff.String(), nil
+}
+
+// redactOutputFile masks the values of sensitive keys in an output file,
+// keeping JSON output as JSON. Missing files stay missing.
+func redactOutputFile(group *config.ConfigGroup, redactor *manifest.Redactor, content []byte) ([]byte, error) {
+	if content == nil {
+		return nil, nil
+	}
+
+	// Split output is always YAML, whatever the configured format
+	if group.OutputRepo.Format != config.OutputFormatJSON || group.OutputRepo.SplitByResource {
+		return redactor.Redact(content)
+	}
+
+	yamlContent, err := manifest.FromJSON(content)
+	if err != nil {
+		return nil, err
+	}
+	redacted, err := redactor.Redact(yamlContent)
+	if err != nil {
+		return nil, err
+	}
+	return manifest.ToJSON(redacted)
+}
+
+// addCommitLinks records a pushed commit in a result: its hash, its URL, and
+// the URL of the group's output at that commit. owner is the account the
+// commit was pushed to. Nothing is added when no commit was made.
+func (h *Handler) addCommitLinks(result map[string]interface{}, group *config.ConfigGroup, owner, sha string) {
+	if sha == "" {
+		return
+	}
+
+	// Output in several files links to their directory
+	multiFile := group.OutputRepo.SplitByResource || len(group.Releases) > 0
+	outputPath := path.Join(group.OutputRepo.Path, outputFilename(group))
+	if multiFile {
+		outputPath = group.OutputRepo.Path
+	}
+
+	result["commit_sha"] = sha
+	result["commit_url"] = h.scm.CommitURL(owner, group.OutputRepo.Repo, sha)
+	result["file_url"] = h.scm.FileURL(owner, group.OutputRepo.Repo, sha, outputPath, multiFile)
+}
+
+// headerData is the context output headers are rendered with
+type headerData struct {
+	Repo      string // Template repository or chart reference
+	Branch    string // Template branch or ref the output was rendered from
+	Group     string
+	Timestamp string // Render time in RFC 3339 format, UTC
+}
+
+// renderHeader renders a group's output header as a comment block ending in
+// a newline. It returns nil when the group has no header.
+func renderHeader(group *config.ConfigGroup, data headerData) ([]byte, error) {
+	if group.OutputRepo.Header == "" {
+		return nil, nil
+	}
+
+	tmpl, err := template.New("header").Option("missingkey=error").Parse(group.OutputRepo.Header)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse output header: %w", err)
+	}
+	var text bytes.Buffer
+	if err := tmpl.Execute(&text, data); err != nil {
+		return nil, fmt.Errorf("failed to render output header: %w", err)
+	}
+
+	var header bytes.Buffer
+	for _, line := range strings.Split(strings.TrimRight(text.String(), "\n"), "\n") {
+		if !strings.HasPrefix(line, "#") {
+			line = strings.TrimRight("# "+line, " ")
+		}
+		header.WriteString(line + "\n")
+	}
+	return header.Bytes(), nil
+}
+
+// headerFields stand in for the values of a header while it is turned into
+// a pattern, so they can be replaced with wildcards once it is rendered
+var headerFields = headerData{
+	Repo:      "\x00repo\x00",
+	Branch:    "\x00branch\x00",
+	Group:     "\x00group\x00",
+	Timestamp: "\x00timestamp\x00",
+}
+
+// headerPattern returns a pattern matching the headers a group's output
+// files start with, whatever values they were rendered with. It returns nil
+// when the group has no header.
+func headerPattern(group *config.ConfigGroup) (*regexp.Regexp, error) {
+	header, err := renderHeader(group, headerFields)
+	if err != nil || header == nil {
+		return nil, err
+	}
+
+	pattern := regexp.QuoteMeta(string(header))
+	for _, field := range []string{headerFields.Repo, headerFields.Branch, headerFields.Group, headerFields.Timestamp} {
+		pattern = strings.ReplaceAll(pattern, field, `[^\n]*`)
+	}
+	return regexp.Compile(`\A` + pattern)
+}
+
+// stripHeaders removes a previously written header from each existing
+// output file, so the header doesn't count as a change. Only a header the
+// group's header template could have rendered is removed; comments that
+// merely look like one, or a header from an older template, are kept and
+// compared like the rest of the file.
+func stripHeaders(group *config.ConfigGroup, files map[string][]byte) error {
+	pattern, err := headerPattern(group)
+	if err != nil || pattern == nil {
+		return err
+	}
+
+	for name, content := range files {
+		if loc := pattern.FindIndex(content); loc != nil {
+			files[name] = content[loc[1]:]
+		}
+	}
+	return nil
+}
+
+// outputDirectory returns the directory a group's output is read from and
+// written to within a clone of its output repository. Previews and commits
+// both go through it so they always compare the same location. An empty
+// output path is the repository root.
+func outputDirectory(group *config.ConfigGroup, repoPath string) string {
+	return filepath.Join(repoPath, filepath.FromSlash(group.OutputRepo.Path))
+}
+
+// outputFilename returns the name of a group's single output file
+func outputFilename(group *config.ConfigGroup) string {
+	if group.OutputRepo.Filename == "" {
+		return "generated.yaml"
+	}
+	return group.OutputRepo.Filename
+}
+
+// sortedNames returns the keys of a file map in order
+func sortedNames(files map[string][]byte) []string {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
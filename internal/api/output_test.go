@@ -0,0 +1,292 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRenderOutputFilesSplit(t *testing.T) {
+	group := pipelineGroup("web", "deploy")
+	group.OutputRepo.SplitByResource = true
+
+	files, err := renderOutputFiles(&group, &groupRender{output: []byte(`kind: ConfigMap
+metadata:
+  name: web
+---
+kind: ConfigMap
+metadata:
+  name: web
+  namespace: other
+---
+kind: ConfigMap
+metadata:
+  name: web
+---
+kind: Service
+metadata:
+  name: web/api
+---
+replicas: 3
+`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := sortedNames(files)
+	want := []string{
+		"configmap-other-web.yaml",
+		"configmap-web-2.yaml",
+		"configmap-web.yaml",
+		"resource-5.yaml",
+		"service-web-api.yaml",
+	}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("files = %q, want %q", names, want)
+	}
+	if got := string(files["configmap-other-web.yaml"]); got != "kind: ConfigMap\nmetadata:\n  name: web\n  namespace: other\n" {
+		t.Errorf("configmap-other-web.yaml = %q, want the document on its own", got)
+	}
+}
+
+func TestCommitSplitByResource(t *testing.T) {
+	group := pipelineGroup("web", "deploy")
+	group.OutputRepo.SplitByResource = true
+	p := newTestPipeline(t, group)
+	service := "apiVersion: v1\nkind: Service\nmetadata:\n  name: web\n"
+	p.addRepo(t, "acme", "values", map[string]string{"web.yaml": configMap("web", "one") + "---\n" + service})
+	p.addRepo(t, "acme", "deploy", map[string]string{
+		"web/generated.yaml": configMap("web", "old"),
+		"web/notes.txt":      "kept\n",
+	})
+
+	commit := func() {
+		t.Helper()
+		if code, response := p.commitChanges(t, `{"branch":"master","message":"Update"}`); code != http.StatusOK {
+			t.Fatalf("CommitChanges() status = %d, response %v", code, response)
+		}
+	}
+
+	commit()
+	if got := p.file(t, "acme", "deploy", "web/configmap-web.yaml"); got != configMap("web", "one") {
+		t.Errorf("web/configmap-web.yaml = %q", got)
+	}
+	if got := p.file(t, "acme", "deploy", "web/service-web.yaml"); got != service {
+		t.Errorf("web/service-web.yaml = %q", got)
+	}
+	if got := p.file(t, "acme", "deploy", "web/generated.yaml"); got != "" {
+		t.Errorf("web/generated.yaml = %q, want YAML the render doesn't produce removed", got)
+	}
+	if got := p.file(t, "acme", "deploy", "web/notes.txt"); got != "kept\n" {
+		t.Errorf("web/notes.txt = %q, want other files kept", got)
+	}
+
+	// A resource the chart no longer renders is removed in the same commit
+	p.pushFiles(t, "acme", "values", map[string]string{"web.yaml": configMap("web", "two")})
+	commit()
+	if got := p.file(t, "acme", "deploy", "web/configmap-web.yaml"); got != configMap("web", "two") {
+		t.Errorf("web/configmap-web.yaml = %q", got)
+	}
+	if got := p.file(t, "acme", "deploy", "web/service-web.yaml"); got != "" {
+		t.Errorf("web/service-web.yaml = %q, want the stale file removed", got)
+	}
+	if n := p.commits(t, "acme", "deploy"); n != 3 {
+		t.Errorf("acme/deploy has %d commits, want one per render", n)
+	}
+}
+
+func TestOutputDirectory(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"", "/clone"},
+		{"apps/web", "/clone/apps/web"},
+		{"apps/web/", "/clone/apps/web"},
+	}
+	for _, tt := range tests {
+		group := pipelineGroup("web", "deploy")
+		group.OutputRepo.Path = tt.path
+		if got := outputDirectory(&group, "/clone"); got != filepath.FromSlash(tt.want) {
+			t.Errorf("outputDirectory() with path %q = %s, want %s", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestPreviewAndCommitShareOutputDirectory(t *testing.T) {
+	for _, path := range []string{"", "apps/web"} {
+		t.Run("path "+path, func(t *testing.T) {
+			group := pipelineGroup("web", "deploy")
+			group.OutputRepo.Path = path
+			p := newTestPipeline(t, group)
+			p.addRepo(t, "acme", "values", map[string]string{"web.yaml": configMap("web", "one")})
+			p.addRepo(t, "acme", "deploy", map[string]string{"README.md": "deploy\n"})
+
+			if code, response := p.commitChanges(t, `{"branch":"master","message":"Update"}`); code != http.StatusOK {
+				t.Fatalf("CommitChanges() status = %d, response %v", code, response)
+			}
+			name := strings.TrimPrefix(path+"/generated.yaml", "/")
+			if got := p.file(t, "acme", "deploy", name); got != configMap("web", "one") {
+				t.Fatalf("%s = %q, want the committed output", name, got)
+			}
+
+			// The preview reads the file the commit wrote
+			w := p.previewGroup("/api/groups/web/preview?branch=master")
+			var response struct{ Result map[string]interface{} }
+			if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+				t.Fatalf("status = %d, body %s", w.Code, w.Body)
+			}
+			if response.Result["content_changed"] != false {
+				t.Errorf("preview result = %v, want the committed output unchanged", response.Result)
+			}
+		})
+	}
+}
+
+func TestRenderHeader(t *testing.T) {
+	group := pipelineGroup("web", "deploy")
+	data := headerData{Repo: "acme/charts", Branch: "main", Group: "web", Timestamp: "2024-01-10T12:00:00Z"}
+
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{"", ""},
+		{"DO NOT EDIT - generated from {{.Repo}}@{{.Branch}} group {{.Group}}", "# DO NOT EDIT - generated from acme/charts@main group web\n"},
+		{"Rendered at {{.Timestamp}}\n\n# Already a comment\n", "# Rendered at 2024-01-10T12:00:00Z\n#\n# Already a comment\n"},
+	}
+	for _, tt := range tests {
+		group.OutputRepo.Header = tt.header
+		got, err := renderHeader(&group, data)
+		if err != nil || string(got) != tt.want {
+			t.Errorf("renderHeader(%q) = %q, %v, want %q", tt.header, got, err, tt.want)
+		}
+	}
+
+	group.OutputRepo.Header = "{{.Missing}}"
+	if _, err := renderHeader(&group, data); err == nil {
+		t.Error("renderHeader() with an unknown field succeeded, want an error")
+	}
+}
+
+func TestStripHeaders(t *testing.T) {
+	group := pipelineGroup("web", "deploy")
+	group.OutputRepo.Header = "DO NOT EDIT - generated from {{.Repo}}@{{.Branch}}\nRendered at {{.Timestamp}}"
+
+	files := map[string][]byte{
+		"rendered":  []byte("# DO NOT EDIT - generated from acme/charts@release/1.2\n# Rendered at 2024-01-10T12:00:00Z\nkind: A\n"),
+		"comments":  []byte("# Tuned by hand\n# for the load test\nkind: B\n"),
+		"old":       []byte("# DO NOT EDIT\n# Rendered at 2024-01-10T12:00:00Z\nkind: C\n"),
+		"no header": []byte("kind: D\n"),
+	}
+	if err := stripHeaders(&group, files); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"rendered":  "kind: A\n",
+		"comments":  "# Tuned by hand\n# for the load test\nkind: B\n",
+		"old":       "# DO NOT EDIT\n# Rendered at 2024-01-10T12:00:00Z\nkind: C\n",
+		"no header": "kind: D\n",
+	}
+	for name, content := range want {
+		if got := string(files[name]); got != content {
+			t.Errorf("%s = %q, want %q", name, got, content)
+		}
+	}
+}
+
+func TestCommitIgnoresHeader(t *testing.T) {
+	p := newSharedOutputPipeline(t)
+	p.config.Groups[0].OutputRepo.Header = "Generated from {{.Repo}} at {{.Timestamp}}"
+
+	// The output as committed by an earlier render
+	p.pushFiles(t, "acme", "deploy", map[string]string{
+		"web/generated.yaml": "# Generated from acme/charts at 2020-01-01T00:00:00Z\n" + configMap("web", "one"),
+	})
+
+	code, response := p.commitChanges(t, `{"branch":"master","message":"Update","groups":["web"]}`)
+	if code != http.StatusOK {
+		t.Fatalf("CommitChanges() status = %d, response %v", code, response)
+	}
+	if n := p.commits(t, "acme", "deploy"); n != 2 {
+		t.Errorf("acme/deploy has %d commits, want the header change ignored", n)
+	}
+}
+
+func TestCommitWritesHeader(t *testing.T) {
+	p := newSharedOutputPipeline(t)
+	p.config.Groups[0].OutputRepo.Header = "DO NOT EDIT - generated from {{.Repo}}@{{.Branch}} group {{.Group}}"
+
+	code, response := p.commitChanges(t, `{"branch":"master","message":"Update","groups":["web"]}`)
+	if code != http.StatusOK {
+		t.Fatalf("CommitChanges() status = %d, response %v", code, response)
+	}
+	want := "# DO NOT EDIT - generated from acme/charts@master group web\n" + configMap("web", "one")
+	if got := p.file(t, "acme", "deploy", "web/generated.yaml"); got != want {
+		t.Errorf("web/generated.yaml = %q, want %q", got, want)
+	}
+}
+
+func TestOutputFilesPlan(t *testing.T) {
+	group := pipelineGroup("web", "deploy")
+	group.OutputRepo.Path = "apps/web"
+
+	existing := map[string][]byte{
+		"configmap-web.yaml": []byte("kind: ConfigMap\n"),
+		"service-web.yaml":   []byte("kind: Service\n"),
+		"secret-web.yaml":    []byte("kind: Secret\n"),
+	}
+	rendered := map[string][]byte{
+		"configmap-web.yaml":  []byte("kind: ConfigMap\n"),
+		"service-web.yaml":    []byte("kind: Service\nspec: {}\n"),
+		"deployment-web.yaml": []byte("kind: Deployment\n"),
+	}
+	want := []map[string]interface{}{
+		{"path": "apps/web/deployment-web.yaml", "action": fileActionCreate},
+		{"path": "apps/web/secret-web.yaml", "action": fileActionDelete},
+		{"path": "apps/web/service-web.yaml", "action": fileActionUpdate},
+	}
+	if got := outputFilesPlan(&group, existing, rendered); !reflect.DeepEqual(got, want) {
+		t.Errorf("outputFilesPlan() = %v, want %v", got, want)
+	}
+
+	// Nothing to do is an empty plan rather than none
+	if got := outputFilesPlan(&group, existing, existing); got == nil || len(got) != 0 {
+		t.Errorf("outputFilesPlan() of unchanged files = %#v, want an empty plan", got)
+	}
+}
+
+func TestPreviewFilesPlan(t *testing.T) {
+	group := pipelineGroup("web", "deploy")
+	group.OutputRepo.SplitByResource = true
+	p := newTestPipeline(t, group)
+	service := "apiVersion: v1\nkind: Service\nmetadata:\n  name: web\n"
+	p.addRepo(t, "acme", "values", map[string]string{"web.yaml": configMap("web", "one") + "---\n" + service})
+	p.addRepo(t, "acme", "deploy", map[string]string{
+		"web/configmap-web.yaml": configMap("web", "old"),
+		"web/secret-web.yaml":    "apiVersion: v1\nkind: Secret\nmetadata:\n  name: web\n",
+	})
+
+	w := p.previewGroup("/api/groups/web/preview?branch=master")
+	var response struct{ Result map[string]interface{} }
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body)
+	}
+	want := []interface{}{
+		map[string]interface{}{"path": "web/configmap-web.yaml", "action": "update"},
+		map[string]interface{}{"path": "web/secret-web.yaml", "action": "delete"},
+		map[string]interface{}{"path": "web/service-web.yaml", "action": "create"},
+	}
+	if got := response.Result["files"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("files = %v, want %v", got, want)
+	}
+
+	// Nothing is written by the preview
+	if n := p.commits(t, "acme", "deploy"); n != 1 {
+		t.Errorf("acme/deploy has %d commits, want the preview to push nothing", n)
+	}
+}
@@ -0,0 +1,67 @@
+package api
+
+import (
+	"errors"
+
+	"github.com/lei/yaml-helm-pipeline/internal/git"
+)
+
+// Phases of processing a group, reported with the group's error so failures
+// can be told apart
+const (
+	phaseConfig        = "config"
+	phaseCloneTemplate = "clone_template"
+	phaseCloneValues   = "clone_values"
+	phaseRender        = "render"
+	phaseCloneOutput   = "clone_output"
+	phaseWrite         = "write"
+	phaseCommit        = "commit"
+	phasePush          = "push"
+)
+
+// phaseError is an error tagged with the phase it happened in
+type phaseError struct {
+	phase string
+	err   error
+}
+
+func (e *phaseError) Error() string {
+	return e.err.Error()
+}
+
+func (e *phaseError) Unwrap() error {
+	return e.err
+}
+
+// inPhase tags an error with the phase it happened in. Errors that already
+// carry a phase keep it, and commit errors caused by a failed push are
+// tagged as push errors.
+func inPhase(phase string, err error) error {
+	if err == nil || errorPhase(err) != "" {
+		return err
+	}
+	if phase == phaseCommit && errors.Is(err, git.ErrPushFailed) {
+		phase = phasePush
+	}
+	return &phaseError{phase: phase, err: err}
+}
+
+// errorPhase returns the phase an error happened in, or "" if it has none
+func errorPhase(err error) string {
+	var tagged *phaseError
+	if errors.As(err, &tagged) {
+		return tagged.phase
+	}
+	return ""
+}
+
+// errorResult is the result reported for a group that failed
+func errorResult(err error) map[string]interface{} {
+	result := map[string]interface{}{
+		"error": err.Error(),
+	}
+	if phase := errorPhase(err); phase != "" {
+		result["phase"] = phase
+	}
+	return result
+}
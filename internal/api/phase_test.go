@@ -0,0 +1,55 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/lei/yaml-helm-pipeline/internal/git"
+)
+
+func TestInPhase(t *testing.T) {
+	if err := inPhase(phaseRender, nil); err != nil {
+		t.Errorf("inPhase(nil) = %v, want nil", err)
+	}
+
+	base := errors.New("boom")
+	err := inPhase(phaseWrite, base)
+	if errorPhase(err) != phaseWrite || !errors.Is(err, base) || err.Error() != "boom" {
+		t.Errorf("inPhase() = %v in phase %q, want boom in phase %s", err, errorPhase(err), phaseWrite)
+	}
+
+	// The innermost phase wins
+	if phase := errorPhase(inPhase(phaseConfig, fmt.Errorf("outer: %w", err))); phase != phaseWrite {
+		t.Errorf("retagged phase = %q, want %s", phase, phaseWrite)
+	}
+
+	// Commits that fail to push are push errors
+	pushErr := fmt.Errorf("%w: %w", git.ErrPushFailed, base)
+	if phase := errorPhase(inPhase(phaseCommit, pushErr)); phase != phasePush {
+		t.Errorf("push failure phase = %q, want %s", phase, phasePush)
+	}
+	if phase := errorPhase(inPhase(phaseCommit, base)); phase != phaseCommit {
+		t.Errorf("commit failure phase = %q, want %s", phase, phaseCommit)
+	}
+}
+
+func TestErrorResult(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want map[string]interface{}
+	}{
+		{"with phase", inPhase(phaseRender, errors.New("bad")), map[string]interface{}{"error": "bad", "phase": phaseRender}},
+		{"without phase", errors.New("bad"), map[string]interface{}{"error": "bad"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := errorResult(tt.err); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("errorResult() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
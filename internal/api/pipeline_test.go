@@ -0,0 +1,345 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/go-git/go-git/v5"
+	gitconfig "github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport/client"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-git/go-git/v5/plumbing/transport/server"
+	"github.com/lei/yaml-helm-pipeline/internal/config"
+	"github.com/lei/yaml-helm-pipeline/internal/extractor"
+	gitservice "github.com/lei/yaml-helm-pipeline/internal/git"
+	"github.com/lei/yaml-helm-pipeline/internal/github"
+	"github.com/lei/yaml-helm-pipeline/internal/helm"
+	"github.com/lei/yaml-helm-pipeline/internal/retry"
+)
+
+// fakeGitHubAPI answers GitHub API requests for the repositories of a test
+// pipeline, which are all on master, and for the contents of files in the
+// bare repositories under root
+func fakeGitHubAPI(root string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.SplitN(strings.Trim(r.URL.Path, "/"), "/", 5)
+		if r.Method != http.MethodGet || len(parts) < 3 || parts[0] != "repos" {
+			http.NotFound(w, r)
+			return
+		}
+
+		owner, repo := parts[1], parts[2]
+		if len(parts) == 5 && parts[3] == "contents" {
+			content, err := fileContents(filepath.Join(root, owner, repo+".git"), r.URL.Query().Get("ref"), parts[4])
+			if err != nil {
+				http.NotFound(w, r)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"type":     "file",
+				"encoding": "base64",
+				"content":  base64.StdEncoding.EncodeToString(content),
+			})
+			return
+		}
+		if len(parts) != 3 {
+			http.NotFound(w, r)
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"name":           repo,
+			"owner":          map[string]string{"login": owner},
+			"clone_url":      "https://github.com/" + owner + "/" + repo + ".git",
+			"default_branch": "master",
+		})
+	}
+}
+
+// fileContents returns the content of a file on branch of the bare
+// repository at path
+func fileContents(path, branch, name string) ([]byte, error) {
+	remote, err := git.PlainOpen(path)
+	if err != nil {
+		return nil, err
+	}
+	ref, err := remote.Reference(plumbing.NewBranchReferenceName(branch), true)
+	if err != nil {
+		return nil, err
+	}
+	commit, err := remote.CommitObject(ref.Hash())
+	if err != nil {
+		return nil, err
+	}
+	file, err := commit.File(name)
+	if err != nil {
+		return nil, err
+	}
+	content, err := file.Contents()
+	return []byte(content), err
+}
+
+// apiTransport sends requests for the GitHub API to a test server
+type apiTransport struct {
+	server *httptest.Server
+}
+
+// RoundTrip implements http.RoundTripper
+func (t apiTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	target, _ := url.Parse(t.server.URL)
+	req = req.Clone(req.Context())
+	req.URL.Scheme = target.Scheme
+	req.URL.Host = target.Host
+	return t.server.Client().Transport.RoundTrip(req)
+}
+
+// fakeHelmScript stands in for helm template: it prints the last values
+// file it is given, so each group's values file holds its rendered output,
+// and a trace with --debug. Other commands succeed without doing anything.
+// Each run is logged to the file named by the placeholder RUNS.
+const fakeHelmScript = `#!/bin/sh
+echo "$@" >> RUNS
+[ "$1" = template ] || exit 0
+case " $* " in *" --debug "*) echo "[debug] CHART PATH: $2" >&2 ;; esac
+for arg; do
+	[ "$previous" = "-f" ] && values=$arg
+	previous=$arg
+done
+cat "$values"
+`
+
+// testPipeline is a handler rendering with fake helm from repositories
+// served in place of github.com
+type testPipeline struct {
+	*Handler
+	root       string             // Directory holding the bare repositories, at root/<owner>/<repo>.git
+	runs       string             // Log of the fake helm's runs
+	githubHTTP github.HTTPOptions // Sends GitHub API requests to the test's fake API
+}
+
+// newTestPipeline returns a pipeline with the given groups and a chart
+// repository acme/charts on master, which is the template repository. It
+// puts a fake helm first on PATH, clones into a fresh TMPDIR, and serves
+// github.com and its API from the test.
+func newTestPipeline(t *testing.T, groups ...config.ConfigGroup) *testPipeline {
+	t.Helper()
+
+	dir := t.TempDir()
+	runs := filepath.Join(dir, "runs")
+	script := strings.Replace(fakeHelmScript, "RUNS", runs, 1)
+	if err := os.WriteFile(filepath.Join(dir, "helm"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	t.Setenv("TMPDIR", t.TempDir())
+
+	root := t.TempDir()
+	client.InstallProtocol("https", server.NewClient(server.NewFilesystemLoader(osfs.New(root))))
+	t.Cleanup(func() { client.InstallProtocol("https", githttp.DefaultClient) })
+
+	api := httptest.NewServer(fakeGitHubAPI(root))
+	t.Cleanup(api.Close)
+	githubHTTP := github.HTTPOptions{Transport: apiTransport{api}}
+
+	once := retry.Policy{MaxAttempts: 1}
+	p := &testPipeline{
+		Handler: NewHandler(github.NewService("token", "acme", "charts", once, githubHTTP), helm.NewService(0),
+			gitservice.NewService("token", once), extractor.NewService(), &config.Config{Groups: groups}),
+		root:       root,
+		runs:       runs,
+		githubHTTP: githubHTTP,
+	}
+
+	p.addRepo(t, "acme", "charts", map[string]string{
+		"Chart.yaml":         "apiVersion: v2\nname: app\nversion: 1.0.0\n",
+		"templates/.gitkeep": "",
+	})
+	return p
+}
+
+// remote returns the path of the bare repository owner/repo
+func (p *testPipeline) remote(owner, repo string) string {
+	return filepath.Join(p.root, owner, repo+".git")
+}
+
+// helmRuns returns the number of times helm was run
+func (p *testPipeline) helmRuns(t *testing.T) int {
+	t.Helper()
+
+	log, err := os.ReadFile(p.runs)
+	if os.IsNotExist(err) {
+		return 0
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Count(string(log), "\n")
+}
+
+// addRepo creates the repository owner/repo with files on master
+func (p *testPipeline) addRepo(t *testing.T, owner, repo string, files map[string]string) {
+	t.Helper()
+
+	remote := p.remote(owner, repo)
+	if _, err := git.PlainInit(remote, true); err != nil {
+		t.Fatal(err)
+	}
+
+	work := t.TempDir()
+	clone, err := git.PlainInit(work, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := clone.CreateRemote(&gitconfig.RemoteConfig{Name: git.DefaultRemoteName, URLs: []string{remote}}); err != nil {
+		t.Fatal(err)
+	}
+	p.commit(t, clone, work, files)
+}
+
+// pushFiles commits files to master of owner/repo, as someone else would
+func (p *testPipeline) pushFiles(t *testing.T, owner, repo string, files map[string]string) {
+	t.Helper()
+
+	work := t.TempDir()
+	clone, err := git.PlainClone(work, false, &git.CloneOptions{URL: p.remote(owner, repo)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.commit(t, clone, work, files)
+}
+
+// commit writes files into the worktree of clone, commits, and pushes them
+func (p *testPipeline) commit(t *testing.T, clone *git.Repository, work string, files map[string]string) {
+	t.Helper()
+
+	for name, content := range files {
+		path := filepath.Join(work, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	worktree, err := clone.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := worktree.AddWithOptions(&git.AddOptions{All: true}); err != nil {
+		t.Fatal(err)
+	}
+	_, err = worktree.Commit("test commit", &git.CommitOptions{
+		Author: &object.Signature{Name: "Test", Email: "test@example.com", When: time.Now()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := clone.Push(&git.PushOptions{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// commits returns the number of commits on master of owner/repo
+func (p *testPipeline) commits(t *testing.T, owner, repo string) int {
+	t.Helper()
+
+	remote, err := git.PlainOpen(p.remote(owner, repo))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := remote.Reference(plumbing.Master, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log, err := remote.Log(&git.LogOptions{From: ref.Hash()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	log.ForEach(func(*object.Commit) error {
+		n++
+		return nil
+	})
+	return n
+}
+
+// head returns the hash of master of owner/repo
+func (p *testPipeline) head(t *testing.T, owner, repo string) string {
+	t.Helper()
+
+	remote, err := git.PlainOpen(p.remote(owner, repo))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := remote.Reference(plumbing.Master, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ref.Hash().String()
+}
+
+// file returns the content of a file on master of owner/repo, or "" when it
+// doesn't exist
+func (p *testPipeline) file(t *testing.T, owner, repo, name string) string {
+	t.Helper()
+
+	remote, err := git.PlainOpen(p.remote(owner, repo))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := remote.Reference(plumbing.Master, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit, err := remote.CommitObject(ref.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := commit.File(name)
+	if errors.Is(err, object.ErrFileNotFound) {
+		return ""
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := file.Contents()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return content
+}
+
+// configMap returns a manifest of a ConfigMap, which the fake helm renders
+// when it is a group's values file
+func configMap(name, value string) string {
+	return "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: " + name + "\ndata:\n  value: " + value + "\n"
+}
+
+// pipelineGroup returns a group rendering the values file <name>.yaml of
+// acme/values into <name>/generated.yaml of acme/<output>
+func pipelineGroup(name, output string) config.ConfigGroup {
+	return config.ConfigGroup{
+		Name:        name,
+		ValuesRepos: []config.ValuesRepo{{Owner: "acme", Repo: "values", Path: name + ".yaml", Branch: "master"}},
+		OutputRepo: config.OutputRepo{
+			Owner:    "acme",
+			Repo:     output,
+			Path:     name,
+			Filename: "generated.yaml",
+			Branch:   "master",
+		},
+	}
+}
@@ -0,0 +1,185 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/go-chi/render"
+	"github.com/lei/yaml-helm-pipeline/internal/extractor"
+)
+
+// PlanVersion is the version of the plan schema. It changes whenever fields
+// are removed or change meaning.
+const PlanVersion = 1
+
+// Statuses of a group in a plan
+const (
+	planStatusChanged   = "changed"
+	planStatusUnchanged = "unchanged"
+	planStatusError     = "error"
+)
+
+// Plan lists the changes a commit would make across groups, in a stable
+// schema meant for tooling such as pull request comments
+type Plan struct {
+	Version int                   `json:"version"`
+	Branch  string                `json:"branch"`
+	Summary extractor.DiffSummary `json:"summary"`
+	Groups  []GroupPlan           `json:"groups"`
+}
+
+// GroupPlan is the part of a plan for one group. Groups are ordered by
+// name, files by path, and changes by resource and key path.
+type GroupPlan struct {
+	Name    string                `json:"name"`
+	Status  string                `json:"status"`
+	Error   string                `json:"error,omitempty"`
+	Phase   string                `json:"phase,omitempty"`
+	Summary extractor.DiffSummary `json:"summary"`
+	Files   []PlanFile            `json:"files"`
+	Changes []PlanChange          `json:"changes"`
+}
+
+// PlanFile is an output file a group's commit would create, update, or
+// delete, relative to the output repository root
+type PlanFile struct {
+	Path   string `json:"path"`
+	Action string `json:"action"`
+}
+
+// PlanChange is a key a group's commit would add, change, or remove in one
+// of its resources, keyed "Kind/name" as in previews grouped by resource
+type PlanChange struct {
+	Resource string `json:"resource"`
+	Path     string `json:"path"`
+	Type     string `json:"type"`
+}
+
+// PlanRequest represents a request for a plan
+type PlanRequest struct {
+	Branch string   `json:"branch"`
+	Groups []string `json:"groups"`
+
+	// Values holds inline values per group name, as in previews
+	Values map[string]interface{} `json:"values,omitempty"`
+}
+
+// CreatePlan previews the selected groups and returns a combined plan of
+// every change a commit would make
+func (h *Handler) CreatePlan(w http.ResponseWriter, r *http.Request) {
+	var req PlanRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.Branch == "" {
+		http.Error(w, "Branch is required", http.StatusBadRequest)
+		return
+	}
+
+	// If no groups specified, use all groups the token may preview
+	selectedGroups := req.Groups
+	if len(selectedGroups) == 0 {
+		selectedGroups = h.groupNames(r, h.scopePreviews)
+	} else if h.scopePreviews && forbidGroups(w, r, selectedGroups) {
+		return
+	}
+
+	if len(selectedGroups) == 0 {
+		http.Error(w, "No configuration groups available", http.StatusInternalServerError)
+		return
+	}
+
+	overlays := make(map[string][]byte)
+	for groupName, values := range req.Values {
+		overlay, err := inlineValues(values)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("group %s: %v", groupName, err), http.StatusBadRequest)
+			return
+		}
+		overlays[groupName] = overlay
+	}
+
+	shared := h.newSharedValues()
+	defer shared.cleanup()
+	renders := newRenderCache()
+
+	plan := Plan{
+		Version: PlanVersion,
+		Branch:  req.Branch,
+		Groups:  make([]GroupPlan, 0, len(selectedGroups)),
+	}
+	for _, groupName := range selectedGroups {
+		result, err := h.processConfigGroup(r.Context(), groupName, processOptions{
+			templateRepoBranch: req.Branch,
+			previewOnly:        true,
+			valuesOverlay:      overlays[groupName],
+			groupBy:            groupByResource,
+			shared:             shared,
+			renders:            renders,
+		})
+
+		group := groupPlan(groupName, result, err)
+		plan.Summary.Added += group.Summary.Added
+		plan.Summary.Changed += group.Summary.Changed
+		plan.Summary.Removed += group.Summary.Removed
+		plan.Groups = append(plan.Groups, group)
+	}
+
+	sort.Slice(plan.Groups, func(i, j int) bool {
+		return plan.Groups[i].Name < plan.Groups[j].Name
+	})
+
+	render.JSON(w, r, plan)
+}
+
+// groupPlan converts the preview result of a group to its part of a plan
+func groupPlan(name string, result map[string]interface{}, err error) GroupPlan {
+	plan := GroupPlan{
+		Name:    name,
+		Files:   []PlanFile{},
+		Changes: []PlanChange{},
+	}
+	if err != nil {
+		plan.Status = planStatusError
+		plan.Error = err.Error()
+		plan.Phase = errorPhase(err)
+		return plan
+	}
+
+	plan.Status = planStatusUnchanged
+	if changed, _ := result["content_changed"].(bool); changed {
+		plan.Status = planStatusChanged
+	}
+	plan.Summary, _ = result["summary"].(extractor.DiffSummary)
+
+	files, _ := result["files"].([]map[string]interface{})
+	for _, file := range files {
+		path, _ := file["path"].(string)
+		action, _ := file["action"].(string)
+		plan.Files = append(plan.Files, PlanFile{Path: path, Action: action})
+	}
+
+	// Changes are grouped by resource, so every document of the output is
+	// compared rather than only the first
+	resources, _ := result["changes"].(map[string]interface{})
+	for resource, diff := range resources {
+		entry, _ := diff.(map[string]interface{})
+		changes, _ := entry["changes"].(map[string]interface{})
+		for path, change := range changes {
+			changeType, _ := change.(string)
+			plan.Changes = append(plan.Changes, PlanChange{Resource: resource, Path: path, Type: changeType})
+		}
+	}
+	sort.Slice(plan.Changes, func(i, j int) bool {
+		if plan.Changes[i].Resource != plan.Changes[j].Resource {
+			return plan.Changes[i].Resource < plan.Changes[j].Resource
+		}
+		return plan.Changes[i].Path < plan.Changes[j].Path
+	})
+
+	return plan
+}
@@ -0,0 +1,75 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/lei/yaml-helm-pipeline/internal/extractor"
+)
+
+func TestCreatePlan(t *testing.T) {
+	p := newTestPipeline(t, pipelineGroup("web", "deploy"), pipelineGroup("api", "deploy"), pipelineGroup("broken", "deploy"))
+	p.addRepo(t, "acme", "values", map[string]string{
+		"web.yaml": configMap("web", "one") + "---\n" + configMap("web-extra", "new"),
+		"api.yaml": configMap("api", "two"),
+	})
+	// Only the second document of web's output changes
+	p.addRepo(t, "acme", "deploy", map[string]string{
+		"web/generated.yaml": configMap("web", "one") + "---\n" + configMap("web-extra", "old"),
+	})
+
+	w := httptest.NewRecorder()
+	p.CreatePlan(w, httptest.NewRequest(http.MethodPost, "/api/plan", strings.NewReader(`{"branch":"master"}`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("CreatePlan() status = %d, body %s", w.Code, w.Body)
+	}
+	var plan Plan
+	if err := json.Unmarshal(w.Body.Bytes(), &plan); err != nil {
+		t.Fatal(err)
+	}
+
+	if plan.Version != PlanVersion || plan.Branch != "master" {
+		t.Errorf("plan version %d for branch %s", plan.Version, plan.Branch)
+	}
+	var names []string
+	for _, group := range plan.Groups {
+		names = append(names, group.Name)
+	}
+	if want := []string{"api", "broken", "web"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("plan groups = %v, want %v", names, want)
+	}
+	api, broken, web := plan.Groups[0], plan.Groups[1], plan.Groups[2]
+
+	wantAPI := []PlanChange{
+		{Resource: "ConfigMap/api", Path: "apiVersion", Type: "added"},
+		{Resource: "ConfigMap/api", Path: "data.value", Type: "added"},
+		{Resource: "ConfigMap/api", Path: "kind", Type: "added"},
+		{Resource: "ConfigMap/api", Path: "metadata.name", Type: "added"},
+	}
+	if api.Status != planStatusChanged || !reflect.DeepEqual(api.Changes, wantAPI) {
+		t.Errorf("api plan = %+v, want the new output's keys added", api)
+	}
+	if want := []PlanFile{{Path: "api/generated.yaml", Action: "create"}}; !reflect.DeepEqual(api.Files, want) {
+		t.Errorf("api files = %+v, want %+v", api.Files, want)
+	}
+
+	wantWeb := []PlanChange{{Resource: "ConfigMap/web-extra", Path: "data.value", Type: "changed"}}
+	if web.Status != planStatusChanged || !reflect.DeepEqual(web.Changes, wantWeb) {
+		t.Errorf("web plan = %+v, want the second document's change", web)
+	}
+	if want := (extractor.DiffSummary{Changed: 1}); web.Summary != want {
+		t.Errorf("web summary = %+v, want %+v", web.Summary, want)
+	}
+
+	if broken.Status != planStatusError || broken.Phase != phaseCloneValues || len(broken.Changes) != 0 {
+		t.Errorf("broken plan = %+v, want a clone_values error", broken)
+	}
+
+	if want := (extractor.DiffSummary{Added: 4, Changed: 1}); plan.Summary != want {
+		t.Errorf("plan summary = %+v, want %+v", plan.Summary, want)
+	}
+}
@@ -0,0 +1,163 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// DefaultPreviewTTL is how long a preview can be committed when no TTL is
+// configured
+const DefaultPreviewTTL = 15 * time.Minute
+
+// Bounds of the memory held by stored previews. The oldest previews are
+// evicted to make room for new ones.
+const (
+	maxPreviews     = 100
+	maxPreviewBytes = 64 << 20
+)
+
+// errPreviewTooLarge is returned by put for a preview that alone exceeds
+// maxPreviewBytes
+var errPreviewTooLarge = errors.New("preview is too large to keep for committing")
+
+// previewStore keeps the renders of recent previews so they can be
+// committed without rendering again
+type previewStore struct {
+	mu       sync.Mutex
+	ttl      time.Duration
+	previews map[string]*storedPreview
+	bytes    int // Total size of the stored previews
+}
+
+// storedPreview is the render of every group a preview succeeded for
+type storedPreview struct {
+	branch  string
+	groups  map[string]*groupRender
+	expires time.Time
+	size    int
+}
+
+// newPreviewStore creates an empty preview store whose previews expire after
+// ttl, or DefaultPreviewTTL when ttl isn't positive
+func newPreviewStore(ttl time.Duration) *previewStore {
+	if ttl <= 0 {
+		ttl = DefaultPreviewTTL
+	}
+	return &previewStore{
+		ttl:      ttl,
+		previews: make(map[string]*storedPreview),
+	}
+}
+
+// put stores the renders of a preview of a branch and returns the token
+// that commits them, evicting the oldest previews to stay within
+// maxPreviews and maxPreviewBytes
+func (s *previewStore) put(branch string, groups map[string]*groupRender) (string, error) {
+	size := 0
+	for _, render := range groups {
+		size += render.size()
+	}
+	if size > maxPreviewBytes {
+		return "", errPreviewTooLarge
+	}
+
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return "", fmt.Errorf("failed to generate preview token: %w", err)
+	}
+	token := hex.EncodeToString(raw)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.prune(now)
+	for len(s.previews) >= maxPreviews || s.bytes+size > maxPreviewBytes {
+		s.evictOldest()
+	}
+
+	s.previews[token] = &storedPreview{
+		branch:  branch,
+		groups:  groups,
+		expires: now.Add(s.ttl),
+		size:    size,
+	}
+	s.bytes += size
+	return token, nil
+}
+
+// get returns the preview stored under a token, if it hasn't expired
+func (s *previewStore) get(token string) (*storedPreview, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.prune(time.Now())
+	preview, ok := s.previews[token]
+	return preview, ok
+}
+
+// take removes the preview stored under a token, so that it is committed
+// only once, and reports whether it was still there
+func (s *previewStore) take(token string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.prune(time.Now())
+	if _, ok := s.previews[token]; !ok {
+		return false
+	}
+	s.remove(token)
+	return true
+}
+
+// prune drops the expired previews. The caller must hold the lock.
+func (s *previewStore) prune(now time.Time) {
+	for token, preview := range s.previews {
+		if !now.Before(preview.expires) {
+			s.remove(token)
+		}
+	}
+}
+
+// evictOldest drops the preview that expires first, which is the oldest
+// since they all live as long. The caller must hold the lock.
+func (s *previewStore) evictOldest() {
+	var oldest string
+	for token, preview := range s.previews {
+		if oldest == "" || preview.expires.Before(s.previews[oldest].expires) {
+			oldest = token
+		}
+	}
+	s.remove(oldest)
+}
+
+// remove drops a stored preview. The caller must hold the lock.
+func (s *previewStore) remove(token string) {
+	if preview, ok := s.previews[token]; ok {
+		s.bytes -= preview.size
+		delete(s.previews, token)
+	}
+}
+
+// render returns the stored render of a group, or nil when there is no
+// preview or the group isn't part of it
+func (p *storedPreview) render(groupName string) *groupRender {
+	if p == nil {
+		return nil
+	}
+	return p.groups[groupName]
+}
+
+// size approximates the memory held by a stored render, which is mostly its
+// output
+func (g *groupRender) size() int {
+	n := len(g.output)
+	for _, release := range g.releases {
+		n += release.size()
+	}
+	return n
+}
@@ -0,0 +1,143 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// previewOf returns the renders of a preview of one group with output of
+// the given size
+func previewOf(size int) map[string]*groupRender {
+	return map[string]*groupRender{"web": {output: make([]byte, size)}}
+}
+
+func TestPreviewStoreTakeCommitsOnce(t *testing.T) {
+	s := newPreviewStore(time.Minute)
+	token, err := s.put("main", previewOf(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := s.get(token); !ok {
+		t.Fatal("get() didn't find the stored preview")
+	}
+	if !s.take(token) {
+		t.Fatal("take() didn't find the stored preview")
+	}
+	if s.take(token) {
+		t.Error("take() found the preview a second time")
+	}
+	if _, ok := s.get(token); ok {
+		t.Error("get() found a taken preview")
+	}
+	if s.bytes != 0 {
+		t.Errorf("store holds %d bytes after take(), want 0", s.bytes)
+	}
+}
+
+func TestPreviewStoreExpires(t *testing.T) {
+	s := newPreviewStore(time.Nanosecond)
+	token, err := s.put("main", previewOf(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond)
+
+	if _, ok := s.get(token); ok {
+		t.Error("get() found an expired preview")
+	}
+}
+
+func TestPreviewStoreEvictsOldest(t *testing.T) {
+	s := newPreviewStore(time.Hour)
+
+	var tokens []string
+	for i := 0; i < maxPreviews+1; i++ {
+		token, err := s.put("main", previewOf(1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tokens = append(tokens, token)
+	}
+	if len(s.previews) != maxPreviews {
+		t.Errorf("store holds %d previews, want %d", len(s.previews), maxPreviews)
+	}
+	if _, ok := s.get(tokens[0]); ok {
+		t.Error("the oldest preview wasn't evicted")
+	}
+	if _, ok := s.get(tokens[maxPreviews]); !ok {
+		t.Error("the newest preview was evicted")
+	}
+
+	// Large previews evict as many others as it takes to fit
+	big, err := s.put("main", previewOf(maxPreviewBytes))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.previews) != 1 || s.bytes != maxPreviewBytes {
+		t.Errorf("store holds %d previews of %d bytes, want only the large one", len(s.previews), s.bytes)
+	}
+	if _, ok := s.get(big); !ok {
+		t.Error("the large preview wasn't stored")
+	}
+}
+
+func TestPreviewStoreRefusesOversizedPreviews(t *testing.T) {
+	s := newPreviewStore(time.Hour)
+	if _, err := s.put("main", previewOf(maxPreviewBytes+1)); !errors.Is(err, errPreviewTooLarge) {
+		t.Errorf("put() error = %v, want errPreviewTooLarge", err)
+	}
+}
+
+func TestPreviewTokens(t *testing.T) {
+	p := newTestPipeline(t, pipelineGroup("web", "deploy"))
+	p.addRepo(t, "acme", "values", map[string]string{"web.yaml": configMap("web", "one")})
+	p.addRepo(t, "acme", "deploy", map[string]string{"README.md": "deploy\n"})
+
+	preview := func(body string) map[string]interface{} {
+		t.Helper()
+		w := httptest.NewRecorder()
+		p.PreviewChanges(w, httptest.NewRequest(http.MethodPost, "/api/preview", strings.NewReader(body)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("PreviewChanges() status = %d, body %s", w.Code, w.Body)
+		}
+		var response map[string]interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		return response
+	}
+	commit := func(token string) int {
+		t.Helper()
+		w := httptest.NewRecorder()
+		p.CommitChanges(w, httptest.NewRequest(http.MethodPost, "/api/commit?from_preview="+token,
+			strings.NewReader(`{"message":"Update"}`)))
+		return w.Code
+	}
+
+	if response := preview(`{"branch":"master"}`); response["preview_token"] != nil {
+		t.Errorf("preview without token = true returned preview_token %v", response["preview_token"])
+	}
+	if len(p.previews.previews) != 0 {
+		t.Errorf("preview without token = true kept %d renders", len(p.previews.previews))
+	}
+
+	token, _ := preview(`{"branch":"master","token":true}`)["preview_token"].(string)
+	if token == "" {
+		t.Fatal("preview with token = true returned no preview_token")
+	}
+	if code := commit(token); code != http.StatusOK {
+		t.Fatalf("commit from preview status = %d", code)
+	}
+	if got := p.file(t, "acme", "deploy", "web/generated.yaml"); !strings.Contains(got, "value: one") {
+		t.Errorf("web/generated.yaml = %q, want the previewed output", got)
+	}
+	if code := commit(token); code != http.StatusNotFound {
+		t.Errorf("second commit from the same preview status = %d, want 404", code)
+	}
+}
@@ -0,0 +1,98 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterAllow(t *testing.T) {
+	l := NewRateLimiter(2, 3)
+	start := time.Date(2024, time.January, 10, 12, 0, 0, 0, time.UTC)
+
+	// A burst drains the bucket
+	for i := 0; i < 3; i++ {
+		if allowed, _ := l.allow("10.0.0.1", start); !allowed {
+			t.Fatalf("request %d of the burst rejected", i+1)
+		}
+	}
+	allowed, wait := l.allow("10.0.0.1", start)
+	if allowed {
+		t.Fatal("request past the burst allowed")
+	}
+	if wait != 500*time.Millisecond {
+		t.Errorf("wait = %v, want the time for one token at 2/s", wait)
+	}
+
+	// Other clients have their own bucket
+	if allowed, _ := l.allow("10.0.0.2", start); !allowed {
+		t.Error("another client's request rejected")
+	}
+
+	// Tokens are refilled at the configured rate
+	if allowed, _ := l.allow("10.0.0.1", start.Add(250*time.Millisecond)); allowed {
+		t.Error("request allowed before a token was refilled")
+	}
+	if allowed, _ := l.allow("10.0.0.1", start.Add(500*time.Millisecond)); !allowed {
+		t.Error("request rejected after a token was refilled")
+	}
+
+	// The bucket never holds more than the burst
+	later := start.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		l.allow("10.0.0.1", later)
+	}
+	if allowed, _ := l.allow("10.0.0.1", later); allowed {
+		t.Error("idle client allowed more than the burst")
+	}
+}
+
+func TestRateLimiterMiddleware(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	handler := NewRateLimiter(0.5, 2).Middleware(ok)
+
+	request := func(remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/preview", nil)
+		req.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	for i := 0; i < 2; i++ {
+		if w := request("10.0.0.1:1234"); w.Code != http.StatusNoContent {
+			t.Fatalf("request %d status = %d, want 204", i+1, w.Code)
+		}
+	}
+
+	// The port doesn't make another client
+	w := request("10.0.0.1:5678")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("status = %d, want 429", w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got != "2" {
+		t.Errorf("Retry-After = %q, want 2", got)
+	}
+
+	if w := request("10.0.0.2:1234"); w.Code != http.StatusNoContent {
+		t.Errorf("another client's status = %d, want 204", w.Code)
+	}
+}
+
+func TestRateLimiterDisabled(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	handler := NewRateLimiter(0, 0).Middleware(ok)
+
+	for i := 0; i < 100; i++ {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/preview", nil))
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("request %d status = %d, want every request allowed", i+1, w.Code)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/lei/yaml-helm-pipeline/internal/helm"
+)
+
+// renderCache holds the helm output of the groups processed by one request,
+// so groups rendering the same chart with the same values run helm once
+type renderCache struct {
+	mu      sync.Mutex
+	renders map[string]*helm.TemplateResult
+}
+
+// newRenderCache creates an empty render cache
+func newRenderCache() *renderCache {
+	return &renderCache{renders: make(map[string]*helm.TemplateResult)}
+}
+
+// get returns the cached render for a key, if any
+func (c *renderCache) get(key string) (*helm.TemplateResult, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	rendered, ok := c.renders[key]
+	return rendered, ok
+}
+
+// put stores a successful render
+func (c *renderCache) put(key string, rendered *helm.TemplateResult) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.renders[key] = rendered
+}
+
+// renderKey fingerprints everything that determines helm's output: the chart
+// and its version, the release name and namespace, the post-renderer, extra helm arguments, and the content
+// of each values file in order
+func renderKey(chart *chartSource, releaseName, namespace, postRenderer string, postRendererArgs, extraArgs []string, valuesPaths []string) (string, error) {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "chart=%q version=%q\n", chart.description, chart.version)
+	fmt.Fprintf(hash, "release=%q namespace=%q\n", releaseName, namespace)
+	fmt.Fprintf(hash, "post-renderer=%q args=%q\n", postRenderer, postRendererArgs)
+	fmt.Fprintf(hash, "extra-args=%q\n", extraArgs)
+
+	for _, path := range valuesPaths {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("failed to read values file: %w", err)
+		}
+		sum := sha256.Sum256(content)
+		fmt.Fprintf(hash, "values=%x\n", sum)
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,111 @@
+package api
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/lei/yaml-helm-pipeline/internal/extractor"
+	"github.com/lei/yaml-helm-pipeline/internal/manifest"
+)
+
+// groupByResource groups preview changes by the resource they belong to
+const groupByResource = "resource"
+
+// Statuses of a resource in a diff grouped by resource
+const (
+	resourceAdded   = "added"
+	resourceChanged = "changed"
+	resourceRemoved = "removed"
+)
+
+// compareResources diffs two multi-document outputs resource by resource.
+// Resources are matched by kind and name, and keyed "Kind/name" in the
+// result, or "Kind/namespace/name" when several share a kind and name. Each
+// resource that differs has a status and its changes keyed by dotted path,
+// as returned by CompareYAML. Unchanged resources are left out. The summary
+// counts the changed keys of every resource.
+func compareResources(comparer *extractor.Service, oldYAML, newYAML []byte) (map[string]interface{}, extractor.DiffSummary, error) {
+	var summary extractor.DiffSummary
+
+	oldResources, err := resourcesByKey(oldYAML)
+	if err != nil {
+		return nil, summary, fmt.Errorf("failed to parse existing output: %w", err)
+	}
+	newResources, err := resourcesByKey(newYAML)
+	if err != nil {
+		return nil, summary, fmt.Errorf("failed to parse rendered output: %w", err)
+	}
+
+	grouped := make(map[string]interface{})
+	compare := func(key string, oldContent, newContent []byte, status string) error {
+		changes, err := comparer.CompareYAML(oldContent, newContent)
+		if err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+		if len(changes) == 0 {
+			return nil
+		}
+
+		resourceSummary := comparer.Summarize(changes)
+		summary.Added += resourceSummary.Added
+		summary.Changed += resourceSummary.Changed
+		summary.Removed += resourceSummary.Removed
+
+		grouped[key] = map[string]interface{}{
+			"status":  status,
+			"changes": changes,
+		}
+		return nil
+	}
+
+	for key, newContent := range newResources {
+		oldContent, exists := oldResources[key]
+		status := resourceChanged
+		if !exists {
+			oldContent = []byte("{}")
+			status = resourceAdded
+		}
+		if err := compare(key, oldContent, newContent, status); err != nil {
+			return nil, summary, err
+		}
+	}
+
+	for key, oldContent := range oldResources {
+		if _, exists := newResources[key]; exists {
+			continue
+		}
+		if err := compare(key, oldContent, []byte("{}"), resourceRemoved); err != nil {
+			return nil, summary, err
+		}
+	}
+
+	return grouped, summary, nil
+}
+
+// resourcesByKey splits multi-document YAML into its resources, keyed by
+// kind and name. Documents without a kind or name are keyed by position.
+func resourcesByKey(content []byte) (map[string][]byte, error) {
+	resources, err := manifest.Split(content)
+	if err != nil {
+		return nil, err
+	}
+
+	// Kind and name identify a resource unless namespaces tell them apart
+	counts := make(map[string]int)
+	for _, resource := range resources {
+		counts[resource.Kind+"/"+resource.Name]++
+	}
+
+	byKey := make(map[string][]byte, len(resources))
+	for i, resource := range resources {
+		key := resource.Kind + "/" + resource.Name
+		switch {
+		case resource.Kind == "" || resource.Name == "":
+			key = "document " + strconv.Itoa(i+1)
+		case counts[key] > 1 && resource.Namespace != "":
+			key = resource.Kind + "/" + resource.Namespace + "/" + resource.Name
+		}
+		byKey[key] = resource.Content
+	}
+	return byKey, nil
+}
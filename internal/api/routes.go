@@ -4,26 +4,41 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
+	"log"
 	"net/http"
 	"os"
-	"os/exec"
+	"path"
 	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/render"
 	"github.com/lei/yaml-helm-pipeline/internal/config"
 	"github.com/lei/yaml-helm-pipeline/internal/extractor"
 	"github.com/lei/yaml-helm-pipeline/internal/git"
 	"github.com/lei/yaml-helm-pipeline/internal/github"
 	"github.com/lei/yaml-helm-pipeline/internal/helm"
+	"github.com/lei/yaml-helm-pipeline/internal/history"
+	"github.com/lei/yaml-helm-pipeline/internal/manifest"
+	"github.com/lei/yaml-helm-pipeline/internal/scm"
+	"github.com/lei/yaml-helm-pipeline/internal/yamlerr"
 )
 
 // Helper functions for configuration groups
 
 // findConfigGroup finds a configuration group by name
 func (h *Handler) findConfigGroup(name string) (*config.ConfigGroup, error) {
-	for _, group := range h.config.Groups {
+	for _, group := range h.currentConfig().Groups {
 		if group.Name == name {
 			return &group, nil
 		}
@@ -31,28 +46,99 @@ func (h *Handler) findConfigGroup(name string) (*config.ConfigGroup, error) {
 	return nil, fmt.Errorf("configuration group not found: %s", name)
 }
 
-// cloneValuesRepositories clones the values repositories for a configuration group
-func (h *Handler) cloneValuesRepositories(group *config.ConfigGroup) ([]string, error) {
+// workspace is a private temporary directory holding the clones made while
+// processing a configuration group. Every run gets its own directory, so
+// concurrent runs never share a clone even when they use the same repositories.
+type workspace struct {
+	root string
+}
+
+// newWorkspace creates a workspace named after the group it serves, under
+// the git service's work directory
+func (h *Handler) newWorkspace(groupName string) (*workspace, error) {
+	root, err := os.MkdirTemp(h.gitService.WorkDir(), "pipeline-"+safeName(groupName)+"-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create workspace: %w", err)
+	}
+	return &workspace{root: root}, nil
+}
+
+// path returns the location of a named clone within the workspace
+func (ws *workspace) path(name string) string {
+	return filepath.Join(ws.root, safeName(name))
+}
+
+// cleanup removes the workspace and everything cloned into it
+func (ws *workspace) cleanup() {
+	if err := os.RemoveAll(ws.root); err != nil {
+		log.Printf("Failed to remove temporary directory %s: %v", ws.root, err)
+	}
+}
+
+// safeName replaces characters that don't belong in a directory name
+func safeName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+			return r
+		}
+		return '-'
+	}, name)
+}
+
+// cloneValuesRepositories clones values repositories into the workspace and
+// returns the paths of their values files in the order they apply, as set by
+// their order fields. Entries marked same_as_template read their file from
+// the template repository clone at templateDir instead of cloning anything.
+func (h *Handler) cloneValuesRepositories(repos []config.ValuesRepo, ws *workspace, templateDir string) ([]string, error) {
 	var valuesPaths []string
 
-	for _, valuesRepo := range group.ValuesRepos {
-		// Construct the repository URL
-		repoURL := config.GetRepoURL(valuesRepo.Owner, valuesRepo.Repo)
+	for i, valuesRepo := range config.OrderValuesRepos(repos) {
+		var valuesRepoPath, source string
+		if valuesRepo.SameAsTemplate {
+			if templateDir == "" {
+				return nil, fmt.Errorf("values file %s is in the template repository, but no template repository was cloned",
+					valuesRepo.Path)
+			}
+			valuesRepoPath = templateDir
+			source = "the template repository"
+		} else {
+			// Construct the repository URL
+			repoURL := h.scm.CloneURL(valuesRepo.Owner, valuesRepo.Repo)
 
-		// Create a unique path for this values repository
-		valuesRepoPath := filepath.Join(
-			os.TempDir(),
-			fmt.Sprintf("values-%s-%s-%s", valuesRepo.Owner, valuesRepo.Repo, valuesRepo.Branch),
-		)
+			// Create a unique path for this values repository
+			valuesRepoPath = ws.path(fmt.Sprintf("values-%d-%s-%s-%s",
+				i, valuesRepo.Owner, valuesRepo.Repo, valuesRepo.Revision()))
 
-		// Clone the repository
-		if err := h.gitService.CloneRepository(repoURL, valuesRepoPath, valuesRepo.Branch); err != nil {
-			return nil, fmt.Errorf("failed to clone values repository %s/%s: %w",
-				valuesRepo.Owner, valuesRepo.Repo, err)
+			// Clone the repository
+			if err := h.gitService.CloneRepository(repoURL, valuesRepoPath, valuesRepo.Revision()); err != nil {
+				return nil, fmt.Errorf("failed to clone values repository %s/%s: %w",
+					valuesRepo.Owner, valuesRepo.Repo, err)
+			}
+			source = fmt.Sprintf("repository %s/%s (ref: %s)", valuesRepo.Owner, valuesRepo.Repo, valuesRepo.Revision())
 		}
 
-		// Add the values file path
+		// Make sure the values file exists in the cloned repository
 		valuesPath := filepath.Join(valuesRepoPath, valuesRepo.Path)
+		info, err := os.Stat(valuesPath)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil, fmt.Errorf("values file %s not found in %s", valuesRepo.Path, source)
+			}
+			return nil, fmt.Errorf("failed to read values file %s in %s: %w", valuesRepo.Path, source, err)
+		}
+		if info.IsDir() {
+			return nil, fmt.Errorf("values path %s in %s is a directory, not a file", valuesRepo.Path, source)
+		}
+
+		// Helm reads YAML and JSON values natively, TOML is converted first
+		if valuesRepo.Format() == config.ValuesFormatTOML {
+			valuesPath, err = convertTOMLValues(valuesPath, ws.path(fmt.Sprintf("values-%d.yaml", i)))
+			if err != nil {
+				return nil, fmt.Errorf("values file %s in %s: %w", valuesRepo.Path, source, err)
+			}
+		}
+
 		valuesPaths = append(valuesPaths, valuesPath)
 	}
 
@@ -60,20 +146,22 @@ func (h *Handler) cloneValuesRepositories(group *config.ConfigGroup) ([]string,
 }
 
 // cloneOutputRepository clones the output repository for a configuration group
-func (h *Handler) cloneOutputRepository(group *config.ConfigGroup) (string, error) {
+func (h *Handler) cloneOutputRepository(group *config.ConfigGroup, ws *workspace) (string, error) {
 	outputRepo := group.OutputRepo
 
 	// Construct the repository URL
-	repoURL := config.GetRepoURL(outputRepo.Owner, outputRepo.Repo)
+	repoURL := h.scm.CloneURL(outputRepo.Owner, outputRepo.Repo)
 
 	// Create a unique path for this output repository
-	outputRepoPath := filepath.Join(
-		os.TempDir(),
-		fmt.Sprintf("output-%s-%s-%s", outputRepo.Owner, outputRepo.Repo, outputRepo.Branch),
-	)
+	outputRepoPath := ws.path(fmt.Sprintf("output-%s-%s-%s", outputRepo.Owner, outputRepo.Repo, outputRepo.Branch))
 
-	// Clone the repository
-	if err := h.gitService.CloneRepository(repoURL, outputRepoPath, outputRepo.Branch); err != nil {
+	// Clone the repository, starting the branch from the default branch if
+	// the group allows it and the branch doesn't exist yet
+	clone := h.gitService.CloneRepository
+	if outputRepo.CreateBranchIfMissing {
+		clone = h.gitService.CloneOrCreateBranch
+	}
+	if err := clone(repoURL, outputRepoPath, outputRepo.Branch); err != nil {
 		return "", fmt.Errorf("failed to clone output repository %s/%s: %w",
 			outputRepo.Owner, outputRepo.Repo, err)
 	}
@@ -81,368 +169,2266 @@ func (h *Handler) cloneOutputRepository(group *config.ConfigGroup) (string, erro
 	return outputRepoPath, nil
 }
 
-// processConfigGroup processes a configuration group
-func (h *Handler) processConfigGroup(
-	ctx context.Context,
-	groupName string,
-	templateRepoBranch string,
-	commitMessage string,
-	previewOnly bool,
-) (map[string]interface{}, error) {
-	// Find the configuration group
-	group, err := h.findConfigGroup(groupName)
-	if err != nil {
-		return nil, err
+// templateRepository returns the clone URL, owner, and name of the chart
+// repository for a group. The globally configured repository is only looked
+// up when the group doesn't override it.
+func (h *Handler) templateRepository(ctx context.Context, group *config.ConfigGroup) (string, string, string, error) {
+	if group.TemplateRepo != nil {
+		return h.scm.CloneURL(group.TemplateRepo.Owner, group.TemplateRepo.Repo),
+			group.TemplateRepo.Owner, group.TemplateRepo.Repo, nil
 	}
 
-	// Get template repository information
-	repo, err := h.githubService.GetRepository(ctx)
+	repo, err := h.scm.GetRepository(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get repository information: %w", err)
+		return "", "", "", fmt.Errorf("failed to get repository information: %w", err)
 	}
 
-	// Clone the template repository
-	repoURL := *repo.CloneURL
-	repoOwner := *repo.Owner.Login
-	repoName := *repo.Name
+	return repo.CloneURL, repo.Owner, repo.Name, nil
+}
 
-	templateRepoPath := h.gitService.GetLocalRepoPath(repoOwner, repoName, templateRepoBranch)
-	if err := h.gitService.CloneRepository(repoURL, templateRepoPath, templateRepoBranch); err != nil {
-		return nil, fmt.Errorf("failed to clone template repository: %w", err)
+// encodeOutput converts rendered YAML into the group's output file format
+func encodeOutput(group *config.ConfigGroup, yamlOutput []byte) ([]byte, error) {
+	if group.OutputRepo.Format != config.OutputFormatJSON {
+		return yamlOutput, nil
 	}
 
-	// Use repository root as chart directory
-	chartPath := templateRepoPath
-
-	// Check if Chart.yaml exists
-	if _, err := os.Stat(filepath.Join(chartPath, "Chart.yaml")); os.IsNotExist(err) {
-		return nil, fmt.Errorf("Chart.yaml not found in repository root")
+	content, err := manifest.ToJSON(yamlOutput)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert output to JSON: %w", err)
 	}
+	return content, nil
+}
 
-	// Check if templates directory exists
-	if _, err := os.Stat(filepath.Join(chartPath, "templates")); os.IsNotExist(err) {
-		return nil, fmt.Errorf("templates directory not found")
+// decodeOutput converts an existing output file back into YAML so it can be
+// compared with the rendered output regardless of the file format
+func decodeOutput(group *config.ConfigGroup, content []byte) ([]byte, error) {
+	if group.OutputRepo.Format != config.OutputFormatJSON {
+		return content, nil
 	}
 
-	// Clone values repositories and get values files
-	valuesPaths, err := h.cloneValuesRepositories(group)
+	yamlContent, err := manifest.FromJSON(content)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("failed to read existing JSON output: %w", err)
 	}
+	return yamlContent, nil
+}
 
-	if len(valuesPaths) == 0 {
-		return nil, fmt.Errorf("no values files found for group %s", groupName)
+// outputChanged reports whether rendered output differs from the existing
+// output. With semantic_compare, output that only differs in formatting
+// counts as unchanged.
+func outputChanged(group *config.ConfigGroup, existing, rendered []byte) (bool, error) {
+	if bytes.Equal(existing, rendered) {
+		return false, nil
+	}
+	if !group.OutputRepo.SemanticCompare {
+		return true, nil
 	}
 
-	// Generate the YAML using Helm
-	yamlOutput, err := h.helmService.TemplateChart(chartPath, valuesPaths)
+	existingYAML, err := decodeOutput(group, existing)
+	if err != nil {
+		return false, err
+	}
+	renderedYAML, err := decodeOutput(group, rendered)
 	if err != nil {
-		return nil, fmt.Errorf("failed to template chart: %w", err)
+		return false, err
 	}
 
-	// If preview only, compare with existing content
-	if previewOnly {
-		// Get output filename and path for comparison
-		outputFilename := group.OutputRepo.Filename
-		if outputFilename == "" {
-			outputFilename = "generated.yaml"
-		}
+	equivalent, err := manifest.Equivalent(existingYAML, renderedYAML)
+	if err != nil {
+		return false, fmt.Errorf("failed to compare output: %w", err)
+	}
+	return !equivalent, nil
+}
 
-		// Clone output repository to get existing content
-		outputRepoPath, err := h.cloneOutputRepository(group)
-		if err != nil {
-			return nil, err
-		}
+// outputFile is a rendered file to be written to the output repository
+type outputFile struct {
+	path    string
+	content []byte
+	mode    os.FileMode
+}
 
-		// Create output directory path
-		outputDir := outputRepoPath
-		if group.OutputRepo.Path != "" {
-			outputDir = filepath.Join(outputRepoPath, group.OutputRepo.Path)
+// writeOutputFiles writes all rendered files for a group into the output
+// repository and removes stale ones. Files are only written once every chart
+// has rendered, and if anything fails the worktree is reset so nothing
+// partial gets committed.
+func (h *Handler) writeOutputFiles(repoPath string, files []outputFile, stale []string) error {
+	for _, file := range files {
+		err := os.MkdirAll(filepath.Dir(file.path), 0755)
+		if err == nil {
+			err = os.WriteFile(file.path, file.content, file.mode)
+		}
+		if err == nil {
+			// WriteFile keeps the permissions of files that already exist
+			err = os.Chmod(file.path, file.mode)
 		}
-
-		outputPath := filepath.Join(outputDir, outputFilename)
-		existingContent, err := os.ReadFile(outputPath)
-		
-		var changes map[string]interface{}
 		if err != nil {
-			// File doesn't exist, extract keys from new content only
-			keys, err := h.extractorService.ExtractKeys(yamlOutput)
-			if err != nil {
-				return nil, fmt.Errorf("failed to extract keys: %w", err)
-			}
-			changes = map[string]interface{}{
-				"all_new": true,
-				"keys":    keys,
-			}
-		} else {
-			// File exists, compare old vs new
-			changes, err = h.extractorService.CompareYAML(existingContent, yamlOutput)
-			if err != nil {
-				return nil, fmt.Errorf("failed to compare YAML: %w", err)
+			if resetErr := h.gitService.ResetWorktree(repoPath); resetErr != nil {
+				return fmt.Errorf("failed to write %s: %w (rollback also failed: %v)", file.path, err, resetErr)
 			}
+			return fmt.Errorf("failed to write %s: %w", file.path, err)
 		}
+	}
 
-		result := map[string]interface{}{
-			"changes": changes,
+	for _, path := range stale {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			if resetErr := h.gitService.ResetWorktree(repoPath); resetErr != nil {
+				return fmt.Errorf("failed to remove %s: %w (rollback also failed: %v)", path, err, resetErr)
+			}
+			return fmt.Errorf("failed to remove %s: %w", path, err)
 		}
-		return result, nil
 	}
 
-	// Extract keys from the YAML
-	keys, err := h.extractorService.ExtractKeys(yamlOutput)
+	return nil
+}
+
+// chartSource describes where a group's chart is rendered from
+type chartSource struct {
+	chart       string              // Local chart directory or remote chart reference
+	repository  string              // Template repository (owner/repo) or chart reference
+	metadata    *helm.ChartMetadata // Chart.yaml of local charts, nil for chart references
+	version     string              // Chart version for remote references
+	description string              // Human-readable origin used in commit messages
+}
+
+// cloneTemplateRepository clones a group's chart repository into the
+// workspace and returns the clone's path and the repository owner and name
+func (h *Handler) cloneTemplateRepository(ctx context.Context, group *config.ConfigGroup, branch string, ws *workspace) (string, string, string, error) {
+	// Resolve the template repository, preferring the group's own chart repo
+	repoURL, repoOwner, repoName, err := h.templateRepository(ctx, group)
 	if err != nil {
-		return nil, fmt.Errorf("failed to extract keys: %w", err)
+		return "", "", "", err
 	}
 
-	result := map[string]interface{}{
-		"keys": keys,
+	templateRepoPath := ws.path(fmt.Sprintf("template-%s-%s-%s", repoOwner, repoName, branch))
+	if err := h.gitService.CloneRepository(repoURL, templateRepoPath, branch); err != nil {
+		return "", "", "", fmt.Errorf("failed to clone template repository: %w", err)
+	}
+
+	return templateRepoPath, repoOwner, repoName, nil
+}
+
+// prepareChart makes a group's chart available for templating, either by
+// cloning its template repository or by referencing a remote chart
+func (h *Handler) prepareChart(ctx context.Context, group *config.ConfigGroup, branch string, ws *workspace) (*chartSource, error) {
+	if group.ChartRef != "" {
+		// Log in to the OCI registry when credentials are configured
+		username := os.Getenv("HELM_REGISTRY_USERNAME")
+		if strings.HasPrefix(group.ChartRef, "oci://") && username != "" {
+			if err := h.helmService.RegistryLogin(ctx, group.ChartRef, username, os.Getenv("HELM_REGISTRY_PASSWORD")); err != nil {
+				return nil, err
+			}
+		}
+
+		description := group.ChartRef
+		if group.ChartVersion != "" {
+			description += " version: " + group.ChartVersion
+		}
+
+		return &chartSource{
+			chart:       group.ChartRef,
+			version:     group.ChartVersion,
+			repository:  group.ChartRef,
+			description: description,
+		}, nil
 	}
 
-	// Clone output repository
-	outputRepoPath, err := h.cloneOutputRepository(group)
+	// Clone the template repository
+	templateRepoPath, repoOwner, repoName, err := h.cloneTemplateRepository(ctx, group, branch, ws)
 	if err != nil {
 		return nil, err
 	}
 
-	// Create output directory if it doesn't exist
-	outputDir := outputRepoPath
-	if group.OutputRepo.Path != "" {
-		outputDir = filepath.Join(outputRepoPath, group.OutputRepo.Path)
-		if err := os.MkdirAll(outputDir, 0755); err != nil {
-			return nil, fmt.Errorf("failed to create output directory: %w", err)
-		}
+	// Use repository root as chart directory
+	chartPath := templateRepoPath
+
+	// Check if Chart.yaml exists
+	if _, err := os.Stat(filepath.Join(chartPath, "Chart.yaml")); os.IsNotExist(err) {
+		return nil, fmt.Errorf("Chart.yaml not found in repository root")
 	}
 
-	// Get output filename
-	outputFilename := group.OutputRepo.Filename
-	if outputFilename == "" {
-		outputFilename = "generated.yaml"
+	// Check if templates directory exists
+	if _, err := os.Stat(filepath.Join(chartPath, "templates")); os.IsNotExist(err) {
+		return nil, fmt.Errorf("templates directory not found")
 	}
 
-	// Check if the file already exists and compare content
-	outputPath := filepath.Join(outputDir, outputFilename)
-	existingContent, err := os.ReadFile(outputPath)
-	fileExists := err == nil
-	contentChanged := true
+	// Fetch chart dependencies, registering any private chart repositories first
+	if err := h.buildChartDependencies(chartPath); err != nil {
+		return nil, err
+	}
 
-	if fileExists {
-		contentChanged = !bytes.Equal(existingContent, yamlOutput)
+	metadata, err := h.helmService.ChartMetadata(chartPath)
+	if err != nil {
+		return nil, err
 	}
 
-	// Write the YAML to the output file
-	if err := os.WriteFile(outputPath, yamlOutput, 0644); err != nil {
-		return nil, fmt.Errorf("failed to write YAML file: %w", err)
+	return &chartSource{
+		chart:       chartPath,
+		repository:  repoOwner + "/" + repoName,
+		metadata:    metadata,
+		description: fmt.Sprintf("%s/%s branch: %s", repoOwner, repoName, branch),
+	}, nil
+}
+
+// postRendererPath resolves a group's post-renderer. Absolute paths and
+// names on the PATH are used as is. An executable shipped in the template
+// repository is only preferred when the group pins the repository to a ref,
+// since otherwise whoever can push the branch a request names would choose
+// what the server runs.
+func postRendererPath(group *config.ConfigGroup, chart *chartSource) string {
+	postRenderer := group.PostRenderer
+	if postRenderer == "" || filepath.IsAbs(postRenderer) || group.TemplateRepo == nil || group.TemplateRepo.Ref == "" {
+		return postRenderer
 	}
 
-	// Prepare commit message
-	finalCommitMessage := commitMessage
-	if commitMessage != "" {
-		finalCommitMessage = fmt.Sprintf("%s (generated from %s/%s branch: %s, group: %s)",
-			commitMessage, repoOwner, repoName, templateRepoBranch, groupName)
+	candidate := filepath.Join(chart.chart, postRenderer)
+	if info, err := os.Stat(candidate); err == nil && !info.IsDir() {
+		return candidate
 	}
+	return postRenderer
+}
 
-	// Commit and push the changes
-	if err := h.gitService.CommitAndPush(outputRepoPath, finalCommitMessage); err != nil {
-		return nil, fmt.Errorf("failed to commit and push changes: %w", err)
+// buildChartDependencies registers the configured chart repositories and
+// builds the chart's dependencies when it declares any
+func (h *Handler) buildChartDependencies(chartPath string) error {
+	hasDependencies, err := h.helmService.HasDependencies(chartPath)
+	if err != nil {
+		return err
+	}
+	if !hasDependencies {
+		return nil
 	}
 
-	// Prepare response message
-	responseMessage := "Changes committed and pushed successfully"
-	if !contentChanged && fileExists {
-		responseMessage = "No changes detected. The generated content is identical to the existing file."
+	for _, repo := range h.currentConfig().HelmRepos {
+		if err := h.helmService.AddRepository(helm.Repository{
+			Name:     repo.Name,
+			URL:      repo.URL,
+			Username: os.ExpandEnv(repo.Username),
+			Password: os.ExpandEnv(repo.Password),
+		}); err != nil {
+			return fmt.Errorf("failed to add helm repository: %w", err)
+		}
 	}
 
-	result["message"] = responseMessage
-	result["content_changed"] = contentChanged
+	if err := h.helmService.BuildDependencies(chartPath); err != nil {
+		return fmt.Errorf("failed to build chart dependencies: %w", err)
+	}
 
-	return result, nil
+	return nil
 }
 
-// Handler handles API requests
-type Handler struct {
-	githubService    *github.Service
-	helmService      *helm.Service
-	gitService       *git.Service
-	extractorService *extractor.Service
-	config           *config.Config
+// processOptions controls how a configuration group is processed
+type processOptions struct {
+	templateRepoBranch string
+	commitMessage      string
+	commitFormat       *config.CommitFormat // Overrides the configured commit format
+	previewOnly        bool
+	diffFormat         string // "keys" (default) or "unified"
+	valuesOverlay      []byte // Extra values applied last, overriding the repo values
+	includeRendered    bool   // Include the rendered output file in previews
+	keyDepth           int    // Levels of keys shown for new output, 0 for all
+	debug              bool   // Include helm's --debug trace in previews
+	showValues         bool   // Include the merged values in previews
+	groupBy            string // "resource" groups preview changes by resource
+
+	// valuesFiles replaces the values files of the group's values
+	// repositories, which aren't cloned when it is set
+	valuesFiles []string
+
+	// shared lets the groups processed by one request reuse a single clone
+	// of the shared values repositories. Cloned per group when nil.
+	shared *sharedValues
+
+	// renders lets groups of one request that render the same chart with
+	// the same values reuse a single helm run. Nothing is cached when nil.
+	renders *renderCache
+
+	// capture receives the render of each previewed group, keyed by group
+	// name, so it can be committed later. Nothing is kept when nil.
+	capture map[string]*groupRender
+
+	// previewed is the output of an earlier preview to commit as is. The
+	// group is rendered again when nil.
+	previewed *groupRender
+
+	// squash writes the group's output into a clone shared with the other
+	// groups of the request targeting the same output repository, leaving
+	// the commit to the caller. Each group commits on its own when nil.
+	squash *squashSet
 }
 
-// NewHandler creates a new API handler
-func NewHandler(githubService *github.Service, helmService *helm.Service, gitService *git.Service, extractorService *extractor.Service, config *config.Config) *Handler {
-	return &Handler{
-		githubService:    githubService,
-		helmService:      helmService,
-		gitService:       gitService,
-		extractorService: extractorService,
-		config:           config,
-	}
+// groupRender is a group's rendered and post-processed output
+type groupRender struct {
+	chart       *chartSource
+	valuesPaths []string // Values files in the group's workspace, nil once it is removed
+	rendered    *helm.TemplateResult
+	deduped     bool
+	output      []byte
+
+	// releases holds the render of each release of a group with releases,
+	// keyed by release name, in which case output joins their outputs
+	releases map[string]*groupRender
+	file     string // Output file of a release's render
 }
 
-// SetupRoutes sets up the API routes
-func SetupRoutes(router chi.Router, githubService *github.Service, helmService *helm.Service, gitService *git.Service, config *config.Config) {
-	extractorService := extractor.NewService()
-
-	handler := NewHandler(githubService, helmService, gitService, extractorService, config)
-
-	router.Route("/api", func(r chi.Router) {
-		r.Get("/branches", handler.ListBranches)
-		r.Get("/groups", handler.ListConfigGroups)
-		r.Post("/preview", handler.PreviewChanges)
-		r.Post("/commit", handler.CommitChanges)
-		r.Get("/health", handler.HealthCheck)
+// renderedValues returns the merged values a render used, redacted
+func (h *Handler) renderedValues(ctx context.Context, out *groupRender, redactor *manifest.Redactor) (map[string]interface{}, error) {
+	values, err := h.helmService.MergedValues(ctx, helm.TemplateOptions{
+		Chart:       out.chart.chart,
+		Version:     out.chart.version,
+		ValuesFiles: out.valuesPaths,
 	})
-}
-
-// ListBranches lists the branches in the repository
-func (h *Handler) ListBranches(w http.ResponseWriter, r *http.Request) {
-	branches, err := h.githubService.ListBranches(context.Background())
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return nil, fmt.Errorf("failed to merge values: %w", err)
 	}
+	return redactValues(redactor, values)
+}
 
-	var branchNames []string
-	for _, branch := range branches {
-		branchNames = append(branchNames, *branch.Name)
+// detached returns a copy of the render that outlives the group's
+// workspace, without its values files or debug trace. Committing it runs no
+// helm, so it doesn't count as deduplicated.
+func (g *groupRender) detached() *groupRender {
+	rendered := *g.rendered
+	rendered.Debug = ""
+	detached := &groupRender{
+		chart:    g.chart,
+		rendered: &rendered,
+		output:   g.output,
+		file:     g.file,
 	}
-
-	render.JSON(w, r, map[string]interface{}{
-		"branches": branchNames,
-	})
+	if g.releases != nil {
+		detached.releases = make(map[string]*groupRender, len(g.releases))
+		for name, release := range g.releases {
+			detached.releases[name] = release.detached()
+		}
+	}
+	return detached
 }
 
-// ListConfigGroups lists available configuration groups
-func (h *Handler) ListConfigGroups(w http.ResponseWriter, r *http.Request) {
-	var groupNames []string
-	for _, group := range h.config.Groups {
-		groupNames = append(groupNames, group.Name)
+// templateRevision returns the template repository ref to check out for a
+// group: its pinned ref or branch if set, otherwise the requested branch
+func templateRevision(group *config.ConfigGroup, branch string) string {
+	if group.TemplateRepo != nil && group.TemplateRepo.Ref != "" {
+		return group.TemplateRepo.Ref
 	}
-
-	render.JSON(w, r, map[string]interface{}{
-		"groups": groupNames,
-	})
+	if group.TemplateRepo != nil && group.TemplateRepo.Branch != "" {
+		return group.TemplateRepo.Branch
+	}
+	return branch
 }
 
-// PreviewRequest represents a request to preview changes
-type PreviewRequest struct {
-	Branch string   `json:"branch"`
-	Groups []string `json:"groups"`
+// comparer returns the extractor service configured to diff output
+func (h *Handler) comparer() *extractor.Service {
+	return h.extractorService.WithArrayKeys(h.currentConfig().ArrayKeys)
 }
 
-// PreviewChanges previews the changes that will be made
-func (h *Handler) PreviewChanges(w http.ResponseWriter, r *http.Request) {
-	var req PreviewRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
+// renderGroup makes a group's chart and values available in the workspace,
+// renders them with helm, and post-processes the output as the group asks
+func (h *Handler) renderGroup(
+	ctx context.Context,
+	group *config.ConfigGroup,
+	templateRepoBranch string,
+	ws *workspace,
+	opts processOptions,
+) (_ *groupRender, err error) {
+	// Tag errors with the phase they happened in
+	phase := phaseCloneTemplate
+	defer func() {
+		err = inPhase(phase, err)
+	}()
+
+	// Make the chart available, from the template repository or a chart reference
+	chart, err := h.prepareChart(ctx, group, templateRepoBranch, ws)
+	if err != nil {
+		return nil, err
 	}
 
-	if req.Branch == "" {
-		http.Error(w, "Branch is required", http.StatusBadRequest)
-		return
+	// Start from the shared values, which every group's own values override
+	phase = phaseCloneValues
+	shared := opts.shared
+	if shared == nil {
+		shared = h.newSharedValues()
+		defer shared.cleanup()
+	}
+	sharedPaths, err := shared.paths()
+	if err != nil {
+		return nil, err
 	}
 
-	// If no groups specified, use all groups
-	selectedGroups := req.Groups
-	if len(selectedGroups) == 0 {
-		for _, group := range h.config.Groups {
-			selectedGroups = append(selectedGroups, group.Name)
+	// Clone values repositories and get values files, unless they were uploaded
+	templateDir := ""
+	if group.ChartRef == "" {
+		templateDir = chart.chart
+	}
+	groupPaths := opts.valuesFiles
+	if groupPaths == nil {
+		groupPaths, err = h.cloneValuesRepositories(group.ValuesRepos, ws, templateDir)
+		if err != nil {
+			return nil, err
 		}
 	}
+	valuesPaths := append(append([]string{}, sharedPaths...), groupPaths...)
 
-	if len(selectedGroups) == 0 {
-		http.Error(w, "No configuration groups available", http.StatusInternalServerError)
-		return
+	if len(group.Releases) > 0 {
+		return h.renderReleases(ctx, group, chart, templateRepoBranch, ws, opts, valuesPaths)
 	}
+	return h.renderValues(ctx, group, chart, templateRepoBranch, ws, opts, nil, valuesPaths)
+}
 
-	// Process each selected group
-	results := make(map[string]interface{})
+// renderReleases renders a group's chart once for each of its releases, with
+// each release's values applied after the group's, and joins their outputs
+// the way output files are joined for comparison
+func (h *Handler) renderReleases(
+	ctx context.Context,
+	group *config.ConfigGroup,
+	chart *chartSource,
+	templateRepoBranch string,
+	ws *workspace,
+	opts processOptions,
+	groupPaths []string,
+) (*groupRender, error) {
+	templateDir := ""
+	if group.ChartRef == "" {
+		templateDir = chart.chart
+	}
 
-	for _, groupName := range selectedGroups {
-		result, err := h.processConfigGroup(r.Context(), groupName, req.Branch, "", true)
+	combined := &groupRender{
+		chart:    chart,
+		rendered: &helm.TemplateResult{},
+		deduped:  true,
+		releases: make(map[string]*groupRender, len(group.Releases)),
+	}
+	files := make(map[string][]byte, len(group.Releases))
+	for i := range group.Releases {
+		release := &group.Releases[i]
+
+		// Keep each release's values apart from the others'
+		releaseWS := &workspace{root: ws.path("release-" + safeName(release.Name))}
+		if err := os.Mkdir(releaseWS.root, 0700); err != nil {
+			return nil, inPhase(phaseCloneValues, fmt.Errorf("failed to create release workspace: %w", err))
+		}
+
+		releasePaths, err := h.cloneValuesRepositories(release.ValuesRepos, releaseWS, templateDir)
 		if err != nil {
-			results[groupName] = map[string]interface{}{
-				"error": err.Error(),
-			}
-		} else {
-			results[groupName] = result
+			return nil, inPhase(phaseCloneValues, fmt.Errorf("release %s: %w", release.Name, err))
+		}
+		valuesPaths := append(append([]string{}, groupPaths...), releasePaths...)
+
+		out, err := h.renderValues(ctx, group, chart, templateRepoBranch, releaseWS, opts, release, valuesPaths)
+		if err != nil {
+			return nil, fmt.Errorf("release %s: %w", release.Name, err)
+		}
+		out.file = release.Filename()
+
+		combined.releases[release.Name] = out
+		combined.deduped = combined.deduped && out.deduped
+		for _, warning := range out.rendered.Warnings {
+			combined.rendered.Warnings = append(combined.rendered.Warnings, fmt.Sprintf("release %s: %s", release.Name, warning))
+		}
+		if out.rendered.Debug != "" {
+			combined.rendered.Debug += fmt.Sprintf("--- release %s ---\n%s", release.Name, out.rendered.Debug)
 		}
+		files[out.file] = out.output
 	}
 
-	render.JSON(w, r, map[string]interface{}{
-		"results": results,
-		"branch":  req.Branch,
-	})
+	combined.output = joinOutputFiles(files)
+	combined.rendered.Output = combined.output
+	return combined, nil
 }
 
-// CommitRequest represents a request to commit changes
-type CommitRequest struct {
-	Branch  string   `json:"branch"`
-	Message string   `json:"message"`
-	Groups  []string `json:"groups"`
-}
+// renderValues renders a group's chart with the given values files, as the
+// given release when the group has releases, and post-processes the output
+// as the group asks
+func (h *Handler) renderValues(
+	ctx context.Context,
+	group *config.ConfigGroup,
+	chart *chartSource,
+	templateRepoBranch string,
+	ws *workspace,
+	opts processOptions,
+	release *config.Release,
+	valuesPaths []string,
+) (_ *groupRender, err error) {
+	// Tag errors with the phase they happened in
+	phase := phaseCloneValues
+	defer func() {
+		err = inPhase(phase, err)
+	}()
 
-// CommitChanges commits the changes to the repository
-func (h *Handler) CommitChanges(w http.ResponseWriter, r *http.Request) {
-	var req CommitRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
+	if len(valuesPaths) == 0 {
+		return nil, inPhase(phaseConfig, fmt.Errorf("no values files found for group %s", group.Name))
 	}
 
-	if req.Branch == "" {
-		http.Error(w, "Branch is required", http.StatusBadRequest)
-		return
+	var releaseName, namespace string
+	if release != nil {
+		releaseName, namespace = release.Name, release.Namespace
 	}
 
-	if req.Message == "" {
-		http.Error(w, "Message is required", http.StatusBadRequest)
-		return
+	// Substitute group, branch, and environment tokens into the values files.
+	// Uploaded files are never templated: whoever uploads them could read the
+	// server's environment back out of the preview.
+	if group.TemplateValues {
+		valuesPaths, err = expandValuesFiles(valuesPaths, ws, valuesTemplateData{
+			Group:  group.Name,
+			Branch: templateRepoBranch,
+			Env:    valuesEnviron(),
+		}, opts.valuesFiles)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	// If no groups specified, use all groups
-	selectedGroups := req.Groups
-	if len(selectedGroups) == 0 {
-		for _, group := range h.config.Groups {
-			selectedGroups = append(selectedGroups, group.Name)
+	// Add values resolved from the server's environment
+	if len(group.EnvValues) > 0 {
+		envContent, err := envValues(group.EnvValues)
+		if err != nil {
+			return nil, fmt.Errorf("group %s: %w", group.Name, err)
 		}
-	}
 
-	if len(selectedGroups) == 0 {
-		http.Error(w, "No configuration groups available", http.StatusInternalServerError)
-		return
+		envPath, err := writeTempValuesFile(ws.root, "values-env", envContent)
+		if err != nil {
+			return nil, err
+		}
+		defer os.Remove(envPath)
+
+		valuesPaths = append(valuesPaths, envPath)
 	}
 
-	// Process each selected group
-	results := make(map[string]interface{})
+	// Apply inline values from the request on top of the repo values
+	if len(opts.valuesOverlay) > 0 {
+		overlayPath, err := writeTempValuesFile(ws.root, "values-overlay", opts.valuesOverlay)
+		if err != nil {
+			return nil, err
+		}
+		defer os.Remove(overlayPath)
+
+		valuesPaths = append(valuesPaths, overlayPath)
+	}
+
+	// Catch values the chart doesn't know about, which helm would ignore
+	phase = phaseRender
+	if group.StrictValues {
+		undefined, err := h.helmService.UndefinedValues(ctx, helm.TemplateOptions{
+			Chart:       chart.chart,
+			Version:     chart.version,
+			ValuesFiles: valuesPaths,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if len(undefined) > 0 {
+			return nil, fmt.Errorf("values set keys the chart doesn't define: %s", strings.Join(undefined, ", "))
+		}
+
+		if group.ChartRef == "" {
+			if err := h.helmService.LintChart(ctx, chart.chart, valuesPaths, true); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// Reuse the output of an identical render earlier in the request
+	renderID, err := renderKey(chart, releaseName, namespace, group.PostRenderer, group.PostRendererArgs, group.ExtraHelmArgs, valuesPaths)
+	if err != nil {
+		return nil, err
+	}
+	// A debug trace is only captured by a fresh helm run
+	renders := opts.renders
+	if opts.debug {
+		renders = nil
+	}
+	rendered, deduped := renders.get(renderID)
+
+	if !deduped {
+		// Catch chart problems before rendering when the group asks for it,
+		// unless the strict lint already did
+		if group.Lint && !group.StrictValues {
+			if err := h.helmService.LintChart(ctx, chart.chart, valuesPaths, false); err != nil {
+				return nil, err
+			}
+		}
+
+		// Generate the YAML using Helm
+		rendered, err = h.helmService.TemplateChart(ctx, helm.TemplateOptions{
+			Chart:       chart.chart,
+			Version:     chart.version,
+			ValuesFiles: valuesPaths,
+			ReleaseName: releaseName,
+			Namespace:   namespace,
+
+			PostRenderer:     postRendererPath(group, chart),
+			PostRendererArgs: group.PostRendererArgs,
+			ExtraArgs:        group.ExtraHelmArgs,
+			Debug:            opts.debug,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to template chart: %w", err)
+		}
+		renders.put(renderID, rendered)
+	}
+	yamlOutput := rendered.Output
+
+	// Make sure the rendered output is well-formed before it goes anywhere
+	if err := manifest.Validate(yamlOutput); err != nil {
+		return nil, fmt.Errorf("rendered output is not valid YAML: %w", err)
+	}
+
+	// Drop the empty documents left behind by conditional templates, and
+	// refuse to replace the output with nothing unless that is expected
+	yamlOutput = manifest.StripEmptyDocuments(yamlOutput)
+	if !group.AllowEmptyOutput && !manifest.HasDocuments(yamlOutput) {
+		return nil, fmt.Errorf("chart rendered no resources, set allow_empty_output if that is expected")
+	}
+
+	// Leave out the kinds the output repository shouldn't contain
+	if len(group.OutputRepo.IncludeKinds) > 0 || len(group.OutputRepo.ExcludeKinds) > 0 {
+		yamlOutput, err = manifest.FilterKinds(yamlOutput, group.OutputRepo.IncludeKinds, group.OutputRepo.ExcludeKinds)
+		if err != nil {
+			return nil, fmt.Errorf("failed to filter resource kinds: %w", err)
+		}
+	}
+
+	// Put resources the chart leaves without a namespace into the release's
+	// namespace, or else the configured one
+	injectNamespace := namespace
+	if injectNamespace == "" {
+		injectNamespace = group.InjectNamespace
+	}
+	if injectNamespace != "" {
+		yamlOutput, err = manifest.InjectNamespace(yamlOutput, injectNamespace)
+		if err != nil {
+			return nil, fmt.Errorf("failed to inject namespace: %w", err)
+		}
+	}
+
+	// Label and annotate every resource as the group asks
+	if len(group.CommonLabels) > 0 || len(group.CommonAnnotations) > 0 {
+		yamlOutput, err = manifest.AddMetadata(yamlOutput, group.CommonLabels, group.CommonAnnotations, group.OverwriteCommonMetadata)
+		if err != nil {
+			return nil, fmt.Errorf("failed to add common metadata: %w", err)
+		}
+	}
+
+	// Normalize the output so key ordering is stable across helm versions
+	if group.CanonicalizeOutput {
+		yamlOutput, err = manifest.Canonicalize(yamlOutput)
+		if err != nil {
+			return nil, fmt.Errorf("failed to canonicalize output: %w", err)
+		}
+	}
+
+	// Order the documents so their order is stable across helm versions
+	if group.OutputRepo.SortDocuments {
+		yamlOutput, err = manifest.SortDocuments(yamlOutput)
+		if err != nil {
+			return nil, fmt.Errorf("failed to sort output documents: %w", err)
+		}
+	}
+
+	return &groupRender{
+		chart:       chart,
+		valuesPaths: valuesPaths,
+		rendered:    rendered,
+		deduped:     deduped,
+		output:      yamlOutput,
+	}, nil
+}
+
+// renderForCommit renders a group without cloning its output repository,
+// so that commits that are all or nothing can render every group before
+// pushing any. The render, committed with processOptions.previewed, is
+// checked to convert into output files first.
+func (h *Handler) renderForCommit(ctx context.Context, groupName string, opts processOptions) (_ *groupRender, err error) {
+	phase := phaseConfig
+	defer func() {
+		err = inPhase(phase, err)
+	}()
+
+	group, err := h.findConfigGroup(groupName)
+	if err != nil {
+		return nil, err
+	}
+	group.OutputRepo.Path, err = group.OutputRepo.ResolvePath(group.Name, opts.templateRepoBranch)
+	if err != nil {
+		return nil, err
+	}
+	templateRepoBranch := templateRevision(group, opts.templateRepoBranch)
+
+	phase = phaseCloneTemplate
+	ws, err := h.newWorkspace(groupName)
+	if err != nil {
+		return nil, err
+	}
+	defer ws.cleanup()
+
+	out, err := h.renderGroup(ctx, group, templateRepoBranch, ws, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	phase = phaseRender
+	if _, err := renderOutputFiles(group, out); err != nil {
+		return nil, err
+	}
+	_, err = renderHeader(group, headerData{
+		Repo:      out.chart.repository,
+		Branch:    templateRepoBranch,
+		Group:     groupName,
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return out.detached(), nil
+}
+
+// processConfigGroup processes a configuration group
+func (h *Handler) processConfigGroup(
+	ctx context.Context,
+	groupName string,
+	opts processOptions,
+) (_ map[string]interface{}, err error) {
+	commitMessage := opts.commitMessage
+
+	// Tag errors with the phase they happened in
+	phase := phaseConfig
+	defer func() {
+		err = inPhase(phase, err)
+	}()
+
+	// Find the configuration group
+	group, err := h.findConfigGroup(groupName)
+	if err != nil {
+		return nil, err
+	}
+
+	// Output paths may depend on the group and the requested branch
+	group.OutputRepo.Path, err = group.OutputRepo.ResolvePath(group.Name, opts.templateRepoBranch)
+	if err != nil {
+		return nil, err
+	}
+
+	templateRepoBranch := templateRevision(group, opts.templateRepoBranch)
+
+	// Remove the clones made for this group once processing completes
+	phase = phaseCloneTemplate
+	ws, err := h.newWorkspace(groupName)
+	if err != nil {
+		return nil, err
+	}
+	defer ws.cleanup()
+
+	// Render the group, unless committing the output of an earlier preview
+	out := opts.previewed
+	if out == nil {
+		out, err = h.renderGroup(ctx, group, templateRepoBranch, ws, opts)
+		if err != nil {
+			return nil, err
+		}
+	}
+	chart, rendered, deduped, yamlOutput := out.chart, out.rendered, out.deduped, out.output
+	phase = phaseRender
+
+	// Convert the output into the files written to the output repository
+	outputFiles, err := renderOutputFiles(group, out)
+	if err != nil {
+		return nil, err
+	}
+	fileContent := joinOutputFiles(outputFiles)
+
+	// Render the header written above the output, which comparisons ignore
+	header, err := renderHeader(group, headerData{
+		Repo:      chart.repository,
+		Branch:    templateRepoBranch,
+		Group:     groupName,
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// If preview only, compare with existing content
+	if opts.previewOnly {
+		// Clone output repository to get existing content
+		phase = phaseCloneOutput
+		outputRepoPath, err := h.cloneOutputRepository(group, ws)
+		if err != nil {
+			return nil, err
+		}
+
+		outputDir := outputDirectory(group, outputRepoPath)
+
+		existingFiles, err := readOutputFiles(group, outputDir)
+		if err != nil {
+			return nil, err
+		}
+		phase = phaseRender
+		if err := stripHeaders(group, existingFiles); err != nil {
+			return nil, err
+		}
+		existingContent := joinOutputFiles(existingFiles)
+		fileExists := len(existingFiles) > 0
+
+		var changes map[string]interface{}
+		var summary extractor.DiffSummary
+		if !fileExists {
+			// File doesn't exist, extract keys from new content only
+			keys, err := h.extractorService.ExtractKeys(yamlOutput, 0)
+			if err != nil {
+				return nil, fmt.Errorf("failed to extract keys: %w", err)
+			}
+			summary = h.extractorService.SummarizeNew(keys)
+
+			// Count every key, but only show as many levels as requested
+			if opts.keyDepth > 0 {
+				keys, err = h.extractorService.ExtractKeys(yamlOutput, opts.keyDepth)
+				if err != nil {
+					return nil, fmt.Errorf("failed to extract keys: %w", err)
+				}
+			}
+			changes = map[string]interface{}{
+				"all_new": true,
+				"keys":    keys,
+			}
+		} else {
+			// File exists, compare old vs new
+			existingYAML, err := decodeOutput(group, existingContent)
+			if err != nil {
+				return nil, err
+			}
+			changes, err = h.comparer().CompareYAML(existingYAML, yamlOutput)
+			if err != nil {
+				return nil, fmt.Errorf("failed to compare YAML: %w", err)
+			}
+			summary = h.extractorService.Summarize(changes)
+		}
+
+		// Organize the changes per resource when asked, counting every
+		// document instead of only the first
+		if opts.groupBy == groupByResource {
+			var existingYAML []byte
+			if fileExists {
+				if existingYAML, err = decodeOutput(group, existingContent); err != nil {
+					return nil, err
+				}
+			}
+			changes, summary, err = compareResources(h.comparer(), existingYAML, yamlOutput)
+			if err != nil {
+				return nil, fmt.Errorf("failed to compare resources: %w", err)
+			}
+		}
+
+		contentChanged := true
+		if fileExists {
+			contentChanged, err = outputChanged(group, existingContent, fileContent)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		result := map[string]interface{}{
+			"changes":         changes,
+			"summary":         summary,
+			"content_changed": contentChanged,
+			"files":           outputFilesPlan(group, existingFiles, outputFiles),
+		}
+		addChartVersions(result, chart)
+		if len(rendered.Warnings) > 0 {
+			result["warnings"] = rendered.Warnings
+		}
+		if deduped {
+			result["deduped"] = true
+		}
+
+		// Values shown in the preview have sensitive keys masked
+		var redactor *manifest.Redactor
+		if opts.diffFormat == diffFormatUnified || opts.includeRendered || opts.showValues {
+			redactor, err = manifest.NewRedactor(h.currentConfig().RedactKeys)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		// Include a text diff of the rendered output when requested
+		if opts.diffFormat == diffFormatUnified {
+			diff, err := h.outputFilesDiff(group, redactor, existingFiles, outputFiles)
+			if err != nil {
+				return nil, err
+			}
+			result["diff"] = diff
+		}
+
+		// Include the rendered file itself, truncated to the configured size
+		if opts.includeRendered {
+			content, err := redactOutputFile(group, redactor, fileContent)
+			if err != nil {
+				return nil, fmt.Errorf("failed to redact rendered output: %w", err)
+			}
+
+			limit := h.renderedLimit()
+			if len(content) > limit {
+				result["rendered"] = string(content[:limit])
+				result["rendered_truncated"] = true
+			} else {
+				result["rendered"] = string(content)
+			}
+		}
+
+		// Include the values the chart was rendered with, per release for
+		// groups with releases
+		if opts.showValues {
+			if out.releases != nil {
+				values := make(map[string]interface{}, len(out.releases))
+				for name, release := range out.releases {
+					if values[name], err = h.renderedValues(ctx, release, redactor); err != nil {
+						return nil, fmt.Errorf("release %s: %w", name, err)
+					}
+				}
+				result["values"] = values
+			} else if result["values"], err = h.renderedValues(ctx, out, redactor); err != nil {
+				return nil, err
+			}
+		}
+
+		// Include helm's debug trace, truncated like the rendered output
+		if opts.debug {
+			limit := h.renderedLimit()
+			if len(rendered.Debug) > limit {
+				result["debug"] = rendered.Debug[:limit]
+				result["debug_truncated"] = true
+			} else {
+				result["debug"] = rendered.Debug
+			}
+		}
+
+		if opts.capture != nil {
+			opts.capture[groupName] = out.detached()
+		}
+
+		return result, nil
+	}
+
+	// Extract keys from the YAML
+	keys, err := h.extractorService.ExtractKeys(yamlOutput, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to extract keys: %w", err)
+	}
+
+	result := map[string]interface{}{
+		"keys": keys,
+	}
+	addChartVersions(result, chart)
+	if len(rendered.Warnings) > 0 {
+		result["warnings"] = rendered.Warnings
+	}
+	if deduped {
+		result["deduped"] = true
+	}
+
+	// Clone output repository, or reuse the clone shared by squashed groups
+	phase = phaseCloneOutput
+	var outputRepoPath string
+	if opts.squash != nil {
+		outputRepoPath, err = opts.squash.checkout(group)
+	} else {
+		outputRepoPath, err = h.cloneOutputRepository(group, ws)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	outputDir := outputDirectory(group, outputRepoPath)
+
+	// Check if the output already exists and compare content
+	existingFiles, err := readOutputFiles(group, outputDir)
+	if err != nil {
+		return nil, err
+	}
+	if err := stripHeaders(group, existingFiles); err != nil {
+		return nil, err
+	}
+	existingContent := joinOutputFiles(existingFiles)
+	fileExists := len(existingFiles) > 0
+	contentChanged := true
+
+	if fileExists {
+		contentChanged, err = outputChanged(group, existingContent, fileContent)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Leave the output repository untouched when nothing changed
+	if !contentChanged {
+		result["message"] = "No changes detected. The generated content is identical to the existing file."
+		result["content_changed"] = false
+		return result, nil
+	}
+
+	// Write every rendered file and remove the ones no longer produced,
+	// rolling back the worktree if anything fails
+	phase = phaseWrite
+	var files []outputFile
+	for _, name := range sortedNames(outputFiles) {
+		files = append(files, outputFile{
+			path:    filepath.Join(outputDir, name),
+			content: append(append([]byte{}, header...), outputFiles[name]...),
+			mode:    group.OutputRepo.Mode(),
+		})
+	}
+	var stale []string
+	for _, name := range staleOutputFiles(existingFiles, outputFiles) {
+		stale = append(stale, filepath.Join(outputDir, name))
+	}
+	if err := h.writeOutputFiles(outputRepoPath, files, stale); err != nil {
+		if opts.squash != nil {
+			opts.squash.fail(group, err)
+		}
+		return nil, err
+	}
+
+	// Prepare commit message
+	finalCommitMessage := buildCommitMessage(h.commitFormat(group, opts.commitFormat),
+		expandChartVersions(commitMessage, chart), chart.description, groupName)
+
+	// Summarize the key-level changes for the history before committing
+	phase = phaseRender
+	var changes map[string]interface{}
+	if fileExists {
+		existingYAML, err := decodeOutput(group, existingContent)
+		if err != nil {
+			return nil, err
+		}
+		changes, err = h.comparer().CompareYAML(existingYAML, yamlOutput)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compare YAML: %w", err)
+		}
+	} else {
+		changes = map[string]interface{}{
+			"all_new": true,
+			"keys":    keys,
+		}
+	}
+
+	// Squashed groups are committed together once every group is written
+	if opts.squash != nil {
+		opts.squash.add(group, &squashGroup{
+			branch:  templateRepoBranch,
+			chart:   chart,
+			changes: changes,
+			result:  result,
+		})
+		result["message"] = "Changes staged for a squashed commit"
+		result["content_changed"] = true
+		return result, nil
+	}
+
+	// Commit and push the changes, through a fork and pull request if the
+	// group is configured with one
+	phase = phaseCommit
+	if group.OutputRepo.ForkOwner != "" {
+		commitSHA, prURL, err := h.commitToFork(ctx, group, outputRepoPath, finalCommitMessage)
+		if err != nil {
+			return nil, err
+		}
+		if commitSHA == "" {
+			return noCommitResult(result), nil
+		}
+
+		h.history.Add(history.Entry{
+			Group:      groupName,
+			Branch:     templateRepoBranch,
+			Repository: group.OutputRepo.ForkOwner + "/" + group.OutputRepo.Repo,
+			CommitSHA:  commitSHA,
+			Changes:    changes,
+		})
+
+		result["message"] = "Changes pushed to fork and pull request opened"
+		result["content_changed"] = true
+		result["pull_request_url"] = prURL
+		h.addCommitLinks(result, group, group.OutputRepo.ForkOwner, commitSHA)
+		return result, nil
+	}
+
+	commitSHA, err := h.gitService.CommitAndPush(outputRepoPath, finalCommitMessage, forceWithLease(group))
+	if err != nil {
+		return nil, fmt.Errorf("failed to commit and push changes: %w", err)
+	}
+	if commitSHA == "" {
+		return noCommitResult(result), nil
+	}
+
+	h.history.Add(history.Entry{
+		Group:      groupName,
+		Branch:     templateRepoBranch,
+		Repository: group.OutputRepo.Owner + "/" + group.OutputRepo.Repo,
+		CommitSHA:  commitSHA,
+		Changes:    changes,
+	})
+
+	result["message"] = "Changes committed and pushed successfully"
+	result["content_changed"] = true
+	h.addCommitLinks(result, group, group.OutputRepo.Owner, commitSHA)
+
+	return result, nil
+}
+
+// noCommitResult marks a group's result as unchanged when writing its output
+// left the worktree clean, so there was nothing to commit
+func noCommitResult(result map[string]interface{}) map[string]interface{} {
+	result["message"] = "No changes detected. The generated content is identical to the existing file."
+	result["content_changed"] = false
+	return result
+}
+
+// forceWithLease reports whether a group's commits replace remote commits
+// made since the output repository was cloned, rather than being replayed
+// on top of them
+func forceWithLease(group *config.ConfigGroup) bool {
+	return group.OutputRepo.PushStrategy == config.PushStrategyForceWithLease
+}
+
+// commitToFork commits the output changes, pushes them to a new branch of the
+// group's fork, and opens a pull request against the output branch. It
+// returns the commit hash and the pull request URL, or empty strings when
+// there was nothing to commit and so no pull request was opened.
+func (h *Handler) commitToFork(ctx context.Context, group *config.ConfigGroup, repoPath, message string) (string, string, error) {
+	output := group.OutputRepo
+	if err := h.scm.EnsureFork(ctx, output.Owner, output.Repo, output.ForkOwner); err != nil {
+		return "", "", inPhase(phasePush, err)
+	}
+
+	branch := forkBranchName(group.Name, time.Now())
+	forkURL := h.scm.CloneURL(output.ForkOwner, output.Repo)
+	commitSHA, err := h.gitService.CommitAndPushBranch(repoPath, message, forkURL, branch)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to commit and push changes to fork: %w", err)
+	}
+	if commitSHA == "" {
+		return "", "", nil
+	}
+
+	title, _, _ := strings.Cut(message, "\n")
+	if title == "" {
+		title = fmt.Sprintf("Update generated output for group %s", group.Name)
+	}
+	body := fmt.Sprintf("Generated by the Helm pipeline for group `%s`.", group.Name)
+
+	prURL, err := h.scm.CreatePullRequest(ctx, output.Owner, output.Repo, output.Branch,
+		github.PullRequestHead(output.ForkOwner, branch), title, body)
+	if err != nil {
+		return "", "", inPhase(phasePush, err)
+	}
+
+	return commitSHA, prURL, nil
+}
+
+// forkBranchName returns a unique branch name for pushing a group's output
+// to a fork
+func forkBranchName(groupName string, now time.Time) string {
+	return fmt.Sprintf("helm-pipeline/%s-%s", safeName(groupName), now.UTC().Format("20060102-150405"))
+}
+
+// historyCapacity is the number of commit runs kept in the history
+const historyCapacity = 500
+
+// Handler handles API requests
+type Handler struct {
+	scm              scm.Provider
+	helmService      *helm.Service
+	gitService       *git.Service
+	extractorService *extractor.Service
+
+	configMu   sync.RWMutex
+	config     *config.Config
+	configPath string
+
+	webhookSecret    string
+	history          *history.Store
+	maxRenderedBytes int
+	buildInfo        BuildInfo
+
+	// scopePreviews applies token group scopes to previews as well as commits
+	scopePreviews bool
+
+	// previews keeps recent preview renders for commits made from them
+	previews *previewStore
+
+	// scheduler tracks the runs of groups with a schedule once started
+	scheduler *scheduler
+}
+
+// defaultMaxRenderedBytes caps rendered output included in previews when no
+// limit is configured
+const defaultMaxRenderedBytes = 1 << 20
+
+// NewHandler creates a new API handler
+func NewHandler(provider scm.Provider, helmService *helm.Service, gitService *git.Service, extractorService *extractor.Service, config *config.Config) *Handler {
+	return &Handler{
+		scm:              provider,
+		helmService:      helmService,
+		gitService:       gitService,
+		extractorService: extractorService,
+		config:           config,
+		history:          history.NewStore(historyCapacity),
+		previews:         newPreviewStore(DefaultPreviewTTL),
+		scheduler:        newScheduler(),
+	}
+}
+
+// Options holds optional settings for the API routes
+type Options struct {
+	// APITokens lists the bearer tokens accepted by the API. Authentication
+	// is disabled when empty.
+	APITokens []string
+
+	// ConfigPath is the configuration file re-read by the reload endpoint
+	ConfigPath string
+
+	// WebhookSecret verifies GitHub webhook signatures. The webhook endpoint
+	// is only enabled when it is set.
+	WebhookSecret string
+
+	// RateLimitRPS and RateLimitBurst configure the per-client rate limit
+	// for endpoints that clone repositories and run helm. Rate limiting is
+	// disabled when RateLimitRPS is zero.
+	RateLimitRPS   float64
+	RateLimitBurst int
+
+	// MaxRenderedBytes caps the rendered output included in previews that
+	// ask for it. Defaults to 1MB.
+	MaxRenderedBytes int
+
+	// TokenScopes limits API tokens to committing some groups. Scoped tokens
+	// are accepted in addition to APITokens.
+	TokenScopes TokenScopes
+
+	// ScopePreviews applies TokenScopes to previews too. Scoped tokens may
+	// preview every group otherwise.
+	ScopePreviews bool
+
+	// PreviewTTL is how long the render of a preview can be committed with
+	// its preview token. Defaults to DefaultPreviewTTL.
+	PreviewTTL time.Duration
+
+	// BuildInfo identifies the running build in the version endpoint
+	BuildInfo BuildInfo
+
+	// RequestTimeout bounds every API request except the commit stream and
+	// the self check, which run for as long as their groups take. No limit
+	// when zero.
+	RequestTimeout time.Duration
+}
+
+// BuildInfo describes the build of the running binary
+type BuildInfo struct {
+	Version string
+	Commit  string
+	Date    string
+}
+
+// renderedLimit returns the most bytes of rendered output or debug trace a
+// preview includes
+func (h *Handler) renderedLimit() int {
+	if h.maxRenderedBytes <= 0 {
+		return defaultMaxRenderedBytes
+	}
+	return h.maxRenderedBytes
+}
+
+// currentConfig returns the active configuration
+func (h *Handler) currentConfig() *config.Config {
+	h.configMu.RLock()
+	defer h.configMu.RUnlock()
+	return h.config
+}
+
+// SetupRoutes sets up the API routes and returns the handler serving them
+func SetupRoutes(router chi.Router, provider scm.Provider, helmService *helm.Service, gitService *git.Service, config *config.Config, opts Options) *Handler {
+	extractorService := extractor.NewService()
+
+	handler := NewHandler(provider, helmService, gitService, extractorService, config)
+	handler.configPath = opts.ConfigPath
+	handler.webhookSecret = opts.WebhookSecret
+	handler.maxRenderedBytes = opts.MaxRenderedBytes
+	handler.buildInfo = opts.BuildInfo
+	handler.scopePreviews = opts.ScopePreviews
+	handler.previews = newPreviewStore(opts.PreviewTTL)
+	rateLimiter := NewRateLimiter(opts.RateLimitRPS, opts.RateLimitBurst)
+
+	router.Route("/api", func(r chi.Router) {
+		// The stream stays open while its groups are processed, and the self
+		// check renders every group, so neither is bound by the request timeout
+		r.With(TokenAuth(opts.APITokens, opts.TokenScopes), rateLimiter.Middleware).Post("/commit/stream", handler.CommitStream)
+		r.With(TokenAuth(opts.APITokens, opts.TokenScopes), rateLimiter.Middleware).Post("/selfcheck", handler.SelfCheckGroups)
+
+		r.Group(func(r chi.Router) {
+			if opts.RequestTimeout > 0 {
+				r.Use(middleware.Timeout(opts.RequestTimeout))
+			}
+
+			// Webhooks are authenticated by their signature instead of a token
+			if opts.WebhookSecret != "" {
+				r.Post("/webhooks/github", handler.GitHubWebhook)
+			}
+
+			r.Group(func(r chi.Router) {
+				r.Use(TokenAuth(opts.APITokens, opts.TokenScopes))
+
+				r.Get("/branches", handler.ListBranches)
+				r.Get("/groups", handler.ListConfigGroups)
+				r.Get("/groups/{name}", handler.GetConfigGroup)
+				r.Get("/groups/{name}/output", handler.GetGroupOutput)
+				r.With(rateLimiter.Middleware).Get("/groups/{name}/preview", handler.PreviewGroup)
+				r.With(rateLimiter.Middleware).Get("/groups/{name}/status", handler.GroupStatus)
+				r.With(rateLimiter.Middleware).Get("/groups/{name}/templates", handler.ListTemplates)
+				r.With(rateLimiter.Middleware).Post("/preview", handler.PreviewChanges)
+				r.With(rateLimiter.Middleware).Post("/preview/upload", handler.PreviewUpload)
+				r.With(rateLimiter.Middleware).Post("/plan", handler.CreatePlan)
+				r.With(rateLimiter.Middleware).Post("/commit", handler.CommitChanges)
+				r.With(rateLimiter.Middleware).Post("/groups/{name}/rollback", handler.RollbackGroup)
+				r.Get("/health", handler.HealthCheck)
+				r.Get("/version", handler.Version)
+				r.Post("/config/reload", handler.ReloadConfig)
+				r.Post("/config/validate", handler.ValidateConfig)
+				r.Get("/history", handler.ListHistory)
+				r.Get("/schedules", handler.ScheduleStatus)
+			})
+		})
+	})
+
+	return handler
+}
+
+// ListBranches lists the branches in the repository
+func (h *Handler) ListBranches(w http.ResponseWriter, r *http.Request) {
+	branches, err := h.scm.ListBranches(context.Background())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var branchNames []string
+	for _, branch := range branches {
+		branchNames = append(branchNames, branch.Name)
+	}
+
+	render.JSON(w, r, map[string]interface{}{
+		"branches": branchNames,
+	})
+}
+
+// ListConfigGroups lists available configuration groups. With
+// ?detailed=true the full group configurations are returned instead of names.
+func (h *Handler) ListConfigGroups(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("detailed") == "true" {
+		render.JSON(w, r, map[string]interface{}{
+			"groups": h.currentConfig().Groups,
+		})
+		return
+	}
+
+	var groupNames []string
+	for _, group := range h.currentConfig().Groups {
+		groupNames = append(groupNames, group.Name)
+	}
+
+	render.JSON(w, r, map[string]interface{}{
+		"groups": groupNames,
+	})
+}
+
+// Supported diff formats for previews
+const (
+	diffFormatKeys    = "keys"
+	diffFormatUnified = "unified"
+)
+
+// GetConfigGroup returns the full configuration of a group, including its
+// values repositories and output destination
+func (h *Handler) GetConfigGroup(w http.ResponseWriter, r *http.Request) {
+	group, err := h.findConfigGroup(chi.URLParam(r, "name"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	render.JSON(w, r, group)
+}
+
+// GetGroupOutput returns a group's output file as committed to its output
+// repository, without rendering anything. The branch query parameter fills
+// in output paths templated with the branch. Sensitive values are redacted
+// as in previews, since reading the output needs no more than a preview.
+func (h *Handler) GetGroupOutput(w http.ResponseWriter, r *http.Request) {
+	group, err := h.findConfigGroup(chi.URLParam(r, "name"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if h.scopePreviews && forbidGroups(w, r, []string{group.Name}) {
+		return
+	}
+
+	if group.OutputRepo.SplitByResource {
+		http.Error(w, "output split by resource has no single output file", http.StatusBadRequest)
+		return
+	}
+	if len(group.Releases) > 0 {
+		http.Error(w, "output of a group with releases has no single output file", http.StatusBadRequest)
+		return
+	}
+
+	group.OutputRepo.Path, err = group.OutputRepo.ResolvePath(group.Name, r.URL.Query().Get("branch"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	outputPath := path.Join(group.OutputRepo.Path, outputFilename(group))
+	content, err := h.scm.GetFileContents(r.Context(), group.OutputRepo.Owner, group.OutputRepo.Repo, outputPath, group.OutputRepo.Branch)
+	if errors.Is(err, scm.ErrFileNotFound) {
+		http.Error(w, fmt.Sprintf("output file %s does not exist in %s/%s (branch: %s)",
+			outputPath, group.OutputRepo.Owner, group.OutputRepo.Repo, group.OutputRepo.Branch), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	redactor, err := manifest.NewRedactor(h.currentConfig().RedactKeys)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	content, err = redactOutputFile(group, redactor, content)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to redact output file %s: %v", outputPath, err), http.StatusInternalServerError)
+		return
+	}
+
+	contentType := "application/yaml"
+	if group.OutputRepo.Format == config.OutputFormatJSON {
+		contentType = "application/json"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Write(content)
+}
+
+// PreviewRequest represents a request to preview changes
+type PreviewRequest struct {
+	Branch string   `json:"branch"`
+	Groups []string `json:"groups"`
+	Format string   `json:"format,omitempty"` // "keys" (default) or "unified"
+
+	// IncludeRendered adds the full rendered output file to each result
+	IncludeRendered bool `json:"include_rendered,omitempty"`
+
+	// Depth limits the levels of keys listed for new output files, replacing
+	// deeper mappings with "{...}". 0 lists every level.
+	Depth int `json:"depth,omitempty"`
+
+	// Values holds inline values per group name, given as an object or a raw
+	// YAML string. They override the repo values and are never persisted.
+	Values map[string]interface{} `json:"values,omitempty"`
+
+	// Debug runs helm template with --debug and includes its trace in each
+	// group's result. Also set by ?debug=true.
+	Debug bool `json:"debug,omitempty"`
+
+	// ShowValues includes the merged values each group was rendered with,
+	// with sensitive keys redacted. Also set by ?show_values=true.
+	ShowValues bool `json:"show_values,omitempty"`
+
+	// GroupBy set to "resource" reports changes per resource instead of as
+	// one flat list. Also set by ?group_by=resource.
+	GroupBy string `json:"group_by,omitempty"`
+
+	// Token keeps the renders and returns a preview_token that commits
+	// them. Also set by ?token=true.
+	Token bool `json:"token,omitempty"`
+}
+
+// PreviewChanges previews the changes that will be made
+func (h *Handler) PreviewChanges(w http.ResponseWriter, r *http.Request) {
+	var req PreviewRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.Branch == "" {
+		http.Error(w, "Branch is required", http.StatusBadRequest)
+		return
+	}
+
+	if req.Format != "" && req.Format != diffFormatKeys && req.Format != diffFormatUnified {
+		http.Error(w, fmt.Sprintf("Unsupported format: %s", req.Format), http.StatusBadRequest)
+		return
+	}
+
+	if value := r.URL.Query().Get("depth"); value != "" && req.Depth == 0 {
+		depth, err := parseDepth(value)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		req.Depth = depth
+	}
+	if req.Depth < 0 {
+		http.Error(w, fmt.Sprintf("Invalid depth: %d", req.Depth), http.StatusBadRequest)
+		return
+	}
+
+	if r.URL.Query().Get("debug") == "true" {
+		req.Debug = true
+	}
+	if r.URL.Query().Get("show_values") == "true" {
+		req.ShowValues = true
+	}
+	if r.URL.Query().Get("token") == "true" {
+		req.Token = true
+	}
+	if groupBy := r.URL.Query().Get("group_by"); groupBy != "" && req.GroupBy == "" {
+		req.GroupBy = groupBy
+	}
+	if req.GroupBy != "" && req.GroupBy != groupByResource {
+		http.Error(w, fmt.Sprintf("Unsupported group_by: %s", req.GroupBy), http.StatusBadRequest)
+		return
+	}
+
+	// If no groups specified, use all groups the token may preview
+	selectedGroups := req.Groups
+	if len(selectedGroups) == 0 {
+		selectedGroups = h.groupNames(r, h.scopePreviews)
+	} else if h.scopePreviews && forbidGroups(w, r, selectedGroups) {
+		return
+	}
+
+	if len(selectedGroups) == 0 {
+		http.Error(w, "No configuration groups available", http.StatusInternalServerError)
+		return
+	}
+
+	// Convert any inline values up front so bad input is rejected early
+	overlays := make(map[string][]byte)
+	for groupName, values := range req.Values {
+		overlay, err := inlineValues(values)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("group %s: %v", groupName, err), http.StatusBadRequest)
+			return
+		}
+		overlays[groupName] = overlay
+	}
+
+	// Keep the renders so they can be committed as previewed when asked,
+	// unless inline values that are never persisted went into them
+	var capture map[string]*groupRender
+	if req.Token && len(overlays) == 0 {
+		capture = make(map[string]*groupRender)
+	}
+
+	// Process each selected group, cloning the shared values only once
+	results := make(map[string]interface{})
+	shared := h.newSharedValues()
+	defer shared.cleanup()
+	renders := newRenderCache()
+
+	for _, groupName := range selectedGroups {
+		result, err := h.processConfigGroup(r.Context(), groupName, processOptions{
+			templateRepoBranch: req.Branch,
+			previewOnly:        true,
+			diffFormat:         req.Format,
+			valuesOverlay:      overlays[groupName],
+			includeRendered:    req.IncludeRendered,
+			keyDepth:           req.Depth,
+			debug:              req.Debug,
+			showValues:         req.ShowValues,
+			groupBy:            req.GroupBy,
+			shared:             shared,
+			renders:            renders,
+			capture:            capture,
+		})
+		if err != nil {
+			results[groupName] = errorResult(err)
+		} else {
+			results[groupName] = result
+		}
+	}
+
+	response := map[string]interface{}{
+		"results": results,
+		"branch":  req.Branch,
+	}
+	if len(capture) > 0 {
+		token, err := h.previews.put(req.Branch, capture)
+		switch {
+		case errors.Is(err, errPreviewTooLarge):
+			response["preview_token_error"] = err.Error()
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		default:
+			response["preview_token"] = token
+		}
+	}
+
+	render.JSON(w, r, response)
+}
+
+// PreviewGroup previews the changes for a single configuration group
+func (h *Handler) PreviewGroup(w http.ResponseWriter, r *http.Request) {
+	groupName := chi.URLParam(r, "name")
+	if _, err := h.findConfigGroup(groupName); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if h.scopePreviews && forbidGroups(w, r, []string{groupName}) {
+		return
+	}
+
+	branch := r.URL.Query().Get("branch")
+	if branch == "" {
+		http.Error(w, "Branch is required", http.StatusBadRequest)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format != "" && format != diffFormatKeys && format != diffFormatUnified {
+		http.Error(w, fmt.Sprintf("Unsupported format: %s", format), http.StatusBadRequest)
+		return
+	}
+
+	depth, err := parseDepth(r.URL.Query().Get("depth"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	groupBy := r.URL.Query().Get("group_by")
+	if groupBy != "" && groupBy != groupByResource {
+		http.Error(w, fmt.Sprintf("Unsupported group_by: %s", groupBy), http.StatusBadRequest)
+		return
+	}
+
+	var capture map[string]*groupRender
+	if r.URL.Query().Get("token") == "true" {
+		capture = make(map[string]*groupRender)
+	}
+	result, err := h.processConfigGroup(r.Context(), groupName, processOptions{
+		templateRepoBranch: branch,
+		previewOnly:        true,
+		diffFormat:         format,
+		includeRendered:    r.URL.Query().Get("rendered") == "true",
+		keyDepth:           depth,
+		debug:              r.URL.Query().Get("debug") == "true",
+		showValues:         r.URL.Query().Get("show_values") == "true",
+		groupBy:            groupBy,
+		capture:            capture,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-	for _, groupName := range selectedGroups {
-		result, err := h.processConfigGroup(r.Context(), groupName, req.Branch, req.Message, false)
+	response := map[string]interface{}{
+		"group":  groupName,
+		"branch": branch,
+		"result": result,
+	}
+	if capture != nil {
+		token, err := h.previews.put(branch, capture)
+		switch {
+		case errors.Is(err, errPreviewTooLarge):
+			response["preview_token_error"] = err.Error()
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		default:
+			response["preview_token"] = token
+		}
+	}
+
+	render.JSON(w, r, response)
+}
+
+// ListTemplates lists the template files of a group's chart for a branch,
+// as paths relative to the chart directory
+func (h *Handler) ListTemplates(w http.ResponseWriter, r *http.Request) {
+	groupName := chi.URLParam(r, "name")
+	group, err := h.findConfigGroup(groupName)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	branch := r.URL.Query().Get("branch")
+	if branch == "" {
+		http.Error(w, "Branch is required", http.StatusBadRequest)
+		return
+	}
+
+	if group.ChartRef != "" {
+		http.Error(w, "Templates can only be listed for groups rendered from a template repository", http.StatusBadRequest)
+		return
+	}
+
+	ws, err := h.newWorkspace(groupName)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer ws.cleanup()
+
+	chartPath, _, _, err := h.cloneTemplateRepository(r.Context(), group, templateRevision(group, branch), ws)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	templates, err := listChartTemplates(chartPath)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	render.JSON(w, r, map[string]interface{}{
+		"group":     groupName,
+		"branch":    branch,
+		"templates": templates,
+	})
+}
+
+// listChartTemplates returns the files under a chart's templates directory
+// as sorted paths relative to the chart, such as "templates/service.yaml".
+// A chart without a templates directory has no templates.
+func listChartTemplates(chartPath string) ([]string, error) {
+	templates := []string{}
+
+	templatesDir := filepath.Join(chartPath, "templates")
+	err := filepath.WalkDir(templatesDir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) && path == templatesDir {
+				return fs.SkipDir
+			}
+			return err
+		}
+		if entry.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(chartPath, path)
 		if err != nil {
+			return err
+		}
+		templates = append(templates, filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list chart templates: %w", err)
+	}
+
+	sort.Strings(templates)
+	return templates, nil
+}
+
+// parseDepth parses the depth query parameter, where "" means unlimited
+func parseDepth(value string) (int, error) {
+	if value == "" {
+		return 0, nil
+	}
+	depth, err := strconv.Atoi(value)
+	if err != nil || depth < 0 {
+		return 0, fmt.Errorf("invalid depth: %s", value)
+	}
+	return depth, nil
+}
+
+// GroupStatus reports whether a group's committed output file matches what
+// the pipeline would generate for a branch
+func (h *Handler) GroupStatus(w http.ResponseWriter, r *http.Request) {
+	groupName := chi.URLParam(r, "name")
+	if _, err := h.findConfigGroup(groupName); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if h.scopePreviews && forbidGroups(w, r, []string{groupName}) {
+		return
+	}
+
+	branch := r.URL.Query().Get("branch")
+	if branch == "" {
+		http.Error(w, "Branch is required", http.StatusBadRequest)
+		return
+	}
+
+	result, err := h.processConfigGroup(r.Context(), groupName, processOptions{
+		templateRepoBranch: branch,
+		previewOnly:        true,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	changed, _ := result["content_changed"].(bool)
+
+	render.JSON(w, r, map[string]interface{}{
+		"group":   groupName,
+		"branch":  branch,
+		"in_sync": !changed,
+		"changes": result["changes"],
+		"summary": result["summary"],
+	})
+}
+
+// CommitRequest represents a request to commit changes
+type CommitRequest struct {
+	Branch  string   `json:"branch"`
+	Message string   `json:"message"`
+	Groups  []string `json:"groups"`
+
+	// AllOrNothing renders every group before pushing any of them and
+	// pushes nothing if a group fails to render. Pushes to separate output
+	// repositories aren't atomic, so one failing doesn't undo the others.
+	// Also settable with ?all_or_nothing=true.
+	AllOrNothing bool `json:"all_or_nothing,omitempty"`
+
+	// CommitFormat overrides the configured commit message format
+	CommitFormat *config.CommitFormat `json:"commit_format,omitempty"`
+
+	// Squash makes a single commit per output repository for all the
+	// groups targeting it, instead of one commit per group. Also settable
+	// with ?squash=true.
+	Squash bool `json:"squash,omitempty"`
+}
+
+// CommitChanges commits the changes to the repository
+func (h *Handler) CommitChanges(w http.ResponseWriter, r *http.Request) {
+	var req CommitRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Commit exactly what an earlier preview rendered instead of rendering again
+	var preview *storedPreview
+	token := r.URL.Query().Get("from_preview")
+	if token != "" {
+		var ok bool
+		preview, ok = h.previews.get(token)
+		if !ok {
+			http.Error(w, "Preview not found or expired", http.StatusNotFound)
+			return
+		}
+		if req.Branch == "" {
+			req.Branch = preview.branch
+		}
+		if req.Branch != preview.branch {
+			http.Error(w, fmt.Sprintf("Preview was made for branch %s, not %s", preview.branch, req.Branch), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if req.Branch == "" {
+		http.Error(w, "Branch is required", http.StatusBadRequest)
+		return
+	}
+
+	if req.Message == "" {
+		http.Error(w, "Message is required", http.StatusBadRequest)
+		return
+	}
+
+	if !h.currentConfig().BranchAllowed(req.Branch) {
+		http.Error(w, fmt.Sprintf("Commits from branch %s are not allowed", req.Branch), http.StatusForbidden)
+		return
+	}
+
+	if req.CommitFormat != nil {
+		if err := req.CommitFormat.Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// If no groups specified, use all groups the token may commit, or those
+	// of them in the preview
+	selectedGroups := req.Groups
+	if len(selectedGroups) == 0 {
+		for _, groupName := range h.groupNames(r, true) {
+			if preview == nil || preview.render(groupName) != nil {
+				selectedGroups = append(selectedGroups, groupName)
+			}
+		}
+	} else if forbidGroups(w, r, selectedGroups) {
+		return
+	}
+
+	if len(selectedGroups) == 0 {
+		http.Error(w, "No configuration groups available", http.StatusInternalServerError)
+		return
+	}
+
+	if preview != nil {
+		for _, groupName := range selectedGroups {
+			if preview.render(groupName) == nil {
+				http.Error(w, fmt.Sprintf("Group %s is not part of the preview", groupName), http.StatusBadRequest)
+				return
+			}
+		}
+
+		// A preview is committed once; a concurrent commit may have taken it
+		if !h.previews.take(token) {
+			http.Error(w, "Preview not found or expired", http.StatusNotFound)
+			return
+		}
+	}
+
+	allOrNothing := req.AllOrNothing || r.URL.Query().Get("all_or_nothing") == "true"
+	squash := req.Squash || r.URL.Query().Get("squash") == "true"
+
+	// Process each selected group, cloning the shared values only once
+	results := make(map[string]interface{})
+	shared := h.newSharedValues()
+	defer shared.cleanup()
+
+	// Render every group up front so a failure stops all pushes, and commit
+	// those renders instead of rendering again. The pushes that follow are
+	// still separate: once one output repository has been pushed to, a
+	// failure pushing to another can't undo it.
+	var prerendered map[string]*groupRender
+	if allOrNothing {
+		failed := false
+		prerendered = make(map[string]*groupRender)
+		renders := newRenderCache()
+		for _, groupName := range selectedGroups {
+			out := preview.render(groupName)
+			if out == nil {
+				var err error
+				out, err = h.renderForCommit(r.Context(), groupName, processOptions{
+					templateRepoBranch: req.Branch,
+					shared:             shared,
+					renders:            renders,
+				})
+				if err != nil {
+					results[groupName] = errorResult(err)
+					failed = true
+					continue
+				}
+			}
+			prerendered[groupName] = out
 			results[groupName] = map[string]interface{}{
-				"error": err.Error(),
+				"message": "Not committed because another group failed",
 			}
+		}
+
+		if failed {
+			render.Status(r, http.StatusUnprocessableEntity)
+			render.JSON(w, r, map[string]interface{}{
+				"results": results,
+				"branch":  req.Branch,
+				"error":   "Nothing was pushed because at least one group failed",
+			})
+			return
+		}
+	}
+
+	var squashed *squashSet
+	if squash {
+		squashed = h.newSquashSet(req.CommitFormat)
+		defer squashed.cleanup()
+	}
+
+	failed := false
+	renders := newRenderCache()
+	for _, groupName := range selectedGroups {
+		previewed := prerendered[groupName]
+		if previewed == nil {
+			previewed = preview.render(groupName)
+		}
+		result, err := h.processConfigGroup(r.Context(), groupName, processOptions{
+			templateRepoBranch: req.Branch,
+			commitMessage:      req.Message,
+			commitFormat:       req.CommitFormat,
+			shared:             shared,
+			renders:            renders,
+			squash:             squashed,
+			previewed:          previewed,
+		})
+		if err != nil {
+			results[groupName] = errorResult(err)
+			failed = true
 		} else {
 			results[groupName] = result
 		}
 	}
 
+	// Commit the squashed groups, one commit per output repository
+	if squashed != nil {
+		for groupName, err := range squashed.commit(req.Message) {
+			results[groupName] = errorResult(err)
+			failed = true
+		}
+	}
+
+	// Groups that rendered may still fail to push; report that as a failure
+	// when the caller asked for all or nothing
+	if allOrNothing && failed {
+		render.Status(r, http.StatusInternalServerError)
+	}
+
 	render.JSON(w, r, map[string]interface{}{
 		"results": results,
 		"branch":  req.Branch,
 	})
 }
 
+// ReloadConfig reloads the configuration without restarting the server. The
+// new configuration is validated before it replaces the active one, so a bad
+// file leaves the running configuration untouched.
+func (h *Handler) ReloadConfig(w http.ResponseWriter, r *http.Request) {
+	newConfig, err := config.ReloadConfig(h.configPath)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to reload configuration: %v", err), http.StatusUnprocessableEntity)
+		return
+	}
+
+	h.configMu.Lock()
+	h.config = newConfig
+	h.configMu.Unlock()
+
+	// The default branch and other repository details may have changed too
+	h.scm.InvalidateRepositoryCache()
+
+	log.Printf("Configuration reloaded with %d groups", len(newConfig.Groups))
+
+	render.JSON(w, r, map[string]interface{}{
+		"message": "Configuration reloaded",
+		"groups":  len(newConfig.Groups),
+	})
+}
+
+// maxConfigPayload bounds the size of configuration documents sent for validation
+const maxConfigPayload = 1 << 20
+
+// ValidateConfig checks a YAML or JSON configuration document sent in the
+// request body without applying it
+func (h *Handler) ValidateConfig(w http.ResponseWriter, r *http.Request) {
+	data, err := io.ReadAll(io.LimitReader(r.Body, maxConfigPayload))
+	if err != nil {
+		http.Error(w, "failed to read request body", http.StatusBadRequest)
+		return
+	}
+
+	parsed, err := config.Parse(data)
+	if err != nil {
+		var validationErrs config.ValidationErrors
+		if !errors.As(err, &validationErrs) {
+			// The document didn't parse, so point at the line instead of a field
+			parseErr := &config.ValidationError{Message: err.Error()}
+			var located *yamlerr.Error
+			if errors.As(err, &located) {
+				parseErr.Line = located.Line
+			}
+			validationErrs = config.ValidationErrors{parseErr}
+		}
+
+		render.JSON(w, r, map[string]interface{}{
+			"valid":  false,
+			"errors": validationErrs,
+		})
+		return
+	}
+
+	render.JSON(w, r, map[string]interface{}{
+		"valid":  true,
+		"groups": len(parsed.Groups),
+	})
+}
+
+// RollbackRequest represents a request to roll back a group's output file
+type RollbackRequest struct {
+	Message string `json:"message"`
+
+	// Branch resolves output paths templated with the branch name
+	Branch string `json:"branch"`
+}
+
+// RollbackGroup reverts a group's output file to the version before its last
+// change and commits the result
+func (h *Handler) RollbackGroup(w http.ResponseWriter, r *http.Request) {
+	group, err := h.findConfigGroup(chi.URLParam(r, "name"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if forbidGroups(w, r, []string{group.Name}) {
+		return
+	}
+
+	if group.OutputRepo.SplitByResource {
+		http.Error(w, "rollback is not supported for output split by resource", http.StatusBadRequest)
+		return
+	}
+	if len(group.Releases) > 0 {
+		http.Error(w, "rollback is not supported for groups with releases", http.StatusBadRequest)
+		return
+	}
+
+	var req RollbackRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	group.OutputRepo.Path, err = group.OutputRepo.ResolvePath(group.Name, req.Branch)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ws, err := h.newWorkspace(group.Name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer ws.cleanup()
+
+	outputRepoPath, err := h.cloneOutputRepository(group, ws)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	relPath := filepath.Join(group.OutputRepo.Path, outputFilename(group))
+
+	content, revertedTo, err := h.gitService.PreviousFileContent(outputRepoPath, relPath)
+	if errors.Is(err, git.ErrNoPreviousVersion) {
+		http.Error(w, fmt.Sprintf("cannot roll back %s: %v", relPath, err), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	files := []outputFile{{path: filepath.Join(outputRepoPath, relPath), content: content, mode: group.OutputRepo.Mode()}}
+	if err := h.writeOutputFiles(outputRepoPath, files, nil); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	message := req.Message
+	if message == "" {
+		message = fmt.Sprintf("Roll back %s to %s", relPath, shortSHA(revertedTo))
+	}
+	message = fmt.Sprintf("%s (group: %s)", message, group.Name)
+
+	commitSHA, err := h.gitService.CommitAndPush(outputRepoPath, message, forceWithLease(group))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to commit and push rollback: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	result := map[string]interface{}{
+		"group":       group.Name,
+		"file":        relPath,
+		"reverted_to": revertedTo,
+		"commit_sha":  commitSHA,
+	}
+	h.addCommitLinks(result, group, group.OutputRepo.Owner, commitSHA)
+	render.JSON(w, r, result)
+}
+
+// ListHistory lists recent commit runs, newest first. Supports ?group= to
+// filter by group and ?limit= to cap the number of entries (default 50).
+func (h *Handler) ListHistory(w http.ResponseWriter, r *http.Request) {
+	limit := 50
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 {
+			http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+
+	render.JSON(w, r, map[string]interface{}{
+		"history": h.history.List(r.URL.Query().Get("group"), limit),
+	})
+}
+
+// CheckOutputAccess verifies that the credentials can push to the output
+// repository of every configured group, or to its fork when the group
+// pushes through one. Each repository is checked once.
+func (h *Handler) CheckOutputAccess(ctx context.Context) error {
+	checked := make(map[string]bool)
+	for _, group := range h.currentConfig().Groups {
+		owner := group.OutputRepo.Owner
+		if group.OutputRepo.ForkOwner != "" {
+			owner = group.OutputRepo.ForkOwner
+		}
+
+		fullName := owner + "/" + group.OutputRepo.Repo
+		if checked[fullName] {
+			continue
+		}
+		checked[fullName] = true
+
+		canPush, err := h.scm.CanPush(ctx, owner, group.OutputRepo.Repo)
+		if err != nil {
+			return fmt.Errorf("group %s: %w", group.Name, err)
+		}
+		if !canPush {
+			return fmt.Errorf("group %s: no write access to output repository %s", group.Name, fullName)
+		}
+	}
+	return nil
+}
+
+// Version reports the build of the running binary and the helm version it
+// renders with. A helm that can't be run is reported as helm_error.
+func (h *Handler) Version(w http.ResponseWriter, r *http.Request) {
+	result := map[string]interface{}{
+		"version":      h.buildInfo.Version,
+		"commit":       h.buildInfo.Commit,
+		"build_date":   h.buildInfo.Date,
+		"go_version":   runtime.Version(),
+		"helm_version": "",
+	}
+
+	// A helm older than the minimum version still reports its version
+	status, err := h.helmService.CheckVersion(r.Context())
+	if status != nil {
+		result["helm_version"] = status.Version
+	} else if err != nil {
+		result["helm_error"] = err.Error()
+	}
+
+	render.JSON(w, r, result)
+}
+
 // HealthCheck checks the health of the API
 func (h *Handler) HealthCheck(w http.ResponseWriter, r *http.Request) {
-	// Check GitHub authentication
-	isAuthenticated := h.githubService.IsAuthenticated(context.Background())
+	// Check authentication with the SCM provider, reported as
+	// github_authenticated for compatibility
+	isAuthenticated := h.scm.IsAuthenticated(context.Background())
 
-	// Check if Helm is installed
+	// Check if Helm is installed and recent enough
 	helmInstalled := true
-	cmd := "helm version"
-	_, err := exec.Command("sh", "-c", cmd).Output()
-	if err != nil {
+	helmVersion := ""
+	helmMinVersion := ""
+	helmSupported := false
+	helmStatus, err := h.helmService.CheckVersion(r.Context())
+	if helmStatus != nil {
+		helmVersion = helmStatus.Version
+		helmMinVersion = helmStatus.MinVersion
+		helmSupported = helmStatus.Supported
+	} else if err != nil {
 		helmInstalled = false
 	}
 
@@ -463,6 +2449,9 @@ func (h *Handler) HealthCheck(w http.ResponseWriter, r *http.Request) {
 		"status":                 "ok",
 		"github_authenticated":   isAuthenticated,
 		"helm_installed":         helmInstalled,
+		"helm_version":           helmVersion,
+		"helm_min_version":       helmMinVersion,
+		"helm_version_supported": helmSupported,
 		"value_files_configured": valueFilesConfigured,
 		"value_files_paths":      valueFilesConfig,
 		"output_configured":      outputRepoConfigured,
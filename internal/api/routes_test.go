@@ -0,0 +1,1011 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/lei/yaml-helm-pipeline/internal/config"
+	"github.com/lei/yaml-helm-pipeline/internal/extractor"
+	"github.com/lei/yaml-helm-pipeline/internal/github"
+	"github.com/lei/yaml-helm-pipeline/internal/retry"
+)
+
+func TestPostRendererPath(t *testing.T) {
+	chartDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(chartDir, "post-render.sh"), []byte("#!/bin/sh\ncat\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	chart := &chartSource{chart: chartDir}
+
+	tests := []struct {
+		name  string
+		group config.ConfigGroup
+		want  string
+	}{
+		{
+			name:  "absolute",
+			group: config.ConfigGroup{PostRenderer: "/usr/bin/kustomize-wrapper"},
+			want:  "/usr/bin/kustomize-wrapper",
+		},
+		{
+			name:  "requested branch",
+			group: config.ConfigGroup{PostRenderer: "post-render.sh"},
+			want:  "post-render.sh",
+		},
+		{
+			name:  "pinned branch",
+			group: config.ConfigGroup{PostRenderer: "post-render.sh", TemplateRepo: &config.TemplateRepo{Owner: "acme", Repo: "chart", Branch: "main"}},
+			want:  "post-render.sh",
+		},
+		{
+			name:  "pinned ref",
+			group: config.ConfigGroup{PostRenderer: "post-render.sh", TemplateRepo: &config.TemplateRepo{Owner: "acme", Repo: "chart", Ref: "v1.0.0"}},
+			want:  filepath.Join(chartDir, "post-render.sh"),
+		},
+		{
+			name:  "pinned ref without the file",
+			group: config.ConfigGroup{PostRenderer: "kustomize-wrapper", TemplateRepo: &config.TemplateRepo{Owner: "acme", Repo: "chart", Ref: "v1.0.0"}},
+			want:  "kustomize-wrapper",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := postRendererPath(&tt.group, chart); got != tt.want {
+				t.Errorf("postRendererPath() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// previewGroup gets the preview of a single group at target, e.g.
+// "/api/groups/web/preview?branch=master"
+func (p *testPipeline) previewGroup(target string) *httptest.ResponseRecorder {
+	router := chi.NewRouter()
+	router.Get("/api/groups/{name}/preview", p.PreviewGroup)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+	return w
+}
+
+func TestPreviewGroup(t *testing.T) {
+	p := newTestPipeline(t, pipelineGroup("web", "deploy"), pipelineGroup("api", "deploy"))
+	p.addRepo(t, "acme", "values", map[string]string{
+		"web.yaml": configMap("web", "one"),
+		"api.yaml": configMap("api", "two"),
+	})
+	p.addRepo(t, "acme", "deploy", map[string]string{"README.md": "deploy\n"})
+
+	w := p.previewGroup("/api/groups/web/preview?branch=master&format=unified")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body)
+	}
+	var response struct {
+		Group  string
+		Branch string
+		Result map[string]interface{}
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Group != "web" || response.Branch != "master" {
+		t.Errorf("response = %+v, want group web on master", response)
+	}
+	if diff, _ := response.Result["diff"].(string); !strings.Contains(diff, "+  value: one") {
+		t.Errorf("diff = %q, want only the web group's output", diff)
+	}
+	if n := p.helmRuns(t); n != 1 {
+		t.Errorf("helm ran %d times, want only for the previewed group", n)
+	}
+	if n := p.commits(t, "acme", "deploy"); n != 1 {
+		t.Errorf("acme/deploy has %d commits, want a preview to push nothing", n)
+	}
+}
+
+func TestPreviewGroupRejectsBadRequests(t *testing.T) {
+	p := newTestPipeline(t, pipelineGroup("web", "deploy"))
+
+	tests := []struct {
+		target string
+		want   int
+	}{
+		{"/api/groups/missing/preview?branch=master", http.StatusNotFound},
+		{"/api/groups/web/preview", http.StatusBadRequest},
+		{"/api/groups/web/preview?branch=master&format=html", http.StatusBadRequest},
+		{"/api/groups/web/preview?branch=master&group_by=kind", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		if w := p.previewGroup(tt.target); w.Code != tt.want {
+			t.Errorf("GET %s status = %d, want %d", tt.target, w.Code, tt.want)
+		}
+	}
+	if n := p.helmRuns(t); n != 0 {
+		t.Errorf("helm ran %d times, want nothing rendered", n)
+	}
+}
+
+func TestPreviewGroupByResource(t *testing.T) {
+	p := newTestPipeline(t, pipelineGroup("web", "deploy"))
+	p.addRepo(t, "acme", "values", map[string]string{
+		"web.yaml": configMap("web", "two") + "---\n" + configMap("web-new", "one") + "---\n" + configMap("web-same", "one"),
+	})
+	p.addRepo(t, "acme", "deploy", map[string]string{
+		"web/generated.yaml": configMap("web", "one") + "---\n" + configMap("web-old", "one") + "---\n" + configMap("web-same", "one"),
+	})
+
+	w := p.previewChanges(`{"branch":"master","group_by":"resource"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body)
+	}
+	var response struct {
+		Results map[string]struct {
+			Changes map[string]struct {
+				Status  string
+				Changes map[string]interface{}
+			}
+			Summary extractor.DiffSummary
+		}
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	result := response.Results["web"]
+
+	// Resources are matched by kind and name, and the identical one is left
+	// out
+	if len(result.Changes) != 3 {
+		t.Fatalf("changes = %+v, want the changed, added, and removed resources", result.Changes)
+	}
+	if web := result.Changes["ConfigMap/web"]; web.Status != resourceChanged || !reflect.DeepEqual(web.Changes, map[string]interface{}{"data.value": "changed"}) {
+		t.Errorf("ConfigMap/web = %+v, want data.value changed", web)
+	}
+	if added := result.Changes["ConfigMap/web-new"]; added.Status != resourceAdded || len(added.Changes) != 4 {
+		t.Errorf("ConfigMap/web-new = %+v, want every key added", added)
+	}
+	if removed := result.Changes["ConfigMap/web-old"]; removed.Status != resourceRemoved || len(removed.Changes) != 4 {
+		t.Errorf("ConfigMap/web-old = %+v, want every key removed", removed)
+	}
+	if want := (extractor.DiffSummary{Added: 4, Changed: 1, Removed: 4}); result.Summary != want {
+		t.Errorf("summary = %+v, want %+v", result.Summary, want)
+	}
+
+	if w := p.previewChanges(`{"branch":"master","group_by":"kind"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("unsupported group_by status = %d, want 400", w.Code)
+	}
+}
+
+// previewChanges posts a preview request to the pipeline
+func (p *testPipeline) previewChanges(body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	p.PreviewChanges(w, httptest.NewRequest(http.MethodPost, "/api/preview", strings.NewReader(body)))
+	return w
+}
+
+func TestPreviewInlineValues(t *testing.T) {
+	p := newTestPipeline(t, pipelineGroup("web", "deploy"), pipelineGroup("api", "deploy"))
+	p.addRepo(t, "acme", "values", map[string]string{
+		"web.yaml": configMap("web", "one"),
+		"api.yaml": configMap("api", "two"),
+	})
+	p.addRepo(t, "acme", "deploy", map[string]string{"README.md": "deploy\n"})
+
+	w := p.previewChanges(`{"branch":"master","format":"unified","values":{"web":"` +
+		strings.ReplaceAll(configMap("web", "inline"), "\n", `\n`) + `"}}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body)
+	}
+	var response struct {
+		Results map[string]map[string]interface{}
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+
+	// The fake helm renders its last values file, which is the overlay
+	if diff, _ := response.Results["web"]["diff"].(string); !strings.Contains(diff, "+  value: inline") {
+		t.Errorf("web diff = %q, want the inline values to win", diff)
+	}
+	if diff, _ := response.Results["api"]["diff"].(string); !strings.Contains(diff, "+  value: two") {
+		t.Errorf("api diff = %q, want the repo values", diff)
+	}
+
+	overlays, err := filepath.Glob(filepath.Join(os.TempDir(), "values-overlay-*"))
+	if err != nil || len(overlays) != 0 {
+		t.Errorf("overlay files %v left behind", overlays)
+	}
+	if got := p.file(t, "acme", "values", "web.yaml"); got != configMap("web", "one") {
+		t.Errorf("values web.yaml = %q, want the inline values not persisted", got)
+	}
+	if n := p.commits(t, "acme", "deploy"); n != 1 {
+		t.Errorf("acme/deploy has %d commits, want a preview to push nothing", n)
+	}
+}
+
+func TestPreviewRejectsInvalidInlineValues(t *testing.T) {
+	p := newTestPipeline(t, pipelineGroup("web", "deploy"))
+
+	for _, values := range []string{`"a: [1"`, `[1, 2]`, `3`} {
+		w := p.previewChanges(`{"branch":"master","values":{"web":` + values + `}}`)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("values %s: status = %d, want 400", values, w.Code)
+		}
+	}
+	if n := p.helmRuns(t); n != 0 {
+		t.Errorf("helm ran %d times, want nothing rendered", n)
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	p := newTestPipeline(t, pipelineGroup("web", "deploy"))
+	p.configPath = filepath.Join(t.TempDir(), "config.yaml")
+	// A configuration in the environment must not replace a broken file
+	t.Setenv("CONFIG_GROUPS", `[{"name":"env","values_repos":[{"owner":"acme","repo":"values","path":"env.yaml"}],`+
+		`"output_repo":{"owner":"acme","repo":"deploy"}}]`)
+
+	reload := func() *httptest.ResponseRecorder {
+		t.Helper()
+		w := httptest.NewRecorder()
+		p.ReloadConfig(w, httptest.NewRequest(http.MethodPost, "/api/config/reload", nil))
+		return w
+	}
+	groupNames := func() []string {
+		var names []string
+		for _, group := range p.currentConfig().Groups {
+			names = append(names, group.Name)
+		}
+		return names
+	}
+
+	valid := `
+groups:
+  - name: api
+    values_repos:
+      - owner: acme
+        repo: values
+        path: api.yaml
+    output_repo:
+      owner: acme
+      repo: deploy
+`
+	if err := os.WriteFile(p.configPath, []byte(valid), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if w := reload(); w.Code != http.StatusOK {
+		t.Fatalf("reload of a valid configuration status = %d, body %s", w.Code, w.Body)
+	}
+	if got := groupNames(); len(got) != 1 || got[0] != "api" {
+		t.Fatalf("groups after reload = %v, want [api]", got)
+	}
+
+	for name, content := range map[string]string{
+		"invalid": "groups:\n  - name: api\n",
+		"broken":  "groups: [\n",
+		"missing": "",
+	} {
+		if err := os.Remove(p.configPath); err != nil && !os.IsNotExist(err) {
+			t.Fatal(err)
+		}
+		if content != "" {
+			if err := os.WriteFile(p.configPath, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if w := reload(); w.Code != http.StatusUnprocessableEntity {
+			t.Errorf("reload of a %s configuration status = %d, want 422", name, w.Code)
+		}
+		if got := groupNames(); len(got) != 1 || got[0] != "api" {
+			t.Errorf("groups after a %s reload = %v, want the previous [api]", name, got)
+		}
+	}
+}
+
+func TestPreviewChartRef(t *testing.T) {
+	group := pipelineGroup("web", "deploy")
+	group.ChartRef = "oci://ghcr.io/acme/app"
+	group.ChartVersion = "1.2.3"
+	p := newTestPipeline(t, group)
+	p.addRepo(t, "acme", "values", map[string]string{"web.yaml": configMap("web", "one")})
+	p.addRepo(t, "acme", "deploy", map[string]string{"README.md": "deploy\n"})
+	t.Setenv("HELM_REGISTRY_USERNAME", "bot")
+	t.Setenv("HELM_REGISTRY_PASSWORD", "s3cret")
+
+	if w := p.previewGroup("/api/groups/web/preview?branch=master"); w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body)
+	}
+
+	log, err := os.ReadFile(p.runs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runs := strings.Split(strings.TrimSpace(string(log)), "\n")
+	if len(runs) != 2 || runs[0] != "registry login ghcr.io --username bot --password-stdin" ||
+		!strings.HasPrefix(runs[1], "template oci://ghcr.io/acme/app --version 1.2.3 -f ") {
+		t.Errorf("helm runs %q, want a registry login then the pinned chart rendered", runs)
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	active := &config.Config{Groups: []config.ConfigGroup{pipelineGroup("web", "deploy")}}
+	h := NewHandler(nil, nil, nil, nil, active)
+
+	tests := []struct {
+		name       string
+		body       string
+		wantValid  bool
+		wantGroup  string
+		wantField  string
+		wantSubstr string
+		wantLine   int
+	}{
+		{
+			name:      "valid YAML",
+			body:      "groups:\n  - name: api\n    values_repos:\n      - {owner: acme, repo: values, path: api.yaml}\n    output_repo: {owner: acme, repo: deploy}\n",
+			wantValid: true,
+		},
+		{
+			name:      "valid JSON",
+			body:      `{"groups":[{"name":"api","values_repos":[{"owner":"acme","repo":"values","path":"api.yaml"}],"output_repo":{"owner":"acme","repo":"deploy"}}]}`,
+			wantValid: true,
+		},
+		{
+			name:       "no groups",
+			body:       "groups: []\n",
+			wantField:  "groups",
+			wantSubstr: "no configuration groups",
+		},
+		{
+			name:       "unnamed group",
+			body:       "groups:\n  - values_repos: [{owner: acme, repo: values, path: a.yaml}]\n    output_repo: {owner: acme, repo: deploy}\n",
+			wantField:  "groups[0].name",
+			wantSubstr: "has no name",
+		},
+		{
+			name:       "incomplete values repo",
+			body:       "groups:\n  - name: api\n    values_repos: [{owner: acme, repo: values}]\n    output_repo: {owner: acme, repo: deploy}\n",
+			wantGroup:  "api",
+			wantField:  "values_repos[0]",
+			wantSubstr: "missing fields",
+		},
+		{
+			name:       "bad output format",
+			body:       "groups:\n  - name: api\n    values_repos: [{owner: acme, repo: values, path: a.yaml}]\n    output_repo: {owner: acme, repo: deploy, format: xml}\n",
+			wantGroup:  "api",
+			wantField:  "output_repo.format",
+			wantSubstr: "unsupported output format",
+		},
+		{
+			name:       "unparsable",
+			body:       "groups:\n  - name: api\n    values_repos: [\n",
+			wantSubstr: "failed to parse",
+			wantLine:   3,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			h.ValidateConfig(w, httptest.NewRequest(http.MethodPost, "/api/config/validate", strings.NewReader(tt.body)))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, body %s", w.Code, w.Body)
+			}
+
+			var response struct {
+				Valid  bool
+				Errors []config.ValidationError
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+			if response.Valid != tt.wantValid {
+				t.Fatalf("valid = %v, want %v: %s", response.Valid, tt.wantValid, w.Body)
+			}
+			if tt.wantValid {
+				return
+			}
+			if len(response.Errors) != 1 {
+				t.Fatalf("errors = %+v, want one", response.Errors)
+			}
+			got := response.Errors[0]
+			if got.Group != tt.wantGroup || got.Field != tt.wantField || !strings.Contains(got.Message, tt.wantSubstr) {
+				t.Errorf("error = %+v, want group %q, field %q and %q", got, tt.wantGroup, tt.wantField, tt.wantSubstr)
+			}
+			if got.Line != tt.wantLine {
+				t.Errorf("line = %d, want %d", got.Line, tt.wantLine)
+			}
+		})
+	}
+
+	if h.currentConfig() != active || len(active.Groups) != 1 || active.Groups[0].Name != "web" {
+		t.Errorf("active configuration changed to %+v", h.currentConfig())
+	}
+}
+
+func TestValidateConfigReportsEveryProblem(t *testing.T) {
+	h := NewHandler(nil, nil, nil, nil, &config.Config{})
+	body := `
+groups:
+  - values_repos: [{owner: acme, repo: values, path: a.yaml}]
+    output_repo: {owner: acme, repo: deploy}
+  - name: api
+    output_repo: {owner: acme}
+  - name: web
+    values_repos: [{owner: acme, repo: values, path: web.yaml}]
+    output_repo: {owner: acme, repo: deploy, format: xml}
+`
+
+	w := httptest.NewRecorder()
+	h.ValidateConfig(w, httptest.NewRequest(http.MethodPost, "/api/config/validate", strings.NewReader(body)))
+	var response struct {
+		Valid  bool
+		Errors []config.ValidationError
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, err := range response.Errors {
+		got = append(got, err.Group+" "+err.Field)
+	}
+	want := []string{" groups[0].name", "api values_repos", "api output_repo", "web output_repo.format"}
+	if response.Valid || !reflect.DeepEqual(got, want) {
+		t.Errorf("errors = %q, want %q", got, want)
+	}
+}
+
+func TestPreviewIncludesRenderedOutput(t *testing.T) {
+	p := newTestPipeline(t, pipelineGroup("web", "deploy"))
+	p.addRepo(t, "acme", "values", map[string]string{"web.yaml": configMap("web", "one")})
+	p.addRepo(t, "acme", "deploy", map[string]string{"README.md": "deploy\n"})
+
+	preview := func(body string) map[string]interface{} {
+		t.Helper()
+		w := p.previewChanges(body)
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d, body %s", w.Code, w.Body)
+		}
+		var response struct {
+			Results map[string]map[string]interface{}
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		return response.Results["web"]
+	}
+
+	if result := preview(`{"branch":"master"}`); result["rendered"] != nil {
+		t.Errorf("result = %v, want no rendered output by default", result)
+	}
+
+	result := preview(`{"branch":"master","include_rendered":true}`)
+	if result["rendered"] != configMap("web", "one") || result["rendered_truncated"] != nil {
+		t.Errorf("result = %v, want the rendered output", result)
+	}
+
+	p.maxRenderedBytes = 10
+	result = preview(`{"branch":"master","include_rendered":true}`)
+	if result["rendered"] != configMap("web", "one")[:10] || result["rendered_truncated"] != true {
+		t.Errorf("result = %v, want the rendered output truncated to 10 bytes", result)
+	}
+}
+
+func TestPreviewRedactsSensitiveValues(t *testing.T) {
+	p := newTestPipeline(t, pipelineGroup("web", "deploy"))
+	secret := "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: web\ndata:\n  dbPassword: hunter2\n  replicas: \"3\"\n"
+	p.addRepo(t, "acme", "values", map[string]string{"web.yaml": secret})
+	p.addRepo(t, "acme", "deploy", map[string]string{"web/generated.yaml": strings.Replace(secret, "hunter2", "swordfish", 1)})
+
+	w := p.previewGroup("/api/groups/web/preview?branch=master&format=unified&rendered=true")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body)
+	}
+	var response struct {
+		Result map[string]interface{}
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	result := response.Result
+
+	for _, field := range []string{"diff", "rendered"} {
+		got, _ := result[field].(string)
+		if strings.Contains(got, "hunter2") || strings.Contains(got, "swordfish") {
+			t.Errorf("%s = %q, want the password masked", field, got)
+		}
+	}
+	if rendered, _ := result["rendered"].(string); !strings.Contains(rendered, "dbPassword: '***'") || !strings.Contains(rendered, `replicas: "3"`) {
+		t.Errorf("rendered = %q, want only the password masked", rendered)
+	}
+	// Both sides are masked alike, so a changed secret doesn't show
+	if diff, _ := result["diff"].(string); diff != "" {
+		t.Errorf("diff = %q, want no visible change", diff)
+	}
+}
+
+// groupStatus gets the status of a group at target, e.g.
+// "/api/groups/web/status?branch=master"
+func (p *testPipeline) groupStatus(t *testing.T, target string) (int, map[string]interface{}) {
+	t.Helper()
+
+	router := chi.NewRouter()
+	router.Get("/api/groups/{name}/status", p.GroupStatus)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+	if w.Code != http.StatusOK {
+		return w.Code, nil
+	}
+	var response map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	return w.Code, response
+}
+
+func TestGroupStatus(t *testing.T) {
+	p := newTestPipeline(t, pipelineGroup("web", "deploy"))
+	p.addRepo(t, "acme", "values", map[string]string{"web.yaml": configMap("web", "one")})
+	p.addRepo(t, "acme", "deploy", map[string]string{"README.md": "deploy\n"})
+
+	_, response := p.groupStatus(t, "/api/groups/web/status?branch=master")
+	if response["in_sync"] != false {
+		t.Errorf("response = %v, want drift before the output is committed", response)
+	}
+
+	p.commitChanges(t, `{"branch":"master","message":"Update"}`)
+	_, response = p.groupStatus(t, "/api/groups/web/status?branch=master")
+	if response["in_sync"] != true || response["group"] != "web" || response["branch"] != "master" {
+		t.Errorf("response = %v, want web in sync on master", response)
+	}
+
+	p.pushFiles(t, "acme", "values", map[string]string{"web.yaml": configMap("web", "two")})
+	_, response = p.groupStatus(t, "/api/groups/web/status?branch=master")
+	if response["in_sync"] != false || response["changes"] == nil {
+		t.Errorf("response = %v, want drift with the changes", response)
+	}
+	if n := p.commits(t, "acme", "deploy"); n != 2 {
+		t.Errorf("acme/deploy has %d commits, want a status check to push nothing", n)
+	}
+
+	if code, _ := p.groupStatus(t, "/api/groups/missing/status?branch=master"); code != http.StatusNotFound {
+		t.Errorf("missing group status = %d, want 404", code)
+	}
+	if code, _ := p.groupStatus(t, "/api/groups/web/status"); code != http.StatusBadRequest {
+		t.Errorf("status without a branch = %d, want 400", code)
+	}
+}
+
+// groupOutput gets the committed output of a group at target, e.g.
+// "/api/groups/web/output"
+func (p *testPipeline) groupOutput(target string) *httptest.ResponseRecorder {
+	router := chi.NewRouter()
+	router.Get("/api/groups/{name}/output", p.GetGroupOutput)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+	return w
+}
+
+func TestGetGroupOutput(t *testing.T) {
+	templated := pipelineGroup("api", "deploy")
+	templated.OutputRepo.Path = "{{branch}}/api"
+	p := newTestPipeline(t, pipelineGroup("web", "deploy"), templated)
+	p.addRepo(t, "acme", "deploy", map[string]string{
+		"web/generated.yaml":         "apiVersion: v1\nkind: Secret\nmetadata:\n  name: web\ndata:\n  password: aHVudGVyMg==\n",
+		"release/api/generated.yaml": configMap("api", "one"),
+	})
+
+	w := p.groupOutput("/api/groups/web/output")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body)
+	}
+	if body := w.Body.String(); strings.Contains(body, "aHVudGVyMg==") || !strings.Contains(body, "name: web") {
+		t.Errorf("output = %q, want the file with its secret data redacted", body)
+	}
+	if got := w.Header().Get("Content-Type"); got != "application/yaml" {
+		t.Errorf("Content-Type = %q, want application/yaml", got)
+	}
+
+	if w := p.groupOutput("/api/groups/api/output?branch=release"); w.Code != http.StatusOK || w.Body.String() != configMap("api", "one") {
+		t.Errorf("templated output status = %d, body %q, want the file under the branch", w.Code, w.Body)
+	}
+	if w := p.groupOutput("/api/groups/api/output?branch=master"); w.Code != http.StatusNotFound {
+		t.Errorf("missing output status = %d, want 404", w.Code)
+	}
+	if w := p.groupOutput("/api/groups/missing/output"); w.Code != http.StatusNotFound {
+		t.Errorf("missing group status = %d, want 404", w.Code)
+	}
+}
+
+func TestCommitInjectsNamespace(t *testing.T) {
+	group := pipelineGroup("web", "deploy")
+	group.InjectNamespace = "team"
+	p := newTestPipeline(t, group)
+	p.addRepo(t, "acme", "values", map[string]string{"web.yaml": configMap("web", "one")})
+	p.addRepo(t, "acme", "deploy", map[string]string{"README.md": "deploy\n"})
+
+	if code, response := p.commitChanges(t, `{"branch":"master","message":"Update"}`); code != http.StatusOK {
+		t.Fatalf("CommitChanges() status = %d, response %v", code, response)
+	}
+	if got := p.file(t, "acme", "deploy", "web/generated.yaml"); !strings.Contains(got, "  namespace: team\n") {
+		t.Errorf("web/generated.yaml = %q, want the namespace injected", got)
+	}
+}
+
+func TestPreviewLintsChart(t *testing.T) {
+	group := pipelineGroup("web", "deploy")
+	group.Lint = true
+	p := newTestPipeline(t, group)
+	p.addRepo(t, "acme", "values", map[string]string{"web.yaml": configMap("web", "one")})
+	p.addRepo(t, "acme", "deploy", map[string]string{"README.md": "deploy\n"})
+
+	if w := p.previewGroup("/api/groups/web/preview?branch=master"); w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body)
+	}
+	log, err := os.ReadFile(p.runs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runs := strings.Split(strings.TrimSpace(string(log)), "\n")
+	if len(runs) != 2 || !strings.HasPrefix(runs[0], "lint ") || !strings.HasSuffix(runs[0], "/web.yaml") ||
+		!strings.HasPrefix(runs[1], "template ") {
+		t.Errorf("helm runs %q, want the chart linted with the values before templating", runs)
+	}
+}
+
+func TestPreviewSummary(t *testing.T) {
+	p := newTestPipeline(t, pipelineGroup("web", "deploy"))
+	p.addRepo(t, "acme", "values", map[string]string{"web.yaml": configMap("web", "one")})
+	p.addRepo(t, "acme", "deploy", map[string]string{"README.md": "deploy\n"})
+
+	summary := func() map[string]interface{} {
+		t.Helper()
+		w := p.previewGroup("/api/groups/web/preview?branch=master")
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d, body %s", w.Code, w.Body)
+		}
+		var response struct {
+			Result struct {
+				Summary map[string]interface{}
+			}
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		return response.Result.Summary
+	}
+
+	// Every key of a new file is added
+	want := map[string]interface{}{"added": 4.0, "changed": 0.0, "removed": 0.0}
+	if got := summary(); !reflect.DeepEqual(got, want) {
+		t.Errorf("summary = %v, want %v", got, want)
+	}
+
+	p.commitChanges(t, `{"branch":"master","message":"Update"}`)
+	p.pushFiles(t, "acme", "values", map[string]string{"web.yaml": configMap("web", "two")})
+	want = map[string]interface{}{"added": 0.0, "changed": 1.0, "removed": 0.0}
+	if got := summary(); !reflect.DeepEqual(got, want) {
+		t.Errorf("summary = %v, want %v", got, want)
+	}
+}
+
+func TestForkBranchName(t *testing.T) {
+	now := time.Date(2024, time.January, 10, 13, 4, 5, 0, time.FixedZone("CET", 3600))
+	if got, want := forkBranchName("web api/prod", now), "helm-pipeline/web-api-prod-20240110-120405"; got != want {
+		t.Errorf("forkBranchName() = %q, want %q", got, want)
+	}
+}
+
+func TestPreviewKeyDepth(t *testing.T) {
+	p := newTestPipeline(t, pipelineGroup("web", "deploy"))
+	p.addRepo(t, "acme", "values", map[string]string{"web.yaml": configMap("web", "one")})
+	p.addRepo(t, "acme", "deploy", map[string]string{"README.md": "deploy\n"})
+
+	w := p.previewGroup("/api/groups/web/preview?branch=master&depth=1")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body)
+	}
+	var response struct {
+		Result struct {
+			Changes struct{ Keys map[string]interface{} }
+			Summary map[string]interface{}
+		}
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if got := response.Result.Changes.Keys["metadata"]; got != "{...}" {
+		t.Errorf("metadata keys = %v, want them truncated", got)
+	}
+	if got := response.Result.Summary["added"]; got != 4.0 {
+		t.Errorf("added = %v, want every key counted", got)
+	}
+
+	for _, depth := range []string{"-1", "deep"} {
+		if w := p.previewGroup("/api/groups/web/preview?branch=master&depth=" + depth); w.Code != http.StatusBadRequest {
+			t.Errorf("depth %s status = %d, want 400", depth, w.Code)
+		}
+	}
+}
+
+func TestListChartTemplates(t *testing.T) {
+	chart := t.TempDir()
+	for _, name := range []string{"Chart.yaml", "templates/service.yaml", "templates/_helpers.tpl", "templates/jobs/migrate.yaml"} {
+		path := filepath.Join(chart, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := listChartTemplates(chart)
+	want := []string{"templates/_helpers.tpl", "templates/jobs/migrate.yaml", "templates/service.yaml"}
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("listChartTemplates() = %q, %v, want %q", got, err, want)
+	}
+
+	got, err = listChartTemplates(t.TempDir())
+	if err != nil || got == nil || len(got) != 0 {
+		t.Errorf("listChartTemplates() without templates = %q, %v, want an empty list", got, err)
+	}
+}
+
+func TestListTemplates(t *testing.T) {
+	p := newTestPipeline(t, pipelineGroup("web", "deploy"))
+	p.pushFiles(t, "acme", "charts", map[string]string{"templates/configmap.yaml": "kind: ConfigMap\n"})
+
+	router := chi.NewRouter()
+	router.Get("/api/groups/{name}/templates", p.ListTemplates)
+	get := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		return w
+	}
+
+	w := get("/api/groups/web/templates?branch=master")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body)
+	}
+	var response struct{ Templates []string }
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"templates/.gitkeep", "templates/configmap.yaml"}; !reflect.DeepEqual(response.Templates, want) {
+		t.Errorf("templates = %q, want %q", response.Templates, want)
+	}
+
+	if w := get("/api/groups/web/templates"); w.Code != http.StatusBadRequest {
+		t.Errorf("status without a branch = %d, want 400", w.Code)
+	}
+	if w := get("/api/groups/missing/templates?branch=master"); w.Code != http.StatusNotFound {
+		t.Errorf("status of a missing group = %d, want 404", w.Code)
+	}
+}
+
+func TestCheckOutputAccess(t *testing.T) {
+	requests := make(map[string]int)
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests[r.URL.Path]++
+		push := r.URL.Path != "/repos/acme/locked"
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"full_name":   strings.TrimPrefix(r.URL.Path, "/repos/"),
+			"permissions": map[string]bool{"pull": true, "push": push},
+		})
+	}))
+	defer api.Close()
+
+	forked := pipelineGroup("forked", "deploy")
+	forked.OutputRepo.ForkOwner = "bot"
+	groups := []config.ConfigGroup{pipelineGroup("web", "deploy"), pipelineGroup("api", "deploy"), forked}
+	githubService := github.NewService("token", "acme", "charts", retry.Policy{MaxAttempts: 1},
+		github.HTTPOptions{Transport: apiTransport{api}})
+
+	h := NewHandler(githubService, nil, nil, nil, &config.Config{Groups: groups})
+	if err := h.CheckOutputAccess(context.Background()); err != nil {
+		t.Fatalf("CheckOutputAccess() error = %v", err)
+	}
+	want := map[string]int{"/repos/acme/deploy": 1, "/repos/bot/deploy": 1}
+	if !reflect.DeepEqual(requests, want) {
+		t.Errorf("requests = %v, want each output repository checked once", requests)
+	}
+
+	locked := pipelineGroup("locked", "locked")
+	h = NewHandler(githubService, nil, nil, nil, &config.Config{Groups: append(groups, locked)})
+	err := h.CheckOutputAccess(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "no write access to output repository acme/locked") {
+		t.Errorf("CheckOutputAccess() error = %v, want acme/locked reported", err)
+	}
+}
+
+func TestVersion(t *testing.T) {
+	p := newTestPipeline(t)
+
+	// A helm reporting its version, in front of the pipeline's fake helm
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "helm"), []byte("#!/bin/sh\necho v3.14.2+gc309b6f\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	router := chi.NewRouter()
+	SetupRoutes(router, p.scm, p.helmService, p.gitService, p.config, Options{
+		BuildInfo: BuildInfo{Version: "1.4.0", Commit: "abc1234", Date: "2024-01-10T12:00:00Z"},
+	})
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/version", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body)
+	}
+
+	var got map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"version":      "1.4.0",
+		"commit":       "abc1234",
+		"build_date":   "2024-01-10T12:00:00Z",
+		"go_version":   runtime.Version(),
+		"helm_version": "v3.14.2+gc309b6f",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("version = %v, want %v", got, want)
+	}
+}
+
+func TestPreviewDebug(t *testing.T) {
+	p := newTestPipeline(t, pipelineGroup("web", "deploy"))
+	p.addRepo(t, "acme", "values", map[string]string{"web.yaml": configMap("web", "one")})
+	p.addRepo(t, "acme", "deploy", map[string]string{"README.md": "deploy\n"})
+
+	// templateRuns returns the arguments of each helm template run so far
+	templateRuns := func() []string {
+		t.Helper()
+		log, err := os.ReadFile(p.runs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var runs []string
+		for _, run := range strings.Split(strings.TrimSpace(string(log)), "\n") {
+			if strings.HasPrefix(run, "template ") {
+				runs = append(runs, run)
+			}
+		}
+		return runs
+	}
+	preview := func(target string) map[string]interface{} {
+		t.Helper()
+		w := p.previewGroup(target)
+		var response struct{ Result map[string]interface{} }
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatalf("status = %d, body %s", w.Code, w.Body)
+		}
+		return response.Result
+	}
+
+	result := preview("/api/groups/web/preview?branch=master")
+	if _, ok := result["debug"]; ok || strings.Contains(templateRuns()[0], "--debug") {
+		t.Errorf("preview without debug ran %q with result %v", templateRuns()[0], result)
+	}
+
+	result = preview("/api/groups/web/preview?branch=master&debug=true")
+	if run := templateRuns()[1]; !strings.HasSuffix(run, " --debug") {
+		t.Errorf("helm run = %q, want --debug", run)
+	}
+	if debug, _ := result["debug"].(string); !strings.HasPrefix(debug, "[debug] CHART PATH: ") {
+		t.Errorf("debug = %q, want helm's trace", debug)
+	}
+
+	// The trace is capped like the rendered output
+	p.maxRenderedBytes = 7
+	result = preview("/api/groups/web/preview?branch=master&debug=true")
+	if result["debug"] != "[debug]" || result["debug_truncated"] != true {
+		t.Errorf("debug = %q, truncated %v, want the trace cut at 7 bytes", result["debug"], result["debug_truncated"])
+	}
+
+	// Commits never run helm with --debug
+	if code, response := p.commitChanges(t, `{"branch":"master","message":"Update"}`); code != http.StatusOK {
+		t.Fatalf("CommitChanges() status = %d, response %v", code, response)
+	}
+	runs := templateRuns()
+	if run := runs[len(runs)-1]; strings.Contains(run, "--debug") {
+		t.Errorf("commit ran helm with %q, want no --debug", run)
+	}
+	if got := p.file(t, "acme", "deploy", "web/generated.yaml"); got != configMap("web", "one") {
+		t.Errorf("web/generated.yaml = %q, want the output without a trace", got)
+	}
+}
+
+func TestPreviewShowValues(t *testing.T) {
+	web := pipelineGroup("web", "deploy")
+	web.TemplateRepo = &config.TemplateRepo{Owner: "acme", Repo: "web-chart"}
+	web.ValuesRepos = append(web.ValuesRepos, config.ValuesRepo{Owner: "acme", Repo: "values", Path: "web-override.yaml", Branch: "master"})
+	p := newTestPipeline(t, web)
+	p.addRepo(t, "acme", "web-chart", map[string]string{
+		"Chart.yaml":         "apiVersion: v2\nname: web\nversion: 1.0.0\n",
+		"values.yaml":        "replicas: 1\nimage:\n  repository: web\n  tag: v1\ndb:\n  password: default\n",
+		"templates/.gitkeep": "",
+	})
+	p.addRepo(t, "acme", "values", map[string]string{
+		"web.yaml":          "replicas: 2\nimage:\n  tag: v2\n",
+		"web-override.yaml": configMap("web", "one") + "replicas: 3\ndb:\n  password: hunter2\n",
+	})
+	p.addRepo(t, "acme", "deploy", map[string]string{"README.md": "deploy\n"})
+
+	w := p.previewGroup("/api/groups/web/preview?branch=master&show_values=true")
+	var response struct{ Result map[string]interface{} }
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body)
+	}
+
+	// Later values files override earlier ones and the chart's defaults
+	values, _ := response.Result["values"].(map[string]interface{})
+	if values["replicas"] != float64(3) {
+		t.Errorf("replicas = %v, want the last values file's", values["replicas"])
+	}
+	want := map[string]interface{}{"repository": "web", "tag": "v2"}
+	if !reflect.DeepEqual(values["image"], want) {
+		t.Errorf("image = %v, want %v", values["image"], want)
+	}
+	if db, _ := values["db"].(map[string]interface{}); db["password"] != "***" {
+		t.Errorf("db = %v, want the password redacted", values["db"])
+	}
+
+	// Values are only shown on request
+	w = p.previewGroup("/api/groups/web/preview?branch=master")
+	if strings.Contains(w.Body.String(), `"values"`) {
+		t.Errorf("preview without show_values = %s, want no values", w.Body)
+	}
+}
+
+func TestCommitReleases(t *testing.T) {
+	p := newTestPipeline(t, pipelineGroup("web", "deploy"))
+	p.addRepo(t, "acme", "values", map[string]string{
+		"web.yaml":   configMap("web", "one"),
+		"blue.yaml":  configMap("blue", "two"),
+		"green.yaml": configMap("green", "three"),
+	})
+	p.addRepo(t, "acme", "deploy", map[string]string{"README.md": "deploy\n"})
+
+	if code, response := p.commitChanges(t, `{"branch":"master","message":"Update"}`); code != http.StatusOK {
+		t.Fatalf("CommitChanges() status = %d, response %v", code, response)
+	}
+	if p.file(t, "acme", "deploy", "web/generated.yaml") == "" {
+		t.Fatal("web/generated.yaml wasn't pushed")
+	}
+
+	// Switch the group to releases, one of them without a namespace
+	group := &p.config.Groups[0]
+	group.InjectNamespace = "shared"
+	group.Releases = []config.Release{
+		{Name: "blue", Namespace: "team-blue", ValuesRepos: []config.ValuesRepo{{Owner: "acme", Repo: "values", Path: "blue.yaml", Branch: "master"}}},
+		{Name: "green", ValuesRepos: []config.ValuesRepo{{Owner: "acme", Repo: "values", Path: "green.yaml", Branch: "master"}}},
+	}
+	if code, response := p.commitChanges(t, `{"branch":"master","message":"Update"}`); code != http.StatusOK {
+		t.Fatalf("CommitChanges() status = %d, response %v", code, response)
+	}
+
+	if got := p.file(t, "acme", "deploy", "web/blue.yaml"); !strings.Contains(got, "namespace: team-blue") {
+		t.Errorf("web/blue.yaml = %q, want the release's namespace", got)
+	}
+	if got := p.file(t, "acme", "deploy", "web/green.yaml"); !strings.Contains(got, "namespace: shared") {
+		t.Errorf("web/green.yaml = %q, want inject_namespace", got)
+	}
+	if got := p.file(t, "acme", "deploy", "web/generated.yaml"); got != "" {
+		t.Errorf("web/generated.yaml = %q, want it removed", got)
+	}
+}
@@ -0,0 +1,77 @@
+package api
+
+import (
+	"context"
+	"fmt"
+)
+
+// RunOptions selects the groups a one-shot run processes and how
+type RunOptions struct {
+	Branch  string   // Template repository branch
+	Groups  []string // Groups to process, all groups when empty
+	Message string   // Commit message
+	Preview bool     // Only preview the changes instead of committing them
+	Squash  bool     // Make one commit per output repository for all groups
+}
+
+// Run processes groups outside of an HTTP request, the same way the preview
+// and commit endpoints do, including their branch allowlist. It returns the
+// result of every group, keyed by name, and an error if any group failed.
+func (h *Handler) Run(ctx context.Context, opts RunOptions) (map[string]interface{}, error) {
+	selectedGroups := opts.Groups
+	if len(selectedGroups) == 0 {
+		for _, group := range h.currentConfig().Groups {
+			selectedGroups = append(selectedGroups, group.Name)
+		}
+	}
+
+	if len(selectedGroups) == 0 {
+		return nil, fmt.Errorf("no configuration groups available")
+	}
+
+	if !opts.Preview && !h.currentConfig().BranchAllowed(opts.Branch) {
+		return nil, fmt.Errorf("commits from branch %s are not allowed", opts.Branch)
+	}
+
+	// Process each selected group, cloning the shared values only once
+	results := make(map[string]interface{})
+	shared := h.newSharedValues()
+	defer shared.cleanup()
+	renders := newRenderCache()
+
+	var squashed *squashSet
+	if opts.Squash && !opts.Preview {
+		squashed = h.newSquashSet(nil)
+		defer squashed.cleanup()
+	}
+
+	failed := 0
+	for _, groupName := range selectedGroups {
+		result, err := h.processConfigGroup(ctx, groupName, processOptions{
+			templateRepoBranch: opts.Branch,
+			commitMessage:      opts.Message,
+			previewOnly:        opts.Preview,
+			shared:             shared,
+			renders:            renders,
+			squash:             squashed,
+		})
+		if err != nil {
+			results[groupName] = errorResult(err)
+			failed++
+		} else {
+			results[groupName] = result
+		}
+	}
+
+	if squashed != nil {
+		for groupName, err := range squashed.commit(opts.Message) {
+			results[groupName] = errorResult(err)
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return results, fmt.Errorf("%d of %d groups failed", failed, len(selectedGroups))
+	}
+	return results, nil
+}
@@ -0,0 +1,204 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-chi/render"
+	"github.com/lei/yaml-helm-pipeline/internal/schedule"
+)
+
+// scheduledMessage is the commit message of scheduled runs
+const scheduledMessage = "Scheduled update of %s"
+
+// scheduler commits the output of groups that have a schedule at the times
+// it selects. A group is never run again while its previous run is going.
+type scheduler struct {
+	mu      sync.Mutex
+	enabled bool
+	runs    map[string]*scheduledRun
+}
+
+// scheduledRun is the state of a group's scheduled runs
+type scheduledRun struct {
+	running   bool
+	lastRun   time.Time
+	lastError string
+	message   string // Result of the last successful run
+	skipped   int    // Runs skipped because the previous one was still going
+}
+
+// newScheduler creates a scheduler that hasn't been started
+func newScheduler() *scheduler {
+	return &scheduler{runs: make(map[string]*scheduledRun)}
+}
+
+// run returns the state of a group's runs. The caller must hold the lock.
+func (s *scheduler) run(groupName string) *scheduledRun {
+	run, ok := s.runs[groupName]
+	if !ok {
+		run = &scheduledRun{}
+		s.runs[groupName] = run
+	}
+	return run
+}
+
+// begin marks a group as running and returns true, or counts a skipped run
+// and returns false if it is already running
+func (s *scheduler) begin(groupName string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	run := s.run(groupName)
+	if run.running {
+		run.skipped++
+		return false
+	}
+	run.running = true
+	return true
+}
+
+// finish records the outcome of a group's run started at start
+func (s *scheduler) finish(groupName string, start time.Time, message string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	run := s.run(groupName)
+	run.running = false
+	run.lastRun = start
+	run.lastError = ""
+	run.message = message
+	if err != nil {
+		run.lastError = err.Error()
+		run.message = ""
+	}
+}
+
+// StartScheduler commits the output of every group with a schedule at the
+// times it selects, in the server's local time, until ctx is canceled.
+// Schedules are read from the active configuration every minute, so reloads
+// take effect without a restart.
+func (h *Handler) StartScheduler(ctx context.Context) {
+	h.scheduler.mu.Lock()
+	h.scheduler.enabled = true
+	h.scheduler.mu.Unlock()
+
+	go func() {
+		for {
+			now := time.Now()
+			minute := now.Truncate(time.Minute).Add(time.Minute)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(minute.Sub(now)):
+			}
+			h.runScheduled(ctx, minute)
+		}
+	}()
+}
+
+// runScheduled starts the groups scheduled for a minute in the background
+func (h *Handler) runScheduled(ctx context.Context, minute time.Time) {
+	for _, group := range h.currentConfig().Groups {
+		if group.Schedule == "" {
+			continue
+		}
+		sched, err := schedule.Parse(group.Schedule)
+		if err != nil || !sched.Matches(minute) {
+			continue
+		}
+
+		if !h.scheduler.begin(group.Name) {
+			log.Printf("Scheduler: group %s is still running, skipping", group.Name)
+			continue
+		}
+		go h.runScheduledGroup(ctx, group.Name)
+	}
+}
+
+// runScheduledGroup commits a group's output rendered from its default
+// template branch
+func (h *Handler) runScheduledGroup(ctx context.Context, groupName string) {
+	start := time.Now()
+	result, err := h.commitScheduledGroup(ctx, groupName)
+
+	var message string
+	if err != nil {
+		log.Printf("Scheduler: group %s failed: %v", groupName, err)
+	} else {
+		message, _ = result["message"].(string)
+		log.Printf("Scheduler: group %s processed", groupName)
+	}
+	h.scheduler.finish(groupName, start, message, err)
+}
+
+// commitScheduledGroup renders and commits a group for a scheduled run.
+// Branches excluded by allowed_branches fail the run like API commits.
+func (h *Handler) commitScheduledGroup(ctx context.Context, groupName string) (map[string]interface{}, error) {
+	group, err := h.findConfigGroup(groupName)
+	if err != nil {
+		return nil, err
+	}
+
+	branch, err := h.defaultTemplateBranch(ctx, group)
+	if err != nil {
+		return nil, err
+	}
+	if !h.currentConfig().BranchAllowed(branch) {
+		return nil, fmt.Errorf("commits from branch %s are not allowed", branch)
+	}
+
+	return h.processConfigGroup(ctx, groupName, processOptions{
+		templateRepoBranch: branch,
+		commitMessage:      fmt.Sprintf(scheduledMessage, groupName),
+	})
+}
+
+// ScheduleStatus lists the groups with a schedule, when each runs next, and
+// the outcome of its last scheduled run
+func (h *Handler) ScheduleStatus(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+
+	h.scheduler.mu.Lock()
+	defer h.scheduler.mu.Unlock()
+
+	groups := make(map[string]interface{})
+	for _, group := range h.currentConfig().Groups {
+		if group.Schedule == "" {
+			continue
+		}
+
+		status := map[string]interface{}{
+			"schedule": group.Schedule,
+			"running":  false,
+			"skipped":  0,
+		}
+		if run, ok := h.scheduler.runs[group.Name]; ok {
+			status["running"] = run.running
+			status["skipped"] = run.skipped
+			if !run.lastRun.IsZero() {
+				status["last_run"] = run.lastRun
+			}
+			if run.lastError != "" {
+				status["last_error"] = run.lastError
+			} else if run.message != "" {
+				status["message"] = run.message
+			}
+		}
+		if sched, err := schedule.Parse(group.Schedule); err == nil && h.scheduler.enabled {
+			if next := sched.Next(now); !next.IsZero() {
+				status["next_run"] = next
+			}
+		}
+		groups[group.Name] = status
+	}
+
+	render.JSON(w, r, map[string]interface{}{
+		"enabled": h.scheduler.enabled,
+		"groups":  groups,
+	})
+}
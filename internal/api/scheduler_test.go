@@ -0,0 +1,61 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSchedulerSkipsRunningGroups(t *testing.T) {
+	s := newScheduler()
+
+	if !s.begin("web") {
+		t.Fatal("begin() refused an idle group")
+	}
+	if s.begin("web") {
+		t.Error("begin() started a group that is still running")
+	}
+	if !s.begin("api") {
+		t.Error("begin() refused a group because another one is running")
+	}
+
+	start := time.Now()
+	s.finish("web", start, "", errors.New("render failed"))
+	run := s.runs["web"]
+	if run.running || run.skipped != 1 || run.lastError != "render failed" || !run.lastRun.Equal(start) {
+		t.Errorf("run after finish() = %+v, want stopped with one skipped run and the error", run)
+	}
+
+	if !s.begin("web") {
+		t.Fatal("begin() refused a group whose run finished")
+	}
+	s.finish("web", start, "Committed", nil)
+	if run.lastError != "" || run.message != "Committed" {
+		t.Errorf("run after a successful finish() = %+v, want the message and no error", run)
+	}
+}
+
+func TestCommitScheduledGroup(t *testing.T) {
+	p := newTestPipeline(t, pipelineGroup("web", "deploy"))
+	p.addRepo(t, "acme", "values", map[string]string{"web.yaml": configMap("web", "one")})
+	p.addRepo(t, "acme", "deploy", map[string]string{"README.md": "deploy\n"})
+
+	p.config.AllowedBranches = []string{"release/*"}
+	_, err := p.commitScheduledGroup(context.Background(), "web")
+	if err == nil || !strings.Contains(err.Error(), "not allowed") {
+		t.Errorf("commitScheduledGroup() error = %v, want the branch refused", err)
+	}
+	if n := p.helmRuns(t); n != 0 {
+		t.Errorf("helm ran %d times for a refused branch", n)
+	}
+
+	p.config.AllowedBranches = []string{"master"}
+	if _, err := p.commitScheduledGroup(context.Background(), "web"); err != nil {
+		t.Fatalf("commitScheduledGroup() error = %v", err)
+	}
+	if got := p.file(t, "acme", "deploy", "web/generated.yaml"); !strings.Contains(got, "value: one") {
+		t.Errorf("web/generated.yaml = %q, want the rendered output", got)
+	}
+}
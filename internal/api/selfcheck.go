@@ -0,0 +1,92 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/go-chi/render"
+)
+
+// SelfCheckRequest represents a request to check every group
+type SelfCheckRequest struct {
+	// Branch of the template repository to render, defaults to its default
+	// branch
+	Branch string `json:"branch,omitempty"`
+}
+
+// SelfCheck clones the repositories of groups and renders them without
+// committing anything, to verify the configuration works end to end. All
+// groups are checked when groups is empty, on the template repository's
+// default branch when branch is empty. The report lists whether each group
+// passed, with the error and phase of those that failed.
+func (h *Handler) SelfCheck(ctx context.Context, branch string, groups []string) (map[string]interface{}, error) {
+	if branch == "" {
+		repo, err := h.scm.GetRepository(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get repository information: %w", err)
+		}
+		branch = repo.DefaultBranch
+	}
+
+	results, err := h.Run(ctx, RunOptions{Branch: branch, Groups: groups, Preview: true})
+	if results == nil {
+		return nil, err
+	}
+
+	passed, failed := 0, 0
+	checks := make(map[string]interface{}, len(results))
+	for groupName, result := range results {
+		// Failed groups keep their error and phase, passed ones only say so
+		check, _ := result.(map[string]interface{})
+		if _, isError := check["error"]; isError {
+			check["ok"] = false
+			failed++
+		} else {
+			check = map[string]interface{}{"ok": true}
+			passed++
+		}
+		checks[groupName] = check
+	}
+
+	return map[string]interface{}{
+		"ok":     failed == 0,
+		"branch": branch,
+		"passed": passed,
+		"failed": failed,
+		"groups": checks,
+	}, nil
+}
+
+// SelfCheckGroups checks that every group the token may preview can be
+// cloned and rendered. Responds with 422 Unprocessable Entity when any fails.
+func (h *Handler) SelfCheckGroups(w http.ResponseWriter, r *http.Request) {
+	var req SelfCheckRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if branch := r.URL.Query().Get("branch"); branch != "" && req.Branch == "" {
+		req.Branch = branch
+	}
+
+	groups := h.groupNames(r, h.scopePreviews)
+	if len(groups) == 0 {
+		http.Error(w, "No configuration groups available", http.StatusInternalServerError)
+		return
+	}
+
+	report, err := h.SelfCheck(r.Context(), req.Branch, groups)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if ok, _ := report["ok"].(bool); !ok {
+		render.Status(r, http.StatusUnprocessableEntity)
+	}
+	render.JSON(w, r, report)
+}
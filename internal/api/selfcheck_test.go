@@ -0,0 +1,49 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func TestSelfCheckRoute(t *testing.T) {
+	p := newSharedOutputPipeline(t)
+	p.config.Groups = append(p.config.Groups, pipelineGroup("broken", "deploy"))
+	router := chi.NewRouter()
+	SetupRoutes(router, p.scm, p.helmService, p.gitService, p.config, Options{
+		APITokens:      []string{"token"},
+		RequestTimeout: time.Nanosecond,
+	})
+
+	r := httptest.NewRequest(http.MethodPost, "/api/selfcheck", strings.NewReader(`{"branch":"master"}`))
+	r.Header.Set("Authorization", "Bearer token")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+
+	// The request timeout would have cut the check off with 503
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("status = %d, want 422, body %s", w.Code, w.Body)
+	}
+	var response struct {
+		Passed int                               `json:"passed"`
+		Failed int                               `json:"failed"`
+		Groups map[string]map[string]interface{} `json:"groups"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Passed != 2 || response.Failed != 1 {
+		t.Errorf("passed %d and failed %d groups, want 2 and 1", response.Passed, response.Failed)
+	}
+	if broken := response.Groups["broken"]; broken["phase"] != phaseCloneValues {
+		t.Errorf("broken group = %v, want a clone_values error", broken)
+	}
+	if n := p.commits(t, "acme", "deploy"); n != 1 {
+		t.Errorf("acme/deploy has %d commits, want nothing pushed", n)
+	}
+}
@@ -0,0 +1,225 @@
+package api
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/lei/yaml-helm-pipeline/internal/config"
+	"github.com/lei/yaml-helm-pipeline/internal/history"
+)
+
+// squashSet collects the output of the groups committed by one request so
+// that every output repository gets a single commit instead of one per group
+type squashSet struct {
+	h      *Handler
+	mu     sync.Mutex
+	ws     *workspace
+	repos  map[string]*squashRepo
+	order  []string
+	format *config.CommitFormat // Overrides the configured commit format
+}
+
+// squashRepo is one output repository branch shared by squashed groups
+type squashRepo struct {
+	owner string
+	repo  string
+	path  string
+	err   error // Set when a group's write failed and the clone was reset
+
+	groups []*squashGroup
+}
+
+// squashGroup is a group whose output was written into a shared clone and
+// is waiting for the squashed commit
+type squashGroup struct {
+	group   *config.ConfigGroup
+	branch  string
+	chart   *chartSource
+	changes map[string]interface{}
+	result  map[string]interface{}
+}
+
+// newSquashSet creates an empty set of squashed output repositories
+func (h *Handler) newSquashSet(format *config.CommitFormat) *squashSet {
+	return &squashSet{h: h, repos: make(map[string]*squashRepo), format: format}
+}
+
+// squashKey identifies the output repository branch of a group
+func squashKey(output config.OutputRepo) string {
+	return output.Owner + "/" + output.Repo + "@" + output.Branch
+}
+
+// checkout returns the shared clone of a group's output repository, cloning
+// it for the first group that targets it
+func (s *squashSet) checkout(group *config.ConfigGroup) (string, error) {
+	if group.OutputRepo.ForkOwner != "" {
+		return "", fmt.Errorf("squash is not supported for groups with fork_owner")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := squashKey(group.OutputRepo)
+	if repo, ok := s.repos[key]; ok {
+		if repo.err != nil {
+			return "", repo.err
+		}
+		return repo.path, nil
+	}
+
+	if s.ws == nil {
+		ws, err := s.h.newWorkspace("squash")
+		if err != nil {
+			return "", err
+		}
+		s.ws = ws
+	}
+
+	path, err := s.h.cloneOutputRepository(group, s.ws)
+	if err != nil {
+		return "", err
+	}
+
+	s.repos[key] = &squashRepo{
+		owner: group.OutputRepo.Owner,
+		repo:  group.OutputRepo.Repo,
+		path:  path,
+	}
+	s.order = append(s.order, key)
+	return path, nil
+}
+
+// add records a group whose output was written into its shared clone
+func (s *squashSet) add(group *config.ConfigGroup, pending *squashGroup) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pending.group = group
+	repo := s.repos[squashKey(group.OutputRepo)]
+	repo.groups = append(repo.groups, pending)
+}
+
+// fail marks a group's shared clone as unusable after a failed write reset
+// it, since the reset also discarded the output of earlier groups
+func (s *squashSet) fail(group *config.ConfigGroup, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if repo, ok := s.repos[squashKey(group.OutputRepo)]; ok {
+		repo.err = inPhase(phaseWrite, fmt.Errorf("output repository %s/%s was reset after group %s failed: %w",
+			repo.owner, repo.repo, group.Name, err))
+	}
+}
+
+// commit makes one commit per output repository holding every squashed
+// group's output and pushes it. The result of each group is updated with
+// the commit, and the names of the groups whose commit failed are returned
+// with their errors.
+func (s *squashSet) commit(message string) map[string]error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	failures := make(map[string]error)
+	for _, key := range s.order {
+		repo := s.repos[key]
+		if len(repo.groups) == 0 {
+			continue
+		}
+
+		if repo.err != nil {
+			for _, pending := range repo.groups {
+				failures[pending.group.Name] = repo.err
+			}
+			continue
+		}
+
+		if err := s.conflict(repo, message); err != nil {
+			for _, pending := range repo.groups {
+				failures[pending.group.Name] = err
+			}
+			continue
+		}
+
+		var names, sources []string
+		seen := make(map[string]bool)
+		for _, pending := range repo.groups {
+			names = append(names, pending.group.Name)
+			if source := pending.chart.description; !seen[source] {
+				seen[source] = true
+				sources = append(sources, source)
+			}
+		}
+
+		// The groups agree on the format, chart versions, and push strategy
+		first := repo.groups[0]
+		format := s.h.commitFormat(first.group, s.format)
+		finalMessage := buildCommitMessage(format, expandChartVersions(message, first.chart),
+			strings.Join(sources, ", "), strings.Join(names, ", "))
+
+		commitSHA, err := s.h.gitService.CommitAndPush(repo.path, finalMessage, forceWithLease(first.group))
+		if err != nil {
+			err = inPhase(phaseCommit, fmt.Errorf("failed to commit and push squashed changes to %s/%s: %w", repo.owner, repo.repo, err))
+			for _, pending := range repo.groups {
+				failures[pending.group.Name] = err
+			}
+			continue
+		}
+
+		for _, pending := range repo.groups {
+			pending.result["squashed_groups"] = names
+			if commitSHA == "" {
+				noCommitResult(pending.result)
+				continue
+			}
+
+			s.h.history.Add(history.Entry{
+				Group:      pending.group.Name,
+				Branch:     pending.branch,
+				Repository: repo.owner + "/" + repo.repo,
+				CommitSHA:  commitSHA,
+				Changes:    pending.changes,
+			})
+
+			pending.result["message"] = "Changes committed and pushed successfully"
+			s.h.addCommitLinks(pending.result, pending.group, repo.owner, commitSHA)
+		}
+	}
+
+	return failures
+}
+
+// conflict returns an error when the groups sharing an output repository
+// would make different commits: with different commit formats, different
+// chart versions in the message, or different push strategies. A single
+// commit can't honor them all, so none is made.
+func (s *squashSet) conflict(repo *squashRepo, message string) error {
+	first := repo.groups[0]
+	format := s.h.commitFormat(first.group, s.format)
+	versions := expandChartVersions(message, first.chart)
+
+	for _, pending := range repo.groups[1:] {
+		var differs string
+		switch {
+		case !reflect.DeepEqual(s.h.commitFormat(pending.group, s.format), format):
+			differs = "commit formats"
+		case expandChartVersions(message, pending.chart) != versions:
+			differs = "chart versions in the commit message"
+		case forceWithLease(pending.group) != forceWithLease(first.group):
+			differs = "push strategies"
+		default:
+			continue
+		}
+		return inPhase(phaseConfig, fmt.Errorf("groups %s and %s can't be squashed into one commit to %s/%s: they have different %s",
+			first.group.Name, pending.group.Name, repo.owner, repo.repo, differs))
+	}
+	return nil
+}
+
+// cleanup removes the shared clones
+func (s *squashSet) cleanup() {
+	if s.ws != nil {
+		s.ws.cleanup()
+	}
+}
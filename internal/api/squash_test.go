@@ -0,0 +1,153 @@
+package api
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/lei/yaml-helm-pipeline/internal/config"
+)
+
+// newSharedOutputPipeline returns a pipeline with groups web and api
+// committing to acme/deploy
+func newSharedOutputPipeline(t *testing.T) *testPipeline {
+	t.Helper()
+
+	p := newTestPipeline(t, pipelineGroup("web", "deploy"), pipelineGroup("api", "deploy"))
+	p.addRepo(t, "acme", "values", map[string]string{
+		"web.yaml": configMap("web", "one"),
+		"api.yaml": configMap("api", "two"),
+	})
+	p.addRepo(t, "acme", "deploy", map[string]string{"README.md": "deploy\n"})
+	return p
+}
+
+func TestCommitSquash(t *testing.T) {
+	p := newSharedOutputPipeline(t)
+
+	code, response := p.commitChanges(t, `{"branch":"master","message":"Update","squash":true}`)
+	if code != http.StatusOK {
+		t.Fatalf("CommitChanges() status = %d, response %v", code, response)
+	}
+	results := response["results"].(map[string]interface{})
+	for _, name := range []string{"web", "api"} {
+		result := results[name].(map[string]interface{})
+		if got := result["squashed_groups"]; !reflect.DeepEqual(got, []interface{}{"web", "api"}) {
+			t.Errorf("%s squashed_groups = %v, want both groups", name, got)
+		}
+		if result["commit_sha"] == nil {
+			t.Errorf("%s result = %v, want the squashed commit", name, result)
+		}
+	}
+	if n := p.commits(t, "acme", "deploy"); n != 2 {
+		t.Errorf("acme/deploy has %d commits, want a single commit on top of the first", n)
+	}
+}
+
+func TestCommitSquashPerOutputRepository(t *testing.T) {
+	p := newTestPipeline(t, pipelineGroup("web", "deploy"), pipelineGroup("api", "deploy"), pipelineGroup("jobs", "batch"))
+	p.addRepo(t, "acme", "values", map[string]string{
+		"web.yaml":  configMap("web", "one"),
+		"api.yaml":  configMap("api", "two"),
+		"jobs.yaml": configMap("jobs", "three"),
+	})
+	p.addRepo(t, "acme", "deploy", map[string]string{"README.md": "deploy\n"})
+	p.addRepo(t, "acme", "batch", map[string]string{"README.md": "batch\n"})
+
+	code, response := p.commitChanges(t, `{"branch":"master","message":"Update","squash":true}`)
+	if code != http.StatusOK {
+		t.Fatalf("CommitChanges() status = %d, response %v", code, response)
+	}
+	if got := groupResult(t, response, "jobs")["squashed_groups"]; !reflect.DeepEqual(got, []interface{}{"jobs"}) {
+		t.Errorf("jobs squashed_groups = %v, want only jobs", got)
+	}
+	if got := groupResult(t, response, "api")["squashed_groups"]; !reflect.DeepEqual(got, []interface{}{"web", "api"}) {
+		t.Errorf("api squashed_groups = %v, want web and api", got)
+	}
+	for _, repo := range []string{"deploy", "batch"} {
+		if n := p.commits(t, "acme", repo); n != 2 {
+			t.Errorf("acme/%s has %d commits, want a single commit on top of the first", repo, n)
+		}
+	}
+	if got := p.file(t, "acme", "batch", "jobs/generated.yaml"); got != configMap("jobs", "three") {
+		t.Errorf("jobs/generated.yaml = %q, want the jobs output", got)
+	}
+}
+
+func TestCommitSquashRejectsConflictingGroups(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+		setup   func(web *config.ConfigGroup)
+		differs string
+	}{
+		{"commit format", "Update", func(web *config.ConfigGroup) {
+			web.CommitFormat = &config.CommitFormat{Style: config.CommitStyleConventional}
+		}, "different commit formats"},
+		{"chart version", "Update to {{chart_version}}", func(web *config.ConfigGroup) {
+			web.TemplateRepo = &config.TemplateRepo{Owner: "acme", Repo: "charts-next"}
+		}, "different chart versions in the commit message"},
+		{"push strategy", "Update", func(web *config.ConfigGroup) {
+			web.OutputRepo.PushStrategy = config.PushStrategyForceWithLease
+		}, "different push strategies"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newSharedOutputPipeline(t)
+			p.addRepo(t, "acme", "charts-next", map[string]string{
+				"Chart.yaml":         "apiVersion: v2\nname: app\nversion: 2.0.0\n",
+				"templates/.gitkeep": "",
+			})
+			tt.setup(&p.config.Groups[0])
+
+			code, response := p.commitChanges(t, `{"branch":"master","message":"`+tt.message+`","squash":true}`)
+			if code != http.StatusOK {
+				t.Fatalf("CommitChanges() status = %d, response %v", code, response)
+			}
+			for _, name := range []string{"web", "api"} {
+				result := groupResult(t, response, name)
+				if err, _ := result["error"].(string); !strings.Contains(err, tt.differs) || result["phase"] != phaseConfig {
+					t.Errorf("%s result = %v, want %s reported in phase %s", name, result, tt.differs, phaseConfig)
+				}
+			}
+			if n := p.commits(t, "acme", "deploy"); n != 1 {
+				t.Errorf("acme/deploy has %d commits, want nothing pushed", n)
+			}
+		})
+	}
+
+	// A commit format given in the request applies to every group alike
+	p := newSharedOutputPipeline(t)
+	p.config.Groups[0].CommitFormat = &config.CommitFormat{Style: config.CommitStyleConventional}
+	code, response := p.commitChanges(t, `{"branch":"master","message":"Update","squash":true,"commit_format":{"style":"suffix"}}`)
+	if code != http.StatusOK || p.commits(t, "acme", "deploy") != 2 {
+		t.Errorf("squash with a requested commit format = %d %v, want one commit", code, response)
+	}
+}
+
+func TestSquashCommitWithoutChanges(t *testing.T) {
+	p := newSharedOutputPipeline(t)
+	group := pipelineGroup("web", "deploy")
+
+	s := p.newSquashSet(nil)
+	defer s.cleanup()
+	if _, err := s.checkout(&group); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing was written into the clone, so there is nothing to commit
+	result := map[string]interface{}{"content_changed": true}
+	s.add(&group, &squashGroup{chart: &chartSource{}, result: result})
+	if failures := s.commit("Update"); len(failures) != 0 {
+		t.Fatalf("commit() failures = %v", failures)
+	}
+
+	if result["content_changed"] != false || result["commit_sha"] != nil {
+		t.Errorf("result = %v, want no changes reported", result)
+	}
+	if !strings.HasPrefix(result["message"].(string), "No changes detected") {
+		t.Errorf("message = %q, want no changes detected", result["message"])
+	}
+}
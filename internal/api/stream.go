@@ -0,0 +1,236 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// eventWriter writes server-sent events, flushing each one to the client
+type eventWriter struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+}
+
+// send writes a named event with a JSON payload
+func (e *eventWriter) send(event string, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(e.w, "event: %s\ndata: %s\n\n", event, payload); err != nil {
+		return err
+	}
+	e.flusher.Flush()
+	return nil
+}
+
+// sendFinish writes the "finish" event of a group that succeeded
+func (e *eventWriter) sendFinish(groupName string, result map[string]interface{}) error {
+	return e.send("finish", map[string]interface{}{
+		"group":  groupName,
+		"result": result,
+	})
+}
+
+// sendError writes the "error" event of a group that failed
+func (e *eventWriter) sendError(groupName string, err error) error {
+	payload := errorResult(err)
+	payload["group"] = groupName
+	return e.send("error", payload)
+}
+
+// CommitStream commits groups like CommitChanges, streaming progress as
+// server-sent events: "start" before each group, "finish" or "error" after
+// it, and a final "summary". Takes the same JSON body as CommitChanges,
+// including squash and all_or_nothing, but not ?from_preview. It is a POST
+// so that clients can send the body and their Authorization header with
+// fetch, which EventSource can't. Processing stops when the client
+// disconnects.
+func (h *Handler) CommitStream(w http.ResponseWriter, r *http.Request) {
+	var req CommitRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.Branch == "" {
+		http.Error(w, "Branch is required", http.StatusBadRequest)
+		return
+	}
+
+	if req.Message == "" {
+		http.Error(w, "Message is required", http.StatusBadRequest)
+		return
+	}
+
+	if !h.currentConfig().BranchAllowed(req.Branch) {
+		http.Error(w, fmt.Sprintf("Commits from branch %s are not allowed", req.Branch), http.StatusForbidden)
+		return
+	}
+
+	if req.CommitFormat != nil {
+		if err := req.CommitFormat.Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// If no groups specified, use all groups the token may commit
+	selectedGroups := req.Groups
+	if len(selectedGroups) == 0 {
+		selectedGroups = h.groupNames(r, true)
+	} else if forbidGroups(w, r, selectedGroups) {
+		return
+	}
+
+	if len(selectedGroups) == 0 {
+		http.Error(w, "No configuration groups available", http.StatusInternalServerError)
+		return
+	}
+
+	allOrNothing := req.AllOrNothing || r.URL.Query().Get("all_or_nothing") == "true"
+	squash := req.Squash || r.URL.Query().Get("squash") == "true"
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	events := &eventWriter{w: w, flusher: flusher}
+
+	// The request context is cancelled when the client goes away, which
+	// aborts the group in progress
+	ctx := r.Context()
+
+	shared := h.newSharedValues()
+	defer shared.cleanup()
+	renders := newRenderCache()
+
+	// Render every group up front so a failure stops all pushes, and commit
+	// those renders. Each group emits a "rendered" or "error" event, and
+	// only the summary follows when one failed.
+	var prerendered map[string]*groupRender
+	if allOrNothing {
+		failed := 0
+		prerendered = make(map[string]*groupRender)
+		for _, groupName := range selectedGroups {
+			if ctx.Err() != nil {
+				return
+			}
+
+			out, err := h.renderForCommit(ctx, groupName, processOptions{
+				templateRepoBranch: req.Branch,
+				shared:             shared,
+				renders:            renders,
+			})
+			if ctx.Err() != nil {
+				return
+			}
+
+			prerendered[groupName] = out
+			if err != nil {
+				failed++
+				err = events.sendError(groupName, err)
+			} else {
+				err = events.send("rendered", map[string]interface{}{"group": groupName})
+			}
+			if err != nil {
+				return
+			}
+		}
+
+		if failed > 0 {
+			events.send("summary", map[string]interface{}{
+				"branch":    req.Branch,
+				"total":     len(selectedGroups),
+				"succeeded": 0,
+				"failed":    failed,
+				"error":     "Nothing was pushed because at least one group failed",
+			})
+			return
+		}
+	}
+
+	var squashed *squashSet
+	if squash {
+		squashed = h.newSquashSet(req.CommitFormat)
+		defer squashed.cleanup()
+	}
+
+	// Squashed groups finish when their output repository's commit is pushed
+	pending := make(map[string]map[string]interface{})
+
+	succeeded, failed := 0, 0
+	for _, groupName := range selectedGroups {
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err := events.send("start", map[string]interface{}{"group": groupName}); err != nil {
+			return
+		}
+
+		result, err := h.processConfigGroup(ctx, groupName, processOptions{
+			templateRepoBranch: req.Branch,
+			commitMessage:      req.Message,
+			commitFormat:       req.CommitFormat,
+			shared:             shared,
+			renders:            renders,
+			squash:             squashed,
+			previewed:          prerendered[groupName],
+		})
+		if ctx.Err() != nil {
+			return
+		}
+
+		switch {
+		case err != nil:
+			failed++
+			err = events.sendError(groupName, err)
+		case squashed != nil:
+			pending[groupName] = result
+		default:
+			succeeded++
+			err = events.sendFinish(groupName, result)
+		}
+		if err != nil {
+			return
+		}
+	}
+
+	// Commit the squashed groups, one commit per output repository
+	if squashed != nil {
+		failures := squashed.commit(req.Message)
+		for _, groupName := range selectedGroups {
+			result, ok := pending[groupName]
+			if !ok {
+				continue
+			}
+
+			var err error
+			if failure := failures[groupName]; failure != nil {
+				failed++
+				err = events.sendError(groupName, failure)
+			} else {
+				succeeded++
+				err = events.sendFinish(groupName, result)
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	events.send("summary", map[string]interface{}{
+		"branch":    req.Branch,
+		"total":     len(selectedGroups),
+		"succeeded": succeeded,
+		"failed":    failed,
+	})
+}
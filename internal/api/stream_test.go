@@ -0,0 +1,173 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// streamEvent is a server-sent event read back from a stream
+type streamEvent struct {
+	name string
+	data map[string]interface{}
+}
+
+// readEvents parses the server-sent events of a stream
+func readEvents(t *testing.T, body io.Reader) []streamEvent {
+	t.Helper()
+
+	var events []streamEvent
+	var event streamEvent
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			event.name = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event.data); err != nil {
+				t.Fatalf("event %s has invalid data: %v", event.name, err)
+			}
+		case line == "":
+			events = append(events, event)
+			event = streamEvent{}
+		}
+	}
+	return events
+}
+
+// eventNames returns each event's name and group, e.g. "start web"
+func eventNames(events []streamEvent) []string {
+	var names []string
+	for _, event := range events {
+		name := event.name
+		if group, ok := event.data["group"].(string); ok {
+			name += " " + group
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+// commitStream posts a commit stream request to the pipeline and returns
+// its events
+func (p *testPipeline) commitStream(t *testing.T, body string) []streamEvent {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	p.CommitStream(w, httptest.NewRequest(http.MethodPost, "/api/commit/stream", strings.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("CommitStream() status = %d, body %s", w.Code, w.Body)
+	}
+	return readEvents(t, w.Body)
+}
+
+func TestCommitStreamEmitsEventsPerGroup(t *testing.T) {
+	p := newSharedOutputPipeline(t)
+
+	events := p.commitStream(t, `{"branch":"master","message":"Update","groups":["web","api"]}`)
+
+	want := []string{"start web", "finish web", "start api", "finish api", "summary"}
+	if got := eventNames(events); !reflect.DeepEqual(got, want) {
+		t.Fatalf("events = %v, want %v", got, want)
+	}
+	if summary := events[4].data; summary["succeeded"] != 2.0 || summary["failed"] != 0.0 {
+		t.Errorf("summary = %v, want 2 succeeded", summary)
+	}
+	if got := p.file(t, "acme", "deploy", "web/generated.yaml"); !strings.Contains(got, "value: one") {
+		t.Errorf("web/generated.yaml = %q, want the rendered output", got)
+	}
+	if n := p.commits(t, "acme", "deploy"); n != 3 {
+		t.Errorf("acme/deploy has %d commits, want one per group on top of the first", n)
+	}
+}
+
+func TestCommitStreamSquashes(t *testing.T) {
+	p := newSharedOutputPipeline(t)
+
+	events := p.commitStream(t, `{"branch":"master","message":"Update","squash":true}`)
+
+	want := []string{"start web", "start api", "finish web", "finish api", "summary"}
+	if got := eventNames(events); !reflect.DeepEqual(got, want) {
+		t.Fatalf("events = %v, want %v", got, want)
+	}
+	result := events[2].data["result"].(map[string]interface{})
+	if got := result["squashed_groups"]; !reflect.DeepEqual(got, []interface{}{"web", "api"}) {
+		t.Errorf("squashed_groups = %v, want both groups", got)
+	}
+	if n := p.commits(t, "acme", "deploy"); n != 2 {
+		t.Errorf("acme/deploy has %d commits, want a single commit on top of the first", n)
+	}
+}
+
+func TestCommitStreamAllOrNothing(t *testing.T) {
+	p := newSharedOutputPipeline(t)
+	broken := pipelineGroup("broken", "deploy")
+	p.config.Groups = append(p.config.Groups, broken)
+
+	events := p.commitStream(t, `{"branch":"master","message":"Update","all_or_nothing":true}`)
+
+	want := []string{"rendered web", "rendered api", "error broken", "summary"}
+	if got := eventNames(events); !reflect.DeepEqual(got, want) {
+		t.Fatalf("events = %v, want %v", got, want)
+	}
+	if err, _ := events[2].data["error"].(string); !strings.Contains(err, "values file broken.yaml not found") {
+		t.Errorf("error = %q, want the missing values file reported", err)
+	}
+	if phase := events[2].data["phase"]; phase != phaseCloneValues {
+		t.Errorf("error phase = %v, want %s", phase, phaseCloneValues)
+	}
+	if n := p.commits(t, "acme", "deploy"); n != 1 {
+		t.Errorf("acme/deploy has %d commits, want nothing pushed", n)
+	}
+}
+
+func TestCommitStreamRoute(t *testing.T) {
+	p := newSharedOutputPipeline(t)
+	router := chi.NewRouter()
+	SetupRoutes(router, p.scm, p.helmService, p.gitService, p.config, Options{
+		APITokens:      []string{"token"},
+		RequestTimeout: time.Nanosecond,
+	})
+
+	tests := []struct {
+		name   string
+		method string
+		token  string
+		want   int
+	}{
+		{"post", http.MethodPost, "token", http.StatusOK},
+		{"no token", http.MethodPost, "", http.StatusUnauthorized},
+		{"get", http.MethodGet, "token", http.StatusMethodNotAllowed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/api/commit/stream", strings.NewReader(`{"branch":"master","message":"Update","groups":["web"]}`))
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d", w.Code, tt.want)
+			}
+			// The request timeout would have cut the stream off before the summary
+			if tt.want == http.StatusOK {
+				events := readEvents(t, w.Body)
+				if len(events) == 0 || events[len(events)-1].name != "summary" {
+					t.Errorf("events = %v, want the stream to finish", eventNames(events))
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,154 @@
+package api
+
+import (
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/go-chi/render"
+	"github.com/lei/yaml-helm-pipeline/internal/config"
+	"gopkg.in/yaml.v3"
+)
+
+// maxUploadBytes bounds the size of the values files uploaded for a preview
+const maxUploadBytes = 10 << 20
+
+// PreviewUpload previews a group rendered with values files uploaded as
+// multipart form data in place of its values repositories. The form has the
+// "group" and "branch" fields and one or more "values" files, applied in the
+// order they are sent. Shared values, env_values, and the chart's own
+// defaults still apply.
+func (h *Handler) PreviewUpload(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadBytes)
+	if err := r.ParseMultipartForm(maxUploadBytes); err != nil {
+		http.Error(w, fmt.Sprintf("invalid upload: %v", err), http.StatusBadRequest)
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	groupName := r.FormValue("group")
+	if groupName == "" {
+		http.Error(w, "Group is required", http.StatusBadRequest)
+		return
+	}
+	if _, err := h.findConfigGroup(groupName); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if h.scopePreviews && forbidGroups(w, r, []string{groupName}) {
+		return
+	}
+
+	branch := r.FormValue("branch")
+	if branch == "" {
+		http.Error(w, "Branch is required", http.StatusBadRequest)
+		return
+	}
+
+	format := r.FormValue("format")
+	if format != "" && format != diffFormatKeys && format != diffFormatUnified {
+		http.Error(w, fmt.Sprintf("Unsupported format: %s", format), http.StatusBadRequest)
+		return
+	}
+
+	depth, err := parseDepth(r.FormValue("depth"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	groupBy := r.FormValue("group_by")
+	if groupBy != "" && groupBy != groupByResource {
+		http.Error(w, fmt.Sprintf("Unsupported group_by: %s", groupBy), http.StatusBadRequest)
+		return
+	}
+
+	uploads := r.MultipartForm.File["values"]
+	if len(uploads) == 0 {
+		http.Error(w, "At least one values file is required", http.StatusBadRequest)
+		return
+	}
+
+	// Keep the uploaded files only for as long as the preview takes
+	dir, err := os.MkdirTemp(h.gitService.WorkDir(), "pipeline-upload-")
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to create upload directory: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	valuesPaths := make([]string, 0, len(uploads))
+	names := make([]string, 0, len(uploads))
+	for i, upload := range uploads {
+		valuesPath, err := saveUploadedValues(upload, dir, i)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("values file %s: %v", upload.Filename, err), http.StatusBadRequest)
+			return
+		}
+		valuesPaths = append(valuesPaths, valuesPath)
+		names = append(names, upload.Filename)
+	}
+
+	result, err := h.processConfigGroup(r.Context(), groupName, processOptions{
+		templateRepoBranch: branch,
+		previewOnly:        true,
+		diffFormat:         format,
+		includeRendered:    r.FormValue("rendered") == "true",
+		keyDepth:           depth,
+		showValues:         r.FormValue("show_values") == "true",
+		groupBy:            groupBy,
+		valuesFiles:        valuesPaths,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	render.JSON(w, r, map[string]interface{}{
+		"group":        groupName,
+		"branch":       branch,
+		"values_files": names,
+		"result":       result,
+	})
+}
+
+// saveUploadedValues writes the i-th uploaded values file into dir, checking
+// that it parses, and returns the path helm should read it from. TOML files
+// are converted to YAML like values files from a repository.
+func saveUploadedValues(upload *multipart.FileHeader, dir string, i int) (string, error) {
+	name := filepath.Base(upload.Filename)
+	valuesFormat := config.ValuesRepo{Path: name}.Format()
+	if valuesFormat == "" {
+		return "", fmt.Errorf("unsupported values file type")
+	}
+
+	file, err := upload.Open()
+	if err != nil {
+		return "", fmt.Errorf("failed to read upload: %w", err)
+	}
+	defer file.Close()
+
+	content, err := io.ReadAll(file)
+	if err != nil {
+		return "", fmt.Errorf("failed to read upload: %w", err)
+	}
+
+	valuesPath := filepath.Join(dir, fmt.Sprintf("%d-%s", i, name))
+	if err := os.WriteFile(valuesPath, content, 0600); err != nil {
+		return "", fmt.Errorf("failed to save upload: %w", err)
+	}
+
+	if valuesFormat == config.ValuesFormatTOML {
+		return convertTOMLValues(valuesPath, filepath.Join(dir, fmt.Sprintf("%d-values.yaml", i)))
+	}
+
+	// YAML and JSON are passed to helm as is, once they are known to parse
+	var values map[string]interface{}
+	if err := yaml.Unmarshal(content, &values); err != nil {
+		return "", fmt.Errorf("invalid values: %w", err)
+	}
+	return valuesPath, nil
+}
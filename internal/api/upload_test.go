@@ -0,0 +1,132 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// previewUpload posts a multipart preview upload with the given fields and
+// values files, which are sent in the order of names
+func (p *testPipeline) previewUpload(t *testing.T, fields map[string]string, names []string, files map[string]string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	for name, value := range fields {
+		form.WriteField(name, value)
+	}
+	for _, name := range names {
+		part, err := form.CreateFormFile("values", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write([]byte(files[name]))
+	}
+	form.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/api/preview/upload", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	w := httptest.NewRecorder()
+	p.PreviewUpload(w, req)
+	return w
+}
+
+func TestPreviewUpload(t *testing.T) {
+	p := newTestPipeline(t, pipelineGroup("web", "deploy"))
+	p.addRepo(t, "acme", "values", map[string]string{"web.yaml": configMap("web", "one")})
+	p.addRepo(t, "acme", "deploy", map[string]string{"README.md": "deploy\n"})
+
+	// The last values file wins, so the uploaded candidate replaces the repo's
+	w := p.previewUpload(t, map[string]string{"group": "web", "branch": "master", "rendered": "true"},
+		[]string{"base.yaml", "candidate.yaml"},
+		map[string]string{"base.yaml": "replicas: 1\n", "candidate.yaml": configMap("web", "uploaded")})
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body)
+	}
+	var response struct {
+		Group       string
+		ValuesFiles []string `json:"values_files"`
+		Result      map[string]interface{}
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Group != "web" || strings.Join(response.ValuesFiles, ",") != "base.yaml,candidate.yaml" {
+		t.Errorf("response = %+v, want both uploads for web", response)
+	}
+	if rendered, _ := response.Result["rendered"].(string); rendered != configMap("web", "uploaded") {
+		t.Errorf("rendered = %q, want the uploaded values", rendered)
+	}
+	if n := p.commits(t, "acme", "deploy"); n != 1 {
+		t.Errorf("acme/deploy has %d commits, want a preview to push nothing", n)
+	}
+
+	// Uploads are removed once the preview completes
+	entries, err := os.ReadDir(os.Getenv("TMPDIR"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), "pipeline-upload-") {
+			t.Errorf("upload directory %s was left behind", entry.Name())
+		}
+	}
+}
+
+func TestPreviewUploadIsNotTemplated(t *testing.T) {
+	t.Setenv("PIPELINE_VALUES_DEPLOY_ENV", "prod")
+
+	group := pipelineGroup("web", "deploy")
+	group.TemplateValues = true
+	p := newTestPipeline(t, group)
+	p.addRepo(t, "acme", "deploy", map[string]string{"README.md": "deploy\n"})
+
+	uploaded := configMap("web", `"{{ .Env.PIPELINE_VALUES_DEPLOY_ENV }}"`)
+	w := p.previewUpload(t, map[string]string{"group": "web", "branch": "master", "rendered": "true"},
+		[]string{"web.yaml"}, map[string]string{"web.yaml": uploaded})
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body)
+	}
+	if strings.Contains(w.Body.String(), "prod") {
+		t.Errorf("response %s, want the uploaded values left verbatim", w.Body)
+	}
+}
+
+func TestPreviewUploadRejectsBadRequests(t *testing.T) {
+	p := newTestPipeline(t, pipelineGroup("web", "deploy"))
+
+	tests := []struct {
+		name   string
+		fields map[string]string
+		files  map[string]string
+		want   int
+	}{
+		{"missing group", map[string]string{"branch": "master"}, map[string]string{"web.yaml": "a: 1\n"}, http.StatusBadRequest},
+		{"unknown group", map[string]string{"group": "missing", "branch": "master"}, map[string]string{"web.yaml": "a: 1\n"}, http.StatusNotFound},
+		{"missing branch", map[string]string{"group": "web"}, map[string]string{"web.yaml": "a: 1\n"}, http.StatusBadRequest},
+		{"no values files", map[string]string{"group": "web", "branch": "master"}, nil, http.StatusBadRequest},
+		{"unsupported file type", map[string]string{"group": "web", "branch": "master"}, map[string]string{"web.txt": "a: 1\n"}, http.StatusBadRequest},
+		{"invalid values", map[string]string{"group": "web", "branch": "master"}, map[string]string{"web.yaml": "a: [1\n"}, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var names []string
+			for name := range tt.files {
+				names = append(names, name)
+			}
+			if w := p.previewUpload(t, tt.fields, names, tt.files); w.Code != tt.want {
+				t.Errorf("status = %d, want %d (body %s)", w.Code, tt.want, w.Body)
+			}
+		})
+	}
+	if n := p.helmRuns(t); n != 0 {
+		t.Errorf("helm ran %d times for rejected uploads", n)
+	}
+}
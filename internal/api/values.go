@@ -0,0 +1,288 @@
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+
+	"github.com/lei/yaml-helm-pipeline/internal/manifest"
+	"github.com/lei/yaml-helm-pipeline/internal/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// sharedValues clones the configuration's shared values repositories on
+// first use and hands the same checkouts to every group processed afterwards
+type sharedValues struct {
+	h    *Handler
+	once sync.Once
+
+	ws     *workspace
+	values []string
+	err    error
+}
+
+// newSharedValues creates a lazily cloned set of shared values files
+func (h *Handler) newSharedValues() *sharedValues {
+	return &sharedValues{h: h}
+}
+
+// paths returns the shared values files, cloning them on the first call
+func (s *sharedValues) paths() ([]string, error) {
+	s.once.Do(func() {
+		repos := s.h.currentConfig().SharedValuesRepos
+		if len(repos) == 0 {
+			return
+		}
+
+		s.ws, s.err = s.h.newWorkspace("shared")
+		if s.err != nil {
+			return
+		}
+
+		s.values, s.err = s.h.cloneValuesRepositories(repos, s.ws, "")
+		if s.err != nil {
+			s.err = fmt.Errorf("shared values: %w", s.err)
+		}
+	})
+	return s.values, s.err
+}
+
+// cleanup removes the shared clones
+func (s *sharedValues) cleanup() {
+	if s.ws != nil {
+		s.ws.cleanup()
+	}
+}
+
+// valuesEnvPrefix starts the names of the environment variables values
+// templates may read. Every other variable, such as the server's tokens,
+// stays out of reach of values files and so out of the rendered output.
+const valuesEnvPrefix = "PIPELINE_VALUES_"
+
+// valuesTemplateData is the context values files are expanded with when a
+// group enables TemplateValues
+type valuesTemplateData struct {
+	Group  string
+	Branch string
+	Env    map[string]string
+}
+
+// expandValuesFiles runs each values file through text/template and writes
+// the results into the workspace, returning the expanded files' paths.
+// Files listed in verbatim are returned as they are. Referencing an
+// environment variable that isn't set is an error.
+func expandValuesFiles(paths []string, ws *workspace, data valuesTemplateData, verbatim []string) ([]string, error) {
+	expanded := make([]string, len(paths))
+	for i, path := range paths {
+		if slices.Contains(verbatim, path) {
+			expanded[i] = path
+			continue
+		}
+
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read values file: %w", err)
+		}
+
+		tmpl, err := template.New(filepath.Base(path)).
+			Option("missingkey=error").
+			Funcs(template.FuncMap{"env": envFunc(data.Env)}).
+			Parse(string(content))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse values template %s: %w", filepath.Base(path), err)
+		}
+
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, data); err != nil {
+			return nil, fmt.Errorf("failed to expand values template %s: %w", filepath.Base(path), err)
+		}
+
+		expanded[i] = ws.path(fmt.Sprintf("expanded-%d-%s", i, filepath.Base(path)))
+		if err := os.WriteFile(expanded[i], buf.Bytes(), 0600); err != nil {
+			return nil, fmt.Errorf("failed to write expanded values file: %w", err)
+		}
+	}
+
+	return expanded, nil
+}
+
+// envFunc returns the template function {{ env "NAME" }}, which fails for
+// variables that aren't set or aren't available to values templates
+func envFunc(env map[string]string) func(string) (string, error) {
+	return func(name string) (string, error) {
+		if !strings.HasPrefix(name, valuesEnvPrefix) {
+			return "", fmt.Errorf("environment variable %s is not available to values templates, only %s* variables are", name, valuesEnvPrefix)
+		}
+		value, ok := env[name]
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		return value, nil
+	}
+}
+
+// valuesEnviron returns the environment variables values templates may
+// read, those whose names start with valuesEnvPrefix
+func valuesEnviron() map[string]string {
+	env := make(map[string]string)
+	for _, entry := range os.Environ() {
+		name, value, ok := strings.Cut(entry, "=")
+		if ok && strings.HasPrefix(name, valuesEnvPrefix) {
+			env[name] = value
+		}
+	}
+	return env
+}
+
+// convertTOMLValues converts a TOML values file into a YAML file at dest and
+// returns dest
+func convertTOMLValues(path, dest string) (string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read values file: %w", err)
+	}
+
+	values, err := toml.Decode(content)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse TOML values: %w", err)
+	}
+
+	converted, err := yaml.Marshal(values)
+	if err != nil {
+		return "", fmt.Errorf("failed to convert TOML values: %w", err)
+	}
+
+	if err := os.WriteFile(dest, converted, 0600); err != nil {
+		return "", fmt.Errorf("failed to write converted values file: %w", err)
+	}
+	return dest, nil
+}
+
+// writeTempValuesFile writes values content to a temporary file in dir and
+// returns its path. The caller is responsible for removing the file.
+func writeTempValuesFile(dir, prefix string, content []byte) (string, error) {
+	file, err := os.CreateTemp(dir, prefix+"-*.yaml")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temporary values file: %w", err)
+	}
+	defer file.Close()
+
+	if _, err := file.Write(content); err != nil {
+		os.Remove(file.Name())
+		return "", fmt.Errorf("failed to write temporary values file: %w", err)
+	}
+
+	return file.Name(), nil
+}
+
+// inlineValues converts inline values from a request, given either as an
+// object or as a raw YAML string, into YAML content
+func inlineValues(values interface{}) ([]byte, error) {
+	if raw, ok := values.(string); ok {
+		var parsed map[string]interface{}
+		if err := yaml.Unmarshal([]byte(raw), &parsed); err != nil {
+			return nil, fmt.Errorf("invalid inline values: %w", err)
+		}
+		return []byte(raw), nil
+	}
+
+	if _, ok := values.(map[string]interface{}); !ok {
+		return nil, fmt.Errorf("inline values must be an object or a YAML string")
+	}
+
+	content, err := yaml.Marshal(values)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode inline values: %w", err)
+	}
+	return content, nil
+}
+
+// envValues builds values content from a mapping of dotted key paths to
+// environment variable names. Every referenced variable must be set.
+func envValues(mapping map[string]string) ([]byte, error) {
+	paths := make([]string, 0, len(mapping))
+	for path := range mapping {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	values := make(map[string]interface{})
+	for _, path := range paths {
+		name := mapping[path]
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return nil, fmt.Errorf("environment variable %s for value %s is not set", name, path)
+		}
+
+		if err := setValuePath(values, path, value); err != nil {
+			return nil, err
+		}
+	}
+
+	content, err := yaml.Marshal(values)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode environment values: %w", err)
+	}
+	return content, nil
+}
+
+// setValuePath sets a value at a dotted key path, creating nested maps as needed
+func setValuePath(values map[string]interface{}, path, value string) error {
+	keys := strings.Split(path, ".")
+	current := values
+
+	for i, key := range keys {
+		if key == "" {
+			return fmt.Errorf("invalid value path: %s", path)
+		}
+
+		if i == len(keys)-1 {
+			if _, exists := current[key]; exists {
+				return fmt.Errorf("value path %s conflicts with another path", path)
+			}
+			current[key] = value
+			return nil
+		}
+
+		next, exists := current[key]
+		if !exists {
+			nested := make(map[string]interface{})
+			current[key] = nested
+			current = nested
+			continue
+		}
+
+		nested, ok := next.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("value path %s conflicts with another path", path)
+		}
+		current = nested
+	}
+
+	return nil
+}
+
+// redactValues masks the sensitive keys of merged values
+func redactValues(redactor *manifest.Redactor, values map[string]interface{}) (map[string]interface{}, error) {
+	content, err := yaml.Marshal(values)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode values: %w", err)
+	}
+
+	redacted, err := redactor.Redact(content)
+	if err != nil {
+		return nil, fmt.Errorf("failed to redact values: %w", err)
+	}
+
+	result := make(map[string]interface{})
+	if err := yaml.Unmarshal(redacted, &result); err != nil {
+		return nil, fmt.Errorf("failed to decode redacted values: %w", err)
+	}
+	return result, nil
+}
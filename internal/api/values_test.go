@@ -0,0 +1,346 @@
+package api
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/lei/yaml-helm-pipeline/internal/config"
+	"gopkg.in/yaml.v3"
+)
+
+func TestEnvValues(t *testing.T) {
+	t.Setenv("DB_PASSWORD", "s3cret")
+	t.Setenv("DB_HOST", "db.internal")
+	t.Setenv("REPLICAS", "3")
+
+	got, err := envValues(map[string]string{
+		"db.password":       "DB_PASSWORD",
+		"db.host":           "DB_HOST",
+		"app.scale.replica": "REPLICAS",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "app:\n    scale:\n        replica: \"3\"\ndb:\n    host: db.internal\n    password: s3cret\n"
+	if string(got) != want {
+		t.Errorf("envValues() = %q, want %q", got, want)
+	}
+}
+
+func TestEnvValuesErrors(t *testing.T) {
+	t.Setenv("DB_PASSWORD", "s3cret")
+	t.Setenv("PIPELINE_TEST_UNSET", "")
+	os.Unsetenv("PIPELINE_TEST_UNSET")
+
+	tests := []struct {
+		name    string
+		mapping map[string]string
+		wantErr string
+	}{
+		{"unset variable", map[string]string{"db.password": "PIPELINE_TEST_UNSET"}, "PIPELINE_TEST_UNSET"},
+		{"empty key", map[string]string{"db..password": "DB_PASSWORD"}, "invalid value path"},
+		{"leaf under a value", map[string]string{"db": "DB_PASSWORD", "db.password": "DB_PASSWORD"}, "conflicts"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := envValues(tt.mapping)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("envValues() error = %v, want it to mention %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestEnvValuesPrecedence(t *testing.T) {
+	t.Setenv("WEB_VALUE", "from-env")
+
+	group := pipelineGroup("web", "deploy")
+	group.EnvValues = map[string]string{"data.value": "WEB_VALUE"}
+	p := newTestPipeline(t, group)
+	p.addRepo(t, "acme", "values", map[string]string{"web.yaml": configMap("web", "one")})
+	p.addRepo(t, "acme", "deploy", map[string]string{"README.md": "deploy\n"})
+
+	w := p.previewChanges(`{"branch":"master","values":{"web":{"data":{"value":"inline"}}}}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body)
+	}
+
+	// Environment values go after the repo values and before inline values
+	log, err := os.ReadFile(p.runs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	order := regexp.MustCompile(`-f \S*/web\.yaml -f \S*/values-env-\S*\.yaml -f \S*/values-overlay-\S*\.yaml`)
+	if !order.Match(log) {
+		t.Errorf("helm runs %q, want repo, environment, then inline values", log)
+	}
+}
+
+func TestEnvValuesUnsetFailsRender(t *testing.T) {
+	t.Setenv("PIPELINE_TEST_UNSET", "")
+	os.Unsetenv("PIPELINE_TEST_UNSET")
+
+	group := pipelineGroup("web", "deploy")
+	group.EnvValues = map[string]string{"db.password": "PIPELINE_TEST_UNSET"}
+	p := newTestPipeline(t, group)
+	p.addRepo(t, "acme", "values", map[string]string{"web.yaml": configMap("web", "one")})
+	p.addRepo(t, "acme", "deploy", map[string]string{"README.md": "deploy\n"})
+
+	_, response := p.commitChanges(t, `{"branch":"master","message":"Update"}`)
+	if err, _ := groupResult(t, response, "web")["error"].(string); !strings.Contains(err, "PIPELINE_TEST_UNSET for value db.password is not set") {
+		t.Errorf("error = %q, want the unset variable named", err)
+	}
+	if n := p.helmRuns(t); n != 0 {
+		t.Errorf("helm ran %d times, want nothing rendered", n)
+	}
+}
+
+func TestSharedValuesAppliedFirst(t *testing.T) {
+	p := newTestPipeline(t, pipelineGroup("web", "deploy"), pipelineGroup("api", "deploy"))
+	p.config.SharedValuesRepos = []config.ValuesRepo{{Owner: "acme", Repo: "base", Path: "base.yaml", Branch: "master"}}
+	p.addRepo(t, "acme", "base", map[string]string{"base.yaml": "replicas: 1\n"})
+	p.addRepo(t, "acme", "values", map[string]string{
+		"web.yaml": configMap("web", "one"),
+		"api.yaml": configMap("api", "two"),
+	})
+	p.addRepo(t, "acme", "deploy", map[string]string{"README.md": "deploy\n"})
+
+	w := p.previewChanges(`{"branch":"master"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body)
+	}
+
+	// Each group's values go after the shared values, which are cloned once
+	// for the request
+	log, err := os.ReadFile(p.runs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	order := regexp.MustCompile(`-f (\S*/base\.yaml) -f \S*/(web|api)\.yaml`)
+	matches := order.FindAllStringSubmatch(string(log), -1)
+	if len(matches) != 2 {
+		t.Fatalf("helm runs %q, want the shared values first for both groups", log)
+	}
+	if matches[0][1] != matches[1][1] {
+		t.Errorf("shared values read from %s and %s, want a single clone", matches[0][1], matches[1][1])
+	}
+}
+
+// expandValues expands a single values file holding content and returns the
+// result
+func expandValues(t *testing.T, content string) (string, error) {
+	t.Helper()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "values.yaml")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ws := &workspace{root: dir}
+	expanded, err := expandValuesFiles([]string{path}, ws, valuesTemplateData{
+		Group:  "web",
+		Branch: "main",
+		Env:    valuesEnviron(),
+	}, nil)
+	if err != nil {
+		return "", err
+	}
+	data, err := os.ReadFile(expanded[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data), nil
+}
+
+func TestExpandValuesFiles(t *testing.T) {
+	t.Setenv("PIPELINE_VALUES_DEPLOY_ENV", "prod")
+
+	got, err := expandValues(t, `name: {{ .Group }}-{{ .Branch }}
+host: db.{{ .Env.PIPELINE_VALUES_DEPLOY_ENV }}.internal
+env: {{ env "PIPELINE_VALUES_DEPLOY_ENV" }}
+`)
+	if err != nil {
+		t.Fatalf("expandValuesFiles() error = %v", err)
+	}
+	want := "name: web-main\nhost: db.prod.internal\nenv: prod\n"
+	if got != want {
+		t.Errorf("expanded values = %q, want %q", got, want)
+	}
+}
+
+func TestExpandValuesFilesRefusesOtherVariables(t *testing.T) {
+	t.Setenv("GITHUB_TOKEN", "ghp_secret")
+
+	for _, content := range []string{
+		`token: {{ .Env.GITHUB_TOKEN }}`,
+		`token: {{ env "GITHUB_TOKEN" }}`,
+		`token: {{ env "PIPELINE_VALUES_UNSET" }}`,
+	} {
+		got, err := expandValues(t, content)
+		if err == nil {
+			t.Errorf("expanding %q = %q, want an error", content, got)
+			continue
+		}
+		if strings.Contains(err.Error(), "ghp_secret") {
+			t.Errorf("expanding %q leaked the variable: %v", content, err)
+		}
+	}
+}
+
+func TestExpandValuesFilesLeavesUploadsVerbatim(t *testing.T) {
+	t.Setenv("PIPELINE_VALUES_DEPLOY_ENV", "prod")
+
+	dir := t.TempDir()
+	shared := filepath.Join(dir, "shared.yaml")
+	uploaded := filepath.Join(dir, "uploaded.yaml")
+	os.WriteFile(shared, []byte(`env: {{ .Env.PIPELINE_VALUES_DEPLOY_ENV }}`), 0644)
+	os.WriteFile(uploaded, []byte(`env: {{ .Env.PIPELINE_VALUES_DEPLOY_ENV }}`), 0644)
+
+	expanded, err := expandValuesFiles([]string{shared, uploaded}, &workspace{root: dir}, valuesTemplateData{
+		Env: valuesEnviron(),
+	}, []string{uploaded})
+	if err != nil {
+		t.Fatalf("expandValuesFiles() error = %v", err)
+	}
+
+	if data, _ := os.ReadFile(expanded[0]); string(data) != "env: prod" {
+		t.Errorf("shared values = %q, want them expanded", data)
+	}
+	if expanded[1] != uploaded {
+		t.Errorf("uploaded values path = %s, want %s", expanded[1], uploaded)
+	}
+	if data, _ := os.ReadFile(expanded[1]); strings.Contains(string(data), "prod") {
+		t.Errorf("uploaded values = %q, want them left verbatim", data)
+	}
+}
+
+func TestTemplateValuesRender(t *testing.T) {
+	t.Setenv("PIPELINE_VALUES_DEPLOY_ENV", "prod")
+
+	group := pipelineGroup("web", "deploy")
+	group.TemplateValues = true
+	p := newTestPipeline(t, group)
+	p.addRepo(t, "acme", "values", map[string]string{"web.yaml": configMap("{{ .Group }}", "{{ .Env.PIPELINE_VALUES_DEPLOY_ENV }}")})
+	p.addRepo(t, "acme", "deploy", map[string]string{"README.md": "deploy\n"})
+
+	if code, response := p.commitChanges(t, `{"branch":"master","message":"Update"}`); code != http.StatusOK {
+		t.Fatalf("CommitChanges() status = %d, response %v", code, response)
+	}
+	if got := p.file(t, "acme", "deploy", "web/generated.yaml"); got != configMap("web", "prod") {
+		t.Errorf("web/generated.yaml = %q, want the values expanded before rendering", got)
+	}
+}
+
+func TestJSONAndTOMLValues(t *testing.T) {
+	tests := []struct {
+		name   string
+		values string
+	}{
+		{"values.json", `{"apiVersion": "v1", "kind": "ConfigMap", "metadata": {"name": "web"}, "data": {"value": "one"}}`},
+		{"values.toml", "apiVersion = \"v1\"\nkind = \"ConfigMap\"\n\n[metadata]\nname = \"web\"\n\n[data]\nvalue = \"one\"\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			group := pipelineGroup("web", "deploy")
+			group.ValuesRepos[0].Path = tt.name
+			p := newTestPipeline(t, group)
+			p.addRepo(t, "acme", "values", map[string]string{tt.name: tt.values})
+			p.addRepo(t, "acme", "deploy", map[string]string{"README.md": "deploy\n"})
+
+			if code, response := p.commitChanges(t, `{"branch":"master","message":"Update"}`); code != http.StatusOK {
+				t.Fatalf("CommitChanges() status = %d, response %v", code, response)
+			}
+			got, err := yamlValue(p.file(t, "acme", "deploy", "web/generated.yaml"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, _ := yamlValue(configMap("web", "one"))
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("web/generated.yaml = %v, want the values rendered as %v", got, want)
+			}
+		})
+	}
+
+	t.Run("invalid TOML", func(t *testing.T) {
+		group := pipelineGroup("web", "deploy")
+		group.ValuesRepos[0].Path = "values.toml"
+		p := newTestPipeline(t, group)
+		p.addRepo(t, "acme", "values", map[string]string{"values.toml": "[metadata\n"})
+		p.addRepo(t, "acme", "deploy", map[string]string{"README.md": "deploy\n"})
+
+		_, response := p.commitChanges(t, `{"branch":"master","message":"Update"}`)
+		if err, _ := groupResult(t, response, "web")["error"].(string); !strings.Contains(err, "failed to parse TOML values") {
+			t.Errorf("error = %q, want the TOML parse error", err)
+		}
+	})
+}
+
+// yamlValue decodes a YAML document
+func yamlValue(content string) (interface{}, error) {
+	var value interface{}
+	err := yaml.Unmarshal([]byte(content), &value)
+	return value, err
+}
+
+func TestValuesFromTemplateRepository(t *testing.T) {
+	group := pipelineGroup("web", "deploy")
+	group.ValuesRepos = []config.ValuesRepo{{Path: "values/web.yaml", SameAsTemplate: true}}
+	p := newTestPipeline(t, group)
+	p.pushFiles(t, "acme", "charts", map[string]string{"values/web.yaml": configMap("web", "one")})
+	p.addRepo(t, "acme", "deploy", map[string]string{"README.md": "deploy\n"})
+
+	// There is no values repository to clone, so the commit only works
+	// from the template repository clone
+	if code, response := p.commitChanges(t, `{"branch":"master","message":"Update"}`); code != http.StatusOK {
+		t.Fatalf("CommitChanges() status = %d, response %v", code, response)
+	}
+	if got := p.file(t, "acme", "deploy", "web/generated.yaml"); got != configMap("web", "one") {
+		t.Errorf("web/generated.yaml = %q, want the values from the template repository", got)
+	}
+
+	group.ValuesRepos[0].Path = "values/missing.yaml"
+	p = newTestPipeline(t, group)
+	p.addRepo(t, "acme", "deploy", map[string]string{"README.md": "deploy\n"})
+	_, response := p.commitChanges(t, `{"branch":"master","message":"Update"}`)
+	if err, _ := groupResult(t, response, "web")["error"].(string); !strings.Contains(err, "values file values/missing.yaml not found in the template repository") {
+		t.Errorf("error = %q, want the missing file in the template repository reported", err)
+	}
+}
+
+func TestValuesReposOrder(t *testing.T) {
+	group := pipelineGroup("web", "deploy")
+	group.ValuesRepos = []config.ValuesRepo{
+		{Owner: "acme", Repo: "values", Path: "web.yaml", Branch: "master", Order: 2},
+		{Owner: "acme", Repo: "values", Path: "base.yaml", Branch: "master"},
+		{Owner: "acme", Repo: "values", Path: "env.yaml", Branch: "master", Order: 1},
+	}
+	p := newTestPipeline(t, group)
+	p.addRepo(t, "acme", "values", map[string]string{
+		"web.yaml":  configMap("web", "one"),
+		"base.yaml": "replicas: 1\n",
+		"env.yaml":  "replicas: 2\n",
+	})
+	p.addRepo(t, "acme", "deploy", map[string]string{"README.md": "deploy\n"})
+
+	w := p.previewChanges(`{"branch":"master"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body)
+	}
+
+	// Values files are passed by ascending order, not as listed
+	log, err := os.ReadFile(p.runs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	order := regexp.MustCompile(`-f \S*/base\.yaml -f \S*/env\.yaml -f \S*/web\.yaml`)
+	if !order.Match(log) {
+		t.Errorf("helm runs %q, want the values files by their order", log)
+	}
+}
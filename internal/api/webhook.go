@@ -0,0 +1,200 @@
+package api
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/render"
+	"github.com/lei/yaml-helm-pipeline/internal/config"
+)
+
+// maxWebhookPayload bounds the size of webhook request bodies
+const maxWebhookPayload = 5 << 20
+
+// pushEvent holds the fields of a GitHub push event used by the pipeline
+type pushEvent struct {
+	Ref        string `json:"ref"`
+	After      string `json:"after"`
+	Repository struct {
+		FullName string `json:"full_name"`
+	} `json:"repository"`
+}
+
+// GitHubWebhook handles GitHub push events for values repositories and
+// commits the output of every config group that uses the pushed repo/branch
+func (h *Handler) GitHubWebhook(w http.ResponseWriter, r *http.Request) {
+	payload, err := io.ReadAll(io.LimitReader(r.Body, maxWebhookPayload))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !validSignature(h.webhookSecret, payload, r.Header.Get("X-Hub-Signature-256")) {
+		http.Error(w, "Invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	event := r.Header.Get("X-GitHub-Event")
+	if event != "push" {
+		render.JSON(w, r, map[string]interface{}{
+			"message": fmt.Sprintf("Ignoring %s event", event),
+		})
+		return
+	}
+
+	var push pushEvent
+	if err := json.Unmarshal(payload, &push); err != nil {
+		http.Error(w, fmt.Sprintf("invalid push event: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	branch, isBranch := strings.CutPrefix(push.Ref, "refs/heads/")
+	if !isBranch {
+		render.JSON(w, r, map[string]interface{}{
+			"message": fmt.Sprintf("Ignoring push to %s", push.Ref),
+		})
+		return
+	}
+
+	groups := h.groupsUsingValuesRepo(push.Repository.FullName, branch)
+	if len(groups) > 0 {
+		message := fmt.Sprintf("Update from push to %s@%s", push.Repository.FullName, shortSHA(push.After))
+		go h.runWebhookCommits(groups, message)
+	}
+
+	render.Status(r, http.StatusAccepted)
+	render.JSON(w, r, map[string]interface{}{
+		"repository": push.Repository.FullName,
+		"branch":     branch,
+		"groups":     groupNames(groups),
+	})
+}
+
+// runWebhookCommits commits the output of each group in the background.
+// Groups whose template branch isn't allowed are skipped.
+func (h *Handler) runWebhookCommits(groups []config.ConfigGroup, message string) {
+	ctx := context.Background()
+	shared := h.newSharedValues()
+	defer shared.cleanup()
+	renders := newRenderCache()
+
+	for _, group := range groups {
+		branch, err := h.defaultTemplateBranch(ctx, &group)
+		if err != nil {
+			log.Printf("Webhook: group %s failed: %v", group.Name, err)
+			continue
+		}
+		if !h.currentConfig().BranchAllowed(branch) {
+			log.Printf("Webhook: group %s skipped: commits from branch %s are not allowed", group.Name, branch)
+			continue
+		}
+
+		_, err = h.processConfigGroup(ctx, group.Name, processOptions{
+			templateRepoBranch: branch,
+			commitMessage:      message,
+			shared:             shared,
+			renders:            renders,
+		})
+		if err != nil {
+			log.Printf("Webhook: group %s failed: %v", group.Name, err)
+			continue
+		}
+
+		log.Printf("Webhook: group %s processed", group.Name)
+	}
+}
+
+// defaultTemplateBranch returns the template branch to render from when no
+// branch is given by a request: the group's pinned branch if set, otherwise
+// the template repository's default branch
+func (h *Handler) defaultTemplateBranch(ctx context.Context, group *config.ConfigGroup) (string, error) {
+	if group.TemplateRepo != nil {
+		if group.TemplateRepo.Branch != "" {
+			return group.TemplateRepo.Branch, nil
+		}
+
+		repo, err := h.scm.GetRepositoryByName(ctx, group.TemplateRepo.Owner, group.TemplateRepo.Repo)
+		if err != nil {
+			return "", fmt.Errorf("failed to get repository information: %w", err)
+		}
+		return repo.DefaultBranch, nil
+	}
+
+	repo, err := h.scm.GetRepository(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to get repository information: %w", err)
+	}
+	return repo.DefaultBranch, nil
+}
+
+// groupsUsingValuesRepo returns the groups with a values repository matching
+// the given "owner/repo" and branch
+func (h *Handler) groupsUsingValuesRepo(fullName, branch string) []config.ConfigGroup {
+	cfg := h.currentConfig()
+
+	// Shared values feed every group
+	for _, repo := range cfg.SharedValuesRepos {
+		if strings.EqualFold(repo.Owner+"/"+repo.Repo, fullName) && repo.Branch == branch {
+			return cfg.Groups
+		}
+	}
+
+	var groups []config.ConfigGroup
+	for _, group := range cfg.Groups {
+		// The values of a group's releases feed the group too
+		repos := append([]config.ValuesRepo{}, group.ValuesRepos...)
+		for _, release := range group.Releases {
+			repos = append(repos, release.ValuesRepos...)
+		}
+
+		for _, repo := range repos {
+			if strings.EqualFold(repo.Owner+"/"+repo.Repo, fullName) && repo.Branch == branch {
+				groups = append(groups, group)
+				break
+			}
+		}
+	}
+	return groups
+}
+
+// validSignature verifies a GitHub X-Hub-Signature-256 header against the payload
+func validSignature(secret string, payload []byte, signature string) bool {
+	hexDigest, ok := strings.CutPrefix(signature, "sha256=")
+	if !ok {
+		return false
+	}
+
+	digest, err := hex.DecodeString(hexDigest)
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return hmac.Equal(digest, mac.Sum(nil))
+}
+
+// groupNames returns the names of the given groups
+func groupNames(groups []config.ConfigGroup) []string {
+	names := make([]string, 0, len(groups))
+	for _, group := range groups {
+		names = append(names, group.Name)
+	}
+	return names
+}
+
+// shortSHA abbreviates a commit SHA for display
+func shortSHA(sha string) string {
+	if len(sha) > 7 {
+		return sha[:7]
+	}
+	return sha
+}
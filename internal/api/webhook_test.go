@@ -0,0 +1,163 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/lei/yaml-helm-pipeline/internal/config"
+)
+
+// sign returns the X-Hub-Signature-256 header for a payload
+func sign(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookHandler returns a handler with the given groups that accepts
+// webhooks signed with "secret"
+func webhookHandler(groups ...config.ConfigGroup) *Handler {
+	h := NewHandler(nil, nil, nil, nil, &config.Config{Groups: groups})
+	h.webhookSecret = "secret"
+	return h
+}
+
+// valuesGroup returns a group reading its values from owner/repo@branch
+func valuesGroup(name, fullName, branch string) config.ConfigGroup {
+	owner, repo, _ := strings.Cut(fullName, "/")
+	return config.ConfigGroup{
+		Name:        name,
+		ValuesRepos: []config.ValuesRepo{{Owner: owner, Repo: repo, Path: "values.yaml", Branch: branch}},
+	}
+}
+
+func TestGitHubWebhookRejectsInvalidSignatures(t *testing.T) {
+	h := webhookHandler()
+	payload := []byte(`{"ref":"refs/heads/main"}`)
+
+	for _, signature := range []string{"", "sha256=00", sign("other", payload)} {
+		req := httptest.NewRequest(http.MethodPost, "/api/webhooks/github", strings.NewReader(string(payload)))
+		req.Header.Set("X-GitHub-Event", "push")
+		req.Header.Set("X-Hub-Signature-256", signature)
+		rec := httptest.NewRecorder()
+
+		h.GitHubWebhook(rec, req)
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("signature %q: status = %d, want 401", signature, rec.Code)
+		}
+	}
+}
+
+func TestGitHubWebhookAcceptsSignedPush(t *testing.T) {
+	h := webhookHandler()
+	payload := []byte(`{"ref":"refs/heads/main","after":"0123456789abcdef","repository":{"full_name":"acme/values"}}`)
+
+	req := httptest.NewRequest(http.MethodPost, "/api/webhooks/github", strings.NewReader(string(payload)))
+	req.Header.Set("X-GitHub-Event", "push")
+	req.Header.Set("X-Hub-Signature-256", sign("secret", payload))
+	rec := httptest.NewRecorder()
+
+	h.GitHubWebhook(rec, req)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("status = %d, want 202: %s", rec.Code, rec.Body)
+	}
+	if got := rec.Header().Get("Content-Type"); !strings.HasPrefix(got, "application/json") {
+		t.Errorf("Content-Type = %q, want application/json", got)
+	}
+
+	var body map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if body["repository"] != "acme/values" || body["branch"] != "main" {
+		t.Errorf("body = %v", body)
+	}
+}
+
+func TestGroupsUsingValuesRepo(t *testing.T) {
+	withRelease := valuesGroup("tenants", "acme/base", "main")
+	withRelease.Releases = []config.Release{{
+		Name:        "a",
+		ValuesRepos: []config.ValuesRepo{{Owner: "acme", Repo: "tenant-a", Path: "values.yaml", Branch: "main"}},
+	}}
+
+	h := webhookHandler(
+		valuesGroup("api", "acme/values", "main"),
+		valuesGroup("web", "acme/values", "develop"),
+		valuesGroup("jobs", "acme/other", "main"),
+		withRelease,
+	)
+
+	tests := []struct {
+		fullName, branch string
+		want             []string
+	}{
+		{"acme/values", "main", []string{"api"}},
+		{"ACME/Values", "develop", []string{"web"}},
+		{"acme/tenant-a", "main", []string{"tenants"}},
+		{"acme/unused", "main", []string{}},
+	}
+	for _, tt := range tests {
+		got := groupNames(h.groupsUsingValuesRepo(tt.fullName, tt.branch))
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("groupsUsingValuesRepo(%s, %s) = %q, want %q", tt.fullName, tt.branch, got, tt.want)
+		}
+	}
+
+	// Shared values feed every group
+	h.config.SharedValuesRepos = []config.ValuesRepo{{Owner: "acme", Repo: "shared", Path: "values.yaml", Branch: "main"}}
+	if got := h.groupsUsingValuesRepo("acme/shared", "main"); len(got) != 4 {
+		t.Errorf("push to shared values triggered %d groups, want 4", len(got))
+	}
+}
+
+func TestRunWebhookCommitsOnlyAffectedGroups(t *testing.T) {
+	other := pipelineGroup("jobs", "deploy")
+	other.ValuesRepos[0].Repo = "other"
+	p := newTestPipeline(t, pipelineGroup("web", "deploy"), pipelineGroup("api", "deploy"), other)
+	p.addRepo(t, "acme", "values", map[string]string{
+		"web.yaml": configMap("web", "one"),
+		"api.yaml": configMap("api", "two"),
+	})
+	p.addRepo(t, "acme", "other", map[string]string{"jobs.yaml": configMap("jobs", "three")})
+	p.addRepo(t, "acme", "deploy", map[string]string{"README.md": "deploy\n"})
+
+	groups := p.groupsUsingValuesRepo("acme/values", "master")
+	if got := groupNames(groups); !reflect.DeepEqual(got, []string{"web", "api"}) {
+		t.Fatalf("groups = %q, want [web api]", got)
+	}
+	p.runWebhookCommits(groups, "Update from push to acme/values@0123456")
+
+	if n := p.helmRuns(t); n != 2 {
+		t.Errorf("helm ran %d times, want once per affected group", n)
+	}
+	if n := p.commits(t, "acme", "deploy"); n != 3 {
+		t.Errorf("acme/deploy has %d commits, want one per affected group", n)
+	}
+	if got := p.file(t, "acme", "deploy", "jobs/generated.yaml"); got != "" {
+		t.Errorf("jobs output = %q, want the unaffected group not rendered", got)
+	}
+}
+
+func TestRunWebhookCommitsSkipsDisallowedBranches(t *testing.T) {
+	p := newSharedOutputPipeline(t)
+
+	p.config.AllowedBranches = []string{"release/*"}
+	p.runWebhookCommits(p.config.Groups, "Update")
+	if n := p.commits(t, "acme", "deploy"); n != 1 {
+		t.Errorf("acme/deploy has %d commits, want nothing pushed", n)
+	}
+
+	p.config.AllowedBranches = []string{"master"}
+	p.runWebhookCommits(p.config.Groups, "Update")
+	if n := p.commits(t, "acme", "deploy"); n != 3 {
+		t.Errorf("acme/deploy has %d commits, want one per group", n)
+	}
+}
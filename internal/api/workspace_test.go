@@ -0,0 +1,148 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	gitservice "github.com/lei/yaml-helm-pipeline/internal/git"
+	"github.com/lei/yaml-helm-pipeline/internal/retry"
+)
+
+func TestProcessConfigGroupRemovesClones(t *testing.T) {
+	tests := []struct {
+		name    string
+		group   string
+		opts    processOptions
+		wantErr bool
+	}{
+		{"preview", "web", processOptions{templateRepoBranch: "master", previewOnly: true}, false},
+		{"commit", "web", processOptions{templateRepoBranch: "master", commitMessage: "Update"}, false},
+		{"missing values file", "api", processOptions{templateRepoBranch: "master", commitMessage: "Update"}, true},
+		{"missing output repository", "docs", processOptions{templateRepoBranch: "master", commitMessage: "Update"}, true},
+		{"missing branch", "web", processOptions{templateRepoBranch: "release", commitMessage: "Update"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestPipeline(t, pipelineGroup("web", "deploy"), pipelineGroup("api", "deploy"), pipelineGroup("docs", "missing"))
+			p.addRepo(t, "acme", "values", map[string]string{
+				"web.yaml":  configMap("web", "one"),
+				"docs.yaml": configMap("docs", "three"),
+			})
+			p.addRepo(t, "acme", "deploy", map[string]string{"README.md": "deploy\n"})
+
+			_, err := p.processConfigGroup(context.Background(), tt.group, tt.opts)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("processConfigGroup() error = %v, want error %v", err, tt.wantErr)
+			}
+
+			entries, err := os.ReadDir(os.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, entry := range entries {
+				t.Errorf("%s left behind", entry.Name())
+			}
+		})
+	}
+}
+
+func TestConcurrentGroupsDontShareClones(t *testing.T) {
+	p := newTestPipeline(t, pipelineGroup("web", "deploy"), pipelineGroup("api", "deploy"))
+	p.addRepo(t, "acme", "values", map[string]string{
+		"web.yaml": configMap("web", "one"),
+		"api.yaml": configMap("api", "two"),
+	})
+	p.addRepo(t, "acme", "deploy", map[string]string{"README.md": "deploy\n"})
+
+	// Both groups clone acme/values@master, and each group runs twice
+	groups := []string{"web", "api", "web", "api"}
+	results := make([]map[string]interface{}, len(groups))
+	errs := make([]error, len(groups))
+	var wg sync.WaitGroup
+	for i, group := range groups {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], errs[i] = p.processConfigGroup(context.Background(), group, processOptions{
+				templateRepoBranch: "master",
+				previewOnly:        true,
+				diffFormat:         diffFormatUnified,
+			})
+		}()
+	}
+	wg.Wait()
+
+	for i, group := range groups {
+		if errs[i] != nil {
+			t.Errorf("run %d of %s: %v", i+1, group, errs[i])
+			continue
+		}
+		want := map[string]string{"web": "+  value: one", "api": "+  value: two"}[group]
+		if diff, _ := results[i]["diff"].(string); !strings.Contains(diff, want) {
+			t.Errorf("run %d of %s diff = %q, want its own values", i+1, group, diff)
+		}
+	}
+}
+
+func TestNewWorkspace(t *testing.T) {
+	h := &Handler{gitService: gitservice.NewService("token", retry.Policy{MaxAttempts: 1})}
+	if err := h.gitService.SetWorkDir(filepath.Join(t.TempDir(), "work")); err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := h.newWorkspace("web/prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := h.newWorkspace("web/prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.root == second.root {
+		t.Errorf("workspaces share %s", first.root)
+	}
+	if dir := filepath.Dir(first.root); dir != h.gitService.WorkDir() {
+		t.Errorf("workspace in %s, want directly in the work directory", dir)
+	}
+	if got := filepath.Base(first.path("values-0-acme-values-feature/x")); got != "values-0-acme-values-feature-x" {
+		t.Errorf("clone directory = %s, want the branch's slash replaced", got)
+	}
+
+	first.cleanup()
+	second.cleanup()
+	if entries, _ := os.ReadDir(h.gitService.WorkDir()); len(entries) != 0 {
+		t.Errorf("%d entries left after cleanup", len(entries))
+	}
+}
+
+func TestClonesUseWorkDir(t *testing.T) {
+	p := newTestPipeline(t, pipelineGroup("web", "deploy"))
+	p.addRepo(t, "acme", "values", map[string]string{"web.yaml": configMap("web", "one")})
+	p.addRepo(t, "acme", "deploy", map[string]string{"README.md": "deploy\n"})
+	work := filepath.Join(t.TempDir(), "work")
+	if err := p.gitService.SetWorkDir(work); err != nil {
+		t.Fatal(err)
+	}
+
+	if code, response := p.commitChanges(t, `{"branch":"master","message":"Update"}`); code != http.StatusOK {
+		t.Fatalf("CommitChanges() status = %d, response %v", code, response)
+	}
+
+	// helm rendered the chart cloned under the work directory
+	log, err := os.ReadFile(p.runs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(log), "template "+work+string(filepath.Separator)) {
+		t.Errorf("helm runs = %q, want the chart cloned under %s", log, work)
+	}
+	if entries, _ := os.ReadDir(work); len(entries) != 0 {
+		t.Errorf("%d entries left in the work directory", len(entries))
+	}
+}
@@ -3,15 +3,135 @@ package config
 import (
 	"encoding/json"
 	"fmt"
+	"log"
 	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"text/template"
 
+	"github.com/lei/yaml-helm-pipeline/internal/schedule"
+	"github.com/lei/yaml-helm-pipeline/internal/yamlerr"
 	"gopkg.in/yaml.v3"
 )
 
 // Config represents the application configuration
 type Config struct {
 	Groups []ConfigGroup `yaml:"groups" json:"groups"`
+
+	// HelmRepos are registered with helm before building chart dependencies
+	HelmRepos []HelmRepo `yaml:"helm_repos,omitempty" json:"helm_repos,omitempty"`
+
+	// SharedValuesRepos are applied to every group before the group's own
+	// values repositories, so they have the lowest precedence
+	SharedValuesRepos []ValuesRepo `yaml:"shared_values_repos,omitempty" json:"shared_values_repos,omitempty"`
+
+	// CommitFormat controls how commit messages are built for every group
+	// that doesn't set its own
+	CommitFormat *CommitFormat `yaml:"commit_format,omitempty" json:"commit_format,omitempty"`
+
+	// AllowedBranches restricts the branches the commit endpoint accepts to
+	// those matching one of the patterns (path.Match globs such as
+	// "release/*"). Every branch is allowed when empty.
+	AllowedBranches []string `yaml:"allowed_branches,omitempty" json:"allowed_branches,omitempty"`
+
+	// RedactKeys are case-insensitive regular expressions matching the keys
+	// whose values are masked in previews that show values. Defaults to
+	// password, token, secret, and key.
+	RedactKeys []string `yaml:"redact_keys,omitempty" json:"redact_keys,omitempty"`
+
+	// DefaultBranch is used for values and output repositories that don't
+	// set a branch, unless their group sets its own. Defaults to "main".
+	DefaultBranch string `yaml:"default_branch,omitempty" json:"default_branch,omitempty"`
+
+	// ArrayKeys are the fields that identify the elements of arrays of
+	// mappings in diffs, tried in order, so that a changed container is
+	// reported by name instead of the whole list. Defaults to "name".
+	ArrayKeys []string `yaml:"array_keys,omitempty" json:"array_keys,omitempty"`
+
+	// OutputPathTemplate is the output path of groups that don't set one,
+	// e.g. "clusters/{{group}}/"
+	OutputPathTemplate string `yaml:"output_path_template,omitempty" json:"output_path_template,omitempty"`
+}
+
+// defaultBranch is the repository branch used when no default is configured
+const defaultBranch = "main"
+
+// BranchAllowed reports whether commits from a branch are allowed by
+// AllowedBranches
+func (c *Config) BranchAllowed(branch string) bool {
+	if len(c.AllowedBranches) == 0 {
+		return true
+	}
+	for _, pattern := range c.AllowedBranches {
+		if matched, _ := path.Match(pattern, branch); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Commit message styles
+const (
+	CommitStyleSuffix       = "suffix"
+	CommitStyleConventional = "conventional"
+)
+
+// CommitFormat describes how commit messages are built from the message
+// given in a commit request
+type CommitFormat struct {
+	// Style is "suffix" (default), which appends the chart source and group
+	// to the message, or "conventional", which builds a "type(scope): message"
+	// subject and puts the chart source and group in the body
+	Style string `yaml:"style,omitempty" json:"style,omitempty"`
+
+	// Type and Scope make up the conventional commit prefix. Type defaults
+	// to "chore" and the scope is left out when empty.
+	Type  string `yaml:"type,omitempty" json:"type,omitempty"`
+	Scope string `yaml:"scope,omitempty" json:"scope,omitempty"`
+
+	// Trailers are appended to the message as "Key: Value" lines, e.g.
+	// Signed-off-by
+	Trailers []Trailer `yaml:"trailers,omitempty" json:"trailers,omitempty"`
+}
+
+// Trailer is a git trailer line such as "Signed-off-by: Name <email>"
+type Trailer struct {
+	Key   string `yaml:"key" json:"key"`
+	Value string `yaml:"value" json:"value"`
+}
+
+// Validate checks the commit format for unsupported styles and malformed
+// prefixes or trailers
+func (f *CommitFormat) Validate() error {
+	switch f.Style {
+	case "", CommitStyleSuffix, CommitStyleConventional:
+	default:
+		return fmt.Errorf("unsupported commit style: %s", f.Style)
+	}
+
+	if strings.ContainsAny(f.Type, " ():") || strings.ContainsAny(f.Scope, "():\n") {
+		return fmt.Errorf("invalid commit type or scope: %s(%s)", f.Type, f.Scope)
+	}
+
+	for _, trailer := range f.Trailers {
+		if trailer.Key == "" || strings.ContainsAny(trailer.Key, " :\n") || strings.Contains(trailer.Value, "\n") {
+			return fmt.Errorf("invalid commit trailer: %s: %s", trailer.Key, trailer.Value)
+		}
+	}
+	return nil
+}
+
+// HelmRepo represents a chart repository used for chart dependencies.
+// Username and password may reference environment variables as ${VAR}.
+type HelmRepo struct {
+	Name     string `yaml:"name" json:"name"`
+	URL      string `yaml:"url" json:"url"`
+	Username string `yaml:"username,omitempty" json:"username,omitempty"`
+	Password string `yaml:"password,omitempty" json:"password,omitempty"`
 }
 
 // ConfigGroup represents a group of values files and their output destination
@@ -19,6 +139,120 @@ type ConfigGroup struct {
 	Name        string       `yaml:"name" json:"name"`
 	ValuesRepos []ValuesRepo `yaml:"values_repos" json:"values_repos"`
 	OutputRepo  OutputRepo   `yaml:"output_repo" json:"output_repo"`
+
+	// TemplateRepo optionally overrides the globally configured chart repository
+	TemplateRepo *TemplateRepo `yaml:"template_repo,omitempty" json:"template_repo,omitempty"`
+
+	// DefaultBranch overrides the top-level DefaultBranch for the group's
+	// values and output repositories
+	DefaultBranch string `yaml:"default_branch,omitempty" json:"default_branch,omitempty"`
+
+	// ChartRef renders a packaged chart from an OCI registry or URL
+	// (oci://..., https://...) instead of cloning a template repository
+	ChartRef string `yaml:"chart_ref,omitempty" json:"chart_ref,omitempty"`
+
+	// ChartVersion pins the version of the chart referenced by ChartRef
+	ChartVersion string `yaml:"chart_version,omitempty" json:"chart_version,omitempty"`
+
+	// EnvValues maps dotted value paths (e.g. "db.password") to the names of
+	// environment variables whose values are injected at render time
+	EnvValues map[string]string `yaml:"env_values,omitempty" json:"env_values,omitempty"`
+
+	// TemplateValues expands the values files with Go text/template before
+	// rendering. Templates can use {{ .Group }}, {{ .Branch }}, and the
+	// environment variables starting with PIPELINE_VALUES_ as {{ .Env.NAME }}
+	// or {{ env "NAME" }}.
+	TemplateValues bool `yaml:"template_values,omitempty" json:"template_values,omitempty"`
+
+	// CanonicalizeOutput re-serializes the rendered YAML with sorted keys so
+	// that helm version differences don't produce spurious diffs
+	CanonicalizeOutput bool `yaml:"canonicalize_output,omitempty" json:"canonicalize_output,omitempty"`
+
+	// Lint runs `helm lint` with the group's values before templating and
+	// fails the run if it reports errors. Requires a template repository.
+	Lint bool `yaml:"lint,omitempty" json:"lint,omitempty"`
+
+	// StrictValues fails the run when the values set keys the chart's
+	// default values don't define, or when `helm lint --strict` reports
+	// warnings for a template repository chart
+	StrictValues bool `yaml:"strict_values,omitempty" json:"strict_values,omitempty"`
+
+	// AllowEmptyOutput lets a chart render nothing, committing an empty
+	// output. Otherwise an empty render fails the run, since it usually means
+	// the values are wrong and would wipe the previous output.
+	AllowEmptyOutput bool `yaml:"allow_empty_output,omitempty" json:"allow_empty_output,omitempty"`
+
+	// InjectNamespace sets metadata.namespace on rendered namespaced resources
+	// that don't specify one
+	InjectNamespace string `yaml:"inject_namespace,omitempty" json:"inject_namespace,omitempty"`
+
+	// CommonLabels and CommonAnnotations are added to the metadata of every
+	// rendered resource, e.g. app.kubernetes.io/managed-by. Labels and
+	// annotations the chart sets are kept unless OverwriteCommonMetadata is
+	// set.
+	CommonLabels            map[string]string `yaml:"common_labels,omitempty" json:"common_labels,omitempty"`
+	CommonAnnotations       map[string]string `yaml:"common_annotations,omitempty" json:"common_annotations,omitempty"`
+	OverwriteCommonMetadata bool              `yaml:"overwrite_common_metadata,omitempty" json:"overwrite_common_metadata,omitempty"`
+
+	// PostRenderer is an executable that helm pipes the rendered manifests
+	// through (e.g. a kustomize wrapper), given as an absolute path or a
+	// name on the PATH. Paths relative to the template repository are only
+	// allowed when TemplateRepo pins a ref.
+	PostRenderer string `yaml:"post_renderer,omitempty" json:"post_renderer,omitempty"`
+
+	// PostRendererArgs are passed to the post-renderer
+	PostRendererArgs []string `yaml:"post_renderer_args,omitempty" json:"post_renderer_args,omitempty"`
+
+	// ExtraHelmArgs are appended verbatim to the helm template command after
+	// the flags the pipeline manages, e.g. --skip-tests. Flags that would
+	// redirect the output or run other programs are rejected.
+	ExtraHelmArgs []string `yaml:"extra_helm_args,omitempty" json:"extra_helm_args,omitempty"`
+
+	// CommitFormat overrides the top-level commit message format
+	CommitFormat *CommitFormat `yaml:"commit_format,omitempty" json:"commit_format,omitempty"`
+
+	// Schedule is a cron expression, e.g. "0 6 * * mon-fri", at which the
+	// scheduler commits the group's output rendered from its default
+	// template branch. Only used when the scheduler is enabled.
+	Schedule string `yaml:"schedule,omitempty" json:"schedule,omitempty"`
+
+	// Releases renders the chart once per release, each with its own release
+	// name, namespace, and values on top of the group's, and writes each to
+	// its own output file. The group renders a single release when empty.
+	Releases []Release `yaml:"releases,omitempty" json:"releases,omitempty"`
+}
+
+// Release is one rendering of a group's chart, e.g. for a tenant
+type Release struct {
+	Name      string `yaml:"name" json:"name"`                               // Helm release name
+	Namespace string `yaml:"namespace,omitempty" json:"namespace,omitempty"` // Passed to helm with --namespace
+
+	// ValuesRepos are applied after the group's values repositories
+	ValuesRepos []ValuesRepo `yaml:"values_repos,omitempty" json:"values_repos,omitempty"`
+
+	// OutputFilename is the release's file in the output path. Defaults to
+	// <name>.yaml.
+	OutputFilename string `yaml:"output_filename,omitempty" json:"output_filename,omitempty"`
+}
+
+// Filename returns the name of the release's output file
+func (r Release) Filename() string {
+	if r.OutputFilename == "" {
+		return r.Name + ".yaml"
+	}
+	return r.OutputFilename
+}
+
+// releaseNamePattern matches the names helm accepts for releases and
+// namespaces: lowercase DNS labels
+var releaseNamePattern = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+
+// TemplateRepo represents a repository containing the Helm chart
+type TemplateRepo struct {
+	Owner  string `yaml:"owner" json:"owner"`
+	Repo   string `yaml:"repo" json:"repo"`
+	Branch string `yaml:"branch,omitempty" json:"branch,omitempty"` // Optional, defaults to the requested branch
+	Ref    string `yaml:"ref,omitempty" json:"ref,omitempty"`       // Optional tag or commit SHA, overrides the branch
 }
 
 // ValuesRepo represents a repository containing values files
@@ -26,20 +260,219 @@ type ValuesRepo struct {
 	Owner  string `yaml:"owner" json:"owner"`
 	Repo   string `yaml:"repo" json:"repo"`
 	Path   string `yaml:"path" json:"path"`
-	Branch string `yaml:"branch,omitempty" json:"branch,omitempty"` // Optional, defaults to "main"
+	Branch string `yaml:"branch,omitempty" json:"branch,omitempty"` // Optional, defaults to the default branch
+	Ref    string `yaml:"ref,omitempty" json:"ref,omitempty"`       // Optional tag or commit SHA, overrides the branch
+
+	// SameAsTemplate reads Path from the group's template repository clone
+	// instead of cloning a separate repository. Owner, Repo, Branch, and Ref
+	// are ignored.
+	SameAsTemplate bool `yaml:"same_as_template,omitempty" json:"same_as_template,omitempty"`
+
+	// Order positions the values file among those of the same list: files
+	// are passed to helm by ascending order, and in the order they are
+	// listed when equal. Later files override earlier ones.
+	Order int `yaml:"order,omitempty" json:"order,omitempty"`
+}
+
+// OrderValuesRepos returns values repositories in the order their files are
+// passed to helm: by ascending Order, keeping the listed order for ties
+func OrderValuesRepos(repos []ValuesRepo) []ValuesRepo {
+	ordered := append([]ValuesRepo(nil), repos...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return ordered[i].Order < ordered[j].Order
+	})
+	return ordered
+}
+
+// Revision returns the ref to check out: the pinned ref if set, otherwise
+// the branch
+func (r ValuesRepo) Revision() string {
+	if r.Ref != "" {
+		return r.Ref
+	}
+	return r.Branch
+}
+
+// Supported values file formats, chosen by the file's extension
+const (
+	ValuesFormatYAML = "yaml"
+	ValuesFormatJSON = "json"
+	ValuesFormatTOML = "toml"
+)
+
+// Format returns the format of the values file based on its extension, or
+// "" if the extension isn't supported. Files without an extension are YAML.
+func (r ValuesRepo) Format() string {
+	switch strings.ToLower(filepath.Ext(r.Path)) {
+	case "", ".yaml", ".yml":
+		return ValuesFormatYAML
+	case ".json":
+		return ValuesFormatJSON
+	case ".toml":
+		return ValuesFormatTOML
+	default:
+		return ""
+	}
 }
 
 // OutputRepo represents a repository for output files
 type OutputRepo struct {
-	Owner    string `yaml:"owner" json:"owner"`
-	Repo     string `yaml:"repo" json:"repo"`
-	Path     string `yaml:"path" json:"path"`         // Path within the repository
+	Owner string `yaml:"owner" json:"owner"`
+	Repo  string `yaml:"repo" json:"repo"`
+
+	// Path within the repository. "{{branch}}" is replaced with the branch
+	// given in each request and "{{group}}" with the group's name, e.g.
+	// "deploy/{{branch}}/" or "clusters/{{group}}/".
+	Path string `yaml:"path" json:"path"`
+
 	Filename string `yaml:"filename" json:"filename"` // Output filename
 	Branch   string `yaml:"branch" json:"branch"`     // Branch to commit to
+
+	// Format of the output file: "yaml" (default) or "json". JSON output is
+	// an array with one object per rendered document.
+	Format string `yaml:"format,omitempty" json:"format,omitempty"`
+
+	// SplitByResource writes each rendered resource to its own
+	// <kind>-<name>.yaml file under Path instead of a single output file.
+	// The directory is owned by the pipeline: YAML files in it that a render
+	// no longer produces are removed.
+	SplitByResource bool `yaml:"split_by_resource,omitempty" json:"split_by_resource,omitempty"`
+
+	// FileMode sets the permissions of the output file as an octal string
+	// such as "0640". Defaults to 0644.
+	FileMode string `yaml:"file_mode,omitempty" json:"file_mode,omitempty"`
+
+	// ForkOwner pushes commits to a new branch of ForkOwner's fork of the
+	// repository and opens a pull request against Branch, for credentials
+	// without write access to the repository itself. The fork is created if
+	// it doesn't exist.
+	ForkOwner string `yaml:"fork_owner,omitempty" json:"fork_owner,omitempty"`
+
+	// ExcludeKinds drops rendered resources of these kinds (e.g. Secret)
+	// before the output is diffed and written. Matching ignores case.
+	ExcludeKinds []string `yaml:"exclude_kinds,omitempty" json:"exclude_kinds,omitempty"`
+
+	// IncludeKinds, when set, keeps only rendered resources of these kinds.
+	// A kind listed in both IncludeKinds and ExcludeKinds is excluded.
+	IncludeKinds []string `yaml:"include_kinds,omitempty" json:"include_kinds,omitempty"`
+
+	// SortDocuments orders the rendered documents by apiVersion, kind,
+	// namespace, and name so commits don't depend on helm's render order
+	SortDocuments bool `yaml:"sort_documents,omitempty" json:"sort_documents,omitempty"`
+
+	// Header is a text/template prepended to every YAML output file as a
+	// "#" comment block, e.g. "DO NOT EDIT - generated from {{.Repo}}".
+	// It can use .Repo, .Branch, .Group, and .Timestamp, and is ignored
+	// when comparing output for changes.
+	Header string `yaml:"header,omitempty" json:"header,omitempty"`
+
+	// SemanticCompare parses the existing and rendered output and only
+	// counts them as different when their data differs, so formatting-only
+	// changes such as indentation or quoting don't produce a commit
+	SemanticCompare bool `yaml:"semantic_compare,omitempty" json:"semantic_compare,omitempty"`
+
+	// CreateBranchIfMissing starts Branch from the repository's default
+	// branch when it doesn't exist yet, instead of failing the clone
+	CreateBranchIfMissing bool `yaml:"create_branch_if_missing,omitempty" json:"create_branch_if_missing,omitempty"`
+
+	// PushStrategy decides what happens when the commit doesn't
+	// fast-forward Branch: "rebase" (default) replays the commit on the new
+	// tip and fails if both changed the same files, "force_with_lease"
+	// pushes over the branch only while it is still at the commit that was
+	// cloned, so it never overwrites commits pushed by someone else
+	PushStrategy string `yaml:"push_strategy,omitempty" json:"push_strategy,omitempty"`
 }
 
-// LoadConfig loads the configuration from a file or environment variables
+// BranchPlaceholder in an output path is replaced with the requested branch
+const BranchPlaceholder = "{{branch}}"
+
+// GroupPlaceholder in an output path is replaced with the group's name
+const GroupPlaceholder = "{{group}}"
+
+// ResolvePath returns the output path of a group for a request on a branch,
+// filling in GroupPlaceholder and BranchPlaceholder. Names that would escape
+// the repository are rejected.
+func (o OutputRepo) ResolvePath(group, branch string) (string, error) {
+	resolved := o.Path
+
+	if strings.Contains(resolved, GroupPlaceholder) {
+		if !isPathSafe(group) {
+			return "", fmt.Errorf("group %q cannot be used in output path %s", group, o.Path)
+		}
+		resolved = strings.ReplaceAll(resolved, GroupPlaceholder, group)
+	}
+
+	if strings.Contains(resolved, BranchPlaceholder) {
+		if branch == "" {
+			return "", fmt.Errorf("output path %s needs a branch", o.Path)
+		}
+		if !isPathSafe(branch) {
+			return "", fmt.Errorf("branch %q cannot be used in output path %s", branch, o.Path)
+		}
+		resolved = strings.ReplaceAll(resolved, BranchPlaceholder, branch)
+	}
+
+	return resolved, nil
+}
+
+// isPathSafe reports whether a name can be placed in a path without leaving
+// the directory it is placed in
+func isPathSafe(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, segment := range strings.Split(name, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// defaultFileMode is the permission used for output files without a file_mode
+const defaultFileMode os.FileMode = 0644
+
+// Mode returns the permissions for the output file
+func (o OutputRepo) Mode() os.FileMode {
+	mode, err := parseFileMode(o.FileMode)
+	if err != nil || o.FileMode == "" {
+		return defaultFileMode
+	}
+	return mode
+}
+
+// parseFileMode parses an octal permission string such as "0640"
+func parseFileMode(s string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("invalid file mode: %s", s)
+	}
+	return os.FileMode(mode), nil
+}
+
+// Supported output file formats
+const (
+	OutputFormatYAML = "yaml"
+	OutputFormatJSON = "json"
+)
+
+// Supported push strategies
+const (
+	PushStrategyRebase         = "rebase"
+	PushStrategyForceWithLease = "force_with_lease"
+)
+
+// LoadConfig loads the configuration from a file, a remote URL (http://,
+// https://, s3://), or environment variables. A remote configuration that
+// can't be loaded is an error rather than a reason to fall back to the
+// environment, so an outage or a typo in the URL never starts the server
+// with a different configuration.
 func LoadConfig(configPath string) (*Config, error) {
+	// Fetch remote configurations through the fetcher for their scheme
+	if location, fetcher := remoteFetcher(configPath); fetcher != nil {
+		return loadConfigFromRemote(location, fetcher)
+	}
+
 	// Try to load from file first
 	config, err := loadConfigFromFile(configPath)
 	if err == nil {
@@ -47,12 +480,23 @@ func LoadConfig(configPath string) (*Config, error) {
 	}
 
 	// If file loading failed, try environment variables
-	fmt.Printf("Failed to load config from file: %v\n", err)
-	fmt.Println("Attempting to load config from environment variables...")
+	log.Printf("Failed to load config from file: %v", err)
+	log.Println("Attempting to load config from environment variables...")
 
 	return loadConfigFromEnv()
 }
 
+// ReloadConfig loads the configuration from its file or remote URL like
+// LoadConfig, but never from environment variables. A reload replaces the
+// running configuration, so a source that can't be read or validated is
+// reported rather than swapped for another configuration.
+func ReloadConfig(configPath string) (*Config, error) {
+	if location, fetcher := remoteFetcher(configPath); fetcher != nil {
+		return loadConfigFromRemote(location, fetcher)
+	}
+	return loadConfigFromFile(configPath)
+}
+
 // loadConfigFromFile loads configuration from a YAML file
 func loadConfigFromFile(configPath string) (*Config, error) {
 	if configPath == "" {
@@ -64,9 +508,20 @@ func loadConfigFromFile(configPath string) (*Config, error) {
 		return nil, fmt.Errorf("failed to read config file: %w", err)
 	}
 
+	return parse(data, configPath)
+}
+
+// Parse parses and validates a YAML (or JSON) configuration document
+func Parse(data []byte) (*Config, error) {
+	return parse(data, "config")
+}
+
+// parse parses and validates a configuration document, naming it source in
+// parse errors
+func parse(data []byte, source string) (*Config, error) {
 	var config Config
 	if err := yaml.Unmarshal(data, &config); err != nil {
-		return nil, fmt.Errorf("failed to parse config file: %w", err)
+		return nil, fmt.Errorf("failed to parse config file: %w", yamlerr.Wrap(source, err))
 	}
 
 	// Validate configuration
@@ -102,7 +557,11 @@ func parseConfigGroupsJSON(configGroupsEnv string) (*Config, error) {
 		return nil, fmt.Errorf("failed to parse CONFIG_GROUPS JSON: %w", err)
 	}
 
-	config := &Config{Groups: groups}
+	config := &Config{
+		Groups:             groups,
+		DefaultBranch:      os.Getenv("DEFAULT_BRANCH"),
+		OutputPathTemplate: os.Getenv("OUTPUT_PATH_TEMPLATE"),
+	}
 
 	// Validate configuration
 	if err := validateConfig(config); err != nil {
@@ -114,7 +573,10 @@ func parseConfigGroupsJSON(configGroupsEnv string) (*Config, error) {
 
 // parseConfigGroupsFromPrefixedEnv parses configuration from prefixed environment variables
 func parseConfigGroupsFromPrefixedEnv() (*Config, error) {
-	var config Config
+	config := Config{
+		DefaultBranch:      os.Getenv("DEFAULT_BRANCH"),
+		OutputPathTemplate: os.Getenv("OUTPUT_PATH_TEMPLATE"),
+	}
 
 	// Find all environment variables with the CONFIG_GROUP prefix
 	for i := 1; ; i++ {
@@ -127,7 +589,8 @@ func parseConfigGroupsFromPrefixedEnv() (*Config, error) {
 		}
 
 		group := ConfigGroup{
-			Name: groupName,
+			Name:          groupName,
+			DefaultBranch: os.Getenv(groupPrefix + "DEFAULT_BRANCH"),
 		}
 
 		// Parse values repositories
@@ -145,6 +608,16 @@ func parseConfigGroupsFromPrefixedEnv() (*Config, error) {
 			group.ValuesRepos = append(group.ValuesRepos, valuesRepo)
 		}
 
+		// Parse template repository
+		templateRepoEnv := os.Getenv(groupPrefix + "TEMPLATE_REPO")
+		if templateRepoEnv != "" {
+			templateRepo, err := parseTemplateRepoString(templateRepoEnv)
+			if err != nil {
+				return nil, err
+			}
+			group.TemplateRepo = &templateRepo
+		}
+
 		// Parse output repository
 		outputRepoEnv := os.Getenv(groupPrefix + "OUTPUT_REPO")
 		if outputRepoEnv != "" {
@@ -184,10 +657,30 @@ func parseValuesRepoString(s string) (ValuesRepo, error) {
 		Path:  parts[1],
 	}
 
+	// Without a branch, validation applies the default branch
 	if len(parts) > 2 {
 		repo.Branch = parts[2]
-	} else {
-		repo.Branch = "main" // Default branch
+	}
+
+	return repo, nil
+}
+
+// parseTemplateRepoString parses a string in the format "owner/repo:branch"
+func parseTemplateRepoString(s string) (TemplateRepo, error) {
+	parts := strings.Split(s, ":")
+
+	repoPath := strings.Split(parts[0], "/")
+	if len(repoPath) != 2 {
+		return TemplateRepo{}, fmt.Errorf("invalid repository format: %s", parts[0])
+	}
+
+	repo := TemplateRepo{
+		Owner: repoPath[0],
+		Repo:  repoPath[1],
+	}
+
+	if len(parts) > 1 {
+		repo.Branch = parts[1]
 	}
 
 	return repo, nil
@@ -217,61 +710,395 @@ func parseOutputRepoString(s string) (OutputRepo, error) {
 		Filename: filename,
 	}
 
+	// Without a branch, validation applies the default branch
 	if len(parts) > 2 {
 		repo.Branch = parts[2]
-	} else {
-		repo.Branch = "main" // Default branch
 	}
 
 	return repo, nil
 }
 
-// validateConfig validates the configuration
+// ValidationError describes a problem with a configuration value
+type ValidationError struct {
+	Group   string `json:"group,omitempty"` // Name of the offending group, if any
+	Field   string `json:"field"`           // Config key of the offending value
+	Message string `json:"message"`
+	Line    int    `json:"line,omitempty"` // Line of a parse error, if known
+}
+
+// Error implements the error interface
+func (e *ValidationError) Error() string {
+	return e.Message
+}
+
+// invalid creates a validation error for a group field
+func invalid(group, field, format string, args ...interface{}) *ValidationError {
+	return &ValidationError{
+		Group:   group,
+		Field:   field,
+		Message: fmt.Sprintf(format, args...),
+	}
+}
+
+// ValidationErrors collects every problem found in a configuration
+type ValidationErrors []*ValidationError
+
+// Error implements the error interface, listing each problem
+func (e ValidationErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Message
+	}
+	return strings.Join(messages, "; ")
+}
+
+// validateValuesRepos checks a group's values repositories, or those of one
+// of its releases, and fills in their default branch. field and owner name
+// the repositories in errors, e.g. "values_repos" and "group web".
+func validateValuesRepos(repos []ValuesRepo, group *ConfigGroup, field, owner, branch string) ValidationErrors {
+	var errs ValidationErrors
+	for j, repo := range repos {
+		if repo.SameAsTemplate {
+			if repo.Path == "" {
+				errs = append(errs, invalid(group.Name, fmt.Sprintf("%s[%d].path", field, j), "%s, values repo %d has no path", owner, j+1))
+			}
+			if group.ChartRef != "" {
+				errs = append(errs, invalid(group.Name, fmt.Sprintf("%s[%d].same_as_template", field, j), "%s, values repo %d uses the template repository, but the group renders a chart reference", owner, j+1))
+			}
+			if repo.Path != "" && repo.Format() == "" {
+				errs = append(errs, invalid(group.Name, fmt.Sprintf("%s[%d].path", field, j), "%s, values repo %d has unsupported values file type: %s", owner, j+1, repo.Path))
+			}
+			continue
+		}
+
+		if repo.Owner == "" || repo.Repo == "" || repo.Path == "" {
+			errs = append(errs, invalid(group.Name, fmt.Sprintf("%s[%d]", field, j), "%s, values repo %d has missing fields", owner, j+1))
+		}
+		if repo.Path != "" && repo.Format() == "" {
+			errs = append(errs, invalid(group.Name, fmt.Sprintf("%s[%d].path", field, j), "%s, values repo %d has unsupported values file type: %s", owner, j+1, repo.Path))
+		}
+
+		// Set default branch if not specified
+		if repo.Branch == "" {
+			repos[j].Branch = branch
+		}
+	}
+	return errs
+}
+
+// validateReleases checks the releases of a group and fills in the default
+// branch of their values repositories
+func validateReleases(group *ConfigGroup, label, branch string) ValidationErrors {
+	if len(group.Releases) == 0 {
+		return nil
+	}
+
+	var errs ValidationErrors
+
+	// Each release is written to its own file next to the others
+	if group.OutputRepo.SplitByResource {
+		errs = append(errs, invalid(group.Name, "releases", "group %s cannot split output by resource with releases", label))
+	}
+	if group.OutputRepo.Format == OutputFormatJSON {
+		errs = append(errs, invalid(group.Name, "releases", "group %s cannot write JSON output with releases", label))
+	}
+
+	names := make(map[string]bool)
+	files := make(map[string]bool)
+	for k, release := range group.Releases {
+		field := fmt.Sprintf("releases[%d]", k)
+		if !releaseNamePattern.MatchString(release.Name) || len(release.Name) > 53 {
+			errs = append(errs, invalid(group.Name, field+".name", "group %s, release %d has invalid name %q, expected a lowercase DNS label of at most 53 characters", label, k+1, release.Name))
+		} else if names[release.Name] {
+			errs = append(errs, invalid(group.Name, field+".name", "group %s has more than one release named %s", label, release.Name))
+		}
+		names[release.Name] = true
+
+		if release.Namespace != "" && (!releaseNamePattern.MatchString(release.Namespace) || len(release.Namespace) > 63) {
+			errs = append(errs, invalid(group.Name, field+".namespace", "group %s, release %s has invalid namespace %q", label, release.Name, release.Namespace))
+		}
+
+		filename := release.Filename()
+		if filename != filepath.Base(filename) || filename == "." || filename == ".." || strings.Contains(filename, "\\") {
+			errs = append(errs, invalid(group.Name, field+".output_filename", "group %s, release %s has invalid output filename %q", label, release.Name, filename))
+		} else if files[filename] {
+			errs = append(errs, invalid(group.Name, field+".output_filename", "group %s has more than one release writing %s", label, filename))
+		}
+		files[filename] = true
+
+		errs = append(errs, validateValuesRepos(release.ValuesRepos, group, field+".values_repos", fmt.Sprintf("group %s, release %s", label, release.Name), branch)...)
+	}
+	return errs
+}
+
+// validateConfig validates the configuration, reporting every problem found
+// rather than stopping at the first one. Defaults are filled in along the way.
 func validateConfig(config *Config) error {
+	var errs ValidationErrors
+
 	if len(config.Groups) == 0 {
-		return fmt.Errorf("no configuration groups defined")
+		errs = append(errs, invalid("", "groups", "no configuration groups defined"))
+	}
+
+	for i, repo := range config.HelmRepos {
+		if repo.Name == "" || repo.URL == "" {
+			errs = append(errs, invalid("", fmt.Sprintf("helm_repos[%d]", i), "helm repo %d is missing a name or URL", i+1))
+		}
+	}
+
+	if config.CommitFormat != nil {
+		if err := config.CommitFormat.Validate(); err != nil {
+			errs = append(errs, invalid("", "commit_format", "%v", err))
+		}
+	}
+
+	for i, pattern := range config.AllowedBranches {
+		if _, err := path.Match(pattern, ""); err != nil {
+			errs = append(errs, invalid("", fmt.Sprintf("allowed_branches[%d]", i), "invalid branch pattern %q: %v", pattern, err))
+		}
+	}
+
+	for i, pattern := range config.RedactKeys {
+		if _, err := regexp.Compile(pattern); err != nil {
+			errs = append(errs, invalid("", fmt.Sprintf("redact_keys[%d]", i), "invalid redact pattern %q: %v", pattern, err))
+		}
+	}
+
+	// Repositories without a branch use the group's default branch, then
+	// the top-level one
+	branch := config.DefaultBranch
+	if branch == "" {
+		branch = defaultBranch
+	}
+
+	for i, repo := range config.SharedValuesRepos {
+		if repo.Owner == "" || repo.Repo == "" || repo.Path == "" {
+			errs = append(errs, invalid("", fmt.Sprintf("shared_values_repos[%d]", i), "shared values repo %d has missing fields", i+1))
+		}
+		if repo.SameAsTemplate {
+			errs = append(errs, invalid("", fmt.Sprintf("shared_values_repos[%d].same_as_template", i), "shared values repo %d cannot use the template repository", i+1))
+		}
+		if repo.Path != "" && repo.Format() == "" {
+			errs = append(errs, invalid("", fmt.Sprintf("shared_values_repos[%d].path", i), "shared values repo %d has unsupported values file type: %s", i+1, repo.Path))
+		}
+
+		// Set default branch if not specified
+		if repo.Branch == "" {
+			config.SharedValuesRepos[i].Branch = branch
+		}
 	}
 
 	for i, group := range config.Groups {
+		// Refer to unnamed groups by position in messages
+		label := group.Name
+		if label == "" {
+			label = strconv.Itoa(i + 1)
+		}
+
 		if group.Name == "" {
-			return fmt.Errorf("group %d has no name", i+1)
+			errs = append(errs, invalid("", fmt.Sprintf("groups[%d].name", i), "group %d has no name", i+1))
+		}
+
+		groupBranch := group.DefaultBranch
+		if groupBranch == "" {
+			groupBranch = branch
+		}
+
+		// Groups without an output path use the configured template
+		if group.OutputRepo.Path == "" && config.OutputPathTemplate != "" {
+			group.OutputRepo.Path = config.OutputPathTemplate
+			config.Groups[i].OutputRepo.Path = config.OutputPathTemplate
+		}
+
+		// Every release has values of its own when the group has none
+		hasValues := len(group.ValuesRepos) > 0 || len(config.SharedValuesRepos) > 0
+		if !hasValues && len(group.Releases) > 0 {
+			hasValues = true
+			for _, release := range group.Releases {
+				hasValues = hasValues && len(release.ValuesRepos) > 0
+			}
 		}
+		if !hasValues {
+			errs = append(errs, invalid(group.Name, "values_repos", "group %s has no values repositories", label))
+		}
+
+		errs = append(errs, validateValuesRepos(config.Groups[i].ValuesRepos, &group, "values_repos", "group "+label, groupBranch)...)
+		errs = append(errs, validateReleases(&config.Groups[i], label, groupBranch)...)
 
-		if len(group.ValuesRepos) == 0 {
-			return fmt.Errorf("group %s has no values repositories", group.Name)
+		// Validate template repo override
+		if group.TemplateRepo != nil && (group.TemplateRepo.Owner == "" || group.TemplateRepo.Repo == "") {
+			errs = append(errs, invalid(group.Name, "template_repo", "group %s has invalid template repository", label))
 		}
 
-		for j, repo := range group.ValuesRepos {
-			if repo.Owner == "" || repo.Repo == "" || repo.Path == "" {
-				return fmt.Errorf("group %s, values repo %d has missing fields", group.Name, j+1)
+		// Validate chart reference
+		if group.ChartRef != "" {
+			if !isRemoteChartRef(group.ChartRef) {
+				errs = append(errs, invalid(group.Name, "chart_ref", "group %s has unsupported chart reference: %s", label, group.ChartRef))
+			}
+			if group.TemplateRepo != nil {
+				errs = append(errs, invalid(group.Name, "chart_ref", "group %s cannot set both a chart reference and a template repository", label))
 			}
+			if group.Lint {
+				errs = append(errs, invalid(group.Name, "lint", "group %s cannot lint a chart reference", label))
+			}
+		} else if group.ChartVersion != "" {
+			errs = append(errs, invalid(group.Name, "chart_version", "group %s sets a chart version without a chart reference", label))
+		}
 
-			// Set default branch if not specified
-			if repo.Branch == "" {
-				config.Groups[i].ValuesRepos[j].Branch = "main"
+		// Validate commit format
+		if group.CommitFormat != nil {
+			if err := group.CommitFormat.Validate(); err != nil {
+				errs = append(errs, invalid(group.Name, "commit_format", "group %s has %v", label, err))
+			}
+		}
+
+		// Validate schedule
+		if group.Schedule != "" {
+			if _, err := schedule.Parse(group.Schedule); err != nil {
+				errs = append(errs, invalid(group.Name, "schedule", "group %s has %v", label, err))
+			}
+		}
+
+		// Validate post-renderer. It runs on the server, so one from the
+		// template repository must come from a ref branch pushes can't move.
+		if group.PostRenderer == "" && len(group.PostRendererArgs) > 0 {
+			errs = append(errs, invalid(group.Name, "post_renderer_args", "group %s sets post-renderer arguments without a post-renderer", label))
+		}
+		if strings.Contains(group.PostRenderer, "/") && !filepath.IsAbs(group.PostRenderer) &&
+			(group.TemplateRepo == nil || group.TemplateRepo.Ref == "") {
+			errs = append(errs, invalid(group.Name, "post_renderer",
+				"group %s can only run post-renderer %s from the template repository when template_repo.ref pins it, use an absolute path or a name on the PATH",
+				label, group.PostRenderer))
+		}
+
+		for j, arg := range group.ExtraHelmArgs {
+			if err := validateHelmArg(arg); err != nil {
+				errs = append(errs, invalid(group.Name, fmt.Sprintf("extra_helm_args[%d]", j), "group %s: %v", label, err))
 			}
 		}
 
 		// Validate output repo
 		if group.OutputRepo.Owner == "" || group.OutputRepo.Repo == "" {
-			return fmt.Errorf("group %s has invalid output repository", group.Name)
+			errs = append(errs, invalid(group.Name, "output_repo", "group %s has invalid output repository", label))
+		}
+
+		// Validate output format
+		switch group.OutputRepo.Format {
+		case "", OutputFormatYAML, OutputFormatJSON:
+		default:
+			errs = append(errs, invalid(group.Name, "output_repo.format", "group %s has unsupported output format: %s", label, group.OutputRepo.Format))
+		}
+
+		if group.Name != "" && strings.Contains(group.OutputRepo.Path, GroupPlaceholder) && !isPathSafe(group.Name) {
+			errs = append(errs, invalid(group.Name, "output_repo.path", "group %s cannot be used in output path %s", label, group.OutputRepo.Path))
+		}
+
+		// Validate push strategy
+		switch group.OutputRepo.PushStrategy {
+		case "", PushStrategyRebase, PushStrategyForceWithLease:
+		default:
+			errs = append(errs, invalid(group.Name, "output_repo.push_strategy", "group %s has unsupported push strategy: %s", label, group.OutputRepo.PushStrategy))
+		}
+
+		// Split output needs a directory of its own and is always YAML
+		if group.OutputRepo.SplitByResource {
+			if group.OutputRepo.Path == "" {
+				errs = append(errs, invalid(group.Name, "output_repo.path", "group %s must set an output path to split output by resource", label))
+			}
+			if group.OutputRepo.Format == OutputFormatJSON {
+				errs = append(errs, invalid(group.Name, "output_repo.format", "group %s cannot split JSON output by resource", label))
+			}
+		}
+
+		// Headers are comments, which JSON has no room for
+		if group.OutputRepo.Header != "" {
+			if group.OutputRepo.Format == OutputFormatJSON {
+				errs = append(errs, invalid(group.Name, "output_repo.header", "group %s cannot add a header to JSON output", label))
+			}
+			if _, err := template.New("header").Parse(group.OutputRepo.Header); err != nil {
+				errs = append(errs, invalid(group.Name, "output_repo.header", "group %s has an invalid header template: %v", label, err))
+			}
+		}
+
+		// Validate output file mode
+		if group.OutputRepo.FileMode != "" {
+			if _, err := parseFileMode(group.OutputRepo.FileMode); err != nil {
+				errs = append(errs, invalid(group.Name, "output_repo.file_mode", "group %s has %v", label, err))
+			}
+		}
+
+		// A fork has to belong to someone other than the repository's owner
+		if group.OutputRepo.ForkOwner != "" && group.OutputRepo.ForkOwner == group.OutputRepo.Owner {
+			errs = append(errs, invalid(group.Name, "output_repo.fork_owner", "group %s has a fork owner equal to the repository owner", label))
 		}
 
 		// Set default filename if not specified
 		if group.OutputRepo.Filename == "" {
 			config.Groups[i].OutputRepo.Filename = "generated.yaml"
+			if group.OutputRepo.Format == OutputFormatJSON {
+				config.Groups[i].OutputRepo.Filename = "generated.json"
+			}
 		}
 
 		// Set default branch if not specified
 		if group.OutputRepo.Branch == "" {
-			config.Groups[i].OutputRepo.Branch = "main"
+			config.Groups[i].OutputRepo.Branch = groupBranch
 		}
 	}
 
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// deniedHelmFlags are helm template flags extra arguments may not set: they
+// would move the output away from stdout, run other programs, read files
+// from the server, or override flags the pipeline manages
+var deniedHelmFlags = []string{
+	"--output-dir",
+	"--post-renderer",
+	"--post-renderer-args",
+	"--set-file",
+	"--values",
+	"--kubeconfig",
+	"--version",
+}
+
+// shellMetacharacters never belong in a helm argument
+const shellMetacharacters = ";|&$`<>\\\n"
+
+// validateHelmArg rejects extra helm arguments that are denied or contain
+// shell metacharacters
+func validateHelmArg(arg string) error {
+	if arg == "" {
+		return fmt.Errorf("empty helm argument")
+	}
+	if strings.ContainsAny(arg, shellMetacharacters) {
+		return fmt.Errorf("helm argument %q contains shell metacharacters", arg)
+	}
+
+	// Values files come from the configured repositories only
+	if strings.HasPrefix(arg, "-f") {
+		return fmt.Errorf("helm flag -f is not allowed")
+	}
+
+	flag, _, _ := strings.Cut(arg, "=")
+	for _, denied := range deniedHelmFlags {
+		if flag == denied {
+			return fmt.Errorf("helm flag %s is not allowed", denied)
+		}
+	}
 	return nil
 }
 
-// GetRepoURL returns the GitHub URL for a repository
-func GetRepoURL(owner, repo string) string {
-	return fmt.Sprintf("https://github.com/%s/%s.git", owner, repo)
+// isRemoteChartRef reports whether a chart reference points at an OCI
+// registry or an HTTP(S) URL
+func isRemoteChartRef(ref string) bool {
+	for _, scheme := range []string{"oci://", "http://", "https://"} {
+		if strings.HasPrefix(ref, scheme) {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,755 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/lei/yaml-helm-pipeline/internal/yamlerr"
+)
+
+// writeConfig writes a config file into a temporary directory and returns
+// its path
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// validGroup is a group that passes validation, to which tests append the
+// settings they check
+const validGroup = `
+groups:
+  - name: web
+    values_repos:
+      - owner: acme
+        repo: values
+        path: values.yaml
+    output_repo:
+      owner: acme
+      repo: deploy
+`
+
+// fieldErrors parses a configuration and returns the fields it reports as
+// invalid
+func fieldErrors(t *testing.T, document string) []string {
+	t.Helper()
+
+	_, err := Parse([]byte(document))
+	if err == nil {
+		return nil
+	}
+	var errs ValidationErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("Parse() error = %v, want validation errors", err)
+	}
+
+	fields := make([]string, len(errs))
+	for i, e := range errs {
+		fields[i] = e.Field
+	}
+	return fields
+}
+
+func TestLoadConfigTemplateRepo(t *testing.T) {
+	path := writeConfig(t, `groups:
+  - name: web
+    template_repo:
+      owner: acme
+      repo: charts
+      branch: stable
+    values_repos:
+      - owner: acme
+        repo: values
+        path: web.yaml
+    output_repo:
+      owner: acme
+      repo: deploy
+  - name: api
+    values_repos:
+      - owner: acme
+        repo: values
+        path: api.yaml
+    output_repo:
+      owner: acme
+      repo: deploy
+`)
+
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	if got, want := config.Groups[0].TemplateRepo, (&TemplateRepo{Owner: "acme", Repo: "charts", Branch: "stable"}); !reflect.DeepEqual(got, want) {
+		t.Errorf("web template repo = %+v, want %+v", got, want)
+	}
+	if got := config.Groups[1].TemplateRepo; got != nil {
+		t.Errorf("api template repo = %+v, want the global repository", got)
+	}
+}
+
+func TestTemplateRepoFromEnv(t *testing.T) {
+	t.Setenv("CONFIG_GROUP_1_NAME", "web")
+	t.Setenv("CONFIG_GROUP_1_VALUES_REPO_1", "acme/values:web.yaml:main")
+	t.Setenv("CONFIG_GROUP_1_TEMPLATE_REPO", "acme/charts:stable")
+	t.Setenv("CONFIG_GROUP_1_OUTPUT_REPO", "acme/deploy:web/generated.yaml:main")
+
+	config, err := LoadConfig(filepath.Join(t.TempDir(), "missing.yaml"))
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	if got, want := config.Groups[0].TemplateRepo, (&TemplateRepo{Owner: "acme", Repo: "charts", Branch: "stable"}); !reflect.DeepEqual(got, want) {
+		t.Errorf("template repo = %+v, want %+v", got, want)
+	}
+}
+
+func TestParseTemplateRepoString(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    TemplateRepo
+		wantErr bool
+	}{
+		{"acme/charts", TemplateRepo{Owner: "acme", Repo: "charts"}, false},
+		{"acme/charts:stable", TemplateRepo{Owner: "acme", Repo: "charts", Branch: "stable"}, false},
+		{"charts", TemplateRepo{}, true},
+		{"acme/charts/extra", TemplateRepo{}, true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseTemplateRepoString(tt.value)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseTemplateRepoString(%q) = %+v, %v, want %+v, error %v", tt.value, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestValidateTemplateRepo(t *testing.T) {
+	for _, templateRepo := range []*TemplateRepo{{Repo: "charts"}, {Owner: "acme"}} {
+		config := &Config{Groups: []ConfigGroup{{
+			Name:         "web",
+			ValuesRepos:  []ValuesRepo{{Owner: "acme", Repo: "values", Path: "web.yaml"}},
+			OutputRepo:   OutputRepo{Owner: "acme", Repo: "deploy"},
+			TemplateRepo: templateRepo,
+		}}}
+		if err := validateConfig(config); err == nil || !strings.Contains(err.Error(), "template repository") {
+			t.Errorf("validateConfig() with template repo %+v = %v, want an error", templateRepo, err)
+		}
+	}
+}
+
+func TestValidateChartRef(t *testing.T) {
+	tests := []struct {
+		name         string
+		chartRef     string
+		chartVersion string
+		templateRepo *TemplateRepo
+		wantErr      string
+	}{
+		{name: "OCI", chartRef: "oci://ghcr.io/acme/app", chartVersion: "1.2.3"},
+		{name: "URL", chartRef: "https://charts.example.com/app-1.0.0.tgz"},
+		{name: "local path", chartRef: "./charts/app", wantErr: "unsupported chart reference"},
+		{name: "both sources", chartRef: "oci://ghcr.io/acme/app", templateRepo: &TemplateRepo{Owner: "acme", Repo: "charts"}, wantErr: "both"},
+		{name: "version without reference", chartVersion: "1.2.3", wantErr: "chart version"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &Config{Groups: []ConfigGroup{{
+				Name:         "web",
+				ValuesRepos:  []ValuesRepo{{Owner: "acme", Repo: "values", Path: "web.yaml"}},
+				OutputRepo:   OutputRepo{Owner: "acme", Repo: "deploy"},
+				TemplateRepo: tt.templateRepo,
+				ChartRef:     tt.chartRef,
+				ChartVersion: tt.chartVersion,
+			}}}
+			err := validateConfig(config)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("validateConfig() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("validateConfig() error = %v, want it to mention %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateConfigReportsAllErrors(t *testing.T) {
+	config := &Config{Groups: []ConfigGroup{
+		{ValuesRepos: []ValuesRepo{{Owner: "acme", Repo: "values", Path: "a.yaml"}}},
+		{Name: "api", OutputRepo: OutputRepo{Owner: "acme", Repo: "deploy"}},
+		{Name: "web", ValuesRepos: []ValuesRepo{{Owner: "acme", Repo: "values", Path: "web.yaml"}}, OutputRepo: OutputRepo{Owner: "acme", Repo: "deploy"}},
+	}}
+
+	err := validateConfig(config)
+	var errs ValidationErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("validateConfig() error = %v, want ValidationErrors", err)
+	}
+	want := "group 1 has no name; group 1 has invalid output repository; group api has no values repositories"
+	if err.Error() != want {
+		t.Errorf("validateConfig() error = %q, want %q", err, want)
+	}
+
+	// Defaults are still filled in for the groups that are valid
+	web := config.Groups[2]
+	if web.ValuesRepos[0].Branch != "main" || web.OutputRepo.Filename != "generated.yaml" || web.OutputRepo.Branch != "main" {
+		t.Errorf("web group = %+v, want defaults set", web)
+	}
+}
+
+func TestOutputFileMode(t *testing.T) {
+	tests := []struct {
+		fileMode string
+		want     os.FileMode
+		valid    bool
+	}{
+		{"", 0644, true},
+		{"0640", 0640, true},
+		{"664", 0664, true},
+		{"0888", 0644, false},
+		{"01777", 0644, false},
+		{"rw-r--r--", 0644, false},
+	}
+
+	for _, tt := range tests {
+		repo := OutputRepo{Owner: "acme", Repo: "deploy", FileMode: tt.fileMode}
+		if got := repo.Mode(); got != tt.want {
+			t.Errorf("Mode() of %q = %o, want %o", tt.fileMode, got, tt.want)
+		}
+
+		config := &Config{Groups: []ConfigGroup{{
+			Name:        "web",
+			ValuesRepos: []ValuesRepo{{Owner: "acme", Repo: "values", Path: "web.yaml"}},
+			OutputRepo:  repo,
+		}}}
+		if err := validateConfig(config); (err == nil) != tt.valid {
+			t.Errorf("validateConfig() with file mode %q = %v, want valid %v", tt.fileMode, err, tt.valid)
+		}
+	}
+}
+
+func TestValidatePostRenderer(t *testing.T) {
+	tests := []struct {
+		name    string
+		extra   string
+		invalid bool
+	}{
+		{"name on the PATH", "    post_renderer: kustomize-wrapper\n", false},
+		{"absolute path", "    post_renderer: /usr/local/bin/kustomize-wrapper\n", false},
+		{"relative path", "    post_renderer: ./hack/post-render.sh\n", true},
+		{"relative path on a branch", "    post_renderer: hack/post-render.sh\n    template_repo: {owner: acme, repo: chart, branch: main}\n", true},
+		{"relative path at a pinned ref", "    post_renderer: hack/post-render.sh\n    template_repo: {owner: acme, repo: chart, ref: v1.2.0}\n", false},
+		{"arguments without a post-renderer", "    post_renderer_args: [--overlay, prod]\n", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fields := fieldErrors(t, validGroup+tt.extra)
+			got := strings.Contains(strings.Join(fields, ","), "post_renderer")
+			if got != tt.invalid {
+				t.Errorf("post_renderer reported invalid = %v, want %v (errors: %v)", got, tt.invalid, fields)
+			}
+		})
+	}
+}
+
+func TestReloadConfigIgnoresEnvironment(t *testing.T) {
+	t.Setenv("CONFIG_GROUP_1_NAME", "web")
+	t.Setenv("CONFIG_GROUP_1_VALUES_REPO_1", "acme/values:web.yaml:main")
+	t.Setenv("CONFIG_GROUP_1_OUTPUT_REPO", "acme/deploy:web/generated.yaml:main")
+
+	if _, err := ReloadConfig(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Error("ReloadConfig() of a missing file succeeded, want an error instead of the environment")
+	}
+	if _, err := LoadConfig(filepath.Join(t.TempDir(), "missing.yaml")); err != nil {
+		t.Errorf("LoadConfig() error = %v, want the environment to be used at startup", err)
+	}
+}
+
+func TestValidateSharedValuesRepos(t *testing.T) {
+	config := &Config{
+		SharedValuesRepos: []ValuesRepo{
+			{Owner: "acme", Repo: "base", Path: "values.yaml"},
+			{Owner: "acme", Repo: "base"},
+		},
+		Groups: []ConfigGroup{{Name: "web", OutputRepo: OutputRepo{Owner: "acme", Repo: "deploy"}}},
+	}
+
+	err := validateConfig(config)
+	if want := "shared values repo 2 has missing fields"; err == nil || err.Error() != want {
+		t.Errorf("validateConfig() error = %v, want %q", err, want)
+	}
+	if config.SharedValuesRepos[0].Branch != "main" {
+		t.Errorf("shared values repo = %+v, want the default branch set", config.SharedValuesRepos[0])
+	}
+
+	// Shared values are enough for a group without its own
+	config.SharedValuesRepos = config.SharedValuesRepos[:1]
+	if err := validateConfig(config); err != nil {
+		t.Errorf("validateConfig() error = %v, want a group with only shared values to be valid", err)
+	}
+}
+
+func TestLoadConfigFromHTTP(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/config.yaml" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(validGroup))
+	}))
+	defer server.Close()
+
+	config, err := LoadConfig(server.URL + "/config.yaml")
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	if len(config.Groups) != 1 || config.Groups[0].Name != "web" {
+		t.Errorf("LoadConfig() groups = %+v", config.Groups)
+	}
+
+	// A reload fetches it again
+	config, err = ReloadConfig(server.URL + "/config.yaml")
+	if err != nil {
+		t.Fatalf("ReloadConfig() error = %v", err)
+	}
+	if len(config.Groups) != 1 || config.Groups[0].Name != "web" {
+		t.Errorf("ReloadConfig() groups = %+v", config.Groups)
+	}
+}
+
+func TestLoadConfigRemoteFailureDoesNotFallBack(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	// The environment holds a valid configuration that must not be used
+	t.Setenv("CONFIG_GROUPS", `[{"name":"env","values_repos":[{"owner":"acme","repo":"values","path":"values.yaml"}],"output_repo":{"owner":"acme","repo":"deploy"}}]`)
+
+	if config, err := LoadConfig(server.URL + "/missing.yaml"); err == nil {
+		t.Fatalf("LoadConfig() = %+v, want an error", config.Groups)
+	}
+	if config, err := ReloadConfig(server.URL + "/missing.yaml"); err == nil {
+		t.Fatalf("ReloadConfig() = %+v, want an error", config.Groups)
+	}
+}
+
+func TestRegisterFetcher(t *testing.T) {
+	RegisterFetcher("test", FetcherFunc(func(ctx context.Context, location *url.URL) ([]byte, error) {
+		if location.Host != "configs" || location.Path != "/prod.yaml" {
+			return nil, fmt.Errorf("unexpected location %s", location)
+		}
+		return []byte(validGroup), nil
+	}))
+
+	if _, err := LoadConfig("test://configs/prod.yaml"); err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+}
+
+func TestLoadConfigFromS3(t *testing.T) {
+	var got *http.Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		w.Write([]byte(validGroup))
+	}))
+	defer server.Close()
+
+	t.Setenv("AWS_ENDPOINT_URL_S3", server.URL)
+	t.Setenv("AWS_REGION", "eu-west-1")
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_SESSION_TOKEN", "session")
+
+	if _, err := LoadConfig("s3://configs/prod/pipeline.yaml"); err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	if got.URL.Path != "/configs/prod/pipeline.yaml" {
+		t.Errorf("path = %s, want path-style addressing on a custom endpoint", got.URL.Path)
+	}
+	if got.Header.Get("X-Amz-Security-Token") != "session" {
+		t.Errorf("X-Amz-Security-Token = %q, want the session token", got.Header.Get("X-Amz-Security-Token"))
+	}
+	auth := got.Header.Get("Authorization")
+	date := got.Header.Get("X-Amz-Date")
+	want := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/" + date[:8] + "/eu-west-1/s3/aws4_request, " +
+		"SignedHeaders=host;x-amz-content-sha256;x-amz-date;x-amz-security-token, Signature="
+	if !strings.HasPrefix(auth, want) || len(auth) != len(want)+64 {
+		t.Errorf("Authorization = %q, want a signature with prefix %q", auth, want)
+	}
+
+	if _, err := LoadConfig("s3://configs"); err == nil {
+		t.Error("LoadConfig() of a location without a key succeeded")
+	}
+}
+
+func TestValidateForkOwner(t *testing.T) {
+	tests := []struct {
+		forkOwner string
+		invalid   bool
+	}{
+		{"platform-bot", false},
+		{"acme", true},
+	}
+
+	for _, tt := range tests {
+		document := validGroup + "      fork_owner: " + tt.forkOwner + "\n"
+		fields := fieldErrors(t, document)
+		got := strings.Contains(strings.Join(fields, ","), "output_repo.fork_owner")
+		if got != tt.invalid {
+			t.Errorf("fork_owner %s reported invalid = %v, want %v (errors: %v)", tt.forkOwner, got, tt.invalid, fields)
+		}
+	}
+}
+
+func TestValuesRepoFormat(t *testing.T) {
+	tests := map[string]string{
+		"values.yaml":      ValuesFormatYAML,
+		"values.YML":       ValuesFormatYAML,
+		"values":           ValuesFormatYAML,
+		"env/values.json":  ValuesFormatJSON,
+		"values.toml":      ValuesFormatTOML,
+		"values.env":       "",
+		"values.yaml.orig": "",
+	}
+	for path, want := range tests {
+		if got := (ValuesRepo{Path: path}).Format(); got != want {
+			t.Errorf("Format() of %s = %q, want %q", path, got, want)
+		}
+	}
+
+	document := strings.Replace(validGroup, "path: values.yaml", "path: values.env", 1)
+	if fields := fieldErrors(t, document); !reflect.DeepEqual(fields, []string{"values_repos[0].path"}) {
+		t.Errorf("invalid fields = %v, want the unsupported values file reported", fields)
+	}
+}
+
+func TestOrderValuesRepos(t *testing.T) {
+	repos := []ValuesRepo{
+		{Path: "overrides.yaml", Order: 2},
+		{Path: "base.yaml"},
+		{Path: "env.yaml", Order: 1},
+		{Path: "defaults.yaml"},
+	}
+
+	var got []string
+	for _, repo := range OrderValuesRepos(repos) {
+		got = append(got, repo.Path)
+	}
+	if want := []string{"base.yaml", "defaults.yaml", "env.yaml", "overrides.yaml"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("OrderValuesRepos() = %v, want %v", got, want)
+	}
+	if repos[0].Path != "overrides.yaml" {
+		t.Error("OrderValuesRepos() reordered its argument")
+	}
+}
+
+func TestCommitFormatValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		format CommitFormat
+		valid  bool
+	}{
+		{"default", CommitFormat{}, true},
+		{"conventional", CommitFormat{Style: CommitStyleConventional, Type: "chore", Scope: "helm"}, true},
+		{"trailer", CommitFormat{Trailers: []Trailer{{Key: "Signed-off-by", Value: "Bot <bot@example.com>"}}}, true},
+		{"unknown style", CommitFormat{Style: "gitmoji"}, false},
+		{"type with scope", CommitFormat{Type: "chore(helm)"}, false},
+		{"multiline scope", CommitFormat{Scope: "helm\nchart"}, false},
+		{"empty trailer key", CommitFormat{Trailers: []Trailer{{Value: "x"}}}, false},
+		{"trailer key with colon", CommitFormat{Trailers: []Trailer{{Key: "Refs:", Value: "x"}}}, false},
+		{"multiline trailer", CommitFormat{Trailers: []Trailer{{Key: "Refs", Value: "a\nb"}}}, false},
+	}
+
+	for _, tt := range tests {
+		if err := tt.format.Validate(); (err == nil) != tt.valid {
+			t.Errorf("%s: Validate() = %v, want valid %v", tt.name, err, tt.valid)
+		}
+	}
+
+	document := "commit_format:\n  style: gitmoji\n" + validGroup + "    commit_format:\n      type: \"a b\"\n"
+	if fields := fieldErrors(t, document); !reflect.DeepEqual(fields, []string{"commit_format", "commit_format"}) {
+		t.Errorf("invalid fields = %v, want the top-level and group commit formats", fields)
+	}
+}
+
+func TestValidateSameAsTemplate(t *testing.T) {
+	sameAsTemplate := strings.Replace(validGroup, "      - owner: acme\n        repo: values\n", "      - same_as_template: true\n", 1)
+	if fields := fieldErrors(t, sameAsTemplate); fields != nil {
+		t.Errorf("invalid fields = %v, want a values file from the template repository valid", fields)
+	}
+
+	chartRef := sameAsTemplate + "    chart_ref: oci://registry.example.com/charts/app\n"
+	if fields := fieldErrors(t, chartRef); !reflect.DeepEqual(fields, []string{"values_repos[0].same_as_template"}) {
+		t.Errorf("invalid fields = %v, want the template repository refused with a chart reference", fields)
+	}
+
+	shared := "shared_values_repos:\n  - same_as_template: true\n    path: base.yaml\n" + validGroup
+	if fields := fieldErrors(t, shared); !reflect.DeepEqual(fields, []string{"shared_values_repos[0]", "shared_values_repos[0].same_as_template"}) {
+		t.Errorf("invalid fields = %v, want shared values refused from the template repository", fields)
+	}
+}
+
+func TestParseErrorsReportLine(t *testing.T) {
+	path := writeConfig(t, validGroup+"    output_repo: [\n")
+
+	_, err := loadConfigFromFile(path)
+	if err == nil || !strings.Contains(err.Error(), path+": line 11") {
+		t.Fatalf("loadConfigFromFile() error = %v, want the file and line reported", err)
+	}
+
+	_, err = Parse([]byte("groups:\n  - name: web\n    values_repos: web.yaml\n"))
+	var located *yamlerr.Error
+	if !errors.As(err, &located) || located.Line != 3 {
+		t.Errorf("Parse() error = %v, want a type error on line 3", err)
+	}
+}
+
+func TestBranchAllowed(t *testing.T) {
+	config := &Config{AllowedBranches: []string{"main", "release/*"}}
+
+	tests := []struct {
+		branch string
+		want   bool
+	}{
+		{"main", true},
+		{"release/1.2", true},
+		{"release/1.2/hotfix", false},
+		{"feature", false},
+		{"mainline", false},
+	}
+	for _, tt := range tests {
+		if got := config.BranchAllowed(tt.branch); got != tt.want {
+			t.Errorf("BranchAllowed(%q) = %v, want %v", tt.branch, got, tt.want)
+		}
+	}
+
+	if !(&Config{}).BranchAllowed("anything") {
+		t.Error("BranchAllowed() = false without an allowlist, want every branch allowed")
+	}
+
+	if fields := fieldErrors(t, "allowed_branches: [\"release/[\"]\n"+validGroup); !reflect.DeepEqual(fields, []string{"allowed_branches[0]"}) {
+		t.Errorf("invalid fields = %v, want the malformed pattern reported", fields)
+	}
+}
+
+func TestValidateRedactKeys(t *testing.T) {
+	if fields := fieldErrors(t, "redact_keys: [\"^credential$\", \"api_?key\"]\n"+validGroup); fields != nil {
+		t.Errorf("invalid fields = %v, want the patterns accepted", fields)
+	}
+	if fields := fieldErrors(t, "redact_keys: [\"(\"]\n"+validGroup); !reflect.DeepEqual(fields, []string{"redact_keys[0]"}) {
+		t.Errorf("invalid fields = %v, want the malformed pattern reported", fields)
+	}
+}
+
+func TestResolvePath(t *testing.T) {
+	tests := []struct {
+		path, group, branch string
+		want                string
+		wantErr             bool
+	}{
+		{path: "web", group: "web", branch: "main", want: "web"},
+		{path: "web", group: "web", branch: "", want: "web"},
+		{path: "deploy/{{branch}}/", group: "web", branch: "main", want: "deploy/main/"},
+		{path: "deploy/{{branch}}/", group: "web", branch: "release/1.2", want: "deploy/release/1.2/"},
+		{path: "{{branch}}/{{branch}}", group: "web", branch: "main", want: "main/main"},
+		{path: "deploy/{{branch}}", group: "web", branch: "", wantErr: true},
+		{path: "deploy/{{branch}}", group: "web", branch: "../main", wantErr: true},
+		{path: "deploy/{{branch}}", group: "web", branch: "release//1.2", wantErr: true},
+		{path: "clusters/{{group}}/", group: "web", branch: "", want: "clusters/web/"},
+		{path: "clusters/{{group}}/{{branch}}", group: "web", branch: "main", want: "clusters/web/main"},
+		{path: "clusters/{{group}}/", group: "..", branch: "main", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := OutputRepo{Path: tt.path}.ResolvePath(tt.group, tt.branch)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ResolvePath(%q, %q) on %s = %q, want an error", tt.group, tt.branch, tt.path, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("ResolvePath(%q, %q) on %s = %q, %v, want %q", tt.group, tt.branch, tt.path, got, err, tt.want)
+		}
+	}
+}
+
+func TestOutputPathTemplate(t *testing.T) {
+	config, err := Parse([]byte(`
+output_path_template: clusters/{{group}}/
+groups:
+  - name: web
+    values_repos:
+      - owner: acme
+        repo: values
+        path: web.yaml
+    output_repo:
+      owner: acme
+      repo: deploy
+  - name: api
+    values_repos:
+      - owner: acme
+        repo: values
+        path: api.yaml
+    output_repo:
+      owner: acme
+      repo: deploy
+      path: services/api
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only groups without a path of their own use the template
+	if got := config.Groups[0].OutputRepo.Path; got != "clusters/{{group}}/" {
+		t.Errorf("web output path = %q, want the template", got)
+	}
+	if got := config.Groups[1].OutputRepo.Path; got != "services/api" {
+		t.Errorf("api output path = %q, want its own", got)
+	}
+	if got, err := config.Groups[0].OutputRepo.ResolvePath("web", "main"); err != nil || got != "clusters/web/" {
+		t.Errorf("web resolved path = %q, %v, want clusters/web/", got, err)
+	}
+}
+
+func TestDefaultBranch(t *testing.T) {
+	config, err := Parse([]byte(`
+default_branch: master
+shared_values_repos:
+  - owner: acme
+    repo: base
+    path: base.yaml
+groups:
+  - name: web
+    values_repos:
+      - owner: acme
+        repo: values
+        path: web.yaml
+      - owner: acme
+        repo: values
+        path: pinned.yaml
+        branch: stable
+    output_repo:
+      owner: acme
+      repo: deploy
+  - name: api
+    default_branch: develop
+    values_repos:
+      - owner: acme
+        repo: values
+        path: api.yaml
+    output_repo:
+      owner: acme
+      repo: deploy
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	web, api := config.Groups[0], config.Groups[1]
+	got := []string{
+		config.SharedValuesRepos[0].Branch,
+		web.ValuesRepos[0].Branch, web.ValuesRepos[1].Branch, web.OutputRepo.Branch,
+		api.ValuesRepos[0].Branch, api.OutputRepo.Branch,
+	}
+	want := []string{"master", "master", "stable", "master", "develop", "develop"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("branches = %v, want %v", got, want)
+	}
+
+	// Without a configured default, repositories use main
+	config, err = Parse([]byte(validGroup))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := config.Groups[0].ValuesRepos[0].Branch + " " + config.Groups[0].OutputRepo.Branch; got != "main main" {
+		t.Errorf("branches = %s, want main", got)
+	}
+}
+
+func TestDefaultBranchFromEnv(t *testing.T) {
+	t.Setenv("DEFAULT_BRANCH", "master")
+	t.Setenv("CONFIG_GROUP_1_NAME", "web")
+	t.Setenv("CONFIG_GROUP_1_VALUES_REPO_1", "acme/values:web.yaml")
+	t.Setenv("CONFIG_GROUP_1_OUTPUT_REPO", "acme/deploy:web/generated.yaml")
+	t.Setenv("CONFIG_GROUP_2_NAME", "api")
+	t.Setenv("CONFIG_GROUP_2_DEFAULT_BRANCH", "develop")
+	t.Setenv("CONFIG_GROUP_2_VALUES_REPO_1", "acme/values:api.yaml")
+	t.Setenv("CONFIG_GROUP_2_OUTPUT_REPO", "acme/deploy:api/generated.yaml")
+
+	config, err := LoadConfig(filepath.Join(t.TempDir(), "missing.yaml"))
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	for i, want := range []string{"master", "develop"} {
+		group := config.Groups[i]
+		if group.ValuesRepos[0].Branch != want || group.OutputRepo.Branch != want {
+			t.Errorf("group %s branches = %s and %s, want %s", group.Name, group.ValuesRepos[0].Branch, group.OutputRepo.Branch, want)
+		}
+	}
+}
+
+func TestValidateExtraHelmArgs(t *testing.T) {
+	tests := []struct {
+		args  string
+		valid bool
+	}{
+		{"[--skip-tests, --no-hooks]", true},
+		{"[--kube-version, 1.29.0, --api-versions=batch/v1]", true},
+		{"[--output-dir, /tmp/out]", false},
+		{"[--output-dir=/tmp/out]", false},
+		{"[--post-renderer=/bin/sh]", false},
+		{"[--set-file, key=/etc/passwd]", false},
+		{"[-f, other.yaml]", false},
+		{"[--values=other.yaml]", false},
+		{"[\"--set=name=$(id)\"]", false},
+		{"[\"--skip-tests; rm -rf /\"]", false},
+		{"[\"\"]", false},
+	}
+
+	for _, tt := range tests {
+		fields := fieldErrors(t, validGroup+"    extra_helm_args: "+tt.args+"\n")
+		if tt.valid && fields != nil {
+			t.Errorf("extra_helm_args %s: invalid fields = %v, want them accepted", tt.args, fields)
+		}
+		if !tt.valid && (len(fields) != 1 || !strings.HasPrefix(fields[0], "extra_helm_args[")) {
+			t.Errorf("extra_helm_args %s: invalid fields = %v, want the argument rejected", tt.args, fields)
+		}
+	}
+}
+
+func TestValidateHeader(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		valid  bool
+	}{
+		{"template", `      header: "DO NOT EDIT - generated from {{.Repo}}@{{.Branch}}"` + "\n", true},
+		{"unparsable", `      header: "generated from {{.Repo"` + "\n", false},
+		{"JSON output", "      header: generated\n      format: json\n", false},
+	}
+
+	for _, tt := range tests {
+		fields := fieldErrors(t, validGroup+tt.output)
+		if tt.valid && fields != nil {
+			t.Errorf("%s: invalid fields = %v, want the header accepted", tt.name, fields)
+		}
+		if !tt.valid && !reflect.DeepEqual(fields, []string{"output_repo.header"}) {
+			t.Errorf("%s: invalid fields = %v, want output_repo.header", tt.name, fields)
+		}
+	}
+}
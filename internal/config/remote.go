@@ -0,0 +1,245 @@
+package config
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// remoteFetchTimeout bounds how long fetching a remote configuration may take
+const remoteFetchTimeout = 30 * time.Second
+
+// maxRemoteConfigSize bounds the size of a remote configuration document
+const maxRemoteConfigSize = 10 << 20
+
+// Fetcher retrieves a configuration document from a remote location
+type Fetcher interface {
+	Fetch(ctx context.Context, location *url.URL) ([]byte, error)
+}
+
+// FetcherFunc adapts a function to the Fetcher interface
+type FetcherFunc func(ctx context.Context, location *url.URL) ([]byte, error)
+
+// Fetch implements Fetcher
+func (f FetcherFunc) Fetch(ctx context.Context, location *url.URL) ([]byte, error) {
+	return f(ctx, location)
+}
+
+var (
+	fetchersMu sync.RWMutex
+	fetchers   = map[string]Fetcher{
+		"http":  FetcherFunc(fetchHTTP),
+		"https": FetcherFunc(fetchHTTP),
+		"s3":    FetcherFunc(fetchS3),
+	}
+)
+
+// RegisterFetcher makes configuration locations with the given URL scheme
+// load through a fetcher, replacing any existing fetcher for the scheme
+func RegisterFetcher(scheme string, fetcher Fetcher) {
+	fetchersMu.Lock()
+	defer fetchersMu.Unlock()
+	fetchers[strings.ToLower(scheme)] = fetcher
+}
+
+// remoteFetcher returns the fetcher for a configuration location, or nil if
+// the location is a local path
+func remoteFetcher(configPath string) (*url.URL, Fetcher) {
+	scheme, _, found := strings.Cut(configPath, "://")
+	if !found {
+		return nil, nil
+	}
+
+	location, err := url.Parse(configPath)
+	if err != nil {
+		return nil, nil
+	}
+
+	fetchersMu.RLock()
+	defer fetchersMu.RUnlock()
+	fetcher, ok := fetchers[strings.ToLower(scheme)]
+	if !ok {
+		return nil, nil
+	}
+	return location, fetcher
+}
+
+// loadConfigFromRemote fetches and parses a configuration document
+func loadConfigFromRemote(location *url.URL, fetcher Fetcher) (*Config, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), remoteFetchTimeout)
+	defer cancel()
+
+	data, err := fetcher.Fetch(ctx, location)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch config from %s: %w", redactURL(location), err)
+	}
+
+	return parse(data, redactURL(location))
+}
+
+// fetchHTTP downloads a configuration document over HTTP(S)
+func fetchHTTP(ctx context.Context, location *url.URL) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, location.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return doFetch(req)
+}
+
+// fetchS3 downloads a configuration document from s3://bucket/key. Requests
+// are signed with AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY when set, and
+// AWS_ENDPOINT_URL_S3 points at S3-compatible storage.
+func fetchS3(ctx context.Context, location *url.URL) ([]byte, error) {
+	bucket := location.Host
+	key := strings.TrimPrefix(location.Path, "/")
+	if bucket == "" || key == "" {
+		return nil, fmt.Errorf("s3 location must be s3://bucket/key")
+	}
+
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	// Use virtual-hosted addressing on AWS and path-style on custom endpoints
+	objectURL := fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", bucket, region, s3EscapePath(key))
+	if endpoint := os.Getenv("AWS_ENDPOINT_URL_S3"); endpoint != "" {
+		objectURL = fmt.Sprintf("%s/%s/%s", strings.TrimSuffix(endpoint, "/"), bucket, s3EscapePath(key))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, objectURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if accessKey := os.Getenv("AWS_ACCESS_KEY_ID"); accessKey != "" {
+		signS3Request(req, accessKey, os.Getenv("AWS_SECRET_ACCESS_KEY"), os.Getenv("AWS_SESSION_TOKEN"), region, time.Now())
+	}
+
+	return doFetch(req)
+}
+
+// doFetch performs a GET request and returns the body of a 200 response
+func doFetch(req *http.Request) ([]byte, error) {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxRemoteConfigSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxRemoteConfigSize {
+		return nil, fmt.Errorf("config exceeds %d bytes", maxRemoteConfigSize)
+	}
+	return data, nil
+}
+
+// emptyPayloadHash is the SHA-256 of an empty request body
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// signS3Request adds AWS Signature Version 4 headers to a bodiless S3 request
+func signS3Request(req *http.Request, accessKey, secretKey, sessionToken, region string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", emptyPayloadHash)
+	if sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", sessionToken)
+	}
+
+	// Canonical headers are the host plus every x-amz-* header, sorted
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-amz-") {
+			headers[lower] = strings.TrimSpace(values[0])
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		emptyPayloadHash,
+	}, "\n")
+
+	scope := date + "/" + region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature))
+}
+
+// hmacSHA256 computes an HMAC-SHA256 digest
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3EscapePath percent-encodes an object key the way Signature Version 4
+// expects: everything except unreserved characters and the slashes between
+// segments
+func s3EscapePath(key string) string {
+	var escaped strings.Builder
+	for _, b := range []byte(key) {
+		switch {
+		case b >= 'A' && b <= 'Z', b >= 'a' && b <= 'z', b >= '0' && b <= '9',
+			b == '-', b == '_', b == '.', b == '~', b == '/':
+			escaped.WriteByte(b)
+		default:
+			fmt.Fprintf(&escaped, "%%%02X", b)
+		}
+	}
+	return escaped.String()
+}
+
+// redactURL returns a location suitable for logs, without credentials or
+// query parameters that may hold signatures
+func redactURL(location *url.URL) string {
+	redacted := *location
+	redacted.User = nil
+	redacted.RawQuery = ""
+	return redacted.String()
+}
@@ -0,0 +1,196 @@
+package extractor
+
+import (
+	"fmt"
+	"strings"
+)
+
+// diffContextLines is the number of unchanged lines shown around each hunk
+const diffContextLines = 3
+
+// diffEdit is a single line of an edit script
+type diffEdit struct {
+	op   byte // ' ' for unchanged, '-' for removed, '+' for added
+	line string
+}
+
+// UnifiedDiff produces a git-style unified diff between the old and new
+// content of the file at path. An empty old content is treated as a new file
+// and an empty new content as a deleted one.
+// An empty string is returned when the contents are identical.
+func (s *Service) UnifiedDiff(path string, oldContent, newContent []byte) string {
+	oldLines := splitLines(string(oldContent))
+	newLines := splitLines(string(newContent))
+
+	edits := diffLines(oldLines, newLines)
+
+	// Record the old and new line offsets at the start of each edit
+	oldPos := make([]int, len(edits)+1)
+	newPos := make([]int, len(edits)+1)
+	changed := false
+	for i, e := range edits {
+		oldPos[i+1], newPos[i+1] = oldPos[i], newPos[i]
+		if e.op != '+' {
+			oldPos[i+1]++
+		}
+		if e.op != '-' {
+			newPos[i+1]++
+		}
+		if e.op != ' ' {
+			changed = true
+		}
+	}
+	if !changed {
+		return ""
+	}
+
+	var out strings.Builder
+	if len(oldLines) == 0 {
+		out.WriteString("--- /dev/null\n")
+	} else {
+		fmt.Fprintf(&out, "--- a/%s\n", path)
+	}
+	if len(newLines) == 0 {
+		out.WriteString("+++ /dev/null\n")
+	} else {
+		fmt.Fprintf(&out, "+++ b/%s\n", path)
+	}
+
+	for i := 0; i < len(edits); {
+		// Skip to the next change
+		for i < len(edits) && edits[i].op == ' ' {
+			i++
+		}
+		if i == len(edits) {
+			break
+		}
+
+		// Extend the hunk while changes are close enough to share context
+		start := max(i-diffContextLines, 0)
+		end := i + 1
+		for j := i; j < len(edits); j++ {
+			if edits[j].op != ' ' {
+				end = j + 1
+			} else if j-end >= 2*diffContextLines {
+				break
+			}
+		}
+		stop := min(end+diffContextLines, len(edits))
+
+		fmt.Fprintf(&out, "@@ -%s +%s @@\n",
+			hunkRange(oldPos[start], oldPos[stop]-oldPos[start]),
+			hunkRange(newPos[start], newPos[stop]-newPos[start]))
+
+		for _, e := range edits[start:stop] {
+			out.WriteByte(e.op)
+			out.WriteString(e.line)
+			if !strings.HasSuffix(e.line, "\n") {
+				out.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+
+		i = stop
+	}
+
+	return out.String()
+}
+
+// hunkRange formats a zero-based line range for a hunk header
+func hunkRange(start, count int) string {
+	switch count {
+	case 0:
+		return fmt.Sprintf("%d,0", start)
+	case 1:
+		return fmt.Sprintf("%d", start+1)
+	default:
+		return fmt.Sprintf("%d,%d", start+1, count)
+	}
+}
+
+// splitLines splits content into lines, keeping the line terminators
+func splitLines(content string) []string {
+	if content == "" {
+		return nil
+	}
+	lines := strings.SplitAfter(content, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// diffLines computes a shortest edit script between two sets of lines using
+// Myers' algorithm
+func diffLines(a, b []string) []diffEdit {
+	n, m := len(a), len(b)
+	limit := n + m
+	if limit == 0 {
+		return nil
+	}
+
+	offset := limit + 1
+	v := make([]int, 2*limit+2)
+	var trace [][]int
+
+search:
+	for d := 0; d <= limit; d++ {
+		trace = append(trace, append([]int(nil), v...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				break search
+			}
+		}
+	}
+
+	// Walk the trace backwards to recover the edit script
+	edits := make([]diffEdit, 0, limit)
+	x, y := n, m
+	for d := len(trace) - 1; d >= 0; d-- {
+		v := trace[d]
+		k := x - y
+
+		var prevK int
+		if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := v[offset+prevK]
+		prevY := prevX - prevK
+
+		for x > prevX && y > prevY {
+			edits = append(edits, diffEdit{op: ' ', line: a[x-1]})
+			x--
+			y--
+		}
+
+		if d > 0 {
+			if x == prevX {
+				edits = append(edits, diffEdit{op: '+', line: b[y-1]})
+			} else {
+				edits = append(edits, diffEdit{op: '-', line: a[x-1]})
+			}
+		}
+
+		x, y = prevX, prevY
+	}
+
+	// Reverse into forward order
+	for i, j := 0, len(edits)-1; i < j; i, j = i+1, j-1 {
+		edits[i], edits[j] = edits[j], edits[i]
+	}
+
+	return edits
+}
@@ -0,0 +1,72 @@
+package extractor
+
+import "testing"
+
+func TestUnifiedDiff(t *testing.T) {
+	tests := []struct {
+		name     string
+		old, new string
+		want     string
+	}{
+		{
+			name: "identical",
+			old:  "a: 1\n",
+			new:  "a: 1\n",
+			want: "",
+		},
+		{
+			name: "new file",
+			old:  "",
+			new:  "a: 1\nb: 2\n",
+			want: "--- /dev/null\n+++ b/out.yaml\n@@ -0,0 +1,2 @@\n+a: 1\n+b: 2\n",
+		},
+		{
+			name: "changed line",
+			old:  "a: 1\nb: 2\nc: 3\n",
+			new:  "a: 1\nb: 20\nc: 3\n",
+			want: "--- a/out.yaml\n+++ b/out.yaml\n@@ -1,3 +1,3 @@\n a: 1\n-b: 2\n+b: 20\n c: 3\n",
+		},
+		{
+			name: "removed line",
+			old:  "a: 1\nb: 2\n",
+			new:  "a: 1\n",
+			want: "--- a/out.yaml\n+++ b/out.yaml\n@@ -1,2 +1 @@\n a: 1\n-b: 2\n",
+		},
+		{
+			name: "deleted file",
+			old:  "a: 1\nb: 2\n",
+			new:  "",
+			want: "--- a/out.yaml\n+++ /dev/null\n@@ -1,2 +0,0 @@\n-a: 1\n-b: 2\n",
+		},
+		{
+			name: "missing newline",
+			old:  "a: 1\n",
+			new:  "a: 1\nb: 2",
+			want: "--- a/out.yaml\n+++ b/out.yaml\n@@ -1 +1,2 @@\n a: 1\n+b: 2\n\\ No newline at end of file\n",
+		},
+		{
+			name: "separate hunks",
+			old:  "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n",
+			new:  "one\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\ntwelve\n",
+			want: "--- a/out.yaml\n+++ b/out.yaml\n" +
+				"@@ -1,4 +1,4 @@\n-1\n+one\n 2\n 3\n 4\n" +
+				"@@ -9,4 +9,4 @@\n 9\n 10\n 11\n-12\n+twelve\n",
+		},
+		{
+			name: "shared context",
+			old:  "1\n2\n3\n4\n5\n6\n7\n8\n",
+			new:  "one\n2\n3\n4\n5\n6\n7\neight\n",
+			want: "--- a/out.yaml\n+++ b/out.yaml\n" +
+				"@@ -1,8 +1,8 @@\n-1\n+one\n 2\n 3\n 4\n 5\n 6\n 7\n-8\n+eight\n",
+		},
+	}
+
+	s := NewService()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := s.UnifiedDiff("out.yaml", []byte(tt.old), []byte(tt.new)); got != tt.want {
+				t.Errorf("UnifiedDiff() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
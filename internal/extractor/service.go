@@ -3,28 +3,55 @@ package extractor
 import (
 	"encoding/json"
 	"fmt"
+	"strconv"
+	"unicode"
 
+	"github.com/lei/yaml-helm-pipeline/internal/yamlerr"
 	"gopkg.in/yaml.v3"
 )
 
 // Service handles key extraction from YAML files
-type Service struct{}
+type Service struct {
+	arrayKeys []string
+}
+
+// DefaultArrayKeys identify the elements of arrays of mappings when
+// comparing them, e.g. the name of each container in a container list
+var DefaultArrayKeys = []string{"name"}
 
 // NewService creates a new extractor service
 func NewService() *Service {
-	return &Service{}
+	return &Service{arrayKeys: DefaultArrayKeys}
+}
+
+// WithArrayKeys returns a copy of the service that matches array elements
+// by the given fields, tried in order. The defaults are kept when keys is
+// empty.
+func (s *Service) WithArrayKeys(keys []string) *Service {
+	if len(keys) == 0 {
+		return s
+	}
+	return &Service{arrayKeys: keys}
 }
 
-// ExtractKeys extracts keys from YAML content without their values
-func (s *Service) ExtractKeys(yamlContent []byte) (map[string]interface{}, error) {
+// TruncatedKeys marks a nested mapping left out of ExtractKeys output because
+// it is deeper than the requested depth
+const TruncatedKeys = "{...}"
+
+// ExtractKeys extracts keys from YAML content without their values. A
+// positive maxDepth limits how many levels of keys are returned, replacing
+// deeper mappings with TruncatedKeys; 0 returns every level. Keys are kept
+// in maps, which encoding/json writes in sorted order at every level, so the
+// serialized output is the same for the same content.
+func (s *Service) ExtractKeys(yamlContent []byte, maxDepth int) (map[string]interface{}, error) {
 	var data map[string]interface{}
 	if err := yaml.Unmarshal(yamlContent, &data); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal YAML: %w", err)
+		return nil, fmt.Errorf("failed to unmarshal YAML: %w", yamlerr.Wrap("rendered output", err))
 	}
 
 	// Extract keys recursively
 	result := make(map[string]interface{})
-	s.extractKeysRecursive(data, result)
+	s.extractKeysRecursive(data, result, 1, maxDepth)
 
 	return result, nil
 }
@@ -34,11 +61,11 @@ func (s *Service) CompareYAML(oldYAML, newYAML []byte) (map[string]interface{},
 	var oldData, newData map[string]interface{}
 
 	if err := yaml.Unmarshal(oldYAML, &oldData); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal old YAML: %w", err)
+		return nil, fmt.Errorf("failed to unmarshal old YAML: %w", yamlerr.Wrap("existing output", err))
 	}
 
 	if err := yaml.Unmarshal(newYAML, &newData); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal new YAML: %w", err)
+		return nil, fmt.Errorf("failed to unmarshal new YAML: %w", yamlerr.Wrap("rendered output", err))
 	}
 
 	// Find differences
@@ -48,13 +75,61 @@ func (s *Service) CompareYAML(oldYAML, newYAML []byte) (map[string]interface{},
 	return diff, nil
 }
 
-// extractKeysRecursive extracts keys from a nested map without their values
-func (s *Service) extractKeysRecursive(data, result map[string]interface{}) {
+// DiffSummary counts the keys in a diff by type of change
+type DiffSummary struct {
+	Added   int `json:"added"`
+	Changed int `json:"changed"`
+	Removed int `json:"removed"`
+}
+
+// Summarize counts the added, changed, and removed keys in a diff returned
+// by CompareYAML
+func (s *Service) Summarize(diff map[string]interface{}) DiffSummary {
+	var summary DiffSummary
+	for _, change := range diff {
+		switch change {
+		case "added":
+			summary.Added++
+		case "changed":
+			summary.Changed++
+		case "removed":
+			summary.Removed++
+		}
+	}
+	return summary
+}
+
+// SummarizeNew counts every key returned by ExtractKeys as added, for output
+// that has no previous version
+func (s *Service) SummarizeNew(keys map[string]interface{}) DiffSummary {
+	return DiffSummary{Added: countLeaves(keys)}
+}
+
+// countLeaves counts the leaf keys of a nested key map
+func countLeaves(keys map[string]interface{}) int {
+	count := 0
+	for _, v := range keys {
+		if nested, ok := v.(map[string]interface{}); ok && len(nested) > 0 {
+			count += countLeaves(nested)
+		} else {
+			count++
+		}
+	}
+	return count
+}
+
+// extractKeysRecursive extracts keys from a nested map without their values,
+// stopping below maxDepth levels when it is positive
+func (s *Service) extractKeysRecursive(data, result map[string]interface{}, depth, maxDepth int) {
 	for k, v := range data {
 		switch val := v.(type) {
 		case map[string]interface{}:
+			if maxDepth > 0 && depth >= maxDepth {
+				result[k] = TruncatedKeys
+				continue
+			}
 			nestedResult := make(map[string]interface{})
-			s.extractKeysRecursive(val, nestedResult)
+			s.extractKeysRecursive(val, nestedResult, depth+1, maxDepth)
 			result[k] = nestedResult
 		case []interface{}:
 			// For arrays, we just indicate they exist but don't show values
@@ -69,15 +144,12 @@ func (s *Service) extractKeysRecursive(data, result map[string]interface{}) {
 // findDifferences finds differences between old and new data
 func (s *Service) findDifferences(oldData, newData, diff map[string]interface{}, prefix string) {
 	for k, newVal := range newData {
-		path := k
-		if prefix != "" {
-			path = prefix + "." + k
-		}
+		path := JoinPath(prefix, k)
 
 		oldVal, exists := oldData[k]
 		if !exists {
 			// Key exists in new but not in old
-			diff[path] = "added"
+			s.markLeaves(newVal, diff, path, "added")
 			continue
 		}
 
@@ -92,8 +164,17 @@ func (s *Service) findDifferences(oldData, newData, diff map[string]interface{},
 				diff[path] = "changed"
 			}
 		case []interface{}:
-			// For arrays, we just indicate they changed
-			if _, ok := oldVal.([]interface{}); !ok || !s.compareArrays(oldVal.([]interface{}), newTyped) {
+			oldTyped, ok := oldVal.([]interface{})
+			if !ok {
+				diff[path] = "changed"
+				continue
+			}
+
+			// Compare arrays of identifiable mappings element by element,
+			// and any other array as a whole
+			if key := s.arrayKey(oldTyped, newTyped); key != "" {
+				s.findElementDifferences(oldTyped, newTyped, diff, path, key)
+			} else if !s.compareArrays(oldTyped, newTyped) {
 				diff[path] = "changed"
 			}
 		default:
@@ -108,15 +189,125 @@ func (s *Service) findDifferences(oldData, newData, diff map[string]interface{},
 
 	// Check for keys in old that don't exist in new
 	for k := range oldData {
-		path := k
-		if prefix != "" {
-			path = prefix + "." + k
-		}
+		path := JoinPath(prefix, k)
 
 		if _, exists := newData[k]; !exists {
-			diff[path] = "removed"
+			s.markLeaves(oldData[k], diff, path, "removed")
+		}
+	}
+}
+
+// markLeaves records every leaf path under a value with the given change
+// type, so an added or removed subtree lists each of its keys
+func (s *Service) markLeaves(value interface{}, diff map[string]interface{}, path, changeType string) {
+	nested, ok := value.(map[string]interface{})
+	if !ok || len(nested) == 0 {
+		diff[path] = changeType
+		return
+	}
+
+	for k, v := range nested {
+		s.markLeaves(v, diff, JoinPath(path, k), changeType)
+	}
+}
+
+// JoinPath appends a key to a dotted change path. Keys that contain dots,
+// brackets, quotes, or whitespace, or are empty, are written as a quoted
+// index such as metadata.annotations["prometheus.io/scrape"] so every path
+// names exactly one key.
+func JoinPath(prefix, key string) string {
+	if !simpleKey(key) {
+		return prefix + "[" + strconv.Quote(key) + "]"
+	}
+	if prefix == "" {
+		return key
+	}
+	return prefix + "." + key
+}
+
+// simpleKey reports whether a key can be written in a path without quoting
+func simpleKey(key string) bool {
+	if key == "" {
+		return false
+	}
+	for _, r := range key {
+		if r == '.' || r == '[' || r == ']' || r == '"' || unicode.IsSpace(r) || !unicode.IsPrint(r) {
+			return false
 		}
 	}
+	return true
+}
+
+// arrayKey returns the first configured field that identifies every element
+// of both arrays: each element must be a mapping holding a unique scalar
+// value for it. It returns "" when no field does.
+func (s *Service) arrayKey(a, b []interface{}) string {
+	for _, key := range s.arrayKeys {
+		if indexElements(a, key) != nil && indexElements(b, key) != nil {
+			return key
+		}
+	}
+	return ""
+}
+
+// indexElements maps the identity of each element of an array to the
+// element, or returns nil if some element can't be identified by key
+func indexElements(elements []interface{}, key string) map[string]map[string]interface{} {
+	if len(elements) == 0 {
+		return nil
+	}
+
+	index := make(map[string]map[string]interface{}, len(elements))
+	for _, element := range elements {
+		mapping, ok := element.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+
+		var id string
+		switch value := mapping[key].(type) {
+		case string:
+			id = value
+		case int, int64, uint64, float64, bool:
+			id = fmt.Sprint(value)
+		default:
+			return nil
+		}
+
+		if _, duplicate := index[id]; duplicate {
+			return nil
+		}
+		index[id] = mapping
+	}
+	return index
+}
+
+// findElementDifferences compares two arrays of mappings by the value of
+// key, reporting changes under paths such as containers[name="app"].image.
+// Elements that only moved are not reported.
+func (s *Service) findElementDifferences(oldElements, newElements []interface{}, diff map[string]interface{}, prefix, key string) {
+	oldIndex := indexElements(oldElements, key)
+	newIndex := indexElements(newElements, key)
+
+	for id, newElement := range newIndex {
+		path := elementPath(prefix, key, id)
+		if oldElement, exists := oldIndex[id]; exists {
+			s.findDifferences(oldElement, newElement, diff, path)
+		} else {
+			s.markLeaves(newElement, diff, path, "added")
+		}
+	}
+
+	for id, oldElement := range oldIndex {
+		if _, exists := newIndex[id]; !exists {
+			s.markLeaves(oldElement, diff, elementPath(prefix, key, id), "removed")
+		}
+	}
+}
+
+// elementPath returns the path of an array element identified by key
+func elementPath(prefix, key, id string) string {
+	return prefix + "[" + key + "=" + strconv.Quote(id) + "]"
 }
 
 // compareArrays compares two arrays for equality
@@ -0,0 +1,320 @@
+package extractor
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCompareYAML(t *testing.T) {
+	tests := []struct {
+		name     string
+		old, new string
+		want     map[string]interface{}
+	}{
+		{
+			name: "scalar change",
+			old:  "spec:\n  replicas: 1\n",
+			new:  "spec:\n  replicas: 2\n",
+			want: map[string]interface{}{"spec.replicas": "changed"},
+		},
+		{
+			name: "added nested map",
+			old:  "spec:\n  replicas: 1\n",
+			new:  "spec:\n  replicas: 1\n  resources:\n    limits:\n      cpu: 1\n      memory: 1Gi\n    requests: {}\n",
+			want: map[string]interface{}{
+				"spec.resources.limits.cpu":    "added",
+				"spec.resources.limits.memory": "added",
+				"spec.resources.requests":      "added",
+			},
+		},
+		{
+			name: "removed nested map",
+			old:  "metadata:\n  labels:\n    app: web\n    tier: front\nkind: Service\n",
+			new:  "kind: Service\n",
+			want: map[string]interface{}{
+				"metadata.labels.app":  "removed",
+				"metadata.labels.tier": "removed",
+			},
+		},
+		{
+			name: "map replacing a scalar",
+			old:  "data: none\n",
+			new:  "data:\n  key: value\n",
+			want: map[string]interface{}{"data": "changed"},
+		},
+		{
+			name: "dotted keys",
+			old:  "metadata:\n  annotations:\n    prometheus.io/scrape: \"true\"\n",
+			new:  "metadata:\n  annotations:\n    prometheus.io/scrape: \"false\"\n    prometheus.io:\n      scrape: \"true\"\n",
+			want: map[string]interface{}{
+				`metadata.annotations["prometheus.io/scrape"]`: "changed",
+				`metadata.annotations["prometheus.io"].scrape`: "added",
+			},
+		},
+	}
+
+	s := NewService()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := s.CompareYAML([]byte(tt.old), []byte(tt.new))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("CompareYAML() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSummarize(t *testing.T) {
+	s := NewService()
+
+	diff, err := s.CompareYAML(
+		[]byte("kind: Deployment\nspec:\n  replicas: 1\n  paused: false\n  strategy: Recreate\nmetadata:\n  labels:\n    app: web\n"),
+		[]byte("kind: Deployment\nspec:\n  replicas: 2\n  template:\n    labels:\n      app: web\n      tier: front\n  minReadySeconds: 5\nmetadata: {}\n"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := DiffSummary{Added: 3, Changed: 1, Removed: 3}
+	if got := s.Summarize(diff); got != want {
+		t.Errorf("Summarize(%v) = %+v, want %+v", diff, got, want)
+	}
+
+	keys, err := s.ExtractKeys([]byte("kind: Service\nmetadata:\n  name: web\n  labels:\n    app: web\nspec: {}\n"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := s.SummarizeNew(keys), (DiffSummary{Added: 4}); got != want {
+		t.Errorf("SummarizeNew(%v) = %+v, want %+v", keys, got, want)
+	}
+}
+
+func TestExtractKeysSerializesInSortedOrder(t *testing.T) {
+	s := NewService()
+	content := []byte(`
+spec:
+  template:
+    spec:
+      volumes: []
+      containers:
+        - name: app
+  selector: {}
+  replicas: 3
+metadata:
+  name: web
+  labels:
+    zone: b
+    app: web
+kind: Deployment
+apiVersion: apps/v1
+`)
+	want := `{"apiVersion":"...","kind":"...","metadata":{"labels":{"app":"...","zone":"..."},"name":"..."},` +
+		`"spec":{"replicas":"...","selector":{},"template":{"spec":{"containers":"[...]","volumes":"[...]"}}}}`
+
+	// Map iteration order varies from run to run, so extract repeatedly
+	for i := 0; i < 20; i++ {
+		keys, err := s.ExtractKeys(content, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := json.Marshal(keys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Fatalf("ExtractKeys() serialized as %s, want %s", got, want)
+		}
+	}
+}
+
+func TestExtractKeysDepth(t *testing.T) {
+	content := []byte("kind: Deployment\nmetadata:\n  name: web\n  labels:\n    app: web\nspec:\n  ports: [80]\n")
+
+	tests := []struct {
+		depth int
+		want  map[string]interface{}
+	}{
+		{
+			depth: 1,
+			want:  map[string]interface{}{"kind": "...", "metadata": TruncatedKeys, "spec": TruncatedKeys},
+		},
+		{
+			depth: 2,
+			want: map[string]interface{}{
+				"kind":     "...",
+				"metadata": map[string]interface{}{"name": "...", "labels": TruncatedKeys},
+				"spec":     map[string]interface{}{"ports": "[...]"},
+			},
+		},
+		{
+			depth: 0,
+			want: map[string]interface{}{
+				"kind":     "...",
+				"metadata": map[string]interface{}{"name": "...", "labels": map[string]interface{}{"app": "..."}},
+				"spec":     map[string]interface{}{"ports": "[...]"},
+			},
+		},
+	}
+
+	s := NewService()
+	for _, tt := range tests {
+		got, err := s.ExtractKeys(content, tt.depth)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ExtractKeys(depth %d) = %v, want %v", tt.depth, got, tt.want)
+		}
+	}
+}
+
+func TestParseErrorsReportLine(t *testing.T) {
+	s := NewService()
+	valid := []byte("kind: ConfigMap\n")
+	invalid := []byte("kind: ConfigMap\nmetadata:\n  name: web\n   labels: {}\n")
+
+	if _, err := s.ExtractKeys(invalid, 0); err == nil || !strings.Contains(err.Error(), "rendered output: line 4") {
+		t.Errorf("ExtractKeys() error = %v, want the line reported", err)
+	}
+	if _, err := s.CompareYAML(invalid, valid); err == nil || !strings.Contains(err.Error(), "existing output: line 4") {
+		t.Errorf("CompareYAML() error = %v, want the line in the existing output reported", err)
+	}
+	if _, err := s.CompareYAML(valid, invalid); err == nil || !strings.Contains(err.Error(), "rendered output: line 4") {
+		t.Errorf("CompareYAML() error = %v, want the line in the rendered output reported", err)
+	}
+}
+
+func TestJoinPath(t *testing.T) {
+	tests := []struct {
+		prefix, key string
+		want        string
+	}{
+		{"", "metadata", "metadata"},
+		{"metadata", "name", "metadata.name"},
+		{"metadata.annotations", "prometheus.io/scrape", `metadata.annotations["prometheus.io/scrape"]`},
+		{"", "app.kubernetes.io/name", `["app.kubernetes.io/name"]`},
+		{"data", "with space", `data["with space"]`},
+		{"data", `say "hi"`, `data["say \"hi\""]`},
+		{"data", "list[0]", `data["list[0]"]`},
+		{"data", "", `data[""]`},
+		{"metadata", "app/name", "metadata.app/name"},
+	}
+
+	for _, tt := range tests {
+		if got := JoinPath(tt.prefix, tt.key); got != tt.want {
+			t.Errorf("JoinPath(%q, %q) = %s, want %s", tt.prefix, tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestCompareYAMLKeyedArrays(t *testing.T) {
+	old := `spec:
+  containers:
+    - name: app
+      image: app:1
+      env:
+        - name: LOG_LEVEL
+          value: info
+    - name: sidecar
+      image: proxy:1
+  args: [--verbose]
+`
+	tests := []struct {
+		name string
+		new  string
+		keys []string
+		want map[string]interface{}
+	}{
+		{
+			name: "changed, added, and removed containers",
+			new: `spec:
+  containers:
+    - name: app
+      image: app:2
+      env:
+        - name: LOG_LEVEL
+          value: debug
+    - name: metrics
+      image: exporter:1
+  args: [--verbose]
+`,
+			want: map[string]interface{}{
+				`spec.containers[name="app"].image`:                       "changed",
+				`spec.containers[name="app"].env[name="LOG_LEVEL"].value`: "changed",
+				`spec.containers[name="metrics"].name`:                    "added",
+				`spec.containers[name="metrics"].image`:                   "added",
+				`spec.containers[name="sidecar"].name`:                    "removed",
+				`spec.containers[name="sidecar"].image`:                   "removed",
+			},
+		},
+		{
+			name: "reordered containers",
+			new: `spec:
+  containers:
+    - name: sidecar
+      image: proxy:1
+    - name: app
+      image: app:1
+      env:
+        - name: LOG_LEVEL
+          value: info
+  args: [--verbose]
+`,
+			want: map[string]interface{}{},
+		},
+		{
+			name: "scalar arrays compared whole",
+			new: `spec:
+  containers:
+    - name: app
+      image: app:1
+      env:
+        - name: LOG_LEVEL
+          value: info
+    - name: sidecar
+      image: proxy:1
+  args: [--quiet]
+`,
+			want: map[string]interface{}{"spec.args": "changed"},
+		},
+		{
+			name: "configured key",
+			new: `spec:
+  containers:
+    - name: app
+      image: app:2
+      env:
+        - name: LOG_LEVEL
+          value: info
+    - name: sidecar
+      image: proxy:1
+  args: [--verbose]
+`,
+			keys: []string{"image"},
+			want: map[string]interface{}{
+				`spec.containers[image="app:1"].name`:  "removed",
+				`spec.containers[image="app:1"].image`: "removed",
+				`spec.containers[image="app:1"].env`:   "removed",
+				`spec.containers[image="app:2"].name`:  "added",
+				`spec.containers[image="app:2"].image`: "added",
+				`spec.containers[image="app:2"].env`:   "added",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewService().WithArrayKeys(tt.keys).CompareYAML([]byte(old), []byte(tt.new))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("CompareYAML() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,264 @@
+package git
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// ErrPushConflict is returned when a commit can't be replayed on a remote
+// branch because both changed the same files
+var ErrPushConflict = errors.New("remote branch changed the same files")
+
+// ErrLeaseBroken is returned when a force push with lease is refused because
+// the remote branch moved since it was cloned
+var ErrLeaseBroken = errors.New("remote branch moved since it was cloned")
+
+// maxRebaseAttempts bounds how often a commit is replayed on a remote branch
+// that keeps moving
+const maxRebaseAttempts = 3
+
+// isNonFastForward reports whether a push was rejected because the remote
+// branch has commits the local branch doesn't
+func isNonFastForward(err error) bool {
+	return errors.Is(err, git.ErrNonFastForwardUpdate) ||
+		(err != nil && strings.Contains(err.Error(), "non-fast-forward update"))
+}
+
+// pushOntoRemote pushes a commit whose push was rejected because the remote
+// branch doesn't fast-forward to it. The commit is replayed on the remote
+// branch, or, with forceWithLease, pushed over it as long as the remote
+// branch is still where it was cloned. It returns the hash of the commit
+// that was pushed, or the zero hash if the remote branch already had the
+// changes.
+func (s *Service) pushOntoRemote(repo *git.Repository, worktree *git.Worktree, commit plumbing.Hash, message string, forceWithLease bool) (plumbing.Hash, error) {
+	head, err := repo.Head()
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("failed to resolve HEAD: %w", err)
+	}
+	branch := head.Name()
+
+	if forceWithLease {
+		if err := s.forcePush(repo, branch); err != nil {
+			return plumbing.ZeroHash, err
+		}
+		return commit, nil
+	}
+
+	for attempt := 0; attempt < maxRebaseAttempts; attempt++ {
+		remote, err := s.fetchBranch(repo, branch)
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+
+		commit, err = replayCommit(repo, worktree, commit, remote, message)
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		if commit.IsZero() {
+			return commit, nil
+		}
+
+		err = s.push(repo, &git.PushOptions{})
+		if err == nil {
+			return commit, nil
+		}
+		if !isNonFastForward(err) {
+			return plumbing.ZeroHash, err
+		}
+	}
+
+	return plumbing.ZeroHash, fmt.Errorf("remote branch %s kept moving, gave up after %d attempts", branch.Short(), maxRebaseAttempts)
+}
+
+// forcePush pushes a branch over the remote branch, leased on the commit
+// the remote-tracking ref recorded when the branch was cloned. Nothing has
+// fetched into that ref yet, so the push fails with ErrLeaseBroken if anyone
+// else pushed to the branch in the meantime instead of overwriting their
+// commits.
+func (s *Service) forcePush(repo *git.Repository, branch plumbing.ReferenceName) error {
+	tracking, err := repo.Reference(plumbing.NewRemoteReferenceName(git.DefaultRemoteName, branch.Short()), true)
+	if errors.Is(err, plumbing.ErrReferenceNotFound) {
+		// The branch didn't exist when it was cloned, but it does now
+		return fmt.Errorf("%w: %s was created by someone else", ErrLeaseBroken, branch.Short())
+	}
+	if err != nil {
+		return fmt.Errorf("failed to resolve the cloned commit of %s: %w", branch.Short(), err)
+	}
+
+	err = s.push(repo, &git.PushOptions{
+		Force:          true,
+		ForceWithLease: &git.ForceWithLease{RefName: branch, Hash: tracking.Hash()},
+	})
+	if isNonFastForward(err) {
+		return fmt.Errorf("%w: %s is no longer at %s", ErrLeaseBroken, branch.Short(), tracking.Hash())
+	}
+	if err != nil {
+		return fmt.Errorf("failed to force push over %s: %w", branch.Short(), err)
+	}
+	return nil
+}
+
+// fetchBranch fetches a branch from origin and returns its hash
+func (s *Service) fetchBranch(repo *git.Repository, branch plumbing.ReferenceName) (plumbing.Hash, error) {
+	remoteRef := plumbing.NewRemoteReferenceName(git.DefaultRemoteName, branch.Short())
+
+	err := s.retry.Do(context.Background(), func() error {
+		auth, err := s.auth()
+		if err != nil {
+			return err
+		}
+
+		err = repo.Fetch(&git.FetchOptions{
+			RefSpecs: []config.RefSpec{config.RefSpec("+" + branch.String() + ":" + remoteRef.String())},
+			Auth:     auth,
+		})
+		if errors.Is(err, git.NoErrAlreadyUpToDate) {
+			return nil
+		}
+		return classifyError(err)
+	})
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("failed to fetch %s: %w", branch.Short(), err)
+	}
+
+	ref, err := repo.Reference(remoteRef, true)
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("failed to resolve %s: %w", remoteRef, err)
+	}
+	return ref.Hash(), nil
+}
+
+// replayCommit re-applies the changes a commit made to its parent on top of
+// another commit, resetting the checked out branch to it and committing the
+// result with the same message. Files changed differently on both sides are
+// a conflict. The zero hash is returned if onto already has every change.
+func replayCommit(repo *git.Repository, worktree *git.Worktree, commit, onto plumbing.Hash, message string) (plumbing.Hash, error) {
+	ours, err := repo.CommitObject(commit)
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("failed to read commit %s: %w", commit, err)
+	}
+	oursTree, err := ours.Tree()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	// A first commit on a new branch replays onto an empty tree
+	baseTree := &object.Tree{}
+	if ours.NumParents() > 0 {
+		parent, err := ours.Parent(0)
+		if err != nil {
+			return plumbing.ZeroHash, fmt.Errorf("failed to read parent of %s: %w", commit, err)
+		}
+		if baseTree, err = parent.Tree(); err != nil {
+			return plumbing.ZeroHash, err
+		}
+	}
+
+	theirs, err := repo.CommitObject(onto)
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("failed to read commit %s: %w", onto, err)
+	}
+	theirsTree, err := theirs.Tree()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	ourChanges, err := object.DiffTree(baseTree, oursTree)
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("failed to diff commit %s: %w", commit, err)
+	}
+	theirChanges, err := object.DiffTree(baseTree, theirsTree)
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("failed to diff commit %s: %w", onto, err)
+	}
+
+	changedByThem := make(map[string]bool)
+	for _, change := range theirChanges {
+		changedByThem[changePath(change)] = true
+	}
+
+	// Both sides may change a file as long as they agree on its content
+	var conflicts []string
+	for _, change := range ourChanges {
+		name := changePath(change)
+		if changedByThem[name] && entryHash(oursTree, name) != entryHash(theirsTree, name) {
+			conflicts = append(conflicts, name)
+		}
+	}
+	if len(conflicts) > 0 {
+		return plumbing.ZeroHash, fmt.Errorf("%w since it was cloned: %s", ErrPushConflict, strings.Join(conflicts, ", "))
+	}
+
+	if err := worktree.Reset(&git.ResetOptions{Commit: onto, Mode: git.HardReset}); err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("failed to reset to %s: %w", onto, err)
+	}
+
+	root := worktree.Filesystem.Root()
+	for _, change := range ourChanges {
+		name := changePath(change)
+		target := filepath.Join(root, filepath.FromSlash(name))
+
+		file, err := oursTree.File(name)
+		if errors.Is(err, object.ErrFileNotFound) {
+			if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+				return plumbing.ZeroHash, fmt.Errorf("failed to remove %s: %w", name, err)
+			}
+			continue
+		}
+		if err != nil {
+			return plumbing.ZeroHash, fmt.Errorf("failed to read %s: %w", name, err)
+		}
+
+		content, err := file.Contents()
+		if err != nil {
+			return plumbing.ZeroHash, fmt.Errorf("failed to read %s: %w", name, err)
+		}
+		mode, err := file.Mode.ToOSFileMode()
+		if err != nil {
+			mode = 0644
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return plumbing.ZeroHash, fmt.Errorf("failed to create directory for %s: %w", name, err)
+		}
+		if err := os.WriteFile(target, []byte(content), mode.Perm()); err != nil {
+			return plumbing.ZeroHash, fmt.Errorf("failed to write %s: %w", name, err)
+		}
+	}
+
+	status, err := worktree.Status()
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("failed to get repository status: %w", err)
+	}
+	if status.IsClean() {
+		return plumbing.ZeroHash, nil
+	}
+
+	return commitAll(worktree, message)
+}
+
+// changePath returns the path a tree change applies to
+func changePath(change *object.Change) string {
+	if change.To.Name != "" {
+		return change.To.Name
+	}
+	return change.From.Name
+}
+
+// entryHash returns the blob hash of a file in a tree, or the zero hash if
+// the tree doesn't have it
+func entryHash(tree *object.Tree, name string) plumbing.Hash {
+	entry, err := tree.FindEntry(name)
+	if err != nil {
+		return plumbing.ZeroHash
+	}
+	return entry.Hash
+}
@@ -0,0 +1,253 @@
+package git
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/lei/yaml-helm-pipeline/internal/retry"
+)
+
+// newRemote creates a bare repository whose master branch holds files
+func newRemote(t *testing.T, files map[string]string) string {
+	t.Helper()
+
+	remote := t.TempDir()
+	if _, err := git.PlainInit(remote, true); err != nil {
+		t.Fatal(err)
+	}
+
+	work := t.TempDir()
+	repo, err := git.PlainInit(work, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.CreateRemote(&config.RemoteConfig{Name: git.DefaultRemoteName, URLs: []string{remote}}); err != nil {
+		t.Fatal(err)
+	}
+	commitFiles(t, work, files)
+	if err := repo.Push(&git.PushOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	return remote
+}
+
+// pushToRemote makes a commit changing files on the remote's master branch,
+// as someone else would
+func pushToRemote(t *testing.T, remote string, files map[string]string) {
+	t.Helper()
+
+	work := t.TempDir()
+	repo, err := git.PlainClone(work, false, &git.CloneOptions{URL: remote})
+	if err != nil {
+		t.Fatal(err)
+	}
+	commitFiles(t, work, files)
+	if err := repo.Push(&git.PushOptions{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// commitFiles writes files into a worktree and commits them
+func commitFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+
+	writeFiles(t, dir, files)
+	repo, err := git.PlainOpen(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	worktree, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := worktree.AddWithOptions(&git.AddOptions{All: true}); err != nil {
+		t.Fatal(err)
+	}
+	_, err = worktree.Commit("test commit", &git.CommitOptions{
+		Author: &object.Signature{Name: "Test", Email: "test@example.com", When: time.Now()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeFiles writes files into a directory
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// remoteFile returns the content of a file on the remote's master branch
+func remoteFile(t *testing.T, remote, name string) string {
+	t.Helper()
+
+	repo, err := git.PlainOpen(remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := repo.Reference(plumbing.Master, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit, err := repo.CommitObject(ref.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := commit.File(name)
+	if errors.Is(err, object.ErrFileNotFound) {
+		return ""
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := file.Contents()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return content
+}
+
+// cloneRemote clones the remote's master branch with the service under test
+func cloneRemote(t *testing.T, s *Service, remote string) string {
+	t.Helper()
+
+	dir := filepath.Join(t.TempDir(), "clone")
+	if err := s.CloneRepository(remote, dir, "master"); err != nil {
+		t.Fatalf("CloneRepository() error = %v", err)
+	}
+	return dir
+}
+
+func newTestService() *Service {
+	return NewService("token", retry.Policy{MaxAttempts: 1})
+}
+
+func TestCommitAndPushFastForward(t *testing.T) {
+	remote := newRemote(t, map[string]string{"generated.yaml": "a: 1\n"})
+	s := newTestService()
+	dir := cloneRemote(t, s, remote)
+
+	writeFiles(t, dir, map[string]string{"generated.yaml": "a: 2\n"})
+	sha, err := s.CommitAndPush(dir, "Update", false)
+	if err != nil {
+		t.Fatalf("CommitAndPush() error = %v", err)
+	}
+	if sha == "" {
+		t.Fatal("CommitAndPush() made no commit")
+	}
+	if got := remoteFile(t, remote, "generated.yaml"); got != "a: 2\n" {
+		t.Errorf("remote generated.yaml = %q, want the pushed change", got)
+	}
+}
+
+func TestCommitAndPushNothingToCommit(t *testing.T) {
+	remote := newRemote(t, map[string]string{"generated.yaml": "a: 1\n"})
+	s := newTestService()
+	dir := cloneRemote(t, s, remote)
+
+	sha, err := s.CommitAndPush(dir, "Update", false)
+	if err != nil || sha != "" {
+		t.Errorf("CommitAndPush() = %q, %v, want no commit", sha, err)
+	}
+}
+
+func TestCommitAndPushRebasesOntoRemoteChanges(t *testing.T) {
+	remote := newRemote(t, map[string]string{"generated.yaml": "a: 1\n", "README.md": "docs\n"})
+	s := newTestService()
+	dir := cloneRemote(t, s, remote)
+
+	// Someone else changes another file after the clone
+	pushToRemote(t, remote, map[string]string{"README.md": "new docs\n"})
+
+	writeFiles(t, dir, map[string]string{"generated.yaml": "a: 2\n"})
+	if _, err := s.CommitAndPush(dir, "Update", false); err != nil {
+		t.Fatalf("CommitAndPush() error = %v", err)
+	}
+	if got := remoteFile(t, remote, "generated.yaml"); got != "a: 2\n" {
+		t.Errorf("remote generated.yaml = %q, want the pushed change", got)
+	}
+	if got := remoteFile(t, remote, "README.md"); got != "new docs\n" {
+		t.Errorf("remote README.md = %q, want the other commit kept", got)
+	}
+}
+
+func TestCommitAndPushReportsConflicts(t *testing.T) {
+	remote := newRemote(t, map[string]string{"generated.yaml": "a: 1\n"})
+	s := newTestService()
+	dir := cloneRemote(t, s, remote)
+
+	pushToRemote(t, remote, map[string]string{"generated.yaml": "a: 3\n"})
+
+	writeFiles(t, dir, map[string]string{"generated.yaml": "a: 2\n"})
+	_, err := s.CommitAndPush(dir, "Update", false)
+	if !errors.Is(err, ErrPushConflict) || !errors.Is(err, ErrPushFailed) {
+		t.Fatalf("CommitAndPush() error = %v, want ErrPushConflict", err)
+	}
+	if got := remoteFile(t, remote, "generated.yaml"); got != "a: 3\n" {
+		t.Errorf("remote generated.yaml = %q, want the other commit kept", got)
+	}
+}
+
+func TestCommitAndPushLeaseRefusesToOverwriteNewCommits(t *testing.T) {
+	remote := newRemote(t, map[string]string{"generated.yaml": "a: 1\n", "README.md": "docs\n"})
+	s := newTestService()
+	dir := cloneRemote(t, s, remote)
+
+	pushToRemote(t, remote, map[string]string{"README.md": "new docs\n"})
+
+	writeFiles(t, dir, map[string]string{"generated.yaml": "a: 2\n"})
+	_, err := s.CommitAndPush(dir, "Update", true)
+	if !errors.Is(err, ErrLeaseBroken) {
+		t.Fatalf("CommitAndPush() error = %v, want ErrLeaseBroken", err)
+	}
+	if got := remoteFile(t, remote, "README.md"); got != "new docs\n" {
+		t.Errorf("remote README.md = %q, want the other commit kept", got)
+	}
+}
+
+func TestCommitAndPushLeaseOverwritesDivergedHistory(t *testing.T) {
+	remote := newRemote(t, map[string]string{"generated.yaml": "a: 1\n"})
+	pushToRemote(t, remote, map[string]string{"generated.yaml": "a: 2\n"})
+	s := newTestService()
+	dir := cloneRemote(t, s, remote)
+
+	// Rewind the clone, so its commit doesn't descend from the remote branch
+	repo, err := git.PlainOpen(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, err := repo.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit, err := repo.CommitObject(head.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	worktree, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := worktree.Reset(&git.ResetOptions{Commit: commit.ParentHashes[0], Mode: git.HardReset}); err != nil {
+		t.Fatal(err)
+	}
+
+	writeFiles(t, dir, map[string]string{"generated.yaml": "a: 3\n"})
+	if _, err := s.CommitAndPush(dir, "Update", true); err != nil {
+		t.Fatalf("CommitAndPush() error = %v", err)
+	}
+	if got := remoteFile(t, remote, "generated.yaml"); got != "a: 3\n" {
+		t.Errorf("remote generated.yaml = %q, want the force pushed change", got)
+	}
+}
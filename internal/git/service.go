@@ -1,95 +1,276 @@
 package git
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strings"
 	"time"
 
 	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
 	"github.com/go-git/go-git/v5/plumbing"
 	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
 	"github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/lei/yaml-helm-pipeline/internal/retry"
+	"golang.org/x/oauth2"
 )
 
 // Service handles Git operations
 type Service struct {
-	token string
+	tokens  oauth2.TokenSource
+	retry   retry.Policy
+	workDir string // Base directory for clones, see SetWorkDir
 }
 
 // NewService creates a new Git service
-func NewService(token string) *Service {
+func NewService(token string, retryPolicy retry.Policy) *Service {
+	return NewServiceWithTokenSource(oauth2.StaticTokenSource(&oauth2.Token{AccessToken: token}), retryPolicy)
+}
+
+// NewServiceWithTokenSource creates a Git service whose credentials come from
+// a token source, such as short-lived GitHub App installation tokens
+func NewServiceWithTokenSource(tokens oauth2.TokenSource, retryPolicy retry.Policy) *Service {
 	return &Service{
-		token: token,
+		tokens: tokens,
+		retry:  retryPolicy,
 	}
 }
 
-// CloneRepository clones a repository to a local directory
-func (s *Service) CloneRepository(url, directory, branch string) error {
-	// Remove directory if it exists
-	if _, err := os.Stat(directory); err == nil {
-		if err := os.RemoveAll(directory); err != nil {
-			return fmt.Errorf("failed to remove existing directory: %w", err)
+// auth returns the HTTP credentials for cloning and pushing
+func (s *Service) auth() (*http.BasicAuth, error) {
+	token, err := s.tokens.Token()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get git credentials: %w", err)
+	}
+
+	return &http.BasicAuth{
+		Username: "x-access-token", // This can be anything except an empty string
+		Password: token.AccessToken,
+	}, nil
+}
+
+// fullCommitSHA and abbreviatedSHA recognize refs that name a commit
+var (
+	fullCommitSHA  = regexp.MustCompile(`^[0-9a-f]{40}$`)
+	abbreviatedSHA = regexp.MustCompile(`^[0-9a-f]{4,39}$`)
+)
+
+// CloneRepository clones a repository to a local directory and checks out
+// ref, which may be a branch, a tag, or a commit SHA. Branches are tried
+// before tags, and abbreviated SHAs only when neither matches.
+func (s *Service) CloneRepository(url, directory, ref string) error {
+	var err error
+	if fullCommitSHA.MatchString(ref) {
+		err = s.cloneCommit(url, directory, ref)
+	} else {
+		err = s.clone(url, directory, plumbing.NewBranchReferenceName(ref))
+		if isMissingRef(err) {
+			err = s.clone(url, directory, plumbing.NewTagReferenceName(ref))
 		}
+		if isMissingRef(err) && abbreviatedSHA.MatchString(ref) {
+			err = s.cloneCommit(url, directory, ref)
+		}
+	}
+	if isMissingRef(err) {
+		return fmt.Errorf("failed to clone repository: no branch, tag, or commit named %s", ref)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to clone repository: %w", err)
 	}
 
-	// Create directory
-	if err := os.MkdirAll(directory, 0755); err != nil {
-		return fmt.Errorf("failed to create directory: %w", err)
+	return nil
+}
+
+// CloneOrCreateBranch clones a branch of a repository. If the branch doesn't
+// exist, the default branch is cloned instead and the branch is created from
+// it locally, so the next push creates it on the remote.
+func (s *Service) CloneOrCreateBranch(url, directory, branch string) error {
+	err := s.clone(url, directory, plumbing.NewBranchReferenceName(branch))
+	if !isMissingRef(err) {
+		if err != nil {
+			return fmt.Errorf("failed to clone repository: %w", err)
+		}
+		return nil
 	}
 
-	// Clone the repository
-	_, err := git.PlainClone(directory, false, &git.CloneOptions{
-		URL:           url,
-		Progress:      os.Stdout,
-		ReferenceName: plumbing.ReferenceName(fmt.Sprintf("refs/heads/%s", branch)),
-		SingleBranch:  true,
-		Auth: &http.BasicAuth{
-			Username: "git", // This can be anything except an empty string
-			Password: s.token,
-		},
+	if err := s.clone(url, directory, ""); err != nil {
+		return fmt.Errorf("failed to clone repository: %w", err)
+	}
+
+	repo, err := git.PlainOpen(directory)
+	if err != nil {
+		return fmt.Errorf("failed to open repository: %w", err)
+	}
+
+	worktree, err := repo.Worktree()
+	if err != nil {
+		return fmt.Errorf("failed to get worktree: %w", err)
+	}
+
+	if err := worktree.Checkout(&git.CheckoutOptions{
+		Branch: plumbing.NewBranchReferenceName(branch),
+		Create: true,
+	}); err != nil {
+		return fmt.Errorf("failed to create branch %s: %w", branch, err)
+	}
+
+	return nil
+}
+
+// clone clones a single branch or tag, starting from an empty directory on
+// every attempt
+func (s *Service) clone(url, directory string, refName plumbing.ReferenceName) error {
+	return s.retry.Do(context.Background(), func() error {
+		if err := os.RemoveAll(directory); err != nil {
+			return retry.Permanent(fmt.Errorf("failed to remove existing directory: %w", err))
+		}
+
+		if err := os.MkdirAll(directory, 0755); err != nil {
+			return retry.Permanent(fmt.Errorf("failed to create directory: %w", err))
+		}
+
+		auth, err := s.auth()
+		if err != nil {
+			return err
+		}
+
+		_, err = git.PlainClone(directory, false, &git.CloneOptions{
+			URL:           url,
+			Progress:      os.Stdout,
+			ReferenceName: refName,
+			SingleBranch:  refName != "",
+			Auth:          auth,
+		})
+		return classifyError(err)
 	})
+}
+
+// cloneCommit clones the whole repository and checks out a commit by SHA
+func (s *Service) cloneCommit(url, directory, sha string) error {
+	if err := s.clone(url, directory, ""); err != nil {
+		return err
+	}
+
+	repo, err := git.PlainOpen(directory)
 	if err != nil {
-		return fmt.Errorf("failed to clone repository: %w", err)
+		return fmt.Errorf("failed to open repository: %w", err)
+	}
+
+	hash, err := repo.ResolveRevision(plumbing.Revision(sha))
+	if err != nil {
+		return fmt.Errorf("commit %s not found: %w", sha, err)
+	}
+
+	worktree, err := repo.Worktree()
+	if err != nil {
+		return fmt.Errorf("failed to get worktree: %w", err)
+	}
+
+	if err := worktree.Checkout(&git.CheckoutOptions{Hash: *hash}); err != nil {
+		return fmt.Errorf("failed to check out commit %s: %w", sha, err)
 	}
 
 	return nil
 }
 
-// CommitAndPush commits changes to a repository and pushes them
-func (s *Service) CommitAndPush(repoPath, message string) error {
+// isMissingRef reports whether a clone failed because the requested branch
+// or tag doesn't exist
+func isMissingRef(err error) bool {
+	return errors.Is(err, git.NoMatchingRefSpecError{}) ||
+		errors.Is(err, plumbing.ErrReferenceNotFound)
+}
+
+// CommitAndPush commits changes to a repository and pushes them, returning
+// the hash of the new commit. An empty hash is returned when there was
+// nothing to commit. If the branch moved on the remote since it was cloned,
+// the commit is replayed on top of the remote branch, failing with
+// ErrPushConflict when both changed the same files. With forceWithLease the
+// remote branch is overwritten instead, but only if it is still at the
+// commit that was cloned; otherwise the push fails with ErrLeaseBroken.
+func (s *Service) CommitAndPush(repoPath, message string, forceWithLease bool) (string, error) {
+	return s.commitAndPush(repoPath, message, "", "", forceWithLease)
+}
+
+// CommitAndPushBranch commits changes to a repository and pushes the commit
+// to a branch of another remote, such as a fork of the cloned repository.
+// The branch is created if it doesn't exist.
+func (s *Service) CommitAndPushBranch(repoPath, message, remoteURL, branch string) (string, error) {
+	return s.commitAndPush(repoPath, message, remoteURL, branch, false)
+}
+
+// commitAndPush stages and commits every change in the worktree, then pushes
+// the checked out branch to origin, or to the given branch of remoteURL
+func (s *Service) commitAndPush(repoPath, message, remoteURL, branch string, forceWithLease bool) (string, error) {
 	// Open the repository
 	repo, err := git.PlainOpen(repoPath)
 	if err != nil {
-		return fmt.Errorf("failed to open repository: %w", err)
+		return "", fmt.Errorf("failed to open repository: %w", err)
 	}
 
 	// Get the worktree
 	worktree, err := repo.Worktree()
 	if err != nil {
-		return fmt.Errorf("failed to get worktree: %w", err)
+		return "", fmt.Errorf("failed to get worktree: %w", err)
 	}
 
 	// Check repository status
 	status, err := worktree.Status()
 	if err != nil {
-		return fmt.Errorf("failed to get repository status: %w", err)
+		return "", fmt.Errorf("failed to get repository status: %w", err)
 	}
 
 	// If there are no changes, return early with no error
 	if status.IsClean() {
 		// No changes to commit, but this is not an error condition
-		return nil
+		return "", nil
 	}
 
-	// Add all changes
-	if err := worktree.AddGlob("."); err != nil {
-		return fmt.Errorf("failed to add changes: %w", err)
+	// Add all changes, including deleted files, and commit them
+	hash, err := commitAll(worktree, message)
+	if err != nil {
+		return "", err
 	}
 
-	// Commit changes
-	_, err = worktree.Commit(message, &git.CommitOptions{
+	pushOptions := &git.PushOptions{}
+	if branch != "" {
+		head, err := repo.Head()
+		if err != nil {
+			return "", fmt.Errorf("failed to resolve HEAD: %w", err)
+		}
+		pushOptions.RemoteURL = remoteURL
+		pushOptions.RefSpecs = []config.RefSpec{
+			config.RefSpec(head.Name().String() + ":" + plumbing.NewBranchReferenceName(branch).String()),
+		}
+	}
+
+	// Push changes, catching up with the remote branch if it moved
+	err = s.push(repo, pushOptions)
+	if err != nil && branch == "" && isNonFastForward(err) {
+		hash, err = s.pushOntoRemote(repo, worktree, hash, message, forceWithLease)
+	}
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", ErrPushFailed, err)
+	}
+	if hash.IsZero() {
+		return "", nil
+	}
+
+	return hash.String(), nil
+}
+
+// commitAll stages every change in the worktree, including deleted files,
+// and commits it
+func commitAll(worktree *git.Worktree, message string) (plumbing.Hash, error) {
+	if err := worktree.AddWithOptions(&git.AddOptions{All: true}); err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("failed to add changes: %w", err)
+	}
+
+	hash, err := worktree.Commit(message, &git.CommitOptions{
 		Author: &object.Signature{
 			Name:  "Helm Pipeline",
 			Email: "helm-pipeline@example.com",
@@ -97,26 +278,163 @@ func (s *Service) CommitAndPush(repoPath, message string) error {
 		},
 	})
 	if err != nil {
-		return fmt.Errorf("failed to commit changes: %w", err)
+		return plumbing.ZeroHash, fmt.Errorf("failed to commit changes: %w", err)
 	}
+	return hash, nil
+}
 
-	// Push changes
-	err = repo.Push(&git.PushOptions{
-		Auth: &http.BasicAuth{
-			Username: "git", // This can be anything except an empty string
-			Password: s.token,
-		},
+// push pushes with fresh credentials, retrying transient failures
+func (s *Service) push(repo *git.Repository, options *git.PushOptions) error {
+	return s.retry.Do(context.Background(), func() error {
+		auth, err := s.auth()
+		if err != nil {
+			return err
+		}
+
+		options.Auth = auth
+		return classifyError(repo.Push(options))
 	})
+}
+
+// ErrPushFailed wraps errors from pushing a commit, to tell them apart from
+// failures to make the commit
+var ErrPushFailed = errors.New("failed to push changes")
+
+// ErrNoPreviousVersion is returned when a file has no earlier committed version
+var ErrNoPreviousVersion = errors.New("no previous version of the file exists")
+
+// PreviousFileContent returns the content of a file as of the commit before
+// the one that last changed it, along with that earlier commit's hash. The
+// path is relative to the repository root.
+func (s *Service) PreviousFileContent(repoPath, filePath string) ([]byte, string, error) {
+	repo, err := git.PlainOpen(repoPath)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to open repository: %w", err)
+	}
+
+	filePath = filepath.ToSlash(filePath)
+	commits, err := repo.Log(&git.LogOptions{FileName: &filePath})
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to get file history: %w", err)
+	}
+	defer commits.Close()
+
+	// Skip the latest commit touching the file and take the one before it
+	if _, err := commits.Next(); err != nil {
+		return nil, "", fmt.Errorf("file %s has no history: %w", filePath, err)
+	}
+	previous, err := commits.Next()
+	if err != nil {
+		return nil, "", ErrNoPreviousVersion
+	}
+
+	file, err := previous.File(filePath)
+	if err != nil {
+		return nil, "", fmt.Errorf("file %s not found in commit %s: %w", filePath, previous.Hash, err)
+	}
+
+	content, err := file.Contents()
 	if err != nil {
-		return fmt.Errorf("failed to push changes: %w", err)
+		return nil, "", fmt.Errorf("failed to read file contents: %w", err)
 	}
 
+	return []byte(content), previous.Hash.String(), nil
+}
+
+// ResetWorktree discards all uncommitted changes in a repository, including
+// untracked files, like `git reset --hard && git clean -fd`
+func (s *Service) ResetWorktree(repoPath string) error {
+	repo, err := git.PlainOpen(repoPath)
+	if err != nil {
+		return fmt.Errorf("failed to open repository: %w", err)
+	}
+
+	worktree, err := repo.Worktree()
+	if err != nil {
+		return fmt.Errorf("failed to get worktree: %w", err)
+	}
+
+	if err := worktree.Reset(&git.ResetOptions{Mode: git.HardReset}); err != nil {
+		return fmt.Errorf("failed to reset worktree: %w", err)
+	}
+
+	if err := worktree.Clean(&git.CleanOptions{Dir: true}); err != nil {
+		return fmt.Errorf("failed to clean worktree: %w", err)
+	}
+
+	return nil
+}
+
+// classifyError marks errors that retrying cannot fix, such as authentication
+// failures, missing repositories or refs, and other 4xx responses
+func classifyError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if errors.Is(err, transport.ErrAuthenticationRequired) ||
+		errors.Is(err, transport.ErrAuthorizationFailed) ||
+		errors.Is(err, transport.ErrRepositoryNotFound) ||
+		errors.Is(err, transport.ErrEmptyRemoteRepository) ||
+		errors.Is(err, git.NoMatchingRefSpecError{}) ||
+		errors.Is(err, plumbing.ErrReferenceNotFound) ||
+		isNonFastForward(err) ||
+		errors.Is(err, git.ErrForceNeeded) ||
+		errors.Is(err, git.NoErrAlreadyUpToDate) {
+		return retry.Permanent(err)
+	}
+
+	var unexpected *plumbing.UnexpectedError
+	if errors.As(err, &unexpected) {
+		var httpErr *http.Err
+		if errors.As(unexpected.Err, &httpErr) {
+			code := httpErr.StatusCode()
+			if code >= 400 && code < 500 && code != 429 {
+				return retry.Permanent(err)
+			}
+		}
+	}
+
+	return err
+}
+
+// SetWorkDir makes dir the base directory for clones instead of the
+// system's temporary directory. The directory is created if missing and
+// must be writable.
+func (s *Service) SetWorkDir(dir string) error {
+	if dir == "" {
+		s.workDir = ""
+		return nil
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create work directory %s: %w", dir, err)
+	}
+
+	// Prove the directory is writable by creating a file in it
+	probe, err := os.CreateTemp(dir, ".write-check-*")
+	if err != nil {
+		return fmt.Errorf("work directory %s is not writable: %w", dir, err)
+	}
+	probe.Close()
+	os.Remove(probe.Name())
+
+	s.workDir = dir
 	return nil
 }
 
+// WorkDir returns the base directory for clones, the system's temporary
+// directory unless SetWorkDir configured another one
+func (s *Service) WorkDir() string {
+	if s.workDir == "" {
+		return os.TempDir()
+	}
+	return s.workDir
+}
+
 // GetLocalRepoPath returns the path to the local repository
 func (s *Service) GetLocalRepoPath(owner, repo, branch string) string {
-	return filepath.Join(os.TempDir(), fmt.Sprintf("%s-%s-%s", owner, repo, branch))
+	return filepath.Join(s.WorkDir(), fmt.Sprintf("%s-%s-%s", owner, repo, branch))
 }
 
 // CloneOutputRepository clones the output repository if specified
@@ -126,7 +444,7 @@ func (s *Service) CloneOutputRepository(outputRepoURL, outputBranch string) (str
 	}
 
 	// Create a unique directory for the output repository
-	outputRepoPath := filepath.Join(os.TempDir(), fmt.Sprintf("output-repo-%s", time.Now().Format("20060102150405")))
+	outputRepoPath := filepath.Join(s.WorkDir(), fmt.Sprintf("output-repo-%s", time.Now().Format("20060102150405")))
 
 	// Clone the repository
 	err := s.CloneRepository(outputRepoURL, outputRepoPath, outputBranch)
@@ -0,0 +1,235 @@
+package git
+
+import (
+	"errors"
+	"fmt"
+	nethttp "net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/go-git/go-git/v5"
+	gitconfig "github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/client"
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-git/go-git/v5/plumbing/transport/server"
+	"github.com/lei/yaml-helm-pipeline/internal/retry"
+)
+
+// statusError returns the error go-git returns for an HTTP response with
+// the given status code
+func statusError(code int) error {
+	request := httptest.NewRequest(nethttp.MethodPost, "https://example.com/acme/values.git/git-receive-pack", nil)
+	return http.NewErr(&nethttp.Response{StatusCode: code, Request: request})
+}
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		permanent bool
+	}{
+		{"authentication", transport.ErrAuthenticationRequired, true},
+		{"authorization", fmt.Errorf("%w: denied", transport.ErrAuthorizationFailed), true},
+		{"not found", transport.ErrRepositoryNotFound, true},
+		{"empty", transport.ErrEmptyRemoteRepository, true},
+		{"non fast forward", git.ErrNonFastForwardUpdate, true},
+		{"bad request", statusError(nethttp.StatusBadRequest), true},
+		{"too many requests", statusError(nethttp.StatusTooManyRequests), false},
+		{"server error", statusError(nethttp.StatusBadGateway), false},
+		{"network", errors.New("connection reset by peer"), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			err := retry.Policy{MaxAttempts: 2}.Do(t.Context(), func() error {
+				calls++
+				return classifyError(tt.err)
+			})
+			if !errors.Is(err, tt.err) {
+				t.Errorf("error = %v, want %v", err, tt.err)
+			}
+			if want := map[bool]int{true: 1, false: 2}[tt.permanent]; calls != want {
+				t.Errorf("attempted %d times, want %d", calls, want)
+			}
+		})
+	}
+
+	if err := classifyError(nil); err != nil {
+		t.Errorf("classifyError(nil) = %v", err)
+	}
+}
+
+// remoteRepo serves a repository acme/values in place of https://example.com
+// with value.yaml at "1" on the first commit, which is tagged v1.0.0, and "2"
+// on master. It returns the hash of the first commit.
+func remoteRepo(t *testing.T) string {
+	t.Helper()
+
+	root := t.TempDir()
+	client.InstallProtocol("https", server.NewClient(server.NewFilesystemLoader(osfs.New(root))))
+	t.Cleanup(func() { client.InstallProtocol("https", http.DefaultClient) })
+
+	remote := filepath.Join(root, "acme", "values.git")
+	if _, err := git.PlainInit(remote, true); err != nil {
+		t.Fatal(err)
+	}
+	work := t.TempDir()
+	repo, err := git.PlainInit(work, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.CreateRemote(&gitconfig.RemoteConfig{Name: git.DefaultRemoteName, URLs: []string{remote}}); err != nil {
+		t.Fatal(err)
+	}
+	worktree, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var first plumbing.Hash
+	for _, value := range []string{"1", "2"} {
+		if err := os.WriteFile(filepath.Join(work, "value.yaml"), []byte(value), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := worktree.Add("value.yaml"); err != nil {
+			t.Fatal(err)
+		}
+		hash, err := worktree.Commit("value "+value, &git.CommitOptions{
+			Author: &object.Signature{Name: "Test", Email: "test@example.com", When: time.Now()},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value == "1" {
+			first = hash
+			if _, err := repo.CreateTag("v1.0.0", hash, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	err = repo.Push(&git.PushOptions{RefSpecs: []gitconfig.RefSpec{"refs/heads/*:refs/heads/*", "refs/tags/*:refs/tags/*"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return first.String()
+}
+
+func TestCloneRepositoryRefs(t *testing.T) {
+	first := remoteRepo(t)
+	s := NewService("token", retry.Policy{MaxAttempts: 1})
+
+	tests := []struct {
+		name string
+		ref  string
+		want string
+	}{
+		{"branch", "master", "2"},
+		{"tag", "v1.0.0", "1"},
+		{"commit", first, "1"},
+		{"abbreviated commit", first[:7], "1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := filepath.Join(t.TempDir(), "clone")
+			if err := s.CloneRepository("https://example.com/acme/values.git", dir, tt.ref); err != nil {
+				t.Fatalf("CloneRepository() error = %v", err)
+			}
+			got, err := os.ReadFile(filepath.Join(dir, "value.yaml"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("value.yaml at %s = %q, want %q", tt.ref, got, tt.want)
+			}
+		})
+	}
+
+	err := s.CloneRepository("https://example.com/acme/values.git", filepath.Join(t.TempDir(), "clone"), "missing")
+	if err == nil || !strings.Contains(err.Error(), "no branch, tag, or commit named missing") {
+		t.Errorf("CloneRepository() of a missing ref error = %v", err)
+	}
+}
+
+func TestCloneOrCreateBranch(t *testing.T) {
+	remoteRepo(t)
+	s := NewService("token", retry.Policy{MaxAttempts: 1})
+	url := "https://example.com/acme/values.git"
+
+	// An existing branch is cloned as is
+	dir := filepath.Join(t.TempDir(), "clone")
+	if err := s.CloneOrCreateBranch(url, dir, "master"); err != nil {
+		t.Fatalf("CloneOrCreateBranch() of master error = %v", err)
+	}
+
+	// A missing branch starts from the default branch and is created by the push
+	dir = filepath.Join(t.TempDir(), "clone")
+	if err := s.CloneOrCreateBranch(url, dir, "release"); err != nil {
+		t.Fatalf("CloneOrCreateBranch() of a missing branch error = %v", err)
+	}
+	repo, err := git.PlainOpen(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, err := repo.Head()
+	if err != nil || head.Name() != plumbing.NewBranchReferenceName("release") {
+		t.Fatalf("HEAD = %v, %v, want the release branch", head, err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "value.yaml"), []byte("3"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.CommitAndPush(dir, "value 3", false); err != nil {
+		t.Fatalf("CommitAndPush() error = %v", err)
+	}
+
+	for branch, want := range map[string]string{"release": "3", "master": "2"} {
+		dir := filepath.Join(t.TempDir(), "clone")
+		if err := s.CloneRepository(url, dir, branch); err != nil {
+			t.Fatalf("CloneRepository() of %s error = %v", branch, err)
+		}
+		if got, err := os.ReadFile(filepath.Join(dir, "value.yaml")); err != nil || string(got) != want {
+			t.Errorf("value.yaml on %s = %q, %v, want %q", branch, got, err, want)
+		}
+	}
+}
+
+func TestSetWorkDir(t *testing.T) {
+	s := NewService("token", retry.Policy{MaxAttempts: 1})
+	if got := s.WorkDir(); got != os.TempDir() {
+		t.Errorf("WorkDir() = %s, want the temp directory by default", got)
+	}
+
+	// A missing directory is created
+	dir := filepath.Join(t.TempDir(), "work", "clones")
+	if err := s.SetWorkDir(dir); err != nil {
+		t.Fatalf("SetWorkDir() error = %v", err)
+	}
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		t.Errorf("work directory not created: %v", err)
+	}
+	if got := s.WorkDir(); got != dir {
+		t.Errorf("WorkDir() = %s, want %s", got, dir)
+	}
+
+	// A path that can't be a directory is rejected, keeping the previous one
+	file := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetWorkDir(filepath.Join(file, "work")); err == nil {
+		t.Error("SetWorkDir() under a file succeeded")
+	}
+	if got := s.WorkDir(); got != dir {
+		t.Errorf("WorkDir() = %s after a failed SetWorkDir, want %s", got, dir)
+	}
+}
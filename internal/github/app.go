@@ -0,0 +1,162 @@
+package github
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/go-github/v45/github"
+	"github.com/lei/yaml-helm-pipeline/internal/retry"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/jws"
+)
+
+// tokenRefreshMargin is how long before expiry an installation token is
+// replaced, so requests never go out with a token about to lapse
+const tokenRefreshMargin = 5 * time.Minute
+
+// appTokenSource mints GitHub App installation tokens
+type appTokenSource struct {
+	appID          int64
+	installationID int64
+	key            *rsa.PrivateKey
+	client         *github.Client // Client used to exchange the app JWT for a token
+	now            func() time.Time
+
+	// contents is the installation's permission on repository contents,
+	// "read" or "write", as granted to the latest token
+	mu       sync.Mutex
+	contents string
+}
+
+// newAppTokenSource creates a source minting a new installation token on
+// every call; callers cache its tokens until shortly before they expire
+func newAppTokenSource(appID, installationID int64, privateKeyPEM []byte, httpOptions HTTPOptions) (*appTokenSource, error) {
+	key, err := parsePrivateKey(privateKeyPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	src := &appTokenSource{
+		appID:          appID,
+		installationID: installationID,
+		key:            key,
+		now:            time.Now,
+	}
+	// A single attempt, bounded like those of the API client; the request
+	// needing the token is retried if the exchange fails
+	src.client = github.NewClient(&http.Client{
+		Transport: &retryTransport{
+			base:    &appTransport{source: src, base: httpOptions.transport()},
+			policy:  retry.Policy{MaxAttempts: 1},
+			timeout: httpOptions.timeout(),
+		},
+	})
+	return src, nil
+}
+
+// NewAppService creates a GitHub service that authenticates as a GitHub App
+// installation instead of with a personal access token
+func NewAppService(appID, installationID int64, privateKeyPEM []byte, repoOwner, repoName string, retryPolicy retry.Policy, httpOptions HTTPOptions) (*Service, error) {
+	src, err := newAppTokenSource(appID, installationID, privateKeyPEM, httpOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	ts := oauth2.ReuseTokenSourceWithExpiry(nil, src, tokenRefreshMargin)
+	s := newService(ts, repoOwner, repoName, retryPolicy, httpOptions)
+	s.installation = true
+	s.app = src
+	return s, nil
+}
+
+// Token implements oauth2.TokenSource by requesting a new installation token
+func (s *appTokenSource) Token() (*oauth2.Token, error) {
+	token, _, err := s.client.Apps.CreateInstallationToken(context.Background(), s.installationID, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create installation token: %w", err)
+	}
+
+	s.mu.Lock()
+	s.contents = token.GetPermissions().GetContents()
+	s.mu.Unlock()
+
+	return &oauth2.Token{
+		AccessToken: token.GetToken(),
+		TokenType:   "token",
+		Expiry:      token.GetExpiresAt(),
+	}, nil
+}
+
+// contentsPermission returns the installation's permission on repository
+// contents as of the latest token, or "" before one was minted
+func (s *appTokenSource) contentsPermission() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.contents
+}
+
+// jwt creates the short-lived JSON Web Token identifying the app itself
+func (s *appTokenSource) jwt() (string, error) {
+	now := s.now()
+
+	// Backdate the issue time to allow for clock drift, as GitHub recommends
+	claims := &jws.ClaimSet{
+		Iss: strconv.FormatInt(s.appID, 10),
+		Iat: now.Add(-time.Minute).Unix(),
+		Exp: now.Add(9 * time.Minute).Unix(),
+	}
+
+	token, err := jws.Encode(&jws.Header{Algorithm: "RS256", Typ: "JWT"}, claims, s.key)
+	if err != nil {
+		return "", fmt.Errorf("failed to sign app JWT: %w", err)
+	}
+	return token, nil
+}
+
+// appTransport authenticates requests with the app JWT
+type appTransport struct {
+	source *appTokenSource
+	base   http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *appTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, err := t.source.jwt()
+	if err != nil {
+		return nil, err
+	}
+
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+token)
+	return t.base.RoundTrip(req)
+}
+
+// parsePrivateKey parses a PEM-encoded RSA private key in PKCS#1 or PKCS#8 form
+func parsePrivateKey(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("failed to decode app private key: no PEM data found")
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse app private key: %w", err)
+	}
+
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("app private key is not an RSA key")
+	}
+	return key, nil
+}
@@ -0,0 +1,263 @@
+package github
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lei/yaml-helm-pipeline/internal/retry"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/jws"
+)
+
+// serverTransport sends every request to a test server instead of GitHub
+type serverTransport struct {
+	server *httptest.Server
+}
+
+// RoundTrip implements http.RoundTripper
+func (t serverTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	target, _ := url.Parse(t.server.URL)
+	req = req.Clone(req.Context())
+	req.URL.Scheme = target.Scheme
+	req.URL.Host = target.Host
+	return t.server.Client().Transport.RoundTrip(req)
+}
+
+// fakeGitHub starts a test server answering GitHub API requests with handler
+// and returns HTTP options that send requests to it
+func fakeGitHub(t *testing.T, handler http.Handler) HTTPOptions {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	return HTTPOptions{Transport: serverTransport{server}}
+}
+
+// appKey generates an app private key and returns it with its PEM encoding
+func appKey(t *testing.T) (*rsa.PrivateKey, []byte) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+}
+
+// installationTokens returns a handler minting installation tokens for app
+// 7's installation 42 that expire after lifetime, after checking the app
+// JWT, and the number of tokens it minted
+func installationTokens(t *testing.T, key *rsa.PrivateKey, lifetime time.Duration) (http.HandlerFunc, *int32) {
+	var minted int32
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/app/installations/42/access_tokens" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			http.NotFound(w, r)
+			return
+		}
+
+		jwt, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || jws.Verify(jwt, &key.PublicKey) != nil {
+			t.Errorf("token request not authenticated with a valid app JWT: %q", r.Header.Get("Authorization"))
+			http.Error(w, "bad credentials", http.StatusUnauthorized)
+			return
+		}
+		claims, err := jws.Decode(jwt)
+		if err != nil || claims.Iss != "7" || claims.Exp-claims.Iat > 10*60 {
+			t.Errorf("app JWT claims = %+v, %v", claims, err)
+		}
+
+		n := atomic.AddInt32(&minted, 1)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"token":      "ghs_" + string(rune('0'+n)),
+			"expires_at": time.Now().Add(lifetime).UTC().Format(time.RFC3339),
+		})
+	}, &minted
+}
+
+// installationRepos returns a handler listing the installation's
+// repositories and recording the tokens it was called with
+func installationRepos(tokens *[]string) http.HandlerFunc {
+	var mu sync.Mutex
+	return func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		*tokens = append(*tokens, strings.TrimPrefix(r.Header.Get("Authorization"), "token "))
+		mu.Unlock()
+		w.Write([]byte(`{"total_count":1,"repositories":[{"full_name":"acme/deploy"}]}`))
+	}
+}
+
+func TestAppServiceReusesTokens(t *testing.T) {
+	key, keyPEM := appKey(t)
+	handler, minted := installationTokens(t, key, time.Hour)
+
+	var used []string
+	mux := http.NewServeMux()
+	mux.Handle("/app/installations/42/access_tokens", handler)
+	mux.Handle("/installation/repositories", installationRepos(&used))
+
+	s, err := NewAppService(7, 42, keyPEM, "acme", "deploy", retry.NewPolicy(1), fakeGitHub(t, mux))
+	if err != nil {
+		t.Fatalf("NewAppService() error = %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if !s.IsAuthenticated(context.Background()) {
+			t.Fatal("IsAuthenticated() = false")
+		}
+	}
+
+	if want := []string{"ghs_1", "ghs_1", "ghs_1"}; !reflect.DeepEqual(used, want) {
+		t.Errorf("requests used tokens %q, want %q", used, want)
+	}
+	if n := atomic.LoadInt32(minted); n != 1 {
+		t.Errorf("minted %d installation tokens, want 1", n)
+	}
+}
+
+func TestAppServiceRefreshesExpiringTokens(t *testing.T) {
+	key, keyPEM := appKey(t)
+	// Tokens expiring within the refresh margin are replaced on next use
+	handler, minted := installationTokens(t, key, tokenRefreshMargin/2)
+
+	var used []string
+	mux := http.NewServeMux()
+	mux.Handle("/app/installations/42/access_tokens", handler)
+	mux.Handle("/installation/repositories", installationRepos(&used))
+
+	s, err := NewAppService(7, 42, keyPEM, "acme", "deploy", retry.NewPolicy(1), fakeGitHub(t, mux))
+	if err != nil {
+		t.Fatalf("NewAppService() error = %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if !s.IsAuthenticated(context.Background()) {
+			t.Fatal("IsAuthenticated() = false")
+		}
+	}
+
+	if want := []string{"ghs_1", "ghs_2"}; !reflect.DeepEqual(used, want) {
+		t.Errorf("requests used tokens %q, want %q", used, want)
+	}
+	if n := atomic.LoadInt32(minted); n != 2 {
+		t.Errorf("minted %d installation tokens, want a fresh one per request", n)
+	}
+}
+
+func TestAppServiceIsAuthenticated(t *testing.T) {
+	key, keyPEM := appKey(t)
+	tokens, _ := installationTokens(t, key, time.Hour)
+
+	mux := http.NewServeMux()
+	mux.Handle("/app/installations/42/access_tokens", tokens)
+	mux.HandleFunc("/user", func(w http.ResponseWriter, r *http.Request) {
+		// Installation tokens can't read the authenticated user
+		http.Error(w, `{"message":"Resource not accessible by integration"}`, http.StatusForbidden)
+	})
+	mux.HandleFunc("/installation/repositories", func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Authorization"); got != "token ghs_1" {
+			http.Error(w, `{"message":"Bad credentials"}`, http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"total_count":1,"repositories":[{"full_name":"acme/deploy"}]}`))
+	})
+
+	s, err := NewAppService(7, 42, keyPEM, "acme", "deploy", retry.NewPolicy(1), fakeGitHub(t, mux))
+	if err != nil {
+		t.Fatalf("NewAppService() error = %v", err)
+	}
+	if !s.IsAuthenticated(context.Background()) {
+		t.Error("IsAuthenticated() = false for a valid installation")
+	}
+}
+
+func TestAppServiceCanPush(t *testing.T) {
+	_, keyPEM := appKey(t)
+
+	tests := []struct {
+		contents string
+		want     bool
+	}{
+		{"write", true},
+		{"read", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		t.Run("contents "+tt.contents, func(t *testing.T) {
+			mux := http.NewServeMux()
+			mux.HandleFunc("/app/installations/42/access_tokens", func(w http.ResponseWriter, r *http.Request) {
+				permissions := map[string]string{"metadata": "read"}
+				if tt.contents != "" {
+					permissions["contents"] = tt.contents
+				}
+				w.WriteHeader(http.StatusCreated)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"token":       "ghs_1",
+					"expires_at":  time.Now().Add(time.Hour).UTC().Format(time.RFC3339),
+					"permissions": permissions,
+				})
+			})
+			// Installation tokens get no permissions with the repository
+			mux.HandleFunc("/repos/acme/deploy", func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(`{"full_name":"acme/deploy"}`))
+			})
+
+			s, err := NewAppService(7, 42, keyPEM, "acme", "deploy", retry.NewPolicy(1), fakeGitHub(t, mux))
+			if err != nil {
+				t.Fatalf("NewAppService() error = %v", err)
+			}
+			got, err := s.CanPush(context.Background(), "acme", "deploy")
+			if err != nil {
+				t.Fatalf("CanPush() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("CanPush() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// Without permissions or an installation, access is unknown
+	mux := http.NewServeMux()
+	mux.HandleFunc("/repos/acme/deploy", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"full_name":"acme/deploy"}`))
+	})
+	s := newService(oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "ghp_1"}), "acme", "deploy", retry.NewPolicy(1), fakeGitHub(t, mux))
+	if _, err := s.CanPush(context.Background(), "acme", "deploy"); err == nil {
+		t.Error("CanPush() error = nil without permissions, want access unknown")
+	}
+}
+
+func TestParsePrivateKey(t *testing.T) {
+	key, pkcs1 := appKey(t)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs8 := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+
+	for name, data := range map[string][]byte{"PKCS#1": pkcs1, "PKCS#8": pkcs8} {
+		parsed, err := parsePrivateKey(data)
+		if err != nil {
+			t.Errorf("%s: parsePrivateKey() error = %v", name, err)
+			continue
+		}
+		if !parsed.Equal(key) {
+			t.Errorf("%s: parsePrivateKey() returned a different key", name)
+		}
+	}
+
+	if _, err := parsePrivateKey([]byte("not a key")); err == nil {
+		t.Error("parsePrivateKey() accepted data without a PEM block")
+	}
+}
@@ -0,0 +1,102 @@
+package github
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/go-github/v45/github"
+)
+
+// forkPollInterval and forkPollAttempts bound how long EnsureFork waits for
+// GitHub to finish creating a fork
+const (
+	forkPollInterval = 2 * time.Second
+	forkPollAttempts = 15
+)
+
+// EnsureFork makes sure forkOwner has a fork of owner/repo, creating it if
+// it doesn't exist yet. Forks are created under an organization when
+// forkOwner isn't the authenticated user. GitHub App installations have no
+// user account, so they always fork into the forkOwner organization.
+func (s *Service) EnsureFork(ctx context.Context, owner, repo, forkOwner string) error {
+	exists, err := s.repositoryExists(ctx, forkOwner, repo)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+
+	opts := &github.RepositoryCreateForkOptions{Organization: forkOwner}
+	if !s.installation {
+		user, _, err := s.client.Users.Get(ctx, "")
+		if err != nil {
+			return fmt.Errorf("failed to get authenticated user: %w", err)
+		}
+		if user.GetLogin() == forkOwner {
+			opts.Organization = ""
+		}
+	}
+
+	// GitHub creates forks asynchronously and answers 202 Accepted
+	_, _, err = s.client.Repositories.CreateFork(ctx, owner, repo, opts)
+	var accepted *github.AcceptedError
+	if err != nil && !errors.As(err, &accepted) {
+		return fmt.Errorf("failed to fork %s/%s into %s: %w", owner, repo, forkOwner, err)
+	}
+
+	for attempt := 0; attempt < forkPollAttempts; attempt++ {
+		exists, err := s.repositoryExists(ctx, forkOwner, repo)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(forkPollInterval):
+		}
+	}
+
+	return fmt.Errorf("fork %s/%s was not ready in time", forkOwner, repo)
+}
+
+// repositoryExists reports whether owner/repo exists and is visible
+func (s *Service) repositoryExists(ctx context.Context, owner, repo string) (bool, error) {
+	_, resp, err := s.client.Repositories.Get(ctx, owner, repo)
+	if resp != nil && resp.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to get repository %s/%s: %w", owner, repo, err)
+	}
+	return true, nil
+}
+
+// PullRequestHead returns the head reference for a pull request from a
+// branch of a fork, e.g. "fork-owner:branch"
+func PullRequestHead(forkOwner, branch string) string {
+	return forkOwner + ":" + branch
+}
+
+// CreatePullRequest opens a pull request against the base branch of
+// owner/repo and returns its URL. For cross-fork pull requests head is
+// "fork-owner:branch", see PullRequestHead.
+func (s *Service) CreatePullRequest(ctx context.Context, owner, repo, base, head, title, body string) (string, error) {
+	pr, _, err := s.client.PullRequests.Create(ctx, owner, repo, &github.NewPullRequest{
+		Title: github.String(title),
+		Head:  github.String(head),
+		Base:  github.String(base),
+		Body:  github.String(body),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to create pull request %s -> %s/%s:%s: %w", head, owner, repo, base, err)
+	}
+	return pr.GetHTMLURL(), nil
+}
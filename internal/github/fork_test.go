@@ -0,0 +1,80 @@
+package github
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/lei/yaml-helm-pipeline/internal/retry"
+)
+
+// forkServer returns a fake GitHub API on which acme/deploy exists and the
+// fork of it is created by the first fork request, and the organization that
+// request named
+func forkServer(t *testing.T, login string) (http.Handler, **string) {
+	var organization *string
+	forked := false
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/user", func(w http.ResponseWriter, r *http.Request) {
+		if login == "" {
+			http.Error(w, `{"message":"Resource not accessible by integration"}`, http.StatusForbidden)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"login": login})
+	})
+	mux.HandleFunc("/repos/acme/deploy/forks", func(w http.ResponseWriter, r *http.Request) {
+		org := r.URL.Query().Get("organization")
+		organization = &org
+		forked = true
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte(`{}`))
+	})
+	mux.HandleFunc("/repos/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/repos/acme/deploy" || forked {
+			w.Write([]byte(`{"full_name":"fork/deploy"}`))
+			return
+		}
+		http.Error(w, `{"message":"Not Found"}`, http.StatusNotFound)
+	})
+	return mux, &organization
+}
+
+func TestEnsureFork(t *testing.T) {
+	tests := []struct {
+		name         string
+		installation bool
+		login        string
+		forkOwner    string
+		organization string
+	}{
+		{"into the user's account", false, "bot", "bot", ""},
+		{"into an organization", false, "bot", "platform", "platform"},
+		{"as an app installation", true, "", "platform", "platform"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler, organization := forkServer(t, tt.login)
+			s := NewService("token", "acme", "deploy", retry.NewPolicy(0), fakeGitHub(t, handler))
+			s.installation = tt.installation
+
+			if err := s.EnsureFork(context.Background(), "acme", "deploy", tt.forkOwner); err != nil {
+				t.Fatalf("EnsureFork() error = %v", err)
+			}
+			if *organization == nil {
+				t.Fatal("EnsureFork() didn't create a fork")
+			}
+			if got := **organization; got != tt.organization {
+				t.Errorf("fork organization = %q, want %q", got, tt.organization)
+			}
+		})
+	}
+}
+
+func TestPullRequestHead(t *testing.T) {
+	if got, want := PullRequestHead("platform-bot", "helm-pipeline/web-20240110-120000"), "platform-bot:helm-pipeline/web-20240110-120000"; got != want {
+		t.Errorf("PullRequestHead() = %q, want %q", got, want)
+	}
+}
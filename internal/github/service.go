@@ -3,44 +3,100 @@ package github
 import (
 	"context"
 	"fmt"
+	"io"
 	"net/http"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/google/go-github/v45/github"
+	"github.com/lei/yaml-helm-pipeline/internal/retry"
+	"github.com/lei/yaml-helm-pipeline/internal/scm"
 	"golang.org/x/oauth2"
 )
 
+// webURL is where GitHub serves repositories
+const webURL = "https://github.com"
+
 // Service handles GitHub API operations
 type Service struct {
 	client    *github.Client
+	tokens    oauth2.TokenSource
 	repoOwner string
 	repoName  string
+
+	// installation is set when the service authenticates as a GitHub App
+	// installation, which has no user of its own
+	installation bool
+	app          *appTokenSource // Source of the installation's tokens
+
+	// The configured repository's metadata is cached for repositoryCacheTTL
+	repoMu       sync.Mutex
+	repoCache    *scm.Repository
+	repoCachedAt time.Time
 }
 
+// Service is the GitHub scm.Provider
+var _ scm.Provider = (*Service)(nil)
+
+// repositoryCacheTTL is how long GetRepository reuses a fetched result
+const repositoryCacheTTL = time.Minute
+
 // NewService creates a new GitHub service
-func NewService(token, repoOwner, repoName string) *Service {
+func NewService(token, repoOwner, repoName string, retryPolicy retry.Policy, httpOptions HTTPOptions) *Service {
 	// Create an OAuth2 client with the token
 	ts := oauth2.StaticTokenSource(
 		&oauth2.Token{AccessToken: token},
 	)
-	tc := oauth2.NewClient(context.Background(), ts)
+	return newService(ts, repoOwner, repoName, retryPolicy, httpOptions)
+}
+
+// newService creates a GitHub service authenticated by a token source
+func newService(ts oauth2.TokenSource, repoOwner, repoName string, retryPolicy retry.Policy, httpOptions HTTPOptions) *Service {
+	// Authenticate every attempt, retrying transient failures and rate
+	// limiting. The timeout applies to each attempt rather than the client,
+	// which would bound the retries too.
+	tc := &http.Client{
+		Transport: &retryTransport{
+			base:    &oauth2.Transport{Source: oauth2.ReuseTokenSource(nil, ts), Base: httpOptions.transport()},
+			policy:  retryPolicy,
+			timeout: httpOptions.timeout(),
+		},
+	}
 
 	// Create a GitHub client
 	client := github.NewClient(tc)
 
 	return &Service{
 		client:    client,
+		tokens:    ts,
 		repoOwner: repoOwner,
 		repoName:  repoName,
 	}
 }
 
+// TokenSource returns the source of the credentials the service uses, so git
+// operations can authenticate the same way
+func (s *Service) TokenSource() oauth2.TokenSource {
+	return s.tokens
+}
+
 // ListBranches returns a list of branches in the repository
-func (s *Service) ListBranches(ctx context.Context) ([]*github.Branch, error) {
+func (s *Service) ListBranches(ctx context.Context) ([]scm.Branch, error) {
 	branches, _, err := s.client.Repositories.ListBranches(ctx, s.repoOwner, s.repoName, nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to list branches: %w", err)
 	}
-	return branches, nil
+
+	result := make([]scm.Branch, len(branches))
+	for i, branch := range branches {
+		result[i] = scm.Branch{
+			Name:      branch.GetName(),
+			Protected: branch.GetProtected(),
+			SHA:       branch.GetCommit().GetSHA(),
+		}
+	}
+	return result, nil
 }
 
 // GetContents retrieves the contents of a file from the repository
@@ -103,18 +159,141 @@ func (s *Service) CreateOrUpdateFile(ctx context.Context, path, branch, message
 	return nil
 }
 
-// GetRepository returns the repository information
-func (s *Service) GetRepository(ctx context.Context) (*github.Repository, error) {
-	repo, _, err := s.client.Repositories.Get(ctx, s.repoOwner, s.repoName)
+// GetRepository returns the repository information. Results are cached for
+// a minute, so the groups of one request share a single API call.
+func (s *Service) GetRepository(ctx context.Context) (*scm.Repository, error) {
+	s.repoMu.Lock()
+	defer s.repoMu.Unlock()
+
+	if s.repoCache != nil && time.Since(s.repoCachedAt) < repositoryCacheTTL {
+		return s.repoCache, nil
+	}
+
+	repository, _, err := s.client.Repositories.Get(ctx, s.repoOwner, s.repoName)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get repository: %w", err)
 	}
+	repo := describeRepository(repository)
+
+	s.repoCache = repo
+	s.repoCachedAt = time.Now()
 	return repo, nil
 }
 
-// IsAuthenticated checks if the GitHub token is valid
+// InvalidateRepositoryCache makes the next GetRepository call fetch fresh
+// repository information
+func (s *Service) InvalidateRepositoryCache() {
+	s.repoMu.Lock()
+	defer s.repoMu.Unlock()
+	s.repoCache = nil
+}
+
+// GetRepositoryByName returns information about another repository
+func (s *Service) GetRepositoryByName(ctx context.Context, owner, repo string) (*scm.Repository, error) {
+	repository, _, err := s.client.Repositories.Get(ctx, owner, repo)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get repository %s/%s: %w", owner, repo, err)
+	}
+	return describeRepository(repository), nil
+}
+
+// describeRepository converts a GitHub repository to the provider-neutral
+// description
+func describeRepository(repo *github.Repository) *scm.Repository {
+	return &scm.Repository{
+		Owner:         repo.GetOwner().GetLogin(),
+		Name:          repo.GetName(),
+		DefaultBranch: repo.GetDefaultBranch(),
+		CloneURL:      repo.GetCloneURL(),
+		WebURL:        repo.GetHTMLURL(),
+	}
+}
+
+// CloneURL returns the HTTPS URL of owner/repo on GitHub
+func (s *Service) CloneURL(owner, repo string) string {
+	return fmt.Sprintf("%s/%s/%s.git", webURL, owner, repo)
+}
+
+// CommitURL returns the web URL of a commit in owner/repo on GitHub
+func (s *Service) CommitURL(owner, repo, sha string) string {
+	return fmt.Sprintf("%s/%s/%s/commit/%s", webURL, owner, repo, sha)
+}
+
+// FileURL returns the web URL of a file or directory in owner/repo on
+// GitHub at a commit
+func (s *Service) FileURL(owner, repo, sha, filePath string, dir bool) string {
+	view := "blob"
+	if dir {
+		view = "tree"
+	}
+	return fmt.Sprintf("%s/%s/%s/%s/%s/%s", webURL, owner, repo, view, sha, strings.TrimPrefix(filePath, "/"))
+}
+
+// CanPush reports whether the credentials may push to owner/repo, based on
+// the permissions GitHub reports for the repository. GitHub App installation
+// tokens get no permissions in the response; since the repository could be
+// read, the installation covers it, and its permission on contents decides.
+// Access that can't be determined is an error rather than a guess.
+func (s *Service) CanPush(ctx context.Context, owner, repo string) (bool, error) {
+	repository, _, err := s.client.Repositories.Get(ctx, owner, repo)
+	if err != nil {
+		return false, fmt.Errorf("failed to get repository %s/%s: %w", owner, repo, err)
+	}
+
+	// The accessor returns an empty map for a missing field, so the field is
+	// checked itself
+	if permissions := repository.Permissions; permissions != nil {
+		return permissions["push"] || permissions["maintain"] || permissions["admin"], nil
+	}
+	if s.app != nil {
+		return s.app.contentsPermission() == "write", nil
+	}
+	return false, fmt.Errorf("GitHub reported no permissions for %s/%s, so write access is unknown", owner, repo)
+}
+
+// GetFileContents returns the content of a file in owner/repo at ref, or
+// scm.ErrFileNotFound if there is no such file
+func (s *Service) GetFileContents(ctx context.Context, owner, repo, filePath, ref string) ([]byte, error) {
+	opts := &github.RepositoryContentGetOptions{Ref: ref}
+	file, _, resp, err := s.client.Repositories.GetContents(ctx, owner, repo, filePath, opts)
+	if resp != nil && resp.StatusCode == http.StatusNotFound {
+		return nil, scm.ErrFileNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get %s from %s/%s: %w", filePath, owner, repo, err)
+	}
+	if file == nil {
+		return nil, fmt.Errorf("%s in %s/%s is a directory", filePath, owner, repo)
+	}
+
+	// Files over 1MB come without content and have to be downloaded
+	if file.GetEncoding() == "none" {
+		reader, _, err := s.client.Repositories.DownloadContents(ctx, owner, repo, filePath, opts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to download %s from %s/%s: %w", filePath, owner, repo, err)
+		}
+		defer reader.Close()
+		return io.ReadAll(reader)
+	}
+
+	content, err := file.GetContent()
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %s from %s/%s: %w", filePath, owner, repo, err)
+	}
+	return []byte(content), nil
+}
+
+// IsAuthenticated checks if the GitHub credentials are valid. Installation
+// tokens can't read the authenticated user, so for GitHub Apps it lists the
+// installation's repositories instead.
 func (s *Service) IsAuthenticated(ctx context.Context) bool {
-	_, resp, err := s.client.Users.Get(ctx, "")
+	var resp *github.Response
+	var err error
+	if s.installation {
+		_, resp, err = s.client.Apps.ListRepos(ctx, &github.ListOptions{PerPage: 1})
+	} else {
+		_, resp, err = s.client.Users.Get(ctx, "")
+	}
 	if err != nil || resp.StatusCode != http.StatusOK {
 		return false
 	}
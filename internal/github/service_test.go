@@ -0,0 +1,116 @@
+package github
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+
+	"github.com/lei/yaml-helm-pipeline/internal/retry"
+	"github.com/lei/yaml-helm-pipeline/internal/scm"
+)
+
+func TestCanPush(t *testing.T) {
+	tests := []struct {
+		permissions string
+		want        bool
+	}{
+		{`{"pull":true,"push":true}`, true},
+		{`{"pull":true,"maintain":true}`, true},
+		{`{"admin":true}`, true},
+		{`{"pull":true,"triage":true}`, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.permissions, func(t *testing.T) {
+			options := fakeGitHub(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(`{"full_name":"acme/deploy","permissions":` + tt.permissions + `}`))
+			}))
+			s := NewService("token", "acme", "charts", retry.NewPolicy(0), options)
+
+			got, err := s.CanPush(context.Background(), "acme", "deploy")
+			if err != nil || got != tt.want {
+				t.Errorf("CanPush() = %v, %v, want %v", got, err, tt.want)
+			}
+		})
+	}
+
+	options := fakeGitHub(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"message":"Not Found"}`, http.StatusNotFound)
+	}))
+	s := NewService("token", "acme", "charts", retry.NewPolicy(0), options)
+	if _, err := s.CanPush(context.Background(), "acme", "deploy"); err == nil {
+		t.Error("CanPush() of a missing repository succeeded")
+	}
+}
+
+func TestGetRepositoryCache(t *testing.T) {
+	var calls int32
+	options := fakeGitHub(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Write([]byte(`{"name":"charts","default_branch":"main"}`))
+	}))
+	s := NewService("token", "acme", "charts", retry.NewPolicy(0), options)
+
+	for i := 0; i < 3; i++ {
+		if _, err := s.GetRepository(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("GetRepository() made %d API calls, want 1", n)
+	}
+
+	s.InvalidateRepositoryCache()
+	if _, err := s.GetRepository(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("GetRepository() made %d API calls after invalidation, want 2", n)
+	}
+}
+
+func TestGetFileContents(t *testing.T) {
+	options := fakeGitHub(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/repos/acme/deploy/contents/apps/generated.yaml" {
+			http.Error(w, `{"message":"Not Found"}`, http.StatusNotFound)
+			return
+		}
+		if ref := r.URL.Query().Get("ref"); ref != "release/1.0" {
+			t.Errorf("ref = %q, want release/1.0", ref)
+		}
+		w.Write([]byte(`{"type":"file","encoding":"base64","content":"` + base64.StdEncoding.EncodeToString([]byte("kind: ConfigMap\n")) + `"}`))
+	}))
+	s := NewService("token", "acme", "charts", retry.NewPolicy(0), options)
+
+	content, err := s.GetFileContents(context.Background(), "acme", "deploy", "apps/generated.yaml", "release/1.0")
+	if err != nil {
+		t.Fatalf("GetFileContents() error = %v", err)
+	}
+	if string(content) != "kind: ConfigMap\n" {
+		t.Errorf("GetFileContents() = %q", content)
+	}
+
+	_, err = s.GetFileContents(context.Background(), "acme", "deploy", "missing.yaml", "main")
+	if !errors.Is(err, scm.ErrFileNotFound) {
+		t.Errorf("GetFileContents() of a missing file error = %v, want scm.ErrFileNotFound", err)
+	}
+}
+
+func TestURLs(t *testing.T) {
+	s := NewService("token", "acme", "charts", retry.NewPolicy(0), HTTPOptions{})
+
+	tests := []struct{ got, want string }{
+		{s.CloneURL("acme", "values"), "https://github.com/acme/values.git"},
+		{s.CommitURL("acme", "deploy", "abc123"), "https://github.com/acme/deploy/commit/abc123"},
+		{s.FileURL("acme", "deploy", "abc123", "/apps/generated.yaml", false), "https://github.com/acme/deploy/blob/abc123/apps/generated.yaml"},
+		{s.FileURL("acme", "deploy", "abc123", "apps", true), "https://github.com/acme/deploy/tree/abc123/apps"},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("URL = %q, want %q", tt.got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package github
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/lei/yaml-helm-pipeline/internal/retry"
+)
+
+// maxRetryAfter is the longest server-requested wait we're willing to sit out
+// before giving up and returning the rate limit response to the caller
+const maxRetryAfter = time.Minute
+
+// retryTransport retries GitHub API requests that fail with network errors,
+// server errors, or rate limiting. Other 4xx responses are returned as-is.
+// Each attempt, until its response body is closed, is bounded by timeout,
+// so a hung attempt is retried instead of using up the whole call.
+type retryTransport struct {
+	base    http.RoundTripper
+	policy  retry.Policy
+	timeout time.Duration
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// Requests whose body can't be replayed only get a single attempt
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return t.attempt(req)
+	}
+
+	var resp *http.Response
+	attempt := 0
+	err := t.policy.Do(req.Context(), func() error {
+		attempt++
+
+		attemptReq := req
+		if attempt > 1 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return retry.Permanent(err)
+			}
+			attemptReq = req.Clone(req.Context())
+			attemptReq.Body = body
+		}
+
+		var err error
+		resp, err = t.attempt(attemptReq)
+		if err != nil {
+			if req.Context().Err() != nil {
+				return retry.Permanent(err)
+			}
+			return err
+		}
+
+		if !retryableResponse(resp) {
+			return nil
+		}
+
+		delay, hinted := retryDelay(resp, time.Now())
+		if attempt >= t.policy.MaxAttempts || delay > maxRetryAfter {
+			// Hand the failed response back so the client can report it
+			return nil
+		}
+
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+
+		retryErr := fmt.Errorf("github API returned status %d", resp.StatusCode)
+		if hinted {
+			return retry.After(retryErr, delay)
+		}
+		return retryErr
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// attempt sends a request once, bounded by the transport's timeout
+func (t *retryTransport) attempt(req *http.Request) (*http.Response, error) {
+	if t.timeout <= 0 {
+		return t.base.RoundTrip(req)
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), t.timeout)
+	resp, err := t.base.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	// The body is read after RoundTrip returns, so the timeout ends with it
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// cancelOnClose releases a response's context when its body is closed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// retryableResponse reports whether a response indicates a transient failure
+func retryableResponse(resp *http.Response) bool {
+	switch resp.StatusCode {
+	case http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout,
+		http.StatusTooManyRequests:
+		return true
+	case http.StatusForbidden:
+		// Secondary rate limits come back as 403 with a Retry-After header,
+		// primary rate limits as 403 with no remaining requests
+		return resp.Header.Get("Retry-After") != "" ||
+			resp.Header.Get("X-RateLimit-Remaining") == "0"
+	}
+	return false
+}
+
+// retryDelay returns the wait requested by GitHub's Retry-After or
+// X-RateLimit-Reset headers, if any
+func retryDelay(resp *http.Response, now time.Time) (time.Duration, bool) {
+	if value := resp.Header.Get("Retry-After"); value != "" {
+		if seconds, err := strconv.Atoi(value); err == nil {
+			return time.Duration(seconds) * time.Second, true
+		}
+		if at, err := http.ParseTime(value); err == nil {
+			return at.Sub(now), true
+		}
+	}
+
+	if resp.Header.Get("X-RateLimit-Remaining") == "0" {
+		if reset, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+			return time.Unix(reset, 0).Sub(now) + time.Second, true
+		}
+	}
+
+	return 0, false
+}
@@ -0,0 +1,179 @@
+package github
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lei/yaml-helm-pipeline/internal/retry"
+)
+
+// flakyTransport answers requests with the given statuses in turn, then 200
+type flakyTransport struct {
+	statuses []int
+	header   http.Header
+	bodies   []string // Bodies of the requests received
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *flakyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	body := ""
+	if req.Body != nil {
+		b, _ := io.ReadAll(req.Body)
+		body = string(b)
+	}
+	t.bodies = append(t.bodies, body)
+
+	status := http.StatusOK
+	if len(t.bodies) <= len(t.statuses) {
+		status = t.statuses[len(t.bodies)-1]
+	}
+	rec := httptest.NewRecorder()
+	for key, values := range t.header {
+		rec.Header()[key] = values
+	}
+	rec.WriteHeader(status)
+	return rec.Result(), nil
+}
+
+func TestRetryTransport(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int
+		header   http.Header
+		want     int // Final status
+		requests int
+	}{
+		{"success", nil, nil, http.StatusOK, 1},
+		{"server errors", []int{500, 502}, nil, http.StatusOK, 3},
+		{"exhausted", []int{503, 503, 503, 503}, nil, http.StatusServiceUnavailable, 3},
+		{"not found", []int{404}, nil, http.StatusNotFound, 1},
+		{"unauthorized", []int{401}, nil, http.StatusUnauthorized, 1},
+		{"forbidden", []int{403}, nil, http.StatusForbidden, 1},
+		{"secondary rate limit", []int{403}, http.Header{"Retry-After": {"0"}}, http.StatusOK, 2},
+		{"primary rate limit", []int{403}, http.Header{
+			"X-Ratelimit-Remaining": {"0"},
+			"X-Ratelimit-Reset":     {strconv.FormatInt(time.Now().Add(-time.Second).Unix(), 10)},
+		}, http.StatusOK, 2},
+		{"long rate limit", []int{429}, http.Header{"Retry-After": {"3600"}}, http.StatusTooManyRequests, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := &flakyTransport{statuses: tt.statuses, header: tt.header}
+			transport := &retryTransport{base: base, policy: retry.Policy{MaxAttempts: 3}}
+
+			req := httptest.NewRequest(http.MethodGet, "https://api.github.com/repos/acme/deploy", nil)
+			resp, err := transport.RoundTrip(req)
+			if err != nil {
+				t.Fatalf("RoundTrip() error = %v", err)
+			}
+			if resp.StatusCode != tt.want || len(base.bodies) != tt.requests {
+				t.Errorf("status %d after %d requests, want %d after %d", resp.StatusCode, len(base.bodies), tt.want, tt.requests)
+			}
+		})
+	}
+}
+
+func TestRetryTransportReplaysBodies(t *testing.T) {
+	base := &flakyTransport{statuses: []int{500}}
+	transport := &retryTransport{base: base, policy: retry.Policy{MaxAttempts: 3}}
+
+	req, err := http.NewRequest(http.MethodPut, "https://api.github.com/repos/acme/deploy/contents/a", strings.NewReader("content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := transport.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("RoundTrip() = %v, %v", resp, err)
+	}
+	if len(base.bodies) != 2 || base.bodies[0] != "content" || base.bodies[1] != "content" {
+		t.Errorf("request bodies = %q, want the body sent on both attempts", base.bodies)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	now := time.Date(2024, time.January, 10, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name   string
+		header http.Header
+		want   time.Duration
+		hinted bool
+	}{
+		{"none", http.Header{}, 0, false},
+		{"seconds", http.Header{"Retry-After": {"30"}}, 30 * time.Second, true},
+		{"date", http.Header{"Retry-After": {now.Add(time.Minute).Format(http.TimeFormat)}}, time.Minute, true},
+		{"reset", http.Header{
+			"X-Ratelimit-Remaining": {"0"},
+			"X-Ratelimit-Reset":     {strconv.FormatInt(now.Add(10*time.Second).Unix(), 10)},
+		}, 11 * time.Second, true},
+		{"remaining", http.Header{
+			"X-Ratelimit-Remaining": {"10"},
+			"X-Ratelimit-Reset":     {strconv.FormatInt(now.Unix(), 10)},
+		}, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			delay, hinted := retryDelay(&http.Response{Header: tt.header}, now)
+			if delay != tt.want || hinted != tt.hinted {
+				t.Errorf("retryDelay() = %v, %v, want %v, %v", delay, hinted, tt.want, tt.hinted)
+			}
+		})
+	}
+}
+
+func TestRetryTransportTimesOutEachAttempt(t *testing.T) {
+	var requests int32
+	options := fakeGitHub(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The first attempt hangs until the client gives up on it
+		if atomic.AddInt32(&requests, 1) == 1 {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+			return
+		}
+		w.Write([]byte(`{"name":"deploy","owner":{"login":"acme"},"default_branch":"main"}`))
+	}))
+	options.Timeout = 200 * time.Millisecond
+
+	s := NewService("token", "acme", "deploy", retry.Policy{MaxAttempts: 2}, options)
+	repo, err := s.GetRepository(context.Background())
+	if err != nil {
+		t.Fatalf("GetRepository() error = %v", err)
+	}
+	if repo.DefaultBranch != "main" {
+		t.Errorf("GetRepository() = %+v", repo)
+	}
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Errorf("sent %d requests, want the hung one retried", n)
+	}
+}
+
+func TestRetryTransportTimeoutDoesNotSpanRetries(t *testing.T) {
+	var requests int32
+	options := fakeGitHub(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Every attempt is slow, and all but the last fail
+		time.Sleep(100 * time.Millisecond)
+		if atomic.AddInt32(&requests, 1) < 3 {
+			w.Header().Set("Retry-After", "0")
+			http.Error(w, `{"message":"Bad Gateway"}`, http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte(`{"name":"deploy","owner":{"login":"acme"},"default_branch":"main"}`))
+	}))
+	options.Timeout = 250 * time.Millisecond
+
+	s := NewService("token", "acme", "deploy", retry.Policy{MaxAttempts: 3}, options)
+	if _, err := s.GetRepository(context.Background()); err != nil {
+		t.Fatalf("GetRepository() error = %v, want the attempts to be bounded one by one", err)
+	}
+}
@@ -0,0 +1,59 @@
+package gitlab
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"time"
+)
+
+// DefaultHTTPTimeout bounds each attempt of a GitLab API call when no
+// timeout is configured
+const DefaultHTTPTimeout = 30 * time.Second
+
+// HTTPOptions configures the HTTP client used for GitLab API calls
+type HTTPOptions struct {
+	// Timeout bounds each attempt of an API call, including reading its
+	// response; retries get a timeout of their own. Defaults to
+	// DefaultHTTPTimeout.
+	Timeout time.Duration
+
+	// Transport sends the requests, e.g. a stub in tests. Defaults to a
+	// pooled transport requiring TLS 1.2 or later.
+	Transport http.RoundTripper
+}
+
+// timeout returns the configured timeout or the default
+func (o HTTPOptions) timeout() time.Duration {
+	if o.Timeout <= 0 {
+		return DefaultHTTPTimeout
+	}
+	return o.Timeout
+}
+
+// transport returns the configured transport or a new default one
+func (o HTTPOptions) transport() http.RoundTripper {
+	if o.Transport != nil {
+		return o.Transport
+	}
+	return newTransport()
+}
+
+// newTransport creates the default transport for GitLab API calls, keeping
+// a few connections to the instance open between requests
+func newTransport() *http.Transport {
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   10 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          20,
+		MaxIdleConnsPerHost:   10,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: time.Second,
+		TLSClientConfig:       &tls.Config{MinVersion: tls.VersionTLS12},
+	}
+}
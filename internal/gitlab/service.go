@@ -0,0 +1,394 @@
+package gitlab
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lei/yaml-helm-pipeline/internal/retry"
+	"github.com/lei/yaml-helm-pipeline/internal/scm"
+)
+
+// DefaultBaseURL is the GitLab instance used when none is configured
+const DefaultBaseURL = "https://gitlab.com"
+
+// branchesPerPage is the page size used when listing branches
+const branchesPerPage = 100
+
+// repositoryCacheTTL is how long GetRepository reuses a fetched result
+const repositoryCacheTTL = time.Minute
+
+// Developer access and above may push to unprotected branches
+const developerAccessLevel = 30
+
+// Service handles GitLab API operations. Owners are namespace paths, which
+// may contain subgroups (e.g. "group/subgroup").
+type Service struct {
+	client    *http.Client
+	timeout   time.Duration // Bounds each attempt of an API call
+	baseURL   string
+	token     string
+	repoOwner string
+	repoName  string
+	policy    retry.Policy
+
+	// The configured project's metadata is cached for repositoryCacheTTL
+	repoMu       sync.Mutex
+	repoCache    *scm.Repository
+	repoCachedAt time.Time
+}
+
+// Service is the GitLab scm.Provider
+var _ scm.Provider = (*Service)(nil)
+
+// NewService creates a new GitLab service for the project repoOwner/repoName
+// on the instance at baseURL, authenticated with a personal, group, or
+// project access token
+func NewService(baseURL, token, repoOwner, repoName string, retryPolicy retry.Policy, httpOptions HTTPOptions) *Service {
+	if baseURL == "" {
+		baseURL = DefaultBaseURL
+	}
+
+	return &Service{
+		client:    &http.Client{Transport: httpOptions.transport()},
+		timeout:   httpOptions.timeout(),
+		baseURL:   strings.TrimSuffix(baseURL, "/"),
+		token:     token,
+		repoOwner: repoOwner,
+		repoName:  repoName,
+		policy:    retryPolicy,
+	}
+}
+
+// project is the subset of a GitLab project the service uses
+type project struct {
+	ID                int64  `json:"id"`
+	Path              string `json:"path"`
+	PathWithNamespace string `json:"path_with_namespace"`
+	DefaultBranch     string `json:"default_branch"`
+	HTTPURLToRepo     string `json:"http_url_to_repo"`
+	WebURL            string `json:"web_url"`
+	Namespace         struct {
+		FullPath string `json:"full_path"`
+	} `json:"namespace"`
+	Permissions struct {
+		ProjectAccess *accessLevel `json:"project_access"`
+		GroupAccess   *accessLevel `json:"group_access"`
+	} `json:"permissions"`
+}
+
+// accessLevel is a member's access level to a project or its group
+type accessLevel struct {
+	AccessLevel int `json:"access_level"`
+}
+
+// branch is the subset of a GitLab branch the service uses
+type branch struct {
+	Name      string `json:"name"`
+	Protected bool   `json:"protected"`
+	Commit    struct {
+		ID string `json:"id"`
+	} `json:"commit"`
+}
+
+// apiError is a non-2xx response from the GitLab API
+type apiError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("gitlab API returned status %d: %s", e.StatusCode, e.Message)
+}
+
+// projectPath returns the URL path of a project's API resource
+func projectPath(owner, repo string) string {
+	return "/projects/" + url.PathEscape(owner+"/"+repo)
+}
+
+// do sends an API request and decodes a JSON response into out, retrying
+// network errors, server errors, and rate limiting. The response is
+// returned so callers can read pagination headers.
+func (s *Service) do(ctx context.Context, method, path string, body, out interface{}) (*http.Response, error) {
+	var payload []byte
+	if body != nil {
+		var err error
+		payload, err = json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var resp *http.Response
+	var respBody []byte
+	attempt := 0
+	err := s.policy.Do(ctx, func() error {
+		attempt++
+
+		// Bound each attempt on its own, so a hung one is retried
+		attemptCtx, cancel := context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+
+		req, err := http.NewRequestWithContext(attemptCtx, method, s.baseURL+"/api/v4"+path, bytes.NewReader(payload))
+		if err != nil {
+			return retry.Permanent(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+s.token)
+		req.Header.Set("Accept", "application/json")
+		if body != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+
+		resp, err = s.client.Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return retry.Permanent(err)
+			}
+			return err
+		}
+		defer resp.Body.Close()
+
+		respBody, err = io.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+
+		switch resp.StatusCode {
+		case http.StatusInternalServerError, http.StatusBadGateway,
+			http.StatusServiceUnavailable, http.StatusGatewayTimeout,
+			http.StatusTooManyRequests:
+			if attempt >= s.policy.MaxAttempts {
+				return nil
+			}
+			retryErr := fmt.Errorf("gitlab API returned status %d", resp.StatusCode)
+			if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+				return retry.After(retryErr, time.Duration(seconds)*time.Second)
+			}
+			return retryErr
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var message struct {
+			Message interface{} `json:"message"`
+			Error   string      `json:"error"`
+		}
+		text := strings.TrimSpace(string(respBody))
+		if json.Unmarshal(respBody, &message) == nil {
+			if message.Message != nil {
+				text = fmt.Sprint(message.Message)
+			} else if message.Error != "" {
+				text = message.Error
+			}
+		}
+		return resp, &apiError{StatusCode: resp.StatusCode, Message: text}
+	}
+
+	if out != nil {
+		if err := json.Unmarshal(respBody, out); err != nil {
+			return resp, fmt.Errorf("failed to decode gitlab response: %w", err)
+		}
+	}
+	return resp, nil
+}
+
+// ListBranches returns every branch of the configured project
+func (s *Service) ListBranches(ctx context.Context) ([]scm.Branch, error) {
+	var branches []scm.Branch
+	for page := 1; page > 0; {
+		var batch []branch
+		resp, err := s.do(ctx, http.MethodGet,
+			fmt.Sprintf("%s/repository/branches?per_page=%d&page=%d", projectPath(s.repoOwner, s.repoName), branchesPerPage, page),
+			nil, &batch)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list branches: %w", err)
+		}
+
+		for _, b := range batch {
+			branches = append(branches, scm.Branch{
+				Name:      b.Name,
+				Protected: b.Protected,
+				SHA:       b.Commit.ID,
+			})
+		}
+
+		// GitLab leaves X-Next-Page empty on the last page
+		page, _ = strconv.Atoi(resp.Header.Get("X-Next-Page"))
+	}
+	return branches, nil
+}
+
+// GetRepository returns the configured project's information. Results are
+// cached for a minute, so the groups of one request share a single API call.
+func (s *Service) GetRepository(ctx context.Context) (*scm.Repository, error) {
+	s.repoMu.Lock()
+	defer s.repoMu.Unlock()
+
+	if s.repoCache != nil && time.Since(s.repoCachedAt) < repositoryCacheTTL {
+		return s.repoCache, nil
+	}
+
+	p, err := s.getProject(ctx, s.repoOwner, s.repoName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get repository: %w", err)
+	}
+	repo := p.describe()
+
+	s.repoCache = repo
+	s.repoCachedAt = time.Now()
+	return repo, nil
+}
+
+// InvalidateRepositoryCache makes the next GetRepository call fetch fresh
+// project information
+func (s *Service) InvalidateRepositoryCache() {
+	s.repoMu.Lock()
+	defer s.repoMu.Unlock()
+	s.repoCache = nil
+}
+
+// GetRepositoryByName returns information about another project
+func (s *Service) GetRepositoryByName(ctx context.Context, owner, repo string) (*scm.Repository, error) {
+	p, err := s.getProject(ctx, owner, repo)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get repository %s/%s: %w", owner, repo, err)
+	}
+	return p.describe(), nil
+}
+
+// getProject fetches a project
+func (s *Service) getProject(ctx context.Context, owner, repo string) (*project, error) {
+	var p project
+	if _, err := s.do(ctx, http.MethodGet, projectPath(owner, repo), nil, &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// describe converts a project to the provider-neutral repository description
+func (p *project) describe() *scm.Repository {
+	return &scm.Repository{
+		Owner:         p.Namespace.FullPath,
+		Name:          p.Path,
+		DefaultBranch: p.DefaultBranch,
+		CloneURL:      p.HTTPURLToRepo,
+		WebURL:        p.WebURL,
+	}
+}
+
+// accessLevel returns the highest access level the token's user has to the
+// project, directly or through its group
+func (p *project) accessLevel() int {
+	level := 0
+	for _, access := range []*accessLevel{p.Permissions.ProjectAccess, p.Permissions.GroupAccess} {
+		if access != nil && access.AccessLevel > level {
+			level = access.AccessLevel
+		}
+	}
+	return level
+}
+
+// CloneURL returns the HTTPS URL of project owner/repo on the instance
+func (s *Service) CloneURL(owner, repo string) string {
+	return fmt.Sprintf("%s/%s/%s.git", s.baseURL, owner, repo)
+}
+
+// CommitURL returns the web URL of a commit in project owner/repo
+func (s *Service) CommitURL(owner, repo, sha string) string {
+	return fmt.Sprintf("%s/%s/%s/-/commit/%s", s.baseURL, owner, repo, sha)
+}
+
+// FileURL returns the web URL of a file or directory in project owner/repo
+// at a commit
+func (s *Service) FileURL(owner, repo, sha, filePath string, dir bool) string {
+	view := "blob"
+	if dir {
+		view = "tree"
+	}
+	return fmt.Sprintf("%s/%s/%s/-/%s/%s/%s", s.baseURL, owner, repo, view, sha, strings.TrimPrefix(filePath, "/"))
+}
+
+// CanPush reports whether the token's user has at least developer access to
+// owner/repo, directly or through its group
+func (s *Service) CanPush(ctx context.Context, owner, repo string) (bool, error) {
+	p, err := s.getProject(ctx, owner, repo)
+	if err != nil {
+		return false, fmt.Errorf("failed to get repository %s/%s: %w", owner, repo, err)
+	}
+	return p.accessLevel() >= developerAccessLevel, nil
+}
+
+// GetFileContents returns the content of a file in project owner/repo at
+// ref, or scm.ErrFileNotFound if there is no such file
+func (s *Service) GetFileContents(ctx context.Context, owner, repo, filePath, ref string) ([]byte, error) {
+	var file struct {
+		Encoding string `json:"encoding"`
+		Content  string `json:"content"`
+	}
+	resource := projectPath(owner, repo) + "/repository/files/" + url.PathEscape(filePath) + "?ref=" + url.QueryEscape(ref)
+	_, err := s.do(ctx, http.MethodGet, resource, nil, &file)
+	var apiErr *apiError
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound {
+		return nil, scm.ErrFileNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get %s from %s/%s: %w", filePath, owner, repo, err)
+	}
+
+	if file.Encoding != "base64" {
+		return []byte(file.Content), nil
+	}
+	content, err := base64.StdEncoding.DecodeString(file.Content)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %s from %s/%s: %w", filePath, owner, repo, err)
+	}
+	return content, nil
+}
+
+// EnsureFork is not supported on GitLab
+func (s *Service) EnsureFork(ctx context.Context, owner, repo, forkOwner string) error {
+	return fmt.Errorf("forking is not supported with GitLab")
+}
+
+// CreatePullRequest opens a merge request from the head branch to the base
+// branch of owner/repo and returns its URL. Merge requests from forks are
+// not supported.
+func (s *Service) CreatePullRequest(ctx context.Context, owner, repo, base, head, title, body string) (string, error) {
+	if strings.Contains(head, ":") {
+		return "", fmt.Errorf("merge requests from forks are not supported with GitLab")
+	}
+
+	var mr struct {
+		WebURL string `json:"web_url"`
+	}
+	_, err := s.do(ctx, http.MethodPost, projectPath(owner, repo)+"/merge_requests", map[string]string{
+		"source_branch": head,
+		"target_branch": base,
+		"title":         title,
+		"description":   body,
+	}, &mr)
+	if err != nil {
+		return "", fmt.Errorf("failed to create merge request %s -> %s/%s:%s: %w", head, owner, repo, base, err)
+	}
+	return mr.WebURL, nil
+}
+
+// IsAuthenticated checks if the GitLab token is valid
+func (s *Service) IsAuthenticated(ctx context.Context) bool {
+	_, err := s.do(ctx, http.MethodGet, "/user", nil, nil)
+	return err == nil
+}
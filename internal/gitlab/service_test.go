@@ -0,0 +1,267 @@
+package gitlab
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lei/yaml-helm-pipeline/internal/retry"
+	"github.com/lei/yaml-helm-pipeline/internal/scm"
+)
+
+// fakeGitLab starts a test server answering GitLab API requests with handler
+// and returns a service for the project group/sub/deploy on it
+func fakeGitLab(t *testing.T, handler http.HandlerFunc) *Service {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Authorization"); got != "Bearer glpat-token" {
+			http.Error(w, `{"message":"401 Unauthorized"}`, http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	return NewService(server.URL+"/", "glpat-token", "group/sub", "deploy", retry.Policy{MaxAttempts: 3}, HTTPOptions{})
+}
+
+// project path of group/sub/deploy in API URLs
+const deployPath = "/api/v4/projects/group%2Fsub%2Fdeploy"
+
+func TestListBranchesFollowsPages(t *testing.T) {
+	s := fakeGitLab(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.EscapedPath() != deployPath+"/repository/branches" {
+			t.Errorf("unexpected request %s", r.URL.EscapedPath())
+		}
+		switch r.URL.Query().Get("page") {
+		case "1":
+			w.Header().Set("X-Next-Page", "2")
+			w.Write([]byte(`[{"name":"main","protected":true,"commit":{"id":"aaa"}}]`))
+		case "2":
+			w.Header().Set("X-Next-Page", "")
+			w.Write([]byte(`[{"name":"develop","commit":{"id":"bbb"}}]`))
+		}
+	})
+
+	branches, err := s.ListBranches(context.Background())
+	if err != nil {
+		t.Fatalf("ListBranches() error = %v", err)
+	}
+	want := []scm.Branch{
+		{Name: "main", Protected: true, SHA: "aaa"},
+		{Name: "develop", SHA: "bbb"},
+	}
+	if !reflect.DeepEqual(branches, want) {
+		t.Errorf("ListBranches() = %+v, want %+v", branches, want)
+	}
+}
+
+func TestGetRepositoryIsCached(t *testing.T) {
+	var requests int32
+	s := fakeGitLab(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Write([]byte(`{"id":7,"path":"deploy","path_with_namespace":"group/sub/deploy",
+			"default_branch":"main","http_url_to_repo":"https://gitlab.example.com/group/sub/deploy.git",
+			"web_url":"https://gitlab.example.com/group/sub/deploy","namespace":{"full_path":"group/sub"}}`))
+	})
+
+	want := &scm.Repository{
+		Owner:         "group/sub",
+		Name:          "deploy",
+		DefaultBranch: "main",
+		CloneURL:      "https://gitlab.example.com/group/sub/deploy.git",
+		WebURL:        "https://gitlab.example.com/group/sub/deploy",
+	}
+	for i := 0; i < 2; i++ {
+		repo, err := s.GetRepository(context.Background())
+		if err != nil {
+			t.Fatalf("GetRepository() error = %v", err)
+		}
+		if !reflect.DeepEqual(repo, want) {
+			t.Errorf("GetRepository() = %+v, want %+v", repo, want)
+		}
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("GetRepository() sent %d requests, want 1", n)
+	}
+
+	s.InvalidateRepositoryCache()
+	if _, err := s.GetRepository(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Errorf("GetRepository() after invalidation sent %d requests in total, want 2", n)
+	}
+}
+
+func TestCanPush(t *testing.T) {
+	tests := []struct {
+		permissions string
+		want        bool
+	}{
+		{`{"project_access":{"access_level":30}}`, true},
+		{`{"project_access":{"access_level":20},"group_access":{"access_level":40}}`, true},
+		{`{"project_access":{"access_level":20}}`, false},
+		{`{}`, false},
+	}
+
+	for _, tt := range tests {
+		s := fakeGitLab(t, func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"path":"deploy","permissions":` + tt.permissions + `}`))
+		})
+
+		got, err := s.CanPush(context.Background(), "group/sub", "deploy")
+		if err != nil {
+			t.Fatalf("CanPush() error = %v", err)
+		}
+		if got != tt.want {
+			t.Errorf("CanPush() with permissions %s = %v, want %v", tt.permissions, got, tt.want)
+		}
+	}
+}
+
+func TestGetFileContents(t *testing.T) {
+	s := fakeGitLab(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.EscapedPath() {
+		case deployPath + "/repository/files/apps%2Fgenerated.yaml":
+			if ref := r.URL.Query().Get("ref"); ref != "release/1.0" {
+				t.Errorf("ref = %q, want release/1.0", ref)
+			}
+			json.NewEncoder(w).Encode(map[string]string{
+				"encoding": "base64",
+				"content":  base64.StdEncoding.EncodeToString([]byte("kind: ConfigMap\n")),
+			})
+		default:
+			http.Error(w, `{"message":"404 File Not Found"}`, http.StatusNotFound)
+		}
+	})
+
+	content, err := s.GetFileContents(context.Background(), "group/sub", "deploy", "apps/generated.yaml", "release/1.0")
+	if err != nil {
+		t.Fatalf("GetFileContents() error = %v", err)
+	}
+	if string(content) != "kind: ConfigMap\n" {
+		t.Errorf("GetFileContents() = %q", content)
+	}
+
+	_, err = s.GetFileContents(context.Background(), "group/sub", "deploy", "missing.yaml", "main")
+	if !errors.Is(err, scm.ErrFileNotFound) {
+		t.Errorf("GetFileContents() of a missing file error = %v, want scm.ErrFileNotFound", err)
+	}
+}
+
+func TestRequestsRetryServerErrors(t *testing.T) {
+	var requests int32
+	s := fakeGitLab(t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.Header().Set("Retry-After", "0")
+			http.Error(w, `{"message":"502 Bad Gateway"}`, http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte(`{"id":1}`))
+	})
+
+	if !s.IsAuthenticated(context.Background()) {
+		t.Error("IsAuthenticated() = false after a retried server error")
+	}
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Errorf("sent %d requests, want 2", n)
+	}
+}
+
+func TestRequestsReportAPIErrors(t *testing.T) {
+	var requests int32
+	s := fakeGitLab(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		http.Error(w, `{"message":"403 Forbidden"}`, http.StatusForbidden)
+	})
+
+	_, err := s.GetRepositoryByName(context.Background(), "group", "other")
+	var apiErr *apiError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusForbidden || apiErr.Message != "403 Forbidden" {
+		t.Errorf("GetRepositoryByName() error = %v, want the API's 403", err)
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("sent %d requests for a client error, want 1", n)
+	}
+}
+
+func TestCreatePullRequest(t *testing.T) {
+	s := fakeGitLab(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.EscapedPath() != deployPath+"/merge_requests" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.EscapedPath())
+		}
+		var body map[string]string
+		json.NewDecoder(r.Body).Decode(&body)
+		want := map[string]string{
+			"source_branch": "helm-pipeline/web",
+			"target_branch": "main",
+			"title":         "Update web",
+			"description":   "Generated",
+		}
+		if !reflect.DeepEqual(body, want) {
+			t.Errorf("merge request = %v, want %v", body, want)
+		}
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"web_url":"https://gitlab.example.com/group/sub/deploy/-/merge_requests/1"}`))
+	})
+
+	url, err := s.CreatePullRequest(context.Background(), "group/sub", "deploy", "main", "helm-pipeline/web", "Update web", "Generated")
+	if err != nil {
+		t.Fatalf("CreatePullRequest() error = %v", err)
+	}
+	if url != "https://gitlab.example.com/group/sub/deploy/-/merge_requests/1" {
+		t.Errorf("CreatePullRequest() = %q", url)
+	}
+
+	if _, err := s.CreatePullRequest(context.Background(), "group/sub", "deploy", "main", "fork:branch", "t", "b"); err == nil {
+		t.Error("CreatePullRequest() from a fork succeeded, want an error")
+	}
+}
+
+func TestURLs(t *testing.T) {
+	s := NewService("https://gitlab.example.com/", "token", "group", "deploy", retry.NewPolicy(0), HTTPOptions{})
+
+	tests := []struct{ got, want string }{
+		{s.CloneURL("group/sub", "values"), "https://gitlab.example.com/group/sub/values.git"},
+		{s.CommitURL("group/sub", "deploy", "abc123"), "https://gitlab.example.com/group/sub/deploy/-/commit/abc123"},
+		{s.FileURL("group/sub", "deploy", "abc123", "/apps/generated.yaml", false), "https://gitlab.example.com/group/sub/deploy/-/blob/abc123/apps/generated.yaml"},
+		{s.FileURL("group/sub", "deploy", "abc123", "apps", true), "https://gitlab.example.com/group/sub/deploy/-/tree/abc123/apps"},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("URL = %q, want %q", tt.got, tt.want)
+		}
+	}
+}
+
+func TestRequestsTimeOutEachAttempt(t *testing.T) {
+	var requests int32
+	s := fakeGitLab(t, func(w http.ResponseWriter, r *http.Request) {
+		// The first attempt hangs until the client gives up on it
+		if atomic.AddInt32(&requests, 1) == 1 {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+			return
+		}
+		w.Write([]byte(`{"id":1}`))
+	})
+	s.timeout = 200 * time.Millisecond
+
+	if !s.IsAuthenticated(context.Background()) {
+		t.Error("IsAuthenticated() = false after a retried hung request")
+	}
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Errorf("sent %d requests, want the hung one retried", n)
+	}
+}
@@ -0,0 +1,38 @@
+package helm
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+)
+
+// defaultBinary is the helm executable run when none is configured, looked
+// up on the PATH
+const defaultBinary = "helm"
+
+// SetBinary sets the helm executable to run, as a path or a name looked up
+// on the PATH. It fails if the executable can't be found. The default is
+// kept when binary is empty.
+func (s *Service) SetBinary(binary string) error {
+	if binary == "" {
+		return nil
+	}
+
+	path, err := exec.LookPath(binary)
+	if err != nil {
+		return fmt.Errorf("helm binary not found: %w", err)
+	}
+	s.binary = path
+	return nil
+}
+
+// command creates a helm command running the configured binary. It inherits
+// the server's environment, so HELM_PLUGINS, HELM_DATA_HOME, and other helm
+// settings apply.
+func (s *Service) command(ctx context.Context, args ...string) *exec.Cmd {
+	binary := s.binary
+	if binary == "" {
+		binary = defaultBinary
+	}
+	return exec.CommandContext(ctx, binary, args...)
+}
@@ -0,0 +1,50 @@
+package helm
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSetBinary(t *testing.T) {
+	s := fakeHelm(t, `echo "kind: FromPath"`)
+	t.Setenv("HELM_PLUGINS", "/opt/helm/plugins")
+
+	binary := filepath.Join(t.TempDir(), "helm3")
+	script := "#!/bin/sh\necho \"kind: $1\"\necho \"plugins: $HELM_PLUGINS\"\n"
+	if err := os.WriteFile(binary, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.SetBinary(""); err != nil || s.binary != "" {
+		t.Fatalf("SetBinary(\"\") = %v, binary %q, want the default kept", err, s.binary)
+	}
+	if err := s.SetBinary(binary); err != nil {
+		t.Fatalf("SetBinary() error = %v", err)
+	}
+
+	// Both templating and reading chart values run the configured binary,
+	// with the server's environment
+	result, err := s.TemplateChart(context.Background(), TemplateOptions{Chart: "chart"})
+	if err != nil {
+		t.Fatalf("TemplateChart() error = %v", err)
+	}
+	if want := "kind: template\nplugins: /opt/helm/plugins\n"; string(result.Output) != want {
+		t.Errorf("TemplateChart() output = %q, want %q", result.Output, want)
+	}
+	values, err := s.MergedValues(context.Background(), TemplateOptions{Chart: "oci://registry.example.com/app"})
+	if err != nil {
+		t.Fatalf("MergedValues() error = %v", err)
+	}
+	if values["kind"] != "show" {
+		t.Errorf("MergedValues() = %v, want the configured binary's output", values)
+	}
+
+	if err := s.SetBinary(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("SetBinary() of a missing binary succeeded")
+	}
+	if s.binary != binary {
+		t.Errorf("binary = %q after a failed SetBinary, want %q kept", s.binary, binary)
+	}
+}
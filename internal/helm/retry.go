@@ -0,0 +1,60 @@
+package helm
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/lei/yaml-helm-pipeline/internal/retry"
+)
+
+// transientMessages are what helm prints when fetching charts or
+// dependencies fails for reasons that may go away on their own
+var transientMessages = []string{
+	"connection refused",
+	"connection reset",
+	"connection timed out",
+	"i/o timeout",
+	"no such host",
+	"tls handshake timeout",
+	"timeout awaiting response headers",
+	"context deadline exceeded",
+	"unexpected eof",
+}
+
+// transientStatuses are the HTTP statuses of chart downloads worth retrying.
+// They only count when helm reports them as a status, so digits that happen
+// to appear in a template error don't make it retryable.
+var transientStatuses = []int{
+	http.StatusTooManyRequests,
+	http.StatusInternalServerError,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+// SetRetries sets how many times a helm template run that failed on the
+// network is retried. Template errors and timeouts are never retried.
+func (s *Service) SetRetries(retries int) {
+	s.retry = retry.NewPolicy(retries)
+}
+
+// isTransient reports whether a failed helm template run may succeed when
+// retried, because helm's output points at a network problem. A run that
+// timed out isn't retried, since a slow chart would only time out again.
+func isTransient(stderr string) bool {
+	stderr = strings.ToLower(stderr)
+	for _, message := range transientMessages {
+		if strings.Contains(stderr, message) {
+			return true
+		}
+	}
+
+	for _, status := range transientStatuses {
+		if strings.Contains(stderr, fmt.Sprintf("status code %d", status)) ||
+			strings.Contains(stderr, strings.ToLower(fmt.Sprintf("%d %s", status, http.StatusText(status)))) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,98 @@
+package helm
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lei/yaml-helm-pipeline/internal/retry"
+)
+
+func TestIsTransient(t *testing.T) {
+	tests := []struct {
+		stderr string
+		want   bool
+	}{
+		{`Error: failed to fetch https://charts.example.com/app-1.0.tgz : 429 Too Many Requests`, true},
+		{`Error: unexpected status code 503 from registry`, true},
+		{`Error: Get "https://charts.example.com/index.yaml": dial tcp: lookup charts.example.com: no such host`, true},
+		{`Error: read tcp 10.0.0.1:4321->10.0.0.2:443: i/o timeout`, true},
+		{`Error: template: app/templates/deploy.yaml:429:12: executing "app" at <.Values.x>: nil pointer`, false},
+		{`Error: values don't meet the specifications of the schema: port: must be <= 65535, got 65536 (500 too big)`, false},
+		{`Error: parse error at (app/templates/svc.yaml:503): unexpected "}"`, false},
+	}
+
+	for _, tt := range tests {
+		if got := isTransient(tt.stderr); got != tt.want {
+			t.Errorf("isTransient(%q) = %v, want %v", tt.stderr, got, tt.want)
+		}
+	}
+}
+
+// retryingHelm returns a service whose helm fails with stderr on the first
+// run and prints a manifest afterwards, and the file counting the runs
+func retryingHelm(t *testing.T, stderr string) (*Service, string) {
+	t.Helper()
+
+	runs := filepath.Join(t.TempDir(), "runs")
+	s := fakeHelm(t, `echo run >> `+runs+`
+if [ "$(wc -l < `+runs+`)" -eq 1 ]; then echo '`+stderr+`' >&2; exit 1; fi
+echo 'kind: ConfigMap'`)
+	s.retry = retry.Policy{MaxAttempts: 3}
+	return s, runs
+}
+
+// countRuns returns how often helm ran
+func countRuns(t *testing.T, runs string) int {
+	t.Helper()
+	data, err := os.ReadFile(runs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Count(string(data), "run")
+}
+
+func TestTemplateChartRetriesTransientFailures(t *testing.T) {
+	s, runs := retryingHelm(t, "Error: failed to fetch chart: 429 Too Many Requests")
+
+	result, err := s.TemplateChart(context.Background(), TemplateOptions{Chart: "chart"})
+	if err != nil {
+		t.Fatalf("TemplateChart() error = %v", err)
+	}
+	if got := string(result.Output); got != "kind: ConfigMap\n" {
+		t.Errorf("output = %q", got)
+	}
+	if n := countRuns(t, runs); n != 2 {
+		t.Errorf("helm ran %d times, want 2", n)
+	}
+}
+
+func TestTemplateChartDoesNotRetryTemplateErrors(t *testing.T) {
+	s, runs := retryingHelm(t, "Error: template: app/templates/cm.yaml:429:3: bad character")
+
+	if _, err := s.TemplateChart(context.Background(), TemplateOptions{Chart: "chart"}); err == nil {
+		t.Fatal("TemplateChart() succeeded, want the template error")
+	}
+	if n := countRuns(t, runs); n != 1 {
+		t.Errorf("helm ran %d times, want 1", n)
+	}
+}
+
+func TestTemplateChartDoesNotRetryTimeouts(t *testing.T) {
+	runs := filepath.Join(t.TempDir(), "runs")
+	s := fakeHelm(t, `echo run >> `+runs+`; exec sleep 5`)
+	s.timeout = 100 * time.Millisecond
+	s.retry = retry.Policy{MaxAttempts: 3}
+
+	_, err := s.TemplateChart(context.Background(), TemplateOptions{Chart: "chart"})
+	if !errors.Is(err, ErrTimeout) {
+		t.Fatalf("TemplateChart() error = %v, want ErrTimeout", err)
+	}
+	if n := countRuns(t, runs); n != 1 {
+		t.Errorf("helm ran %d times, want 1", n)
+	}
+}
@@ -2,47 +2,336 @@ package helm
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
-	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
 
+	"github.com/lei/yaml-helm-pipeline/internal/retry"
 	"gopkg.in/yaml.v3"
 )
 
+// ErrTimeout is returned when helm template doesn't finish in time
+var ErrTimeout = errors.New("helm template timed out")
+
 // Service handles Helm operations
-type Service struct{}
+type Service struct {
+	timeout    time.Duration
+	binary     string       // helm executable, see SetBinary
+	minVersion string       // Minimum helm CLI version, see SetMinVersion
+	retry      retry.Policy // Retries of transient helm template failures
+}
 
-// NewService creates a new Helm service
-func NewService() *Service {
-	return &Service{}
+// NewService creates a new Helm service. A positive timeout bounds each helm
+// template run in addition to the caller's context.
+func NewService(timeout time.Duration) *Service {
+	return &Service{
+		timeout: timeout,
+	}
 }
 
-// TemplateChart renders a Helm chart with the given values
-func (s *Service) TemplateChart(chartPath string, valuesPaths []string) ([]byte, error) {
-	// Build the helm template command
-	args := []string{"template", chartPath}
+// TemplateResult holds the output of a helm template run
+type TemplateResult struct {
+	Output   []byte
+	Warnings []string // Non-fatal messages helm printed to stderr
+	Debug    string   // Everything helm printed to stderr, set in debug mode
+}
 
-	// Add each values file
-	for _, valuesPath := range valuesPaths {
-		// Check if the file exists
+// TemplateOptions describes a helm template run
+type TemplateOptions struct {
+	Chart       string   // Local chart directory or remote chart reference (oci://, https://)
+	Version     string   // Chart version constraint for remote chart references
+	ValuesFiles []string // Values files in increasing order of precedence
+
+	ReleaseName string // Release name, helm's default when empty
+	Namespace   string // Release namespace, helm's default when empty
+
+	PostRenderer     string   // Executable the rendered manifests are piped through
+	PostRendererArgs []string // Arguments passed to the post-renderer
+	ExtraArgs        []string // Appended after every other argument
+
+	Debug bool // Run with --debug and capture the trace in the result
+}
+
+// TemplateChart renders a Helm chart with the given values. The helm process
+// is killed when the context is done or the configured timeout elapses.
+func (s *Service) TemplateChart(ctx context.Context, opts TemplateOptions) (*TemplateResult, error) {
+	// Check that each values file exists
+	for _, valuesPath := range opts.ValuesFiles {
 		if _, err := os.Stat(valuesPath); os.IsNotExist(err) {
 			return nil, fmt.Errorf("values file not found: %s", valuesPath)
 		}
-		args = append(args, "-f", valuesPath)
 	}
 
-	// Run helm template command and capture output directly
-	cmd := exec.Command("helm", args...)
+	// Build the helm template command
+	args := templateArgs(opts)
+
+	// Retry runs that failed on the network, but not template errors, which
+	// fail the same way every time, or timeouts
 	var stdout, stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
+	err := s.retry.Do(ctx, func() error {
+		stdout.Reset()
+		stderr.Reset()
+		err := s.runTemplate(ctx, args, &stdout, &stderr)
+		if err != nil && (errors.Is(err, ErrTimeout) || !isTransient(stderr.String())) {
+			return retry.Permanent(err)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The debug trace goes to stderr, so it replaces the warnings
+	if opts.Debug {
+		return &TemplateResult{Output: stdout.Bytes(), Debug: stderr.String()}, nil
+	}
+
+	return &TemplateResult{
+		Output:   stdout.Bytes(),
+		Warnings: parseWarnings(stderr.String()),
+	}, nil
+}
+
+// runTemplate runs helm template once, bounded by the service's timeout
+func (s *Service) runTemplate(ctx context.Context, args []string, stdout, stderr *bytes.Buffer) error {
+	if s.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+	}
+
+	// Run helm template command and capture output directly
+	cmd := s.command(ctx, args...)
+	cmd.WaitDelay = 5 * time.Second
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	if err := cmd.Run(); err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return ErrTimeout
+		}
+		if ctx.Err() != nil {
+			return fmt.Errorf("helm template cancelled: %w", ctx.Err())
+		}
+		return fmt.Errorf("helm template failed: %w, stderr: %s", err, stderr.String())
+	}
+	return nil
+}
+
+// templateArgs builds the arguments for `helm template`
+func templateArgs(opts TemplateOptions) []string {
+	args := []string{"template"}
+	if opts.ReleaseName != "" {
+		args = append(args, opts.ReleaseName)
+	}
+	args = append(args, opts.Chart)
+
+	if opts.Namespace != "" {
+		args = append(args, "--namespace", opts.Namespace)
+	}
+
+	if opts.Version != "" {
+		args = append(args, "--version", opts.Version)
+	}
+
+	// Add each values file
+	for _, valuesPath := range opts.ValuesFiles {
+		args = append(args, "-f", valuesPath)
+	}
+
+	if opts.PostRenderer != "" {
+		args = append(args, "--post-renderer", opts.PostRenderer)
+		for _, arg := range opts.PostRendererArgs {
+			args = append(args, "--post-renderer-args", arg)
+		}
+	}
+
+	args = append(args, opts.ExtraArgs...)
+
+	if opts.Debug {
+		args = append(args, "--debug")
+	}
+	return args
+}
+
+// RegistryLogin logs in to the OCI registry hosting a chart reference
+func (s *Service) RegistryLogin(ctx context.Context, chartRef, username, password string) error {
+	host, _, _ := strings.Cut(strings.TrimPrefix(chartRef, "oci://"), "/")
+
+	cmd := s.command(ctx, "registry", "login", host, "--username", username, "--password-stdin")
+	cmd.Stdin = strings.NewReader(password)
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("helm registry login to %s failed: %w, output: %s", host, err, output.String())
+	}
+
+	return nil
+}
+
+// parseWarnings splits helm's stderr into individual warnings, dropping the
+// "WARNING:" prefix helm puts on most of them
+func parseWarnings(stderr string) []string {
+	var warnings []string
+	for _, line := range strings.Split(stderr, "\n") {
+		line = strings.TrimSpace(line)
+		line = strings.TrimSpace(strings.TrimPrefix(line, "WARNING:"))
+		if line != "" {
+			warnings = append(warnings, line)
+		}
+	}
+	return warnings
+}
+
+// Repository is a chart repository registered with helm before resolving
+// chart dependencies
+type Repository struct {
+	Name     string
+	URL      string
+	Username string
+	Password string
+}
+
+// AddRepository registers a chart repository, replacing any existing
+// repository with the same name. The password is passed on stdin so it
+// never shows up in the process list, and credentials are redacted from
+// errors.
+func (s *Service) AddRepository(repo Repository) error {
+	cmd := s.command(context.Background(), repoAddArgs(repo)...)
+	if repo.Password != "" {
+		cmd.Stdin = strings.NewReader(repo.Password)
+	}
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("helm repo add %s failed: %s, output: %s",
+			repo.Name, redact(err.Error(), repo), redact(output.String(), repo))
+	}
+
+	return nil
+}
+
+// repoAddArgs builds the arguments for `helm repo add`. The password is
+// read from stdin, never passed as an argument.
+func repoAddArgs(repo Repository) []string {
+	args := []string{"repo", "add", repo.Name, repo.URL, "--force-update"}
+	if repo.Username != "" {
+		args = append(args, "--username", repo.Username)
+	}
+	if repo.Password != "" {
+		args = append(args, "--password-stdin")
+	}
+	return args
+}
+
+// redact masks a repository's credentials in command output
+func redact(text string, repo Repository) string {
+	for _, secret := range []string{repo.Password, repo.Username} {
+		if secret != "" {
+			text = strings.ReplaceAll(text, secret, "***")
+		}
+	}
+	return text
+}
+
+// HasDependencies reports whether the chart declares any dependencies
+func (s *Service) HasDependencies(chartPath string) (bool, error) {
+	data, err := os.ReadFile(filepath.Join(chartPath, "Chart.yaml"))
+	if err != nil {
+		return false, fmt.Errorf("failed to read Chart.yaml: %w", err)
+	}
+
+	var chart struct {
+		Dependencies []interface{} `yaml:"dependencies"`
+	}
+	if err := yaml.Unmarshal(data, &chart); err != nil {
+		return false, fmt.Errorf("failed to parse Chart.yaml: %w", err)
+	}
+
+	return len(chart.Dependencies) > 0, nil
+}
+
+// ChartMetadata is the identifying information in a chart's Chart.yaml.
+// Fields the chart doesn't set are empty.
+type ChartMetadata struct {
+	Name       string `yaml:"name"`
+	Version    string `yaml:"version"`
+	AppVersion string `yaml:"appVersion"`
+}
+
+// ChartMetadata reads the name and versions of a local chart
+func (s *Service) ChartMetadata(chartPath string) (*ChartMetadata, error) {
+	data, err := os.ReadFile(filepath.Join(chartPath, "Chart.yaml"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read Chart.yaml: %w", err)
+	}
+
+	var metadata ChartMetadata
+	if err := yaml.Unmarshal(data, &metadata); err != nil {
+		return nil, fmt.Errorf("failed to parse Chart.yaml: %w", err)
+	}
+
+	return &metadata, nil
+}
+
+// BuildDependencies downloads the chart's dependencies into its charts/ directory
+func (s *Service) BuildDependencies(chartPath string) error {
+	cmd := s.command(context.Background(), "dependency", "build", chartPath)
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
 
 	if err := cmd.Run(); err != nil {
-		return nil, fmt.Errorf("helm template failed: %w, stderr: %s", err, stderr.String())
+		return fmt.Errorf("helm dependency build failed: %w, output: %s", err, output.String())
+	}
+
+	return nil
+}
+
+// LintChart runs `helm lint` on a local chart with the given values files and
+// returns an error containing the lint output if any errors are reported.
+// With strict, warnings fail the lint as well.
+func (s *Service) LintChart(ctx context.Context, chartPath string, valuesPaths []string, strict bool) error {
+	if s.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+	}
+
+	args := []string{"lint", chartPath}
+	for _, valuesPath := range valuesPaths {
+		args = append(args, "-f", valuesPath)
+	}
+	if strict {
+		args = append(args, "--strict")
+	}
+
+	cmd := s.command(ctx, args...)
+	cmd.WaitDelay = 5 * time.Second
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	if err := cmd.Run(); err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return ErrTimeout
+		}
+		if ctx.Err() != nil {
+			return fmt.Errorf("helm lint cancelled: %w", ctx.Err())
+		}
+		return fmt.Errorf("helm lint failed: %w, output: %s", err, output.String())
 	}
 
-	return stdout.Bytes(), nil
+	return nil
 }
 
 // ExtractKeys extracts keys from YAML content without their values
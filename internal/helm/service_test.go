@@ -0,0 +1,320 @@
+package helm
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeHelm puts a shell script named helm first on PATH and returns a
+// service that runs it
+func fakeHelm(t *testing.T, script string) *Service {
+	t.Helper()
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "helm"), []byte("#!/bin/sh\n"+script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	return NewService(0)
+}
+
+func TestRepoAddArgs(t *testing.T) {
+	tests := []struct {
+		name string
+		repo Repository
+		want []string
+	}{
+		{
+			name: "public",
+			repo: Repository{Name: "charts", URL: "https://charts.example.com"},
+			want: []string{"repo", "add", "charts", "https://charts.example.com", "--force-update"},
+		},
+		{
+			name: "credentials",
+			repo: Repository{Name: "charts", URL: "https://charts.example.com", Username: "bot", Password: "s3cret"},
+			want: []string{"repo", "add", "charts", "https://charts.example.com", "--force-update",
+				"--username", "bot", "--password-stdin"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := repoAddArgs(tt.repo); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("repoAddArgs() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAddRepositoryPassesPasswordOnStdin(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out")
+	s := fakeHelm(t, `echo "$@" > `+out+`.args; cat > `+out+`.stdin`)
+
+	err := s.AddRepository(Repository{Name: "charts", URL: "https://charts.example.com", Username: "bot", Password: "s3cret"})
+	if err != nil {
+		t.Fatalf("AddRepository() error = %v", err)
+	}
+
+	args, _ := os.ReadFile(out + ".args")
+	if strings.Contains(string(args), "s3cret") {
+		t.Errorf("password passed as an argument: %s", args)
+	}
+	stdin, _ := os.ReadFile(out + ".stdin")
+	if string(stdin) != "s3cret" {
+		t.Errorf("stdin = %q, want the password", stdin)
+	}
+}
+
+func TestAddRepositoryRedactsErrors(t *testing.T) {
+	s := fakeHelm(t, `echo "401 for bot:$(cat)" >&2; exit 1`)
+
+	err := s.AddRepository(Repository{Name: "charts", URL: "https://charts.example.com", Username: "bot", Password: "s3cret"})
+	if err == nil {
+		t.Fatal("AddRepository() succeeded, want an error")
+	}
+	if strings.Contains(err.Error(), "s3cret") || strings.Contains(err.Error(), "bot") {
+		t.Errorf("error leaks credentials: %v", err)
+	}
+}
+
+func TestTemplateChartTimeout(t *testing.T) {
+	fakeHelm(t, "exec sleep 30")
+
+	start := time.Now()
+	_, err := NewService(100*time.Millisecond).TemplateChart(context.Background(), TemplateOptions{Chart: "chart"})
+	if !errors.Is(err, ErrTimeout) {
+		t.Fatalf("TemplateChart() error = %v, want ErrTimeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("TemplateChart() took %v, want helm killed at the timeout", elapsed)
+	}
+}
+
+func TestTemplateChartCancelled(t *testing.T) {
+	s := fakeHelm(t, "exec sleep 30")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	start := time.Now()
+	_, err := s.TemplateChart(ctx, TemplateOptions{Chart: "chart"})
+	if err == nil || errors.Is(err, ErrTimeout) || !errors.Is(err, context.Canceled) {
+		t.Fatalf("TemplateChart() error = %v, want it cancelled", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("TemplateChart() took %v, want helm killed on cancellation", elapsed)
+	}
+}
+
+func TestTemplateChartWarnings(t *testing.T) {
+	s := fakeHelm(t, `echo "kind: ConfigMap"
+echo "WARNING: Kubernetes configuration file is group-readable" >&2
+echo >&2
+echo "coalesce.go:237: warning: skipped value for foo: Not a table." >&2`)
+
+	result, err := s.TemplateChart(context.Background(), TemplateOptions{Chart: "chart"})
+	if err != nil {
+		t.Fatalf("TemplateChart() error = %v", err)
+	}
+	if string(result.Output) != "kind: ConfigMap\n" {
+		t.Errorf("Output = %q, want stdout only", result.Output)
+	}
+	want := []string{
+		"Kubernetes configuration file is group-readable",
+		"coalesce.go:237: warning: skipped value for foo: Not a table.",
+	}
+	if !reflect.DeepEqual(result.Warnings, want) {
+		t.Errorf("Warnings = %q, want %q", result.Warnings, want)
+	}
+}
+
+func TestTemplateChartDebug(t *testing.T) {
+	s := fakeHelm(t, `echo "kind: ConfigMap"
+echo "args: $*" >&2
+echo "WARNING: Kubernetes configuration file is group-readable" >&2`)
+
+	result, err := s.TemplateChart(context.Background(), TemplateOptions{Chart: "chart", Debug: true})
+	if err != nil {
+		t.Fatalf("TemplateChart() error = %v", err)
+	}
+	if string(result.Output) != "kind: ConfigMap\n" {
+		t.Errorf("Output = %q, want stdout only", result.Output)
+	}
+	if want := "args: template chart --debug\nWARNING: Kubernetes configuration file is group-readable\n"; result.Debug != want {
+		t.Errorf("Debug = %q, want %q", result.Debug, want)
+	}
+	if result.Warnings != nil {
+		t.Errorf("Warnings = %q, want them left in the debug trace", result.Warnings)
+	}
+}
+
+func TestTemplateArgs(t *testing.T) {
+	tests := []struct {
+		name string
+		opts TemplateOptions
+		want []string
+	}{
+		{
+			name: "local chart",
+			opts: TemplateOptions{Chart: "/tmp/chart", ValuesFiles: []string{"a.yaml", "b.yaml"}},
+			want: []string{"template", "/tmp/chart", "-f", "a.yaml", "-f", "b.yaml"},
+		},
+		{
+			name: "pinned OCI chart",
+			opts: TemplateOptions{Chart: "oci://ghcr.io/acme/app", Version: "1.2.3", ValuesFiles: []string{"a.yaml"}},
+			want: []string{"template", "oci://ghcr.io/acme/app", "--version", "1.2.3", "-f", "a.yaml"},
+		},
+		{
+			name: "post-renderer",
+			opts: TemplateOptions{Chart: "/tmp/chart", PostRenderer: "kustomize-wrapper", PostRendererArgs: []string{"--overlay", "prod"}},
+			want: []string{"template", "/tmp/chart", "--post-renderer", "kustomize-wrapper",
+				"--post-renderer-args", "--overlay", "--post-renderer-args", "prod"},
+		},
+		{
+			name: "extra arguments",
+			opts: TemplateOptions{Chart: "/tmp/chart", ValuesFiles: []string{"a.yaml"}, ExtraArgs: []string{"--skip-tests", "--kube-version", "1.29.0"}},
+			want: []string{"template", "/tmp/chart", "-f", "a.yaml", "--skip-tests", "--kube-version", "1.29.0"},
+		},
+		{
+			name: "debug",
+			opts: TemplateOptions{Chart: "/tmp/chart", ValuesFiles: []string{"a.yaml"}, Debug: true},
+			want: []string{"template", "/tmp/chart", "-f", "a.yaml", "--debug"},
+		},
+		{
+			name: "unpinned URL",
+			opts: TemplateOptions{Chart: "https://charts.example.com/app-1.0.0.tgz"},
+			want: []string{"template", "https://charts.example.com/app-1.0.0.tgz"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := templateArgs(tt.opts); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("templateArgs() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRegistryLogin(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out")
+	s := fakeHelm(t, `echo "$@" > `+out+`.args; cat > `+out+`.stdin`)
+
+	if err := s.RegistryLogin(context.Background(), "oci://ghcr.io/acme/app", "bot", "s3cret"); err != nil {
+		t.Fatalf("RegistryLogin() error = %v", err)
+	}
+
+	args, _ := os.ReadFile(out + ".args")
+	if got, want := strings.TrimSpace(string(args)), "registry login ghcr.io --username bot --password-stdin"; got != want {
+		t.Errorf("args = %q, want %q", got, want)
+	}
+	stdin, _ := os.ReadFile(out + ".stdin")
+	if string(stdin) != "s3cret" {
+		t.Errorf("stdin = %q, want the password", stdin)
+	}
+}
+
+// postRenderingHelm stands in for helm template with --post-renderer: it
+// pipes a ConfigMap through the post-renderer it is given
+const postRenderingHelm = `while [ $# -gt 0 ]; do
+	[ "$1" = --post-renderer ] && renderer=$2
+	shift
+done
+printf 'kind: ConfigMap\nmetadata:\n  name: web\n' | "$renderer" || exit 1
+`
+
+func TestTemplateChartPostRenderer(t *testing.T) {
+	s := fakeHelm(t, postRenderingHelm)
+	renderer := filepath.Join(t.TempDir(), "post-render.sh")
+	if err := os.WriteFile(renderer, []byte("#!/bin/sh\nsed 's/name: web/name: web-patched/'\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := s.TemplateChart(context.Background(), TemplateOptions{Chart: "chart", PostRenderer: renderer})
+	if err != nil {
+		t.Fatalf("TemplateChart() error = %v", err)
+	}
+	if want := "kind: ConfigMap\nmetadata:\n  name: web-patched\n"; string(result.Output) != want {
+		t.Errorf("Output = %q, want %q", result.Output, want)
+	}
+}
+
+func TestTemplateChartPostRendererFailure(t *testing.T) {
+	s := fakeHelm(t, postRenderingHelm)
+	renderer := filepath.Join(t.TempDir(), "post-render.sh")
+	if err := os.WriteFile(renderer, []byte("#!/bin/sh\necho 'kustomization.yaml not found' >&2\nexit 1\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := s.TemplateChart(context.Background(), TemplateOptions{Chart: "chart", PostRenderer: renderer})
+	if err == nil || !strings.Contains(err.Error(), "kustomization.yaml not found") {
+		t.Errorf("TemplateChart() error = %v, want the post-renderer's stderr", err)
+	}
+}
+
+func TestLintChart(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "args")
+	s := fakeHelm(t, `echo "$@" > `+out+`; echo "1 chart(s) linted, 0 chart(s) failed"`)
+
+	for strict, want := range map[bool]string{
+		false: "lint /charts/app -f base.yaml -f web.yaml\n",
+		true:  "lint /charts/app -f base.yaml -f web.yaml --strict\n",
+	} {
+		if err := s.LintChart(context.Background(), "/charts/app", []string{"base.yaml", "web.yaml"}, strict); err != nil {
+			t.Fatalf("LintChart() error = %v", err)
+		}
+		if args, _ := os.ReadFile(out); string(args) != want {
+			t.Errorf("helm args with strict %v = %q, want %q", strict, args, want)
+		}
+	}
+}
+
+func TestLintChartFailure(t *testing.T) {
+	s := fakeHelm(t, `echo "[ERROR] templates/: parse error in deployment.yaml"; echo "Error: 1 chart(s) linted, 1 chart(s) failed" >&2; exit 1`)
+
+	err := s.LintChart(context.Background(), "/charts/app", nil, false)
+	if err == nil {
+		t.Fatal("LintChart() succeeded, want an error")
+	}
+	for _, want := range []string{"helm lint failed", "parse error in deployment.yaml", "1 chart(s) failed"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("LintChart() error = %q, want it to contain %q", err, want)
+		}
+	}
+}
+
+func TestChartMetadata(t *testing.T) {
+	tests := []struct {
+		name  string
+		chart string
+		want  ChartMetadata
+	}{
+		{"all fields", "apiVersion: v2\nname: web\nversion: 1.2.3\nappVersion: \"2.0\"\n", ChartMetadata{Name: "web", Version: "1.2.3", AppVersion: "2.0"}},
+		{"no appVersion", "apiVersion: v2\nname: web\nversion: 1.2.3\n", ChartMetadata{Name: "web", Version: "1.2.3"}},
+	}
+
+	s := NewService(0)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(dir, "Chart.yaml"), []byte(tt.chart), 0644); err != nil {
+				t.Fatal(err)
+			}
+			got, err := s.ChartMetadata(dir)
+			if err != nil || *got != tt.want {
+				t.Errorf("ChartMetadata() = %+v, %v, want %+v", got, err, tt.want)
+			}
+		})
+	}
+
+	if _, err := s.ChartMetadata(t.TempDir()); err == nil || !strings.Contains(err.Error(), "failed to read Chart.yaml") {
+		t.Errorf("ChartMetadata() without a Chart.yaml error = %v", err)
+	}
+}
@@ -0,0 +1,304 @@
+package helm
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// MergedValues returns the values a helm template run with the given options
+// renders the chart with: the chart's default values, overridden by each
+// values file in order. Nested mappings are merged key by key, other values
+// are replaced, and a null removes the key, as helm does. Values of
+// subcharts that only come from their own defaults are not included.
+func (s *Service) MergedValues(ctx context.Context, opts TemplateOptions) (map[string]interface{}, error) {
+	defaults, err := s.chartValues(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	merged, err := parseValues(defaults)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse chart default values: %w", err)
+	}
+
+	for _, valuesPath := range opts.ValuesFiles {
+		data, err := os.ReadFile(valuesPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read values file %s: %w", valuesPath, err)
+		}
+
+		values, err := parseValues(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse values file %s: %w", valuesPath, err)
+		}
+		coalesceValues(merged, values)
+	}
+
+	return merged, nil
+}
+
+// chartValues returns the raw default values of a chart, read from a local
+// chart directory or fetched with helm show values
+func (s *Service) chartValues(ctx context.Context, opts TemplateOptions) ([]byte, error) {
+	if info, err := os.Stat(opts.Chart); err == nil && info.IsDir() {
+		data, err := os.ReadFile(filepath.Join(opts.Chart, "values.yaml"))
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read chart default values: %w", err)
+		}
+		return data, nil
+	}
+
+	args := []string{"show", "values", opts.Chart}
+	if opts.Version != "" {
+		args = append(args, "--version", opts.Version)
+	}
+
+	cmd := s.command(ctx, args...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("helm show values failed: %w, stderr: %s", err, stderr.String())
+	}
+	return stdout.Bytes(), nil
+}
+
+// parseValues parses a values file, treating an empty file as no values
+func parseValues(data []byte) (map[string]interface{}, error) {
+	values := make(map[string]interface{})
+	if err := yaml.Unmarshal(data, &values); err != nil {
+		return nil, err
+	}
+	if values == nil {
+		values = make(map[string]interface{})
+	}
+	return values, nil
+}
+
+// coalesceValues merges src into dst, with src taking precedence
+func coalesceValues(dst, src map[string]interface{}) {
+	for key, value := range src {
+		if value == nil {
+			delete(dst, key)
+			continue
+		}
+
+		srcMap, ok := value.(map[string]interface{})
+		if !ok {
+			dst[key] = value
+			continue
+		}
+
+		// Merge into a fresh mapping too, so nulls nested in src are dropped
+		dstMap, ok := dst[key].(map[string]interface{})
+		if !ok {
+			dstMap = make(map[string]interface{})
+			dst[key] = dstMap
+		}
+		coalesceValues(dstMap, srcMap)
+	}
+}
+
+// UndefinedValues returns the dotted paths of values set by the values files
+// that the chart's default values don't define, which are likely typos
+// since helm ignores them. It is a best-effort check: anything goes under a
+// default that is an empty mapping or null, and the top-level keys "global"
+// and those of subcharts are always allowed.
+func (s *Service) UndefinedValues(ctx context.Context, opts TemplateOptions) ([]string, error) {
+	data, err := s.chartValues(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	defaults, err := parseValues(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse chart default values: %w", err)
+	}
+
+	// Values for the subcharts are checked by neither
+	subcharts, err := s.subchartNames(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range append(subcharts, "global") {
+		if _, ok := defaults[name]; !ok {
+			defaults[name] = nil
+		}
+	}
+
+	found := make(map[string]bool)
+	for _, valuesPath := range opts.ValuesFiles {
+		data, err := os.ReadFile(valuesPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read values file %s: %w", valuesPath, err)
+		}
+
+		values, err := parseValues(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse values file %s: %w", valuesPath, err)
+		}
+		undefinedPaths(defaults, values, "", found)
+	}
+
+	undefined := make([]string, 0, len(found))
+	for path := range found {
+		undefined = append(undefined, path)
+	}
+	sort.Strings(undefined)
+	return undefined, nil
+}
+
+// undefinedPaths records the paths in values that defaults doesn't define
+func undefinedPaths(defaults, values map[string]interface{}, prefix string, found map[string]bool) {
+	for key, value := range values {
+		path := key
+		if prefix != "" {
+			path = prefix + "." + key
+		}
+
+		def, ok := defaults[key]
+		if !ok {
+			found[path] = true
+			continue
+		}
+
+		defMap, defIsMap := def.(map[string]interface{})
+		valueMap, valueIsMap := value.(map[string]interface{})
+		if defIsMap && valueIsMap && len(defMap) > 0 {
+			undefinedPaths(defMap, valueMap, path, found)
+		}
+	}
+}
+
+// subchartNames returns the names under which a chart's subcharts take
+// values: the names and aliases of its dependencies, and the charts in its
+// charts directory, unpacked or packaged. The dependencies of remote chart
+// references are read with helm show chart.
+func (s *Service) subchartNames(ctx context.Context, opts TemplateOptions) ([]string, error) {
+	if info, err := os.Stat(opts.Chart); err != nil || !info.IsDir() {
+		data, err := s.showChart(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+		return dependencyNames(data), nil
+	}
+
+	var names []string
+	if data, err := os.ReadFile(filepath.Join(opts.Chart, "Chart.yaml")); err == nil {
+		names = dependencyNames(data)
+	}
+
+	if entries, err := os.ReadDir(filepath.Join(opts.Chart, "charts")); err == nil {
+		for _, entry := range entries {
+			switch {
+			case entry.IsDir():
+				names = append(names, entry.Name())
+			case strings.HasSuffix(entry.Name(), ".tgz"):
+				name, err := packagedChartName(filepath.Join(opts.Chart, "charts", entry.Name()))
+				if err != nil {
+					return nil, err
+				}
+				names = append(names, name)
+			}
+		}
+	}
+
+	return names, nil
+}
+
+// showChart returns the Chart.yaml of a remote chart reference
+func (s *Service) showChart(ctx context.Context, opts TemplateOptions) ([]byte, error) {
+	args := []string{"show", "chart", opts.Chart}
+	if opts.Version != "" {
+		args = append(args, "--version", opts.Version)
+	}
+
+	cmd := s.command(ctx, args...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("helm show chart failed: %w, stderr: %s", err, stderr.String())
+	}
+	return stdout.Bytes(), nil
+}
+
+// dependencyNames returns the names and aliases of the dependencies declared
+// in a Chart.yaml
+func dependencyNames(data []byte) []string {
+	var chart struct {
+		Dependencies []struct {
+			Name  string `yaml:"name"`
+			Alias string `yaml:"alias"`
+		} `yaml:"dependencies"`
+	}
+	if yaml.Unmarshal(data, &chart) != nil {
+		return nil
+	}
+
+	var names []string
+	for _, dependency := range chart.Dependencies {
+		names = append(names, dependency.Name)
+		if dependency.Alias != "" {
+			names = append(names, dependency.Alias)
+		}
+	}
+	return names
+}
+
+// packagedChartName returns the name in the Chart.yaml of a packaged chart,
+// which sits in the archive's top-level directory
+func packagedChartName(archivePath string) (string, error) {
+	file, err := os.Open(archivePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read packaged chart: %w", err)
+	}
+	defer file.Close()
+
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return "", fmt.Errorf("failed to read packaged chart %s: %w", filepath.Base(archivePath), err)
+	}
+	defer gz.Close()
+
+	archive := tar.NewReader(gz)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return "", fmt.Errorf("packaged chart %s has no Chart.yaml", filepath.Base(archivePath))
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to read packaged chart %s: %w", filepath.Base(archivePath), err)
+		}
+
+		dir, name := path.Split(header.Name)
+		if name != "Chart.yaml" || strings.Count(dir, "/") != 1 {
+			continue
+		}
+
+		data, err := io.ReadAll(archive)
+		if err != nil {
+			return "", fmt.Errorf("failed to read packaged chart %s: %w", filepath.Base(archivePath), err)
+		}
+		var chart struct {
+			Name string `yaml:"name"`
+		}
+		if err := yaml.Unmarshal(data, &chart); err != nil || chart.Name == "" {
+			return "", fmt.Errorf("packaged chart %s has an invalid Chart.yaml", filepath.Base(archivePath))
+		}
+		return chart.Name, nil
+	}
+}
@@ -0,0 +1,143 @@
+package helm
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// writeFile writes a file, creating its directory
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writePackagedChart writes a chart archive holding only a Chart.yaml
+func writePackagedChart(t *testing.T, path, dir, chartYAML string) {
+	t.Helper()
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	archive := tar.NewWriter(gz)
+	if err := archive.WriteHeader(&tar.Header{Name: dir + "/Chart.yaml", Mode: 0644, Size: int64(len(chartYAML))}); err != nil {
+		t.Fatal(err)
+	}
+	archive.Write([]byte(chartYAML))
+	archive.Close()
+	gz.Close()
+
+	writeFile(t, path, buf.String())
+}
+
+func TestUndefinedValuesLocalChart(t *testing.T) {
+	chart := t.TempDir()
+	writeFile(t, filepath.Join(chart, "Chart.yaml"), "name: app\ndependencies:\n  - name: postgresql\n    alias: db\n")
+	writeFile(t, filepath.Join(chart, "values.yaml"), "image:\n  tag: v1\npodAnnotations: {}\n")
+	writeFile(t, filepath.Join(chart, "charts", "common", "Chart.yaml"), "name: common\n")
+	writePackagedChart(t, filepath.Join(chart, "charts", "redis-17.0.0.tgz"), "redis", "name: redis\nversion: 17.0.0\n")
+
+	values := filepath.Join(t.TempDir(), "values.yaml")
+	writeFile(t, values, `image:
+  tag: v2
+  pullPolicy: Always
+imag:
+  tag: v2
+podAnnotations:
+  team: a
+db:
+  auth: {}
+common:
+  x: 1
+redis:
+  replicas: 1
+global:
+  env: prod
+`)
+
+	s := NewService(0)
+	undefined, err := s.UndefinedValues(context.Background(), TemplateOptions{Chart: chart, ValuesFiles: []string{values}})
+	if err != nil {
+		t.Fatalf("UndefinedValues() error = %v", err)
+	}
+	want := []string{"imag", "image.pullPolicy"}
+	if !reflect.DeepEqual(undefined, want) {
+		t.Errorf("UndefinedValues() = %q, want %q", undefined, want)
+	}
+}
+
+func TestUndefinedValuesChartRef(t *testing.T) {
+	s := fakeHelm(t, `case "$2" in
+values) echo 'replicas: 1' ;;
+chart) printf 'name: app\ndependencies:\n  - name: redis\n' ;;
+esac`)
+
+	values := filepath.Join(t.TempDir(), "values.yaml")
+	writeFile(t, values, "replicas: 2\nredis:\n  replicas: 3\nreplica: 1\n")
+
+	undefined, err := s.UndefinedValues(context.Background(), TemplateOptions{
+		Chart:       "oci://registry.example.com/charts/app",
+		ValuesFiles: []string{values},
+	})
+	if err != nil {
+		t.Fatalf("UndefinedValues() error = %v", err)
+	}
+	if want := []string{"replica"}; !reflect.DeepEqual(undefined, want) {
+		t.Errorf("UndefinedValues() = %q, want %q", undefined, want)
+	}
+}
+
+func TestMergedValues(t *testing.T) {
+	chart := t.TempDir()
+	writeFile(t, filepath.Join(chart, "values.yaml"), "image:\n  repository: app\n  tag: v1\nreplicas: 1\nextra: x\n")
+
+	dir := t.TempDir()
+	first := filepath.Join(dir, "first.yaml")
+	second := filepath.Join(dir, "second.yaml")
+	writeFile(t, first, "image:\n  tag: v2\nreplicas: 2\n")
+	writeFile(t, second, "replicas: 3\nextra: null\n")
+
+	merged, err := NewService(0).MergedValues(context.Background(), TemplateOptions{Chart: chart, ValuesFiles: []string{first, second}})
+	if err != nil {
+		t.Fatalf("MergedValues() error = %v", err)
+	}
+	want := map[string]interface{}{
+		"image":    map[string]interface{}{"repository": "app", "tag": "v2"},
+		"replicas": 3,
+	}
+	if !reflect.DeepEqual(merged, want) {
+		t.Errorf("MergedValues() = %v, want %v", merged, want)
+	}
+}
+
+func TestMergedValuesChartRef(t *testing.T) {
+	s := fakeHelm(t, `[ "$1 $2 $3 $4 $5" = "show values oci://registry.example.com/charts/app --version 1.2.0" ] || exit 1
+printf 'resources:\n  limits:\n    cpu: 1\n'`)
+
+	values := filepath.Join(t.TempDir(), "values.yaml")
+	writeFile(t, values, "resources:\n  limits:\n    cpu: null\n    memory: 1Gi\n")
+
+	merged, err := s.MergedValues(context.Background(), TemplateOptions{
+		Chart:       "oci://registry.example.com/charts/app",
+		Version:     "1.2.0",
+		ValuesFiles: []string{values},
+	})
+	if err != nil {
+		t.Fatalf("MergedValues() error = %v", err)
+	}
+	want := map[string]interface{}{
+		"resources": map[string]interface{}{"limits": map[string]interface{}{"memory": "1Gi"}},
+	}
+	if !reflect.DeepEqual(merged, want) {
+		t.Errorf("MergedValues() = %v, want %v", merged, want)
+	}
+}
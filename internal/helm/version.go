@@ -0,0 +1,99 @@
+package helm
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// VersionStatus describes the installed helm CLI
+type VersionStatus struct {
+	Version    string // Output of helm version --short, e.g. v3.14.2+gc309b6f
+	MinVersion string // Minimum required version, empty when unconstrained
+	Supported  bool   // Whether Version satisfies MinVersion
+}
+
+// SetMinVersion requires the helm CLI to be at least the given version, e.g.
+// v3.8.0, for CheckVersion to report it as supported
+func (s *Service) SetMinVersion(minVersion string) error {
+	if minVersion != "" {
+		if _, err := ParseVersion(minVersion); err != nil {
+			return err
+		}
+	}
+	s.minVersion = minVersion
+	return nil
+}
+
+// CheckVersion runs helm version and compares the result against the
+// minimum required version
+func (s *Service) CheckVersion(ctx context.Context) (*VersionStatus, error) {
+	output, err := s.command(ctx, "version", "--short").Output()
+	if err != nil {
+		return nil, fmt.Errorf("helm CLI not available: %w", err)
+	}
+
+	status := &VersionStatus{
+		Version:    strings.TrimSpace(string(output)),
+		MinVersion: s.minVersion,
+		Supported:  true,
+	}
+	if s.minVersion == "" {
+		return status, nil
+	}
+
+	if err := CheckMinVersion(status.Version, s.minVersion); err != nil {
+		status.Supported = false
+		return status, err
+	}
+	return status, nil
+}
+
+// CheckMinVersion returns an error if version is older than minVersion
+func CheckMinVersion(version, minVersion string) error {
+	have, err := ParseVersion(version)
+	if err != nil {
+		return err
+	}
+	want, err := ParseVersion(minVersion)
+	if err != nil {
+		return err
+	}
+
+	for i := range have {
+		if have[i] != want[i] {
+			if have[i] < want[i] {
+				return fmt.Errorf("helm %s is older than the required %s", version, minVersion)
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+// ParseVersion parses a helm version such as v3.14.2+gc309b6f into its major,
+// minor, and patch numbers. Missing minor or patch numbers count as zero and
+// pre-release and build suffixes are ignored.
+func ParseVersion(version string) ([3]int, error) {
+	var parsed [3]int
+
+	trimmed := strings.TrimPrefix(strings.TrimSpace(version), "v")
+	if i := strings.IndexAny(trimmed, "-+"); i >= 0 {
+		trimmed = trimmed[:i]
+	}
+
+	parts := strings.Split(trimmed, ".")
+	if len(parts) > 3 {
+		return parsed, fmt.Errorf("invalid helm version %q", version)
+	}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return parsed, fmt.Errorf("invalid helm version %q", version)
+		}
+		parsed[i] = n
+	}
+
+	return parsed, nil
+}
@@ -0,0 +1,88 @@
+package helm
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestParseVersion(t *testing.T) {
+	tests := []struct {
+		version string
+		want    [3]int
+		wantErr bool
+	}{
+		{version: "v3.14.2+gc309b6f", want: [3]int{3, 14, 2}},
+		{version: "v3.8.0", want: [3]int{3, 8, 0}},
+		{version: "3.12.1\n", want: [3]int{3, 12, 1}},
+		{version: "v3.15.0-rc.1", want: [3]int{3, 15, 0}},
+		{version: "v3.9", want: [3]int{3, 9, 0}},
+		{version: "v3", want: [3]int{3, 0, 0}},
+		{version: "", wantErr: true},
+		{version: "v3.x.1", wantErr: true},
+		{version: "v3.1.2.3", wantErr: true},
+		{version: "v3.-1.0", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseVersion(tt.version)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseVersion(%q) = %v, want an error", tt.version, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("ParseVersion(%q) = %v, %v, want %v", tt.version, got, err, tt.want)
+		}
+	}
+}
+
+func TestCheckMinVersion(t *testing.T) {
+	tests := []struct {
+		version, minVersion string
+		ok                  bool
+	}{
+		{"v3.14.2+gc309b6f", "v3.8.0", true},
+		{"v3.8.0", "v3.8.0", true},
+		{"v3.8.0", "3.8", true},
+		{"v3.7.9", "v3.8.0", false},
+		{"v3.10.0", "v3.9.1", true},
+		{"v2.17.0", "v3.0.0", false},
+		{"v4.0.0", "v3.20.0", true},
+	}
+
+	for _, tt := range tests {
+		err := CheckMinVersion(tt.version, tt.minVersion)
+		if (err == nil) != tt.ok {
+			t.Errorf("CheckMinVersion(%q, %q) = %v, want ok %v", tt.version, tt.minVersion, err, tt.ok)
+		}
+	}
+
+	if err := CheckMinVersion("unknown", "v3.8.0"); err == nil {
+		t.Error("CheckMinVersion() of an unparseable version succeeded")
+	}
+}
+
+func TestCheckVersion(t *testing.T) {
+	s := fakeHelm(t, `echo v3.7.1+g1d11fcb`)
+
+	status, err := s.CheckVersion(context.Background())
+	if err != nil || status.Version != "v3.7.1+g1d11fcb" || !status.Supported {
+		t.Fatalf("CheckVersion() = %+v, %v, want v3.7.1 supported without a minimum", status, err)
+	}
+
+	if err := s.SetMinVersion("three"); err == nil {
+		t.Error("SetMinVersion() of an invalid version succeeded")
+	}
+	if err := s.SetMinVersion("v3.8.0"); err != nil {
+		t.Fatal(err)
+	}
+	status, err = s.CheckVersion(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "older than the required v3.8.0") {
+		t.Errorf("CheckVersion() error = %v, want helm reported as too old", err)
+	}
+	if status == nil || status.Supported || status.MinVersion != "v3.8.0" {
+		t.Errorf("CheckVersion() = %+v, want the version reported as unsupported", status)
+	}
+}
@@ -0,0 +1,63 @@
+package history
+
+import (
+	"sync"
+	"time"
+)
+
+// Entry records a single pipeline run that pushed a commit
+type Entry struct {
+	Timestamp  time.Time              `json:"timestamp"`
+	Group      string                 `json:"group"`
+	Branch     string                 `json:"branch"`     // Template repository branch that was rendered
+	Repository string                 `json:"repository"` // Output repository as owner/repo
+	CommitSHA  string                 `json:"commit_sha"`
+	Changes    map[string]interface{} `json:"changes"` // Key-level change summary, without values
+}
+
+// Store keeps the most recent entries in memory
+type Store struct {
+	mu       sync.Mutex
+	entries  []Entry
+	capacity int
+}
+
+// NewStore creates a store holding up to capacity entries
+func NewStore(capacity int) *Store {
+	return &Store{capacity: capacity}
+}
+
+// Add records an entry, evicting the oldest one when the store is full
+func (s *Store) Add(entry Entry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if entry.Timestamp.IsZero() {
+		entry.Timestamp = time.Now()
+	}
+
+	s.entries = append(s.entries, entry)
+	if len(s.entries) > s.capacity {
+		s.entries = s.entries[len(s.entries)-s.capacity:]
+	}
+}
+
+// List returns up to limit entries, newest first, optionally filtered by
+// group. A non-positive limit returns all matching entries.
+func (s *Store) List(group string, limit int) []Entry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries := []Entry{}
+	for i := len(s.entries) - 1; i >= 0; i-- {
+		if group != "" && s.entries[i].Group != group {
+			continue
+		}
+		entries = append(entries, s.entries[i])
+		if limit > 0 && len(entries) == limit {
+			break
+		}
+	}
+
+	return entries
+}
@@ -0,0 +1,87 @@
+package manifest
+
+import (
+	"bytes"
+)
+
+// StripEmptyDocuments removes documents that hold nothing but whitespace and
+// comments from multi-document YAML, such as the ones templates guarded by
+// {{- if }} leave behind. The remaining documents are kept byte for byte.
+// Content without any non-empty document is returned unchanged.
+func StripEmptyDocuments(content []byte) []byte {
+	var (
+		kept     [][]byte
+		current  []byte
+		started  bool // Whether current began with a --- separator
+		nonEmpty bool
+	)
+	flush := func() {
+		if nonEmpty {
+			if !started && len(kept) > 0 {
+				current = append([]byte("---\n"), current...)
+			}
+			kept = append(kept, current)
+		}
+		current, started, nonEmpty = nil, false, false
+	}
+
+	for _, line := range bytes.SplitAfter(content, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+
+		if isSeparator(line) {
+			flush()
+			started = true
+			current = append(current, line...)
+			if hasContent(line[3:]) {
+				nonEmpty = true
+			}
+			continue
+		}
+
+		current = append(current, line...)
+		if hasContent(line) {
+			nonEmpty = true
+		}
+	}
+	flush()
+
+	if len(kept) == 0 {
+		return content
+	}
+
+	// The first document needs no separator in front of it
+	kept[0] = bytes.TrimPrefix(kept[0], []byte("---\n"))
+	return bytes.Join(kept, nil)
+}
+
+// HasDocuments reports whether multi-document YAML has any document with
+// more than whitespace and comments
+func HasDocuments(content []byte) bool {
+	for _, line := range bytes.SplitAfter(content, []byte("\n")) {
+		if isSeparator(line) {
+			line = line[3:]
+		}
+		if hasContent(line) {
+			return true
+		}
+	}
+	return false
+}
+
+// isSeparator reports whether a line starts a new document
+func isSeparator(line []byte) bool {
+	if !bytes.HasPrefix(line, []byte("---")) {
+		return false
+	}
+	rest := line[3:]
+	return len(rest) == 0 || rest[0] == ' ' || rest[0] == '\t' || rest[0] == '\n' || rest[0] == '\r'
+}
+
+// hasContent reports whether a line holds anything besides whitespace and a
+// comment
+func hasContent(line []byte) bool {
+	trimmed := bytes.TrimSpace(line)
+	return len(trimmed) > 0 && trimmed[0] != '#'
+}
@@ -0,0 +1,68 @@
+package manifest
+
+import "testing"
+
+func TestStripEmptyDocuments(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{
+			name:    "no empty documents",
+			content: "kind: A\n---\nkind: B\n",
+			want:    "kind: A\n---\nkind: B\n",
+		},
+		{
+			name:    "guarded templates",
+			content: "---\n# Source: app/templates/a.yaml\nkind: A\n---\n# Source: app/templates/hpa.yaml\n---\n   \n---\nkind: B\n---\n",
+			want:    "# Source: app/templates/a.yaml\nkind: A\n---\nkind: B\n",
+		},
+		{
+			name:    "leading empty document",
+			content: "\n---\nkind: A\n",
+			want:    "kind: A\n",
+		},
+		{
+			name:    "content on the separator line",
+			content: "--- \n---  kind: A\n",
+			want:    "---  kind: A\n",
+		},
+		{
+			name:    "block scalar holding a separator lookalike",
+			content: "kind: A\ndata:\n  script: |\n    ---x\n",
+			want:    "kind: A\ndata:\n  script: |\n    ---x\n",
+		},
+		{
+			name:    "only empty documents",
+			content: "---\n# nothing rendered\n---\n",
+			want:    "---\n# nothing rendered\n---\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(StripEmptyDocuments([]byte(tt.content))); got != tt.want {
+				t.Errorf("StripEmptyDocuments() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHasDocuments(t *testing.T) {
+	tests := []struct {
+		content string
+		want    bool
+	}{
+		{"", false},
+		{"---\n# Source: app/templates/hpa.yaml\n---\n  \n", false},
+		{"---\nkind: A\n", true},
+		{"# Source: app/templates/a.yaml\nkind: A\n", true},
+	}
+
+	for _, tt := range tests {
+		if got := HasDocuments([]byte(tt.content)); got != tt.want {
+			t.Errorf("HasDocuments(%q) = %v, want %v", tt.content, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package manifest
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// Equivalent reports whether two multi-document YAML contents hold the same
+// data, ignoring formatting such as indentation, quoting, key order, flow
+// or block style, and comments. Documents are compared in order and empty
+// documents are ignored.
+func Equivalent(a, b []byte) (bool, error) {
+	aData, err := documentData(a)
+	if err != nil {
+		return false, err
+	}
+	bData, err := documentData(b)
+	if err != nil {
+		return false, err
+	}
+	return reflect.DeepEqual(aData, bData), nil
+}
+
+// documentData decodes the non-empty documents of multi-document YAML into
+// plain values
+func documentData(content []byte) ([]interface{}, error) {
+	docs, err := Decode(content)
+	if err != nil {
+		return nil, err
+	}
+
+	data := []interface{}{}
+	for i, doc := range docs {
+		if isEmptyDocument(doc) {
+			continue
+		}
+
+		var value interface{}
+		if err := doc.Decode(&value); err != nil {
+			return nil, fmt.Errorf("failed to decode document %d: %w", i+1, err)
+		}
+		data = append(data, value)
+	}
+	return data, nil
+}
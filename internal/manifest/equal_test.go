@@ -0,0 +1,46 @@
+package manifest
+
+import "testing"
+
+func TestEquivalent(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		want bool
+	}{
+		{"identical", "kind: A\n", "kind: A\n", true},
+		{"trailing newline", "kind: A\n", "kind: A", true},
+		{
+			name: "indentation and key order",
+			a:    "kind: A\nspec:\n  replicas: 2\n  ports:\n  - 80\n",
+			b:    "spec:\n    ports:\n        - 80\n    replicas: 2\nkind: A\n",
+			want: true,
+		},
+		{"quoting", "name: web\n", "name: \"web\"\n", true},
+		{"flow style", "labels:\n  app: web\n", "labels: {app: web}\n", true},
+		{"comments", "# Source: app/templates/a.yaml\nkind: A # inline\n", "kind: A\n", true},
+		{"empty documents", "---\nkind: A\n---\n# nothing\n---\nkind: B\n", "kind: A\n---\nkind: B\n", true},
+		{"changed value", "replicas: 2\n", "replicas: 3\n", false},
+		{"string and number", "value: \"1\"\n", "value: 1\n", false},
+		{"document order", "kind: A\n---\nkind: B\n", "kind: B\n---\nkind: A\n", false},
+		{"extra document", "kind: A\n", "kind: A\n---\nkind: B\n", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Equivalent([]byte(tt.a), []byte(tt.b))
+			if err != nil {
+				t.Fatalf("Equivalent() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Equivalent() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEquivalentInvalidYAML(t *testing.T) {
+	if _, err := Equivalent([]byte("kind: A\n"), []byte("kind: [A\n")); err == nil {
+		t.Error("Equivalent() of invalid YAML succeeded")
+	}
+}
@@ -0,0 +1,80 @@
+package manifest
+
+import (
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// FilterKinds keeps only the resources whose kind matches one of include,
+// or every resource when include is empty, and then drops those matching
+// one of exclude, so exclude wins when a kind is in both. Matching ignores
+// case and items of list kinds are filtered individually. Documents that
+// aren't Kubernetes resources are kept, document order is preserved, and
+// empty documents are dropped.
+func FilterKinds(content []byte, include, exclude []string) ([]byte, error) {
+	return filterKinds(content, func(kind string) bool {
+		if len(include) > 0 && !containsKind(include, kind) {
+			return false
+		}
+		return !containsKind(exclude, kind)
+	})
+}
+
+// filterKinds keeps the resources for which keep returns true
+func filterKinds(content []byte, keep func(kind string) bool) ([]byte, error) {
+	docs, err := Decode(content)
+	if err != nil {
+		return nil, err
+	}
+
+	var kept []*yaml.Node
+	for _, doc := range docs {
+		if isEmptyDocument(doc) {
+			continue
+		}
+		if keepResource(doc.Content[0], keep) {
+			kept = append(kept, doc)
+		}
+	}
+
+	return Encode(kept)
+}
+
+// keepResource reports whether a resource passes the filter, removing the
+// items of list kinds that don't
+func keepResource(resource *yaml.Node, keep func(kind string) bool) bool {
+	if resource.Kind != yaml.MappingNode {
+		return true
+	}
+
+	kind := scalarValue(mappingValue(resource, "kind"))
+	if kind == "" {
+		return true
+	}
+
+	if strings.HasSuffix(kind, "List") {
+		if items := mappingValue(resource, "items"); items != nil && items.Kind == yaml.SequenceNode {
+			var kept []*yaml.Node
+			for _, item := range items.Content {
+				if keepResource(item, keep) {
+					kept = append(kept, item)
+				}
+			}
+			items.Content = kept
+			return true
+		}
+	}
+
+	return keep(kind)
+}
+
+// containsKind reports whether kinds contains kind, ignoring case
+func containsKind(kinds []string, kind string) bool {
+	for _, k := range kinds {
+		if strings.EqualFold(k, kind) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,97 @@
+package manifest
+
+import "testing"
+
+func TestFilterKinds(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		include []string
+		exclude []string
+		want    string
+	}{
+		{
+			name: "order preserved",
+			content: "kind: ConfigMap\nmetadata:\n  name: a\n---\nkind: Secret\nmetadata:\n  name: b\n---\n" +
+				"kind: Service\nmetadata:\n  name: c\n---\nkind: Secret\nmetadata:\n  name: d\n---\nkind: Deployment\nmetadata:\n  name: e\n",
+			exclude: []string{"Secret"},
+			want: "kind: ConfigMap\nmetadata:\n  name: a\n---\nkind: Service\nmetadata:\n  name: c\n---\n" +
+				"kind: Deployment\nmetadata:\n  name: e\n",
+		},
+		{
+			name:    "case ignored",
+			content: "kind: secret\nmetadata:\n  name: a\n---\nkind: ConfigMap\nmetadata:\n  name: b\n",
+			exclude: []string{"SECRET"},
+			want:    "kind: ConfigMap\nmetadata:\n  name: b\n",
+		},
+		{
+			name:    "several kinds",
+			content: "kind: Secret\n---\nkind: ServiceAccount\n---\nkind: Role\n",
+			exclude: []string{"Secret", "Role"},
+			want:    "kind: ServiceAccount\n",
+		},
+		{
+			name: "include only",
+			content: "kind: ConfigMap\nmetadata:\n  name: a\n---\nkind: Secret\n---\nkind: Deployment\nmetadata:\n  name: b\n---\n" +
+				"kind: Service\n---\nkind: configmap\nmetadata:\n  name: c\n",
+			include: []string{"ConfigMap", "Deployment"},
+			want: "kind: ConfigMap\nmetadata:\n  name: a\n---\nkind: Deployment\nmetadata:\n  name: b\n---\n" +
+				"kind: configmap\nmetadata:\n  name: c\n",
+		},
+		{
+			name:    "exclude wins over include",
+			content: "kind: ConfigMap\n---\nkind: Secret\n---\nkind: Deployment\n",
+			include: []string{"ConfigMap", "Secret"},
+			exclude: []string{"secret", "Deployment"},
+			want:    "kind: ConfigMap\n",
+		},
+		{
+			name:    "included list items",
+			content: "kind: List\nitems:\n  - kind: Secret\n  - kind: ConfigMap\n",
+			include: []string{"ConfigMap"},
+			want:    "kind: List\nitems:\n  - kind: ConfigMap\n",
+		},
+		{
+			name:    "non-resources kept with include",
+			content: "replicas: 3\n---\nkind: Secret\n",
+			include: []string{"ConfigMap"},
+			want:    "replicas: 3\n",
+		},
+		{
+			name:    "list items",
+			content: "kind: List\nitems:\n  - kind: Secret\n  - kind: ConfigMap\n",
+			exclude: []string{"Secret"},
+			want:    "kind: List\nitems:\n  - kind: ConfigMap\n",
+		},
+		{
+			name:    "not a resource",
+			content: "replicas: 3\n---\nkind: Secret\n",
+			exclude: []string{"Secret"},
+			want:    "replicas: 3\n",
+		},
+		{
+			name:    "empty documents dropped",
+			content: "---\n---\nkind: ConfigMap\n---\n",
+			exclude: []string{"Secret"},
+			want:    "kind: ConfigMap\n",
+		},
+		{
+			name:    "everything excluded",
+			content: "kind: Secret\n",
+			exclude: []string{"Secret"},
+			want:    "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := FilterKinds([]byte(tt.content), tt.include, tt.exclude)
+			if err != nil {
+				t.Fatalf("FilterKinds() error = %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("FilterKinds() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,119 @@
+package manifest
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// AddMetadata merges labels and annotations into metadata.labels and
+// metadata.annotations of every resource, descending into the items of list
+// kinds. Entries a resource already has are kept unless overwrite is set.
+// Documents that aren't Kubernetes resources are left untouched, and empty
+// documents are dropped.
+func AddMetadata(content []byte, labels, annotations map[string]string, overwrite bool) ([]byte, error) {
+	docs, err := Decode(content)
+	if err != nil {
+		return nil, err
+	}
+
+	var updated []*yaml.Node
+	for i, doc := range docs {
+		if isEmptyDocument(doc) {
+			continue
+		}
+		if err := addMetadata(doc.Content[0], labels, annotations, overwrite); err != nil {
+			return nil, fmt.Errorf("document %d: %w", i+1, err)
+		}
+		updated = append(updated, doc)
+	}
+
+	return Encode(updated)
+}
+
+// addMetadata merges labels and annotations into a single resource
+func addMetadata(resource *yaml.Node, labels, annotations map[string]string, overwrite bool) error {
+	if resource.Kind != yaml.MappingNode {
+		return nil
+	}
+
+	kind := mappingValue(resource, "kind")
+	if kind == nil || kind.Kind != yaml.ScalarNode {
+		return nil
+	}
+
+	if strings.HasSuffix(kind.Value, "List") {
+		if items := mappingValue(resource, "items"); items != nil && items.Kind == yaml.SequenceNode {
+			for _, item := range items.Content {
+				if err := addMetadata(item, labels, annotations, overwrite); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+
+	metadata, err := childMapping(resource, "metadata")
+	if err != nil {
+		return fmt.Errorf("%s has invalid metadata: %w", kind.Value, err)
+	}
+	if err := mergeStrings(metadata, "labels", labels, overwrite); err != nil {
+		return fmt.Errorf("%s has invalid labels: %w", kind.Value, err)
+	}
+	if err := mergeStrings(metadata, "annotations", annotations, overwrite); err != nil {
+		return fmt.Errorf("%s has invalid annotations: %w", kind.Value, err)
+	}
+	return nil
+}
+
+// mergeStrings merges entries into the mapping under key, in key order so the
+// output is stable. The mapping is only created when there is something to
+// add.
+func mergeStrings(node *yaml.Node, key string, entries map[string]string, overwrite bool) error {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	mapping, err := childMapping(node, key)
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if !overwrite && mappingValue(mapping, name) != nil {
+			continue
+		}
+		setMappingValue(mapping, name, entries[name])
+	}
+	return nil
+}
+
+// childMapping returns the mapping under key, adding an empty one if the key
+// is missing or null
+func childMapping(node *yaml.Node, key string) (*yaml.Node, error) {
+	child := mappingValue(node, key)
+	if child == nil {
+		child = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		node.Content = append(node.Content,
+			&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, child)
+		return child, nil
+	}
+
+	if child.Kind == yaml.ScalarNode && child.Tag == "!!null" {
+		child.Kind = yaml.MappingNode
+		child.Tag = "!!map"
+		child.Value = ""
+	}
+	if child.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("%s is not a mapping", key)
+	}
+	return child, nil
+}
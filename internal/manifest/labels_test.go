@@ -0,0 +1,87 @@
+package manifest
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAddMetadata(t *testing.T) {
+	labels := map[string]string{"app.kubernetes.io/managed-by": "yaml-helm-pipeline", "team": "platform"}
+	annotations := map[string]string{"owner": "platform@example.com"}
+
+	tests := []struct {
+		name      string
+		content   string
+		overwrite bool
+		want      string
+	}{
+		{
+			name:    "missing labels and annotations",
+			content: "kind: ConfigMap\nmetadata:\n  name: app\n",
+			want:    "kind: ConfigMap\nmetadata:\n  name: app\n  labels:\n    app.kubernetes.io/managed-by: yaml-helm-pipeline\n    team: platform\n  annotations:\n    owner: platform@example.com\n",
+		},
+		{
+			name:    "merged with existing entries",
+			content: "kind: Service\nmetadata:\n  name: app\n  labels:\n    app: web\n  annotations:\n    note: kept\n",
+			want:    "kind: Service\nmetadata:\n  name: app\n  labels:\n    app: web\n    app.kubernetes.io/managed-by: yaml-helm-pipeline\n    team: platform\n  annotations:\n    note: kept\n    owner: platform@example.com\n",
+		},
+		{
+			name:    "existing values kept",
+			content: "kind: Service\nmetadata:\n  name: app\n  labels:\n    team: payments\n",
+			want:    "kind: Service\nmetadata:\n  name: app\n  labels:\n    team: payments\n    app.kubernetes.io/managed-by: yaml-helm-pipeline\n  annotations:\n    owner: platform@example.com\n",
+		},
+		{
+			name:      "existing values overwritten",
+			content:   "kind: Service\nmetadata:\n  name: app\n  labels:\n    team: payments\n",
+			overwrite: true,
+			want:      "kind: Service\nmetadata:\n  name: app\n  labels:\n    team: platform\n    app.kubernetes.io/managed-by: yaml-helm-pipeline\n  annotations:\n    owner: platform@example.com\n",
+		},
+		{
+			name:    "null labels",
+			content: "kind: Secret\nmetadata:\n  name: app\n  labels:\n",
+			want:    "kind: Secret\nmetadata:\n  name: app\n  labels:\n    app.kubernetes.io/managed-by: yaml-helm-pipeline\n    team: platform\n  annotations:\n    owner: platform@example.com\n",
+		},
+		{
+			name:    "list items",
+			content: "kind: List\nitems:\n  - kind: ConfigMap\n    metadata:\n      name: app\n",
+			want:    "kind: List\nitems:\n  - kind: ConfigMap\n    metadata:\n      name: app\n      labels:\n        app.kubernetes.io/managed-by: yaml-helm-pipeline\n        team: platform\n      annotations:\n        owner: platform@example.com\n",
+		},
+		{
+			name:    "not a resource",
+			content: "replicas: 3\n",
+			want:    "replicas: 3\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := AddMetadata([]byte(tt.content), labels, annotations, tt.overwrite)
+			if err != nil {
+				t.Fatalf("AddMetadata() error = %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("AddMetadata() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAddMetadataErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{"invalid metadata", "kind: ConfigMap\n---\nkind: Service\nmetadata: app\n", "document 2: Service has invalid metadata"},
+		{"invalid labels", "kind: Service\nmetadata:\n  labels: [web]\n", "document 1: Service has invalid labels"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := AddMetadata([]byte(tt.content), map[string]string{"team": "platform"}, nil, false)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("AddMetadata() error = %v, want it to mention %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,227 @@
+package manifest
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Decode parses multi-document YAML content into document nodes, keeping
+// the order in which the documents appear
+func Decode(content []byte) ([]*yaml.Node, error) {
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+
+	var docs []*yaml.Node
+	for {
+		var doc yaml.Node
+		err := decoder.Decode(&doc)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse document %d: %w", len(docs)+1, err)
+		}
+		docs = append(docs, &doc)
+	}
+
+	return docs, nil
+}
+
+// Validate checks that every document in multi-document YAML content parses,
+// reporting the index of the first document that doesn't
+func Validate(content []byte) error {
+	_, err := Decode(content)
+	return err
+}
+
+// Encode serializes document nodes back into multi-document YAML
+func Encode(docs []*yaml.Node) ([]byte, error) {
+	// The encoder can't finish a stream it never started
+	if len(docs) == 0 {
+		return []byte{}, nil
+	}
+
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+
+	for i, doc := range docs {
+		if err := encoder.Encode(doc); err != nil {
+			return nil, fmt.Errorf("failed to encode document %d: %w", i+1, err)
+		}
+	}
+
+	if err := encoder.Close(); err != nil {
+		return nil, fmt.Errorf("failed to finalize YAML output: %w", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// ToJSON converts multi-document YAML into a JSON array with one element per
+// non-empty document, in document order
+func ToJSON(content []byte) ([]byte, error) {
+	docs, err := Decode(content)
+	if err != nil {
+		return nil, err
+	}
+
+	objects := []interface{}{}
+	for i, doc := range docs {
+		if isEmptyDocument(doc) {
+			continue
+		}
+
+		var object interface{}
+		if err := doc.Decode(&object); err != nil {
+			return nil, fmt.Errorf("failed to decode document %d: %w", i+1, err)
+		}
+		objects = append(objects, object)
+	}
+
+	output, err := json.MarshalIndent(objects, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode JSON: %w", err)
+	}
+
+	return append(output, '\n'), nil
+}
+
+// FromJSON converts a JSON array of objects back into multi-document YAML
+func FromJSON(content []byte) ([]byte, error) {
+	var objects []interface{}
+	if err := json.Unmarshal(content, &objects); err != nil {
+		return nil, fmt.Errorf("failed to parse JSON: %w", err)
+	}
+
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+
+	for i, object := range objects {
+		if err := encoder.Encode(object); err != nil {
+			return nil, fmt.Errorf("failed to encode document %d: %w", i+1, err)
+		}
+	}
+
+	if err := encoder.Close(); err != nil {
+		return nil, fmt.Errorf("failed to finalize YAML output: %w", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Canonicalize re-serializes multi-document YAML with the keys of every
+// mapping sorted and block style used throughout. Document order is kept
+// as rendered and empty documents are dropped. Comments are not preserved.
+func Canonicalize(content []byte) ([]byte, error) {
+	docs, err := Decode(content)
+	if err != nil {
+		return nil, err
+	}
+
+	var canonical []*yaml.Node
+	for _, doc := range docs {
+		if isEmptyDocument(doc) {
+			continue
+		}
+		canonicalizeNode(doc)
+		canonical = append(canonical, doc)
+	}
+
+	return Encode(canonical)
+}
+
+// canonicalizeNode sorts mapping keys and clears comments and flow styles
+// recursively
+func canonicalizeNode(node *yaml.Node) {
+	node.HeadComment = ""
+	node.LineComment = ""
+	node.FootComment = ""
+
+	switch node.Kind {
+	case yaml.MappingNode:
+		node.Style &^= yaml.FlowStyle
+		pairs := make([][2]*yaml.Node, 0, len(node.Content)/2)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			pairs = append(pairs, [2]*yaml.Node{node.Content[i], node.Content[i+1]})
+		}
+		sort.SliceStable(pairs, func(i, j int) bool {
+			return pairs[i][0].Value < pairs[j][0].Value
+		})
+		node.Content = node.Content[:0]
+		for _, pair := range pairs {
+			node.Content = append(node.Content, pair[0], pair[1])
+		}
+	case yaml.SequenceNode:
+		node.Style &^= yaml.FlowStyle
+	}
+
+	for _, child := range node.Content {
+		canonicalizeNode(child)
+	}
+}
+
+// isEmptyDocument reports whether a document has no content besides comments
+func isEmptyDocument(doc *yaml.Node) bool {
+	if doc.Kind != yaml.DocumentNode || len(doc.Content) == 0 {
+		return true
+	}
+	root := doc.Content[0]
+	return root.Kind == yaml.ScalarNode && root.Tag == "!!null" && root.Value == ""
+}
+
+// Resource is a single document of a multi-document manifest
+type Resource struct {
+	Kind      string
+	Name      string
+	Namespace string
+	Content   []byte // The document serialized on its own
+}
+
+// Split breaks multi-document YAML into one resource per non-empty document,
+// in document order
+func Split(content []byte) ([]Resource, error) {
+	docs, err := Decode(content)
+	if err != nil {
+		return nil, err
+	}
+
+	var resources []Resource
+	for i, doc := range docs {
+		if isEmptyDocument(doc) {
+			continue
+		}
+
+		encoded, err := Encode([]*yaml.Node{doc})
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode document %d: %w", i+1, err)
+		}
+
+		resource := Resource{Content: encoded}
+		root := doc.Content[0]
+		if root.Kind == yaml.MappingNode {
+			resource.Kind = scalarValue(mappingValue(root, "kind"))
+			if metadata := mappingValue(root, "metadata"); metadata != nil && metadata.Kind == yaml.MappingNode {
+				resource.Name = scalarValue(mappingValue(metadata, "name"))
+				resource.Namespace = scalarValue(mappingValue(metadata, "namespace"))
+			}
+		}
+		resources = append(resources, resource)
+	}
+
+	return resources, nil
+}
+
+// scalarValue returns the value of a scalar node, or "" for anything else
+func scalarValue(node *yaml.Node) string {
+	if node == nil || node.Kind != yaml.ScalarNode {
+		return ""
+	}
+	return node.Value
+}
@@ -0,0 +1,136 @@
+package manifest
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{"empty", "", ""},
+		{"documents", "a: 1\n---\nb: 2\n", ""},
+		{"broken first", "a: [1\n---\nb: 2\n", "document 1"},
+		{"broken second", "a: 1\n---\nb: {2\n", "document 2"},
+		{"bad indentation", "a: 1\n---\nb: 2\n---\nc:\n  d: 1\n e: 2\n", "document 3"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Validate([]byte(tt.content))
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("Validate() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("Validate() error = %v, want it to name %s", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestToJSON(t *testing.T) {
+	content := []byte(`apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: one
+data:
+  replicas: "3"
+---
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: two
+spec:
+  ports:
+    - port: 80
+`)
+
+	output, err := ToJSON(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []map[string]interface{}
+	if err := json.Unmarshal(output, &got); err != nil {
+		t.Fatalf("ToJSON() = %s, not a JSON array: %v", output, err)
+	}
+	want := []map[string]interface{}{
+		{
+			"apiVersion": "v1",
+			"kind":       "ConfigMap",
+			"metadata":   map[string]interface{}{"name": "one"},
+			"data":       map[string]interface{}{"replicas": "3"},
+		},
+		{
+			"apiVersion": "v1",
+			"kind":       "Service",
+			"metadata":   map[string]interface{}{"name": "two"},
+			"spec":       map[string]interface{}{"ports": []interface{}{map[string]interface{}{"port": float64(80)}}},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ToJSON() = %s, want every non-empty document in order", output)
+	}
+
+	// Converting back yields the same documents
+	yamlContent, err := FromJSON(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roundTrip, err := ToJSON(yamlContent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(roundTrip) != string(output) {
+		t.Errorf("ToJSON(FromJSON()) = %s, want %s", roundTrip, output)
+	}
+}
+
+func TestToJSONEmpty(t *testing.T) {
+	output, err := ToJSON([]byte("---\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(output) != "[]\n" {
+		t.Errorf("ToJSON() = %q, want an empty array", output)
+	}
+}
+
+func TestSplit(t *testing.T) {
+	resources, err := Split([]byte(`kind: ConfigMap
+metadata:
+  name: web
+  namespace: team
+---
+---
+kind: List
+items: []
+---
+- not
+- a resource
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Resource{
+		{Kind: "ConfigMap", Name: "web", Namespace: "team", Content: []byte("kind: ConfigMap\nmetadata:\n  name: web\n  namespace: team\n")},
+		{Kind: "List", Content: []byte("kind: List\nitems: []\n")},
+		{Content: []byte("- not\n- a resource\n")},
+	}
+	if !reflect.DeepEqual(resources, want) {
+		t.Errorf("Split() = %+v, want %+v", resources, want)
+	}
+
+	if _, err := Split([]byte("a: 1\n---\nb: {\n")); err == nil || !strings.Contains(err.Error(), "document 2") {
+		t.Errorf("Split() of invalid YAML error = %v, want it to name document 2", err)
+	}
+}
@@ -0,0 +1,131 @@
+package manifest
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// clusterScopedKinds lists the built-in kinds that don't belong to a namespace
+var clusterScopedKinds = map[string]bool{
+	"APIService":                       true,
+	"CertificateSigningRequest":        true,
+	"ClusterIssuer":                    true,
+	"ClusterRole":                      true,
+	"ClusterRoleBinding":               true,
+	"ComponentStatus":                  true,
+	"CSIDriver":                        true,
+	"CSINode":                          true,
+	"CustomResourceDefinition":         true,
+	"FlowSchema":                       true,
+	"IngressClass":                     true,
+	"MutatingWebhookConfiguration":     true,
+	"Namespace":                        true,
+	"Node":                             true,
+	"PersistentVolume":                 true,
+	"PodSecurityPolicy":                true,
+	"PriorityClass":                    true,
+	"PriorityLevelConfiguration":       true,
+	"RuntimeClass":                     true,
+	"StorageClass":                     true,
+	"ValidatingAdmissionPolicy":        true,
+	"ValidatingAdmissionPolicyBinding": true,
+	"ValidatingWebhookConfiguration":   true,
+	"VolumeAttachment":                 true,
+}
+
+// InjectNamespace sets metadata.namespace on every namespaced resource that
+// doesn't already have one. Cluster-scoped kinds are left untouched, as are
+// documents that aren't Kubernetes resources. Empty documents are dropped.
+func InjectNamespace(content []byte, namespace string) ([]byte, error) {
+	docs, err := Decode(content)
+	if err != nil {
+		return nil, err
+	}
+
+	var injected []*yaml.Node
+	for i, doc := range docs {
+		if isEmptyDocument(doc) {
+			continue
+		}
+		if err := injectNamespace(doc.Content[0], namespace); err != nil {
+			return nil, fmt.Errorf("document %d: %w", i+1, err)
+		}
+		injected = append(injected, doc)
+	}
+
+	return Encode(injected)
+}
+
+// injectNamespace sets the namespace on a single resource, descending into
+// the items of list kinds
+func injectNamespace(resource *yaml.Node, namespace string) error {
+	if resource.Kind != yaml.MappingNode {
+		return nil
+	}
+
+	kind := mappingValue(resource, "kind")
+	if kind == nil || kind.Kind != yaml.ScalarNode {
+		return nil
+	}
+
+	if strings.HasSuffix(kind.Value, "List") {
+		if items := mappingValue(resource, "items"); items != nil && items.Kind == yaml.SequenceNode {
+			for _, item := range items.Content {
+				if err := injectNamespace(item, namespace); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+
+	if clusterScopedKinds[kind.Value] {
+		return nil
+	}
+
+	metadata := mappingValue(resource, "metadata")
+	if metadata == nil {
+		metadata = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		resource.Content = append(resource.Content,
+			&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "metadata"}, metadata)
+	}
+	if metadata.Kind != yaml.MappingNode {
+		return fmt.Errorf("%s has invalid metadata", kind.Value)
+	}
+
+	if existing := mappingValue(metadata, "namespace"); existing != nil && existing.Value != "" {
+		return nil
+	}
+	setMappingValue(metadata, "namespace", namespace)
+
+	return nil
+}
+
+// mappingValue returns the value for a key in a mapping node, or nil
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// setMappingValue sets a string value for a key in a mapping node, adding the
+// key if needed
+func setMappingValue(node *yaml.Node, key, value string) {
+	if existing := mappingValue(node, key); existing != nil {
+		existing.Kind = yaml.ScalarNode
+		existing.Tag = "!!str"
+		existing.Style = 0
+		existing.Value = value
+		existing.Content = nil
+		return
+	}
+
+	node.Content = append(node.Content,
+		&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key},
+		&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value})
+}
@@ -0,0 +1,87 @@
+package manifest
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestInjectNamespace(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{
+			name:    "missing namespace",
+			content: "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: app\n",
+			want:    "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: app\n  namespace: team\n",
+		},
+		{
+			name:    "empty namespace",
+			content: "kind: Service\nmetadata:\n  name: app\n  namespace: \"\"\n",
+			want:    "kind: Service\nmetadata:\n  name: app\n  namespace: team\n",
+		},
+		{
+			name:    "namespace kept",
+			content: "kind: Service\nmetadata:\n  name: app\n  namespace: other\n",
+			want:    "kind: Service\nmetadata:\n  name: app\n  namespace: other\n",
+		},
+		{
+			name:    "missing metadata",
+			content: "kind: Secret\n",
+			want:    "kind: Secret\nmetadata:\n  namespace: team\n",
+		},
+		{
+			name:    "cluster-scoped kinds",
+			content: "kind: Namespace\nmetadata:\n  name: team\n---\nkind: ClusterRole\nmetadata:\n  name: reader\n---\nkind: CustomResourceDefinition\nmetadata:\n  name: widgets.acme.io\n",
+			want:    "kind: Namespace\nmetadata:\n  name: team\n---\nkind: ClusterRole\nmetadata:\n  name: reader\n---\nkind: CustomResourceDefinition\nmetadata:\n  name: widgets.acme.io\n",
+		},
+		{
+			name:    "list items",
+			content: "kind: List\nitems:\n  - kind: ConfigMap\n    metadata:\n      name: app\n  - kind: StorageClass\n    metadata:\n      name: fast\n",
+			want:    "kind: List\nitems:\n  - kind: ConfigMap\n    metadata:\n      name: app\n      namespace: team\n  - kind: StorageClass\n    metadata:\n      name: fast\n",
+		},
+		{
+			name:    "not a resource",
+			content: "replicas: 3\n",
+			want:    "replicas: 3\n",
+		},
+		{
+			name:    "empty documents dropped",
+			content: "---\nkind: ConfigMap\nmetadata:\n  name: app\n---\n---\n",
+			want:    "kind: ConfigMap\nmetadata:\n  name: app\n  namespace: team\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := InjectNamespace([]byte(tt.content), "team")
+			if err != nil {
+				t.Fatalf("InjectNamespace() error = %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("InjectNamespace() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInjectNamespaceErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{"invalid YAML", "kind: ConfigMap\n---\nmetadata: {\n", "document 2"},
+		{"invalid metadata", "kind: ConfigMap\n---\nkind: Service\nmetadata: app\n", "document 2: Service has invalid metadata"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := InjectNamespace([]byte(tt.content), "team")
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("InjectNamespace() error = %v, want it to mention %q", err, tt.wantErr)
+			}
+		})
+	}
+}
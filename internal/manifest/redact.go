@@ -0,0 +1,125 @@
+package manifest
+
+import (
+	"fmt"
+	"regexp"
+
+	"gopkg.in/yaml.v3"
+)
+
+// RedactedValue replaces the values of sensitive keys
+const RedactedValue = "***"
+
+// DefaultRedactPatterns match the keys whose values are redacted when no
+// patterns are configured
+var DefaultRedactPatterns = []string{"password", "token", "secret", "key"}
+
+// Redactor masks the values of mapping keys that look sensitive
+type Redactor struct {
+	patterns []*regexp.Regexp
+}
+
+// NewRedactor creates a redactor for keys matching any of the regular
+// expressions, case-insensitively. The default patterns are used when none
+// are given.
+func NewRedactor(patterns []string) (*Redactor, error) {
+	if len(patterns) == 0 {
+		patterns = DefaultRedactPatterns
+	}
+
+	r := &Redactor{}
+	for _, pattern := range patterns {
+		compiled, err := regexp.Compile("(?i)" + pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redact pattern %q: %w", pattern, err)
+		}
+		r.patterns = append(r.patterns, compiled)
+	}
+	return r, nil
+}
+
+// Redact re-serializes multi-document YAML with every scalar under a
+// sensitive key, and the data of every Secret, replaced by RedactedValue.
+// Empty documents are dropped.
+func (r *Redactor) Redact(content []byte) ([]byte, error) {
+	docs, err := Decode(content)
+	if err != nil {
+		return nil, err
+	}
+
+	var redacted []*yaml.Node
+	for _, doc := range docs {
+		if isEmptyDocument(doc) {
+			continue
+		}
+		redactSecretData(doc.Content[0])
+		r.redactNode(doc)
+		redacted = append(redacted, doc)
+	}
+
+	return Encode(redacted)
+}
+
+// redactNode walks a node and masks the values of sensitive keys
+func (r *Redactor) redactNode(node *yaml.Node) {
+	if node.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if r.sensitive(node.Content[i].Value) {
+				mask(node.Content[i+1])
+			} else {
+				r.redactNode(node.Content[i+1])
+			}
+		}
+		return
+	}
+
+	for _, child := range node.Content {
+		r.redactNode(child)
+	}
+}
+
+// redactSecretData masks the data of a Secret, whose keys are arbitrary
+func redactSecretData(root *yaml.Node) {
+	if root.Kind != yaml.MappingNode || scalarValue(mappingValue(root, "kind")) != "Secret" {
+		return
+	}
+	for _, field := range []string{"data", "stringData"} {
+		if data := mappingValue(root, field); data != nil {
+			mask(data)
+		}
+	}
+}
+
+// sensitive reports whether a key matches any redact pattern
+func (r *Redactor) sensitive(key string) bool {
+	for _, pattern := range r.patterns {
+		if pattern.MatchString(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// mask replaces every scalar within a node, keeping the structure around
+// them so nested keys remain visible
+func mask(node *yaml.Node) {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		if node.Tag == "!!null" {
+			return
+		}
+		node.Value = RedactedValue
+		node.Tag = "!!str"
+		node.Style = 0
+	case yaml.AliasNode:
+		// Aliases point at anchored content that is masked where defined
+	default:
+		for i, child := range node.Content {
+			// Mapping keys stay readable
+			if node.Kind == yaml.MappingNode && i%2 == 0 {
+				continue
+			}
+			mask(child)
+		}
+	}
+}
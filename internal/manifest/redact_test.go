@@ -0,0 +1,75 @@
+package manifest
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRedact(t *testing.T) {
+	r, err := NewRedactor(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := []byte(`apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: web
+data:
+  replicas: "3"
+  dbPassword: hunter2
+  auth:
+    apiToken: abc123
+    tokens:
+      - first
+      - second
+    issuer: https://auth.example.com
+  emptyKey: null
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: web
+data:
+  username: YWRtaW4=
+stringData:
+  config: |
+    plain text
+`)
+	redacted, err := r.Redact(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := string(redacted)
+
+	for _, secret := range []string{"hunter2", "abc123", "first", "second", "YWRtaW4=", "plain text"} {
+		if strings.Contains(got, secret) {
+			t.Errorf("Redact() kept %q:\n%s", secret, got)
+		}
+	}
+	// Keys, other values, and nulls stay as they were
+	for _, kept := range []string{`replicas: "3"`, "issuer: https://auth.example.com", "dbPassword: '***'", "username: '***'", "emptyKey: null", "name: web"} {
+		if !strings.Contains(got, kept) {
+			t.Errorf("Redact() lost %q:\n%s", kept, got)
+		}
+	}
+}
+
+func TestRedactPatterns(t *testing.T) {
+	r, err := NewRedactor([]string{"^credential$"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	redacted, err := r.Redact([]byte("credential: a\nCREDENTIAL: b\ncredentials: c\npassword: d\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(redacted), "credential: '***'\nCREDENTIAL: '***'\ncredentials: c\npassword: d\n"; got != want {
+		t.Errorf("Redact() = %q, want %q", got, want)
+	}
+
+	if _, err := NewRedactor([]string{"("}); err == nil {
+		t.Error("NewRedactor() accepted an invalid pattern")
+	}
+}
@@ -0,0 +1,73 @@
+package manifest
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"gopkg.in/yaml.v3"
+)
+
+// sortableDocument is a document with the fields it is ordered by
+type sortableDocument struct {
+	node     *yaml.Node
+	resource bool      // Whether the document has an apiVersion and kind
+	key      [4]string // apiVersion, kind, namespace, name
+	encoded  []byte    // Breaks ties so the order never depends on the input
+}
+
+// SortDocuments orders multi-document YAML by apiVersion, kind, namespace,
+// and name, so the output doesn't depend on the order helm renders in.
+// Documents without an apiVersion or kind come last, ordered by content, as
+// do resources that are otherwise identical. Empty documents are dropped.
+func SortDocuments(content []byte) ([]byte, error) {
+	docs, err := Decode(content)
+	if err != nil {
+		return nil, err
+	}
+
+	var sortable []sortableDocument
+	for i, doc := range docs {
+		if isEmptyDocument(doc) {
+			continue
+		}
+
+		encoded, err := Encode([]*yaml.Node{doc})
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode document %d: %w", i+1, err)
+		}
+
+		document := sortableDocument{node: doc, encoded: encoded}
+		if root := doc.Content[0]; root.Kind == yaml.MappingNode {
+			document.key[0] = scalarValue(mappingValue(root, "apiVersion"))
+			document.key[1] = scalarValue(mappingValue(root, "kind"))
+			if metadata := mappingValue(root, "metadata"); metadata != nil && metadata.Kind == yaml.MappingNode {
+				document.key[2] = scalarValue(mappingValue(metadata, "namespace"))
+				document.key[3] = scalarValue(mappingValue(metadata, "name"))
+			}
+			document.resource = document.key[0] != "" && document.key[1] != ""
+		}
+		sortable = append(sortable, document)
+	}
+
+	sort.SliceStable(sortable, func(i, j int) bool {
+		a, b := sortable[i], sortable[j]
+		if a.resource != b.resource {
+			return a.resource
+		}
+		if a.resource {
+			for k := range a.key {
+				if a.key[k] != b.key[k] {
+					return a.key[k] < b.key[k]
+				}
+			}
+		}
+		return bytes.Compare(a.encoded, b.encoded) < 0
+	})
+
+	sorted := make([]*yaml.Node, len(sortable))
+	for i, document := range sortable {
+		sorted[i] = document.node
+	}
+	return Encode(sorted)
+}
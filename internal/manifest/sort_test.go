@@ -0,0 +1,50 @@
+package manifest
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSortDocuments(t *testing.T) {
+	documents := []string{
+		"apiVersion: v1\nkind: Service\nmetadata:\n  name: web\n",
+		"apiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: web\n  namespace: prod\n",
+		"note: no kind\n",
+		"apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: b\n",
+		"apiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: api\n  namespace: prod\n",
+		"apiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: web\n  namespace: dev\n",
+		"apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: a\n",
+		"another: plain document\n",
+	}
+	want := strings.Join([]string{
+		documents[5], // apps/v1 Deployment dev/web
+		documents[4], // apps/v1 Deployment prod/api
+		documents[1], // apps/v1 Deployment prod/web
+		documents[6], // v1 ConfigMap a
+		documents[3], // v1 ConfigMap b
+		documents[0], // v1 Service web
+		documents[7], // no apiVersion or kind, by content
+		documents[2],
+	}, "---\n")
+
+	got, err := SortDocuments([]byte(strings.Join(documents, "---\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("SortDocuments() =\n%s\nwant\n%s", got, want)
+	}
+
+	// Any input order gives the same output, and empty documents are dropped
+	reversed := make([]string, len(documents))
+	for i, doc := range documents {
+		reversed[len(documents)-1-i] = doc
+	}
+	got, err = SortDocuments([]byte("---\n" + strings.Join(reversed, "---\n") + "---\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("SortDocuments() of the reversed input =\n%s\nwant\n%s", got, want)
+	}
+}
@@ -0,0 +1,132 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+)
+
+// Policy configures retries with exponential backoff
+type Policy struct {
+	MaxAttempts int           // Total attempts including the first one
+	BaseDelay   time.Duration // Delay before the first retry
+	MaxDelay    time.Duration // Upper bound for any single delay
+}
+
+// NewPolicy creates a policy that retries up to maxRetries times after the
+// first attempt with the default backoff settings
+func NewPolicy(maxRetries int) Policy {
+	if maxRetries < 0 {
+		maxRetries = 0
+	}
+
+	return Policy{
+		MaxAttempts: maxRetries + 1,
+		BaseDelay:   500 * time.Millisecond,
+		MaxDelay:    30 * time.Second,
+	}
+}
+
+// Delay returns the backoff delay before the given retry attempt (1-based),
+// with up to 20% jitter
+func (p Policy) Delay(attempt int) time.Duration {
+	delay := p.BaseDelay
+	for i := 1; i < attempt && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+
+	return delay - time.Duration(rand.Int63n(int64(delay)/5+1))
+}
+
+// Do calls fn until it succeeds, returns an error marked with Permanent, the
+// attempts are exhausted, or the context is done. The last error is returned.
+func (p Policy) Do(ctx context.Context, fn func() error) error {
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = fn()
+		if err == nil {
+			return nil
+		}
+
+		var permanent *permanentError
+		if errors.As(err, &permanent) {
+			return permanent.err
+		}
+
+		if attempt >= p.MaxAttempts {
+			return unwrapDelay(err)
+		}
+
+		delay := p.Delay(attempt)
+		var hinted *delayError
+		if errors.As(err, &hinted) {
+			delay = hinted.delay
+		}
+
+		if err := Sleep(ctx, delay); err != nil {
+			return unwrapDelay(err)
+		}
+	}
+}
+
+// Sleep waits for the given duration or until the context is done
+func Sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// permanentError marks an error that should not be retried
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// Permanent marks an error as not retryable
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+// delayError carries a server-provided hint for when to retry
+type delayError struct {
+	err   error
+	delay time.Duration
+}
+
+func (e *delayError) Error() string { return e.err.Error() }
+func (e *delayError) Unwrap() error { return e.err }
+
+// After marks an error as retryable after the given delay instead of the
+// policy's backoff
+func After(err error, delay time.Duration) error {
+	if err == nil {
+		return nil
+	}
+	return &delayError{err: err, delay: delay}
+}
+
+// unwrapDelay strips a retry hint from an error returned to the caller
+func unwrapDelay(err error) error {
+	if hinted, ok := err.(*delayError); ok {
+		return hinted.err
+	}
+	return err
+}
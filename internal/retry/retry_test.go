@@ -0,0 +1,109 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDoRetriesUntilSuccess(t *testing.T) {
+	calls := 0
+	err := Policy{MaxAttempts: 3}.Do(context.Background(), func() error {
+		calls++
+		if calls < 3 {
+			return errors.New("transient")
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Errorf("Do() = %v after %d calls, want success on the third", err, calls)
+	}
+}
+
+func TestDoStopsAfterMaxAttempts(t *testing.T) {
+	calls := 0
+	failure := errors.New("transient")
+	err := Policy{MaxAttempts: 2}.Do(context.Background(), func() error {
+		calls++
+		return After(failure, 0)
+	})
+	if err != failure || calls != 2 {
+		t.Errorf("Do() = %v after %d calls, want the last error after 2", err, calls)
+	}
+}
+
+func TestDoDoesNotRetryPermanentErrors(t *testing.T) {
+	calls := 0
+	failure := errors.New("unauthorized")
+	err := Policy{MaxAttempts: 3}.Do(context.Background(), func() error {
+		calls++
+		return Permanent(failure)
+	})
+	if err != failure || calls != 1 {
+		t.Errorf("Do() = %v after %d calls, want the unwrapped error after 1", err, calls)
+	}
+}
+
+func TestDoWaitsForHintedDelay(t *testing.T) {
+	calls := 0
+	start := time.Now()
+	err := Policy{MaxAttempts: 2, BaseDelay: time.Hour}.Do(context.Background(), func() error {
+		calls++
+		if calls == 1 {
+			return After(errors.New("rate limited"), 10*time.Millisecond)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Do() error = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 10*time.Millisecond || elapsed > time.Minute {
+		t.Errorf("waited %v, want the hinted delay instead of the backoff", elapsed)
+	}
+}
+
+func TestDoStopsWhenContextIsDone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	err := Policy{MaxAttempts: 3, BaseDelay: time.Hour}.Do(ctx, func() error {
+		calls++
+		cancel()
+		return errors.New("transient")
+	})
+	if !errors.Is(err, context.Canceled) || calls != 1 {
+		t.Errorf("Do() = %v after %d calls, want context.Canceled after 1", err, calls)
+	}
+}
+
+func TestDelay(t *testing.T) {
+	p := Policy{BaseDelay: time.Second, MaxDelay: 5 * time.Second}
+
+	tests := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 5 * time.Second},
+		{10, 5 * time.Second},
+	}
+
+	for _, tt := range tests {
+		// Up to 20% jitter is taken off the delay
+		got := p.Delay(tt.attempt)
+		if got > tt.want || got < tt.want*4/5 {
+			t.Errorf("Delay(%d) = %v, want %v less up to 20%%", tt.attempt, got, tt.want)
+		}
+	}
+}
+
+func TestNewPolicy(t *testing.T) {
+	if got := NewPolicy(3).MaxAttempts; got != 4 {
+		t.Errorf("NewPolicy(3).MaxAttempts = %d, want 4", got)
+	}
+	if got := NewPolicy(-1).MaxAttempts; got != 1 {
+		t.Errorf("NewPolicy(-1).MaxAttempts = %d, want 1", got)
+	}
+}
@@ -0,0 +1,91 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		expr    string
+		invalid bool
+	}{
+		{"*/15 * * * *", false},
+		{"0 6 * * mon-fri", false},
+		{"30 2 1,15 jan-jun 7", false},
+		{"5/10 * * * *", false},
+		{"@daily", false},
+		{"@HOURLY", false},
+		{"* * * *", true},
+		{"* * * * * *", true},
+		{"60 * * * *", true},
+		{"* 24 * * *", true},
+		{"* * 0 * *", true},
+		{"* * * 13 *", true},
+		{"* * * * 8", true},
+		{"*/0 * * * *", true},
+		{"10-5 * * * *", true},
+		{"* * * * funday", true},
+		{"@fortnightly", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			s, err := Parse(tt.expr)
+			if (err != nil) != tt.invalid {
+				t.Fatalf("Parse(%q) error = %v, want invalid %v", tt.expr, err, tt.invalid)
+			}
+			if err == nil && s.String() != tt.expr {
+				t.Errorf("String() = %q, want %q", s.String(), tt.expr)
+			}
+		})
+	}
+}
+
+func TestNext(t *testing.T) {
+	// A Wednesday
+	from := time.Date(2024, time.January, 10, 12, 7, 30, 0, time.UTC)
+
+	tests := []struct {
+		expr string
+		want time.Time
+	}{
+		{"*/15 * * * *", time.Date(2024, time.January, 10, 12, 15, 0, 0, time.UTC)},
+		{"7 12 * * *", time.Date(2024, time.January, 11, 12, 7, 0, 0, time.UTC)},
+		{"0 6 * * mon-fri", time.Date(2024, time.January, 11, 6, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2024, time.January, 14, 0, 0, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2024, time.February, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 feb *", time.Date(2024, time.February, 29, 0, 0, 0, 0, time.UTC)},
+		// Either day field matches when both are restricted: the 15th or a Friday
+		{"0 0 15 * fri", time.Date(2024, time.January, 12, 0, 0, 0, 0, time.UTC)},
+		{"0 0 30 feb *", time.Time{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			s, err := Parse(tt.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := s.Next(from); !got.Equal(tt.want) {
+				t.Errorf("Next() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNextIsAfter(t *testing.T) {
+	s, err := Parse("* * * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A time on the minute selects the following one
+	from := time.Date(2024, time.January, 10, 12, 0, 0, 0, time.UTC)
+	if got, want := s.Next(from), from.Add(time.Minute); !got.Equal(want) {
+		t.Errorf("Next() = %v, want %v", got, want)
+	}
+	if !s.Matches(from) {
+		t.Errorf("Matches(%v) = false, want true", from)
+	}
+}
@@ -0,0 +1,82 @@
+// Package scm describes the source code hosting API the pipeline talks to,
+// independently of the provider behind it
+package scm
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrFileNotFound is returned by GetFileContents when the file doesn't exist
+var ErrFileNotFound = errors.New("file not found")
+
+// Repository describes a hosted repository
+type Repository struct {
+	// Owner is the user, organization, or namespace path the repository
+	// belongs to, e.g. "group/subgroup" on GitLab
+	Owner string
+
+	// Name is the repository's name within its owner
+	Name string
+
+	// DefaultBranch is the branch checked out by default
+	DefaultBranch string
+
+	// CloneURL is the HTTPS URL git clones the repository from
+	CloneURL string
+
+	// WebURL is the repository's page
+	WebURL string
+}
+
+// Branch describes a branch of a repository
+type Branch struct {
+	Name      string
+	Protected bool
+
+	// SHA is the commit the branch points at
+	SHA string
+}
+
+// Provider is the source code hosting API the pipeline talks to, such as
+// GitHub or GitLab
+type Provider interface {
+	// ListBranches returns the branches of the configured repository
+	ListBranches(ctx context.Context) ([]Branch, error)
+
+	// GetRepository returns the configured repository, possibly cached
+	GetRepository(ctx context.Context) (*Repository, error)
+
+	// InvalidateRepositoryCache drops any cached GetRepository result
+	InvalidateRepositoryCache()
+
+	// GetRepositoryByName returns another repository
+	GetRepositoryByName(ctx context.Context, owner, repo string) (*Repository, error)
+
+	// CanPush reports whether the credentials may push to owner/repo
+	CanPush(ctx context.Context, owner, repo string) (bool, error)
+
+	// GetFileContents returns the content of a file in owner/repo at ref,
+	// or ErrFileNotFound
+	GetFileContents(ctx context.Context, owner, repo, filePath, ref string) ([]byte, error)
+
+	// EnsureFork makes sure forkOwner has a fork of owner/repo
+	EnsureFork(ctx context.Context, owner, repo, forkOwner string) error
+
+	// CreatePullRequest opens a pull request and returns its URL
+	CreatePullRequest(ctx context.Context, owner, repo, base, head, title, body string) (string, error)
+
+	// IsAuthenticated checks that the credentials are valid
+	IsAuthenticated(ctx context.Context) bool
+
+	// CloneURL returns the HTTPS URL git clones owner/repo from, without
+	// looking the repository up
+	CloneURL(owner, repo string) string
+
+	// CommitURL returns the web URL of a commit in owner/repo
+	CommitURL(owner, repo, sha string) string
+
+	// FileURL returns the web URL of a file, or of a directory when dir is
+	// set, in owner/repo at a commit
+	FileURL(owner, repo, sha, path string, dir bool) string
+}
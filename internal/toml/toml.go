@@ -0,0 +1,678 @@
+// Package toml decodes TOML documents into the generic maps the rest of the
+// pipeline works with. It covers the parts of TOML v1.0 used by values files:
+// tables, arrays of tables, dotted and quoted keys, inline tables, arrays,
+// all string forms, integers, floats, and booleans. Dates and times are kept
+// as strings.
+package toml
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// byteOrderMark may start a UTF-8 document and is ignored
+const byteOrderMark = "\uFEFF"
+
+// Decode parses a TOML document into nested maps
+func Decode(data []byte) (map[string]interface{}, error) {
+	p := &parser{
+		src:   strings.TrimPrefix(string(data), byteOrderMark),
+		line:  1,
+		kinds: make(map[string]tableKind),
+	}
+	root := make(map[string]interface{})
+	if err := p.parse(root); err != nil {
+		return nil, fmt.Errorf("line %d: %w", p.line, err)
+	}
+	return root, nil
+}
+
+// parser reads a TOML document one token at a time
+type parser struct {
+	src  string
+	pos  int
+	line int
+
+	// kinds records how each table and array was defined, by path, since
+	// TOML only lets some of them be extended later
+	kinds   map[string]tableKind
+	inlines int // Number of inline tables read, to give each its own path
+}
+
+// tableKind is how a table or array was defined
+type tableKind int
+
+const (
+	// implicitTable is created by a header naming one of its sub-tables,
+	// and may still be defined by a header of its own
+	implicitTable tableKind = iota
+
+	// headerTable is defined by a [table] header
+	headerTable
+
+	// dottedTable is defined by a dotted key, e.g. a.b = 1
+	dottedTable
+
+	// arrayOfTables is defined by [[array]] headers
+	arrayOfTables
+
+	// staticValue is an inline table or array, which can't be extended
+	staticValue
+)
+
+// childPath returns the path of a key within the table at path
+func childPath(path, key string) string {
+	return path + "\x00" + key
+}
+
+// elementPath returns the path of an element of the array at path
+func elementPath(path string, index int) string {
+	return fmt.Sprintf("%s\x01%d", path, index)
+}
+
+// parse reads every table and key/value pair of the document into root
+func (p *parser) parse(root map[string]interface{}) error {
+	current, currentPath := root, ""
+	for {
+		p.skipBlank()
+		if p.eof() {
+			return nil
+		}
+
+		var err error
+		switch {
+		case strings.HasPrefix(p.src[p.pos:], "[["):
+			p.pos += 2
+			current, currentPath, err = p.parseArrayTable(root)
+		case p.peek() == '[':
+			p.pos++
+			current, currentPath, err = p.parseTable(root)
+		default:
+			err = p.parseKeyValue(current, currentPath)
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := p.endOfLine(); err != nil {
+			return err
+		}
+	}
+}
+
+// parseTable reads a [table] header and returns the table it opens and its
+// path. A table can only be defined once, and not at all if a dotted key or
+// an inline table already defined it.
+func (p *parser) parseTable(root map[string]interface{}) (map[string]interface{}, string, error) {
+	keys, err := p.parseKey()
+	if err != nil {
+		return nil, "", err
+	}
+	if !p.consume("]") {
+		return nil, "", fmt.Errorf("expected ] after table name")
+	}
+
+	parent, parentPath, err := p.descend(root, "", keys[:len(keys)-1], false)
+	if err != nil {
+		return nil, "", err
+	}
+
+	name := strings.Join(keys, ".")
+	last := keys[len(keys)-1]
+	path := childPath(parentPath, last)
+	switch existing := parent[last].(type) {
+	case nil:
+		table := make(map[string]interface{})
+		parent[last] = table
+		p.kinds[path] = headerTable
+		return table, path, nil
+	case map[string]interface{}:
+		if p.kinds[path] != implicitTable {
+			return nil, "", fmt.Errorf("table %s is defined more than once", name)
+		}
+		p.kinds[path] = headerTable
+		return existing, path, nil
+	default:
+		return nil, "", fmt.Errorf("key %s is already defined", name)
+	}
+}
+
+// parseArrayTable reads an [[array]] header and returns the table it appends
+// and its path
+func (p *parser) parseArrayTable(root map[string]interface{}) (map[string]interface{}, string, error) {
+	keys, err := p.parseKey()
+	if err != nil {
+		return nil, "", err
+	}
+	if !p.consume("]]") {
+		return nil, "", fmt.Errorf("expected ]] after array of tables name")
+	}
+
+	parent, parentPath, err := p.descend(root, "", keys[:len(keys)-1], false)
+	if err != nil {
+		return nil, "", err
+	}
+
+	last := keys[len(keys)-1]
+	path := childPath(parentPath, last)
+	table := make(map[string]interface{})
+	switch existing := parent[last].(type) {
+	case nil:
+		parent[last] = []interface{}{table}
+		p.kinds[path] = arrayOfTables
+		return table, elementPath(path, 0), nil
+	case []interface{}:
+		if p.kinds[path] != arrayOfTables {
+			return nil, "", fmt.Errorf("key %s is an array and can't be extended", strings.Join(keys, "."))
+		}
+		parent[last] = append(existing, table)
+		return table, elementPath(path, len(existing)), nil
+	default:
+		return nil, "", fmt.Errorf("key %s is already defined", strings.Join(keys, "."))
+	}
+}
+
+// descend walks a key path from the table at path, creating missing tables,
+// and returns the table it ends at and that table's path. Arrays of tables
+// resolve to their last element. Inline tables and arrays can't be entered,
+// and dotted keys can't enter tables defined by headers.
+func (p *parser) descend(table map[string]interface{}, path string, keys []string, dotted bool) (map[string]interface{}, string, error) {
+	for i, key := range keys {
+		name := strings.Join(keys[:i+1], ".")
+		path = childPath(path, key)
+		switch existing := table[key].(type) {
+		case nil:
+			child := make(map[string]interface{})
+			table[key] = child
+			table = child
+			if dotted {
+				p.kinds[path] = dottedTable
+			} else {
+				p.kinds[path] = implicitTable
+			}
+		case map[string]interface{}:
+			switch p.kinds[path] {
+			case staticValue:
+				return nil, "", fmt.Errorf("inline table %s can't be extended", name)
+			case headerTable:
+				if dotted {
+					return nil, "", fmt.Errorf("table %s can't be extended with dotted keys", name)
+				}
+			}
+			table = existing
+		case []interface{}:
+			if p.kinds[path] != arrayOfTables {
+				return nil, "", fmt.Errorf("key %s is not a table", name)
+			}
+			child, ok := lastTable(existing)
+			if !ok {
+				return nil, "", fmt.Errorf("key %s is not a table", name)
+			}
+			table = child
+			path = elementPath(path, len(existing)-1)
+		default:
+			return nil, "", fmt.Errorf("key %s is not a table", name)
+		}
+	}
+	return table, path, nil
+}
+
+// lastTable returns the last element of an array of tables
+func lastTable(array []interface{}) (map[string]interface{}, bool) {
+	if len(array) == 0 {
+		return nil, false
+	}
+	table, ok := array[len(array)-1].(map[string]interface{})
+	return table, ok
+}
+
+// parseKeyValue reads a key = value pair into the table at path
+func (p *parser) parseKeyValue(table map[string]interface{}, path string) error {
+	keys, err := p.parseKey()
+	if err != nil {
+		return err
+	}
+	if !p.consume("=") {
+		return fmt.Errorf("expected = after key %s", strings.Join(keys, "."))
+	}
+	p.skipSpace()
+
+	value, err := p.parseValue()
+	if err != nil {
+		return err
+	}
+
+	parent, parentPath, err := p.descend(table, path, keys[:len(keys)-1], true)
+	if err != nil {
+		return err
+	}
+	last := keys[len(keys)-1]
+	if _, exists := parent[last]; exists {
+		return fmt.Errorf("key %s is defined more than once", strings.Join(keys, "."))
+	}
+	parent[last] = value
+
+	// Inline tables and arrays are complete as written
+	switch value.(type) {
+	case map[string]interface{}, []interface{}:
+		p.kinds[childPath(parentPath, last)] = staticValue
+	}
+	return nil
+}
+
+// parseKey reads a bare, quoted, or dotted key
+func (p *parser) parseKey() ([]string, error) {
+	var keys []string
+	for {
+		p.skipSpace()
+		if p.eof() {
+			return nil, fmt.Errorf("expected a key")
+		}
+
+		var key string
+		var err error
+		switch p.peek() {
+		case '"':
+			key, err = p.parseBasicString()
+		case '\'':
+			key, err = p.parseLiteralString()
+		default:
+			start := p.pos
+			for !p.eof() && isBareKeyChar(p.peek()) {
+				p.pos++
+			}
+			if p.pos == start {
+				return nil, fmt.Errorf("expected a key")
+			}
+			key = p.src[start:p.pos]
+		}
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+
+		p.skipSpace()
+		if !p.consume(".") {
+			return keys, nil
+		}
+	}
+}
+
+// isBareKeyChar reports whether c may appear in an unquoted key
+func isBareKeyChar(c byte) bool {
+	return c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '_' || c == '-'
+}
+
+// parseValue reads any value
+func (p *parser) parseValue() (interface{}, error) {
+	switch {
+	case p.eof():
+		return nil, fmt.Errorf("expected a value")
+	case strings.HasPrefix(p.src[p.pos:], `"""`):
+		return p.parseMultilineString(`"""`, true)
+	case strings.HasPrefix(p.src[p.pos:], "'''"):
+		return p.parseMultilineString("'''", false)
+	case p.peek() == '"':
+		return p.parseBasicString()
+	case p.peek() == '\'':
+		return p.parseLiteralString()
+	case p.peek() == '[':
+		p.pos++
+		return p.parseArray()
+	case p.peek() == '{':
+		p.pos++
+		return p.parseInlineTable()
+	}
+
+	// Everything else is a bare token up to the next delimiter
+	start := p.pos
+	for !p.eof() && !strings.ContainsRune(",]}#\r\n", rune(p.peek())) {
+		p.pos++
+	}
+	token := strings.TrimRight(p.src[start:p.pos], " \t")
+	return parseScalar(token)
+}
+
+// parseArray reads the elements of an array after its opening bracket
+func (p *parser) parseArray() ([]interface{}, error) {
+	values := []interface{}{}
+	for {
+		p.skipBlank()
+		if p.consume("]") {
+			return values, nil
+		}
+
+		value, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+
+		p.skipBlank()
+		if p.consume("]") {
+			return values, nil
+		}
+		if !p.consume(",") {
+			return nil, fmt.Errorf("expected , or ] in array")
+		}
+	}
+}
+
+// parseInlineTable reads the pairs of an inline table after its opening brace
+func (p *parser) parseInlineTable() (map[string]interface{}, error) {
+	table := make(map[string]interface{})
+	p.skipSpace()
+	if p.consume("}") {
+		return table, nil
+	}
+
+	// Keys within the inline table are tracked apart from the document's
+	p.inlines++
+	path := fmt.Sprintf("\x02%d", p.inlines)
+	for {
+		if err := p.parseKeyValue(table, path); err != nil {
+			return nil, err
+		}
+
+		p.skipSpace()
+		if p.consume("}") {
+			return table, nil
+		}
+		if !p.consume(",") {
+			return nil, fmt.Errorf("expected , or } in inline table")
+		}
+	}
+}
+
+// parseBasicString reads a double-quoted string, resolving escapes
+func (p *parser) parseBasicString() (string, error) {
+	p.pos++ // Opening quote
+
+	var buf strings.Builder
+	for {
+		if p.eof() || p.peek() == '\n' {
+			return "", fmt.Errorf("unterminated string")
+		}
+
+		c := p.src[p.pos]
+		switch c {
+		case '"':
+			p.pos++
+			return buf.String(), nil
+		case '\\':
+			if err := p.parseEscape(&buf); err != nil {
+				return "", err
+			}
+		default:
+			buf.WriteByte(c)
+			p.pos++
+		}
+	}
+}
+
+// parseLiteralString reads a single-quoted string, which has no escapes
+func (p *parser) parseLiteralString() (string, error) {
+	p.pos++ // Opening quote
+
+	end := strings.IndexAny(p.src[p.pos:], "'\n")
+	if end < 0 || p.src[p.pos+end] != '\'' {
+		return "", fmt.Errorf("unterminated string")
+	}
+
+	value := p.src[p.pos : p.pos+end]
+	p.pos += end + 1
+	return value, nil
+}
+
+// parseMultilineString reads a multi-line basic or literal string. A newline
+// right after the opening delimiter is dropped, and in basic strings a
+// backslash at the end of a line trims the following whitespace.
+func (p *parser) parseMultilineString(delim string, escapes bool) (string, error) {
+	p.pos += len(delim)
+	if p.consume("\r\n") || p.consume("\n") {
+		p.line++
+	}
+
+	quote := delim[0]
+	var buf strings.Builder
+	for {
+		if p.eof() {
+			return "", fmt.Errorf("unterminated multi-line string")
+		}
+
+		if strings.HasPrefix(p.src[p.pos:], delim) {
+			// Up to two quotes directly before the closing delimiter belong
+			// to the string
+			n := 0
+			for p.pos+n < len(p.src) && p.src[p.pos+n] == quote && n < len(delim)+2 {
+				n++
+			}
+			buf.WriteString(p.src[p.pos : p.pos+n-len(delim)])
+			p.pos += n
+			return buf.String(), nil
+		}
+
+		c := p.src[p.pos]
+		switch {
+		case c == '\\' && escapes && p.lineEndingBackslash():
+			for !p.eof() && strings.ContainsRune(" \t\r\n", rune(p.peek())) {
+				if p.peek() == '\n' {
+					p.line++
+				}
+				p.pos++
+			}
+		case c == '\\' && escapes:
+			if err := p.parseEscape(&buf); err != nil {
+				return "", err
+			}
+		default:
+			if c == '\n' {
+				p.line++
+			}
+			buf.WriteByte(c)
+			p.pos++
+		}
+	}
+}
+
+// lineEndingBackslash reports whether the backslash at the current position
+// is followed only by whitespace up to the end of the line
+func (p *parser) lineEndingBackslash() bool {
+	for i := p.pos + 1; i < len(p.src); i++ {
+		switch p.src[i] {
+		case ' ', '\t', '\r':
+		case '\n':
+			p.pos++
+			return true
+		default:
+			return false
+		}
+	}
+	return false
+}
+
+// parseEscape decodes the escape sequence at the current position
+func (p *parser) parseEscape(buf *strings.Builder) error {
+	if p.pos+1 >= len(p.src) {
+		return fmt.Errorf("unterminated escape sequence")
+	}
+
+	c := p.src[p.pos+1]
+	p.pos += 2
+	switch c {
+	case 'b':
+		buf.WriteByte('\b')
+	case 't':
+		buf.WriteByte('\t')
+	case 'n':
+		buf.WriteByte('\n')
+	case 'f':
+		buf.WriteByte('\f')
+	case 'r':
+		buf.WriteByte('\r')
+	case '"':
+		buf.WriteByte('"')
+	case '\\':
+		buf.WriteByte('\\')
+	case 'u', 'U':
+		size := 4
+		if c == 'U' {
+			size = 8
+		}
+		if p.pos+size > len(p.src) {
+			return fmt.Errorf("invalid unicode escape")
+		}
+		code, err := strconv.ParseUint(p.src[p.pos:p.pos+size], 16, 32)
+		if err != nil || !utf8.ValidRune(rune(code)) {
+			return fmt.Errorf("invalid unicode escape \\%c%s", c, p.src[p.pos:p.pos+size])
+		}
+		buf.WriteRune(rune(code))
+		p.pos += size
+	default:
+		return fmt.Errorf("invalid escape sequence \\%c", c)
+	}
+	return nil
+}
+
+// dateTime matches offset and local date-times, local dates, and local times
+var dateTime = regexp.MustCompile(`^(\d{4}-\d{2}-\d{2}([Tt ]\d{2}:\d{2}:\d{2}(\.\d+)?([Zz]|[+-]\d{2}:\d{2})?)?|\d{2}:\d{2}:\d{2}(\.\d+)?)$`)
+
+// leadingZero matches decimal numbers with a leading zero, which TOML rejects
+var leadingZero = regexp.MustCompile(`^[+-]?0[0-9]`)
+
+// integerLiteral matches every integer, in range or not, so integers too big
+// for 64 bits are rejected rather than read as floats
+var integerLiteral = regexp.MustCompile(`^([+-]?[0-9]+|0x[0-9A-Fa-f]+|0o[0-7]+|0b[01]+)$`)
+
+// parseScalar converts a bare token into a boolean, number, or date string
+func parseScalar(token string) (interface{}, error) {
+	switch token {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "inf", "+inf":
+		return math.Inf(1), nil
+	case "-inf":
+		return math.Inf(-1), nil
+	case "nan", "+nan", "-nan":
+		return math.NaN(), nil
+	case "":
+		return nil, fmt.Errorf("expected a value")
+	}
+
+	if dateTime.MatchString(token) {
+		return token, nil
+	}
+
+	// Underscores may only separate digits
+	if strings.HasPrefix(token, "_") || strings.HasSuffix(token, "_") || strings.Contains(token, "__") {
+		return nil, fmt.Errorf("invalid value %q", token)
+	}
+	number := strings.ReplaceAll(token, "_", "")
+	if leadingZero.MatchString(number) {
+		return nil, fmt.Errorf("invalid value %q", token)
+	}
+
+	if integerLiteral.MatchString(number) {
+		n, ok := parseInteger(number)
+		if !ok {
+			return nil, fmt.Errorf("integer %s is out of range", token)
+		}
+		return n, nil
+	}
+	if f, err := strconv.ParseFloat(number, 64); err == nil && !strings.ContainsAny(number, "xXpP") {
+		return f, nil
+	}
+
+	return nil, fmt.Errorf("invalid value %q", token)
+}
+
+// parseInteger parses a decimal, hexadecimal, octal, or binary integer
+func parseInteger(s string) (int64, bool) {
+	for _, prefix := range []struct {
+		prefix string
+		base   int
+	}{{"0x", 16}, {"0o", 8}, {"0b", 2}} {
+		if strings.HasPrefix(s, prefix.prefix) {
+			n, err := strconv.ParseInt(s[2:], prefix.base, 64)
+			return n, err == nil
+		}
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	return n, err == nil
+}
+
+// endOfLine checks that only whitespace or a comment follows on the line
+func (p *parser) endOfLine() error {
+	p.skipSpace()
+	p.skipComment()
+	if p.eof() {
+		return nil
+	}
+	if p.consume("\r\n") || p.consume("\n") {
+		p.line++
+		return nil
+	}
+	return fmt.Errorf("unexpected %q after value", p.peek())
+}
+
+// skipBlank skips whitespace, newlines, and comments
+func (p *parser) skipBlank() {
+	for !p.eof() {
+		switch p.peek() {
+		case ' ', '\t', '\r':
+			p.pos++
+		case '\n':
+			p.line++
+			p.pos++
+		case '#':
+			p.skipComment()
+		default:
+			return
+		}
+	}
+}
+
+// skipSpace skips spaces and tabs
+func (p *parser) skipSpace() {
+	for !p.eof() && (p.peek() == ' ' || p.peek() == '\t') {
+		p.pos++
+	}
+}
+
+// skipComment skips a comment up to the end of the line
+func (p *parser) skipComment() {
+	if p.eof() || p.peek() != '#' {
+		return
+	}
+	if end := strings.IndexByte(p.src[p.pos:], '\n'); end >= 0 {
+		p.pos += end
+	} else {
+		p.pos = len(p.src)
+	}
+}
+
+// consume advances past s if the input continues with it
+func (p *parser) consume(s string) bool {
+	if strings.HasPrefix(p.src[p.pos:], s) {
+		p.pos += len(s)
+		return true
+	}
+	return false
+}
+
+// peek returns the current byte
+func (p *parser) peek() byte {
+	return p.src[p.pos]
+}
+
+// eof reports whether the whole input has been read
+func (p *parser) eof() bool {
+	return p.pos >= len(p.src)
+}
@@ -0,0 +1,214 @@
+package toml
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+// The cases below follow the TOML v1.0 specification and the valid and
+// invalid documents of the toml-test suite for the features Decode covers
+
+func TestDecodeValid(t *testing.T) {
+	tests := []struct {
+		name     string
+		document string
+		want     map[string]interface{}
+	}{
+		{
+			name:     "empty document",
+			document: "",
+			want:     map[string]interface{}{},
+		},
+		{
+			name:     "byte order mark",
+			document: "\uFEFFkey = \"value\"\n",
+			want:     map[string]interface{}{"key": "value"},
+		},
+		{
+			name:     "comments and blank lines",
+			document: "# comment\n\nkey = 1 # trailing\n\n",
+			want:     map[string]interface{}{"key": int64(1)},
+		},
+		{
+			name:     "bare, quoted, and dotted keys",
+			document: "bare-key_1 = 1\n\"quoted key\" = 2\n'literal key' = 3\nsite.\"google.com\" = true\n",
+			want: map[string]interface{}{
+				"bare-key_1":  int64(1),
+				"quoted key":  int64(2),
+				"literal key": int64(3),
+				"site":        map[string]interface{}{"google.com": true},
+			},
+		},
+		{
+			name:     "basic string escapes",
+			document: `s = "tab\tquote\"backslash\\unicode\u00e9\U0001F600"` + "\n",
+			want:     map[string]interface{}{"s": "tab\tquote\"backslash\\unicodeé😀"},
+		},
+		{
+			name:     "literal string",
+			document: `path = 'C:\Users\nodejs'` + "\n",
+			want:     map[string]interface{}{"path": `C:\Users\nodejs`},
+		},
+		{
+			name:     "multi-line strings",
+			document: "a = \"\"\"\nline one\nline two\"\"\"\nb = \"\"\"\\\n    trimmed \\\n    words\"\"\"\nc = '''\nraw \\n'''\nd = \"\"\"quote\"\"\"\"\"\n",
+			want: map[string]interface{}{
+				"a": "line one\nline two",
+				"b": "trimmed words",
+				"c": "raw \\n",
+				"d": `quote""`,
+			},
+		},
+		{
+			name:     "integers",
+			document: "a = +99\nb = -17\nc = 1_000\nd = 0xDEAD_beef\ne = 0o755\nf = 0b1101\ng = 9223372036854775807\nh = -9223372036854775808\n",
+			want: map[string]interface{}{
+				"a": int64(99), "b": int64(-17), "c": int64(1000), "d": int64(0xdeadbeef),
+				"e": int64(0755), "f": int64(13), "g": int64(math.MaxInt64), "h": int64(math.MinInt64),
+			},
+		},
+		{
+			name:     "floats",
+			document: "a = 1.5\nb = -0.01\nc = 5e+22\nd = 6.626e-34\ne = 9_224_617.445_991\nf = inf\ng = -inf\n",
+			want: map[string]interface{}{
+				"a": 1.5, "b": -0.01, "c": 5e+22, "d": 6.626e-34, "e": 9224617.445991,
+				"f": math.Inf(1), "g": math.Inf(-1),
+			},
+		},
+		{
+			name:     "dates and times are strings",
+			document: "a = 1979-05-27T07:32:00Z\nb = 1979-05-27T00:32:00.999-07:00\nc = 1979-05-27\nd = 07:32:00\n",
+			want: map[string]interface{}{
+				"a": "1979-05-27T07:32:00Z", "b": "1979-05-27T00:32:00.999-07:00", "c": "1979-05-27", "d": "07:32:00",
+			},
+		},
+		{
+			name:     "arrays",
+			document: "a = [1, 2, 3]\nb = [\n  \"x\", # comment\n  [true, false],\n]\nc = []\n",
+			want: map[string]interface{}{
+				"a": []interface{}{int64(1), int64(2), int64(3)},
+				"b": []interface{}{"x", []interface{}{true, false}},
+				"c": []interface{}{},
+			},
+		},
+		{
+			name:     "inline tables",
+			document: "point = { x = 1, y = 2 }\nname = { first.given = \"Tom\" }\nempty = {}\n",
+			want: map[string]interface{}{
+				"point": map[string]interface{}{"x": int64(1), "y": int64(2)},
+				"name":  map[string]interface{}{"first": map[string]interface{}{"given": "Tom"}},
+				"empty": map[string]interface{}{},
+			},
+		},
+		{
+			name:     "tables",
+			document: "[table]\nkey = 1\n\n[dog.\"tater.man\"]\ntype.name = \"pug\"\n",
+			want: map[string]interface{}{
+				"table": map[string]interface{}{"key": int64(1)},
+				"dog": map[string]interface{}{
+					"tater.man": map[string]interface{}{"type": map[string]interface{}{"name": "pug"}},
+				},
+			},
+		},
+		{
+			name:     "super-table defined after its sub-table",
+			document: "[x.y.z]\na = 1\n[x]\nb = 2\n",
+			want: map[string]interface{}{
+				"x": map[string]interface{}{"b": int64(2), "y": map[string]interface{}{"z": map[string]interface{}{"a": int64(1)}}},
+			},
+		},
+		{
+			name:     "sub-table of a table defined by dotted keys",
+			document: "[fruit]\napple.color = \"red\"\n[fruit.apple.texture]\nsmooth = true\n",
+			want: map[string]interface{}{
+				"fruit": map[string]interface{}{"apple": map[string]interface{}{
+					"color":   "red",
+					"texture": map[string]interface{}{"smooth": true},
+				}},
+			},
+		},
+		{
+			name:     "arrays of tables",
+			document: "[[fruits]]\nname = \"apple\"\n[fruits.physical]\ncolor = \"red\"\n[[fruits.varieties]]\nname = \"red delicious\"\n[[fruits]]\nname = \"banana\"\n[fruits.physical]\ncolor = \"yellow\"\n",
+			want: map[string]interface{}{
+				"fruits": []interface{}{
+					map[string]interface{}{
+						"name":      "apple",
+						"physical":  map[string]interface{}{"color": "red"},
+						"varieties": []interface{}{map[string]interface{}{"name": "red delicious"}},
+					},
+					map[string]interface{}{
+						"name":     "banana",
+						"physical": map[string]interface{}{"color": "yellow"},
+					},
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Decode([]byte(tt.document))
+			if err != nil {
+				t.Fatalf("Decode() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Decode() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	tests := []struct {
+		name     string
+		document string
+	}{
+		{"duplicate key", "a = 1\na = 2\n"},
+		{"duplicate key through dotted keys", "a.b = 1\na.b = 2\n"},
+		{"key redefined as a table", "a = 1\n[a]\n"},
+		{"table defined twice", "[t]\na = 1\n[t]\nb = 2\n"},
+		{"dotted table defined twice", "[a.b]\n[a.b]\n"},
+		{"super-table defined twice", "[a]\n[a.b]\n[a]\n"},
+		{"table defined by dotted keys redefined by a header", "[fruit]\napple.color = \"red\"\n[fruit.apple]\n"},
+		{"header table extended with dotted keys", "[a.b]\nz = 1\n[a]\nb.y = 2\n"},
+		{"inline table extended by a header", "a = { b = 1 }\n[a]\nc = 2\n"},
+		{"inline table extended by a sub-table header", "a = { b = 1 }\n[a.c]\n"},
+		{"inline table extended by dotted keys", "a = { b = 1 }\na.c = 2\n"},
+		{"inline table extended within itself", "a = { b = { c = 1 }, b.d = 2 }\n"},
+		{"static array extended by an array of tables", "a = [{ b = 1 }]\n[[a]]\n"},
+		{"static array entered by a header", "a = [{ b = 1 }]\n[a.c]\n"},
+		{"array of tables redefined as a table", "[[a]]\n[a]\n"},
+		{"table redefined as an array of tables", "[a]\n[[a]]\n"},
+		{"integer overflow", "a = 9223372036854775808\n"},
+		{"negative integer overflow", "a = -9223372036854775809\n"},
+		{"hexadecimal overflow", "a = 0x8000000000000000\n"},
+		{"leading zero", "a = 012\n"},
+		{"misplaced underscore", "a = 1__000\n"},
+		{"trailing underscore", "a = 1_\n"},
+		{"invalid escape", `a = "\q"` + "\n"},
+		{"unterminated string", "a = \"abc\n"},
+		{"unterminated multi-line string", "a = '''abc\n"},
+		{"missing value", "a =\n"},
+		{"two pairs on a line", "a = 1 b = 2\n"},
+		{"unterminated array", "a = [1, 2\n"},
+		{"unterminated table header", "[a\n"},
+		{"byte order mark in the middle", "a = 1\n\uFEFFb = 2\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, err := Decode([]byte(tt.document)); err == nil {
+				t.Errorf("Decode(%q) = %v, want an error", tt.document, got)
+			}
+		})
+	}
+}
+
+func TestDecodeReportsLine(t *testing.T) {
+	_, err := Decode([]byte("a = 1\n\n[t]\n[t]\n"))
+	if err == nil || err.Error() != "line 4: table t is defined more than once" {
+		t.Errorf("Decode() error = %v, want it on line 4", err)
+	}
+}
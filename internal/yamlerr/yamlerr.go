@@ -0,0 +1,94 @@
+// Package yamlerr locates YAML parse failures, turning the messages of the
+// yaml library into errors that carry the file and line they refer to.
+package yamlerr
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Error is a YAML parse failure in a named file
+type Error struct {
+	File   string // File or source that failed to parse
+	Line   int    // 1-based line of the failure, 0 when unknown
+	Column int    // 1-based column of the failure, 0 when unknown
+	Err    error  // Error returned by the yaml library
+}
+
+// Error implements error as "file: line L, column C: message"
+func (e *Error) Error() string {
+	location := e.File
+	if e.Line > 0 {
+		location += fmt.Sprintf(": line %d", e.Line)
+		if e.Column > 0 {
+			location += fmt.Sprintf(", column %d", e.Column)
+		}
+	}
+	return location + ": " + message(e.Err)
+}
+
+// Unwrap returns the error from the yaml library
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// linePattern matches the position yaml.v3 puts into its messages
+var linePattern = regexp.MustCompile(`line (\d+)(?:, column (\d+))?: `)
+
+// Wrap annotates an error from parsing file with the position of the
+// failure. For type errors, which may list several failures, the first
+// position is used. Nil errors are returned unchanged.
+func Wrap(file string, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	located := &Error{File: file, Err: err}
+
+	text := err.Error()
+	var typeErr *yaml.TypeError
+	if errors.As(err, &typeErr) && len(typeErr.Errors) > 0 {
+		text = typeErr.Errors[0]
+	}
+
+	if match := linePattern.FindStringSubmatch(text); match != nil {
+		located.Line, _ = strconv.Atoi(match[1])
+		if match[2] != "" {
+			located.Column, _ = strconv.Atoi(match[2])
+		}
+	}
+
+	return located
+}
+
+// message strips the "yaml:" prefix and the position from a yaml library
+// message, which Error reports separately
+func message(err error) string {
+	var typeErr *yaml.TypeError
+	if errors.As(err, &typeErr) {
+		// The first position is reported by Error, later ones stay inline
+		messages := make([]string, len(typeErr.Errors))
+		for i, text := range typeErr.Errors {
+			messages[i] = strings.TrimSpace(text)
+		}
+		if len(messages) > 0 {
+			messages[0] = stripPosition(messages[0])
+		}
+		return strings.Join(messages, "; ")
+	}
+
+	return stripPosition(strings.TrimPrefix(err.Error(), "yaml: "))
+}
+
+// stripPosition removes a leading "line L: " from a message
+func stripPosition(text string) string {
+	if loc := linePattern.FindStringIndex(text); loc != nil && loc[0] == 0 {
+		return text[loc[1]:]
+	}
+	return text
+}
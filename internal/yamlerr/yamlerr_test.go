@@ -0,0 +1,65 @@
+package yamlerr
+
+import (
+	"errors"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestWrap(t *testing.T) {
+	tests := []struct {
+		name         string
+		document     string
+		line, column int
+		want         string
+	}{
+		{
+			name:     "syntax error",
+			document: "a: 1\nb: 2\nc: \"unterminated\n",
+			line:     3,
+			want:     "values.yaml: line 3: found unexpected end of stream",
+		},
+		{
+			name:     "type error",
+			document: "a: 1\nb:\n  - 2\n",
+			line:     3,
+			want:     "values.yaml: line 3: cannot unmarshal !!seq into string",
+		},
+		{
+			name:     "indentation error",
+			document: "a: 1\n  b: 2\n",
+			line:     2,
+			want:     "values.yaml: line 2: mapping values are not allowed in this context",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var data map[string]string
+			err := Wrap("values.yaml", yaml.Unmarshal([]byte(tt.document), &data))
+
+			var located *Error
+			if !errors.As(err, &located) {
+				t.Fatalf("Wrap() = %v, want a located error", err)
+			}
+			if located.Line != tt.line || located.Column != tt.column {
+				t.Errorf("position = line %d, column %d, want line %d, column %d",
+					located.Line, located.Column, tt.line, tt.column)
+			}
+			if err.Error() != tt.want {
+				t.Errorf("Error() = %q, want %q", err.Error(), tt.want)
+			}
+		})
+	}
+
+	// Messages that carry a column report it too
+	err := Wrap("values.yaml", errors.New("yaml: line 5, column 3: unexpected token"))
+	if got, want := err.Error(), "values.yaml: line 5, column 3: unexpected token"; got != want {
+		t.Errorf("Error() = %q, want %q", got, want)
+	}
+
+	if err := Wrap("values.yaml", nil); err != nil {
+		t.Errorf("Wrap(nil) = %v, want nil", err)
+	}
+}